@@ -0,0 +1,80 @@
+// Package agecrypt decrypts files encrypted with age (https://age-encryption.org)
+// for fsdecomp, backed by filippo.io/age. It lives in its own package so that
+// programs not using it don't link the cryptographic dependency.
+//
+// Decryption is a transform (see fsdecomp.WithTransforms), so it composes
+// with decompression in the order given by the file's extensions:
+// "secrets.yaml.zst.age" is decrypted and then decompressed, while
+// "secrets.yaml.age.zst" is decompressed and then decrypted, and both open
+// as "secrets.yaml":
+//
+//	dfs := fsdecomp.New(fsys, agecrypt.WithDecryption(func(name string) ([]byte, error) {
+//		return os.ReadFile("keys/" + path.Dir(name) + ".key")
+//	}))
+//
+// Files are only listed without their ".age" extension when decryption is
+// configured.
+package agecrypt
+
+import (
+	"bytes"
+	"errors"
+	"io"
+
+	"filippo.io/age"
+	fsdecomp "github.com/AndreRenaud/FSDecomp"
+)
+
+// Extension is the file extension of age-encrypted files
+const Extension = ".age"
+
+// KeyError reports that a file couldn't be decrypted because no key was
+// available for it, or because none of its keys match the file's recipients.
+// It is returned wrapped in a fsdecomp.DecompressError, and is distinct from
+// the errors reported for files that are corrupt.
+type KeyError struct {
+	Name string // Name of the encrypted file
+	Err  error  // Error from the key callback, or from age
+}
+
+func (e *KeyError) Error() string {
+	return "no key for " + e.Name + ": " + e.Err.Error()
+}
+
+func (e *KeyError) Unwrap() error {
+	return e.Err
+}
+
+// WithDecryption decrypts ".age" files using the identities returned by
+// keyFor for each file, given the file's name in the underlying filesystem
+// (less the extensions of any layers outside the encryption). The keys are
+// parsed as an age identity file, one "AGE-SECRET-KEY-1..." identity per
+// line.
+//
+// age authenticates each chunk of the file before returning any of it, and
+// detects truncation, so data that fails authentication is never returned:
+// reading fails with a DecompressError instead.
+func WithDecryption(keyFor func(name string) ([]byte, error)) fsdecomp.Option {
+	return fsdecomp.WithTransforms(fsdecomp.Transform{
+		Ext: Extension,
+		NewReaderFor: func(name string, r io.Reader) (io.ReadCloser, error) {
+			key, err := keyFor(name)
+			if err != nil {
+				return nil, &KeyError{Name: name, Err: err}
+			}
+			identities, err := age.ParseIdentities(bytes.NewReader(key))
+			if err != nil {
+				return nil, &KeyError{Name: name, Err: err}
+			}
+			decrypted, err := age.Decrypt(r, identities...)
+			var noMatch *age.NoIdentityMatchError
+			if errors.As(err, &noMatch) {
+				return nil, &KeyError{Name: name, Err: err}
+			}
+			if err != nil {
+				return nil, err
+			}
+			return io.NopCloser(decrypted), nil
+		},
+	})
+}
@@ -0,0 +1,160 @@
+package agecrypt_test
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/fs"
+	"testing"
+	"testing/fstest"
+
+	"filippo.io/age"
+	fsdecomp "github.com/AndreRenaud/FSDecomp"
+	"github.com/AndreRenaud/FSDecomp/agecrypt"
+	_ "github.com/AndreRenaud/FSDecomp/zstdfmt"
+	"github.com/klauspost/compress/zstd"
+)
+
+func encrypt(t *testing.T, recipient age.Recipient, data []byte) []byte {
+	var buf bytes.Buffer
+	w, err := age.Encrypt(&buf, recipient)
+	if err != nil {
+		t.Fatalf("Failed to create age writer: %v", err)
+	}
+	if _, err := w.Write(data); err != nil {
+		t.Fatalf("Failed to write age data: %v", err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("Failed to close age writer: %v", err)
+	}
+	return buf.Bytes()
+}
+
+func compress(t *testing.T, data []byte) []byte {
+	var buf bytes.Buffer
+	zw, err := zstd.NewWriter(&buf)
+	if err != nil {
+		t.Fatalf("Failed to create zstd writer: %v", err)
+	}
+	if _, err := zw.Write(data); err != nil {
+		t.Fatalf("Failed to write zstd data: %v", err)
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatalf("Failed to close zstd writer: %v", err)
+	}
+	return buf.Bytes()
+}
+
+// TestWithDecryption ensures encrypted files open under their plain names,
+// and that key failures are told apart from corruption
+func TestWithDecryption(t *testing.T) {
+	identity, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatalf("Failed to generate identity: %v", err)
+	}
+	other, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatalf("Failed to generate identity: %v", err)
+	}
+
+	content := []byte("password: hunter2\n")
+	encrypted := encrypt(t, identity.Recipient(), compress(t, content))
+	testFS := fstest.MapFS{
+		"secrets.yaml.zst.age":  &fstest.MapFile{Data: encrypted},
+		"reversed.yaml.age.zst": &fstest.MapFile{Data: compress(t, encrypt(t, identity.Recipient(), content))},
+		"other.yaml.age":        &fstest.MapFile{Data: encrypt(t, other.Recipient(), content)},
+		"nokey.yaml.age":        &fstest.MapFile{Data: encrypt(t, identity.Recipient(), content)},
+		"truncated.yaml.zst.age": &fstest.MapFile{
+			Data: encrypted[:len(encrypted)-10],
+		},
+	}
+	dfs := fsdecomp.New(testFS, agecrypt.WithDecryption(func(name string) ([]byte, error) {
+		if name == "nokey.yaml.age" {
+			return nil, fs.ErrNotExist
+		}
+		return []byte(identity.String()), nil
+	}))
+
+	for _, name := range []string{"secrets.yaml", "reversed.yaml"} {
+		data, err := fs.ReadFile(dfs, name)
+		if err != nil {
+			t.Fatalf("Unexpected error reading %s: %v", name, err)
+		}
+		if !bytes.Equal(data, content) {
+			t.Errorf("Expected %s content %q, got %q", name, content, data)
+		}
+	}
+
+	for _, name := range []string{"other.yaml", "nokey.yaml"} {
+		_, err := dfs.Open(name)
+		var keyErr *agecrypt.KeyError
+		if !errors.As(err, &keyErr) {
+			t.Fatalf("Expected KeyError opening %s, got %v", name, err)
+		}
+		if keyErr.Name != name+".age" {
+			t.Errorf("Expected KeyError for %q, got %q", name+".age", keyErr.Name)
+		}
+	}
+
+	// Truncation fails without returning unauthenticated data
+	file, err := dfs.Open("truncated.yaml")
+	if err != nil {
+		t.Fatalf("Unexpected error opening truncated.yaml: %v", err)
+	}
+	defer file.Close()
+	data, err := io.ReadAll(file)
+	var keyErr *agecrypt.KeyError
+	if err == nil || errors.As(err, &keyErr) {
+		t.Errorf("Expected a decoding error reading truncated.yaml, got %v", err)
+	}
+	if len(data) != 0 {
+		t.Errorf("Expected no data from truncated.yaml, got %q", data)
+	}
+
+	// Without decryption, encrypted files are listed as they are
+	entries, err := fs.ReadDir(fsdecomp.New(testFS), ".")
+	if err != nil {
+		t.Fatalf("Unexpected error reading directory: %v", err)
+	}
+	if entries[len(entries)-1].Name() != "truncated.yaml.zst.age" {
+		t.Errorf("Expected truncated.yaml.zst.age to keep its name, got %s", entries[len(entries)-1].Name())
+	}
+}
+
+// TestTruncatedChunks ensures files truncated between age's chunks fail,
+// returning only the chunks before the cut
+func TestTruncatedChunks(t *testing.T) {
+	identity, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatalf("Failed to generate identity: %v", err)
+	}
+
+	// age encrypts 64KiB chunks, each followed by a 16 byte tag
+	const chunk, tag = 64 * 1024, 16
+	content := bytes.Repeat([]byte("0123456789abcdef"), (2*chunk+chunk/2)/16)
+	encrypted := encrypt(t, identity.Recipient(), content)
+	last := len(encrypted) - (chunk/2 + tag)
+	testFS := fstest.MapFS{
+		"first.txt.age": &fstest.MapFile{Data: encrypted[:last-(chunk+tag)]},
+		"last.txt.age":  &fstest.MapFile{Data: encrypted[:last]},
+	}
+	dfs := fsdecomp.New(testFS, agecrypt.WithDecryption(func(name string) ([]byte, error) {
+		return []byte(identity.String()), nil
+	}))
+
+	for _, name := range []string{"first.txt", "last.txt"} {
+		file, err := dfs.Open(name)
+		if err != nil {
+			t.Fatalf("Unexpected error opening %s: %v", name, err)
+		}
+		data, err := io.ReadAll(file)
+		file.Close()
+		var keyErr *agecrypt.KeyError
+		if err == nil || errors.As(err, &keyErr) {
+			t.Errorf("Expected a decoding error reading %s, got %v", name, err)
+		}
+		if len(data) >= len(content) || !bytes.Equal(data, content[:len(data)]) {
+			t.Errorf("Expected %s to return part of its content, got %d bytes", name, len(data))
+		}
+	}
+}
@@ -0,0 +1,31 @@
+// Package all registers every format decompressor shipped with fsdecomp:
+// Zstandard (.zst), LZ4 (.lz4), xz (.xz) and Brotli (.br), in addition to the
+// gzip, bzip2, BGZF, zlib and raw deflate formats the core package handles
+// with the standard library.
+//
+// The core fsdecomp package only depends on the standard library. Programs
+// that want the historical behaviour of supporting every format can blank
+// import this package:
+//
+//	import _ "github.com/AndreRenaud/FSDecomp/all"
+//
+// or call New in place of fsdecomp.New. Packages that replace a built-in
+// decoder, such as fastgzip and dsnetbzip2, or need configuring, such as
+// agecrypt, are not included.
+package all
+
+import (
+	"io/fs"
+
+	fsdecomp "github.com/AndreRenaud/FSDecomp"
+	_ "github.com/AndreRenaud/FSDecomp/brotlifmt"
+	_ "github.com/AndreRenaud/FSDecomp/lz4fmt"
+	_ "github.com/AndreRenaud/FSDecomp/xzfmt"
+	_ "github.com/AndreRenaud/FSDecomp/zstdfmt"
+)
+
+// New is equivalent to fsdecomp.New, and is provided so callers can make it
+// obvious that all formats are expected to be available
+func New(fsys fs.FS, opts ...fsdecomp.Option) *fsdecomp.DecompressFS {
+	return fsdecomp.New(fsys, opts...)
+}
@@ -0,0 +1,122 @@
+package fsdecomp
+
+import (
+	"errors"
+	"io/fs"
+	"sync/atomic"
+)
+
+// BackendOps counts the calls made to the filesystem a DecompressFS wraps
+type BackendOps struct {
+	Opens     int64 // Files and directories opened
+	Stats     int64 // Names statted, with fs.Stat
+	ReadDirs  int64 // Directory listings, whole or in part
+	ReadLinks int64 // Symbolic links read (see WithResolveSymlinkTargets)
+}
+
+// BackendOps returns the calls dfs has made to the filesystem it wraps since
+// it was created, to see the effect of probe strategies (see
+// WithProbeStrategy) and caches such as the snapshot index on a remote
+// backend. Calls made by open files, such as to read them, aren't counted.
+// The calls made by a single Open are given by ResolutionInfo.
+func (dfs *DecompressFS) BackendOps() BackendOps {
+	return BackendOps{
+		Opens:     dfs.ops.opens.Load(),
+		Stats:     dfs.ops.stats.Load(),
+		ReadDirs:  dfs.ops.readDirs.Load(),
+		ReadLinks: dfs.ops.readLinks.Load(),
+	}
+}
+
+// Backend returns the filesystem dfs wraps, for extensions that read files
+// other than those being decompressed, such as dictionaries, to read them
+// as dfs does: calls made through it are counted by BackendOps, and fail with
+// an error wrapping fs.ErrClosed once dfs has been closed. It implements
+// fs.StatFS.
+func (dfs *DecompressFS) Backend() fs.FS {
+	return backendFS{dfs: dfs}
+}
+
+// backendFS is the filesystem returned by Backend
+type backendFS struct {
+	dfs *DecompressFS
+}
+
+func (bf backendFS) Open(name string) (fs.File, error) {
+	if err := bf.dfs.errIfClosed("open", name); err != nil {
+		return nil, err
+	}
+	return bf.dfs.backend(nil).Open(name)
+}
+
+func (bf backendFS) Stat(name string) (fs.FileInfo, error) {
+	if err := bf.dfs.errIfClosed("stat", name); err != nil {
+		return nil, err
+	}
+	return bf.dfs.backend(nil).stat(name)
+}
+
+// opCounters holds the running totals returned by BackendOps
+type opCounters struct {
+	opens, stats, readDirs, readLinks atomic.Int64
+}
+
+// backend is the filesystem wrapped by dfs, as used by a single operation.
+// All calls to it are made through here, to be counted in the totals of dfs
+// and, if set, in ops, the calls made by the operation.
+type backend struct {
+	dfs *DecompressFS
+	ops *BackendOps
+}
+
+// backend returns the wrapped filesystem for an operation counting its calls
+// in ops, if set
+func (dfs *DecompressFS) backend(ops *BackendOps) backend {
+	return backend{dfs: dfs, ops: ops}
+}
+
+// Open implements fs.FS.Open
+func (b backend) Open(name string) (fs.File, error) {
+	b.dfs.ops.opens.Add(1)
+	if b.ops != nil {
+		b.ops.Opens++
+	}
+	return b.dfs.FS.Open(name)
+}
+
+// stat returns the FileInfo of the named file, as fs.Stat does
+func (b backend) stat(name string) (fs.FileInfo, error) {
+	b.dfs.ops.stats.Add(1)
+	if b.ops != nil {
+		b.ops.Stats++
+	}
+	return fs.Stat(b.dfs.FS, name)
+}
+
+// readDir lists the named directory, as fs.ReadDir does
+func (b backend) readDir(name string) ([]fs.DirEntry, error) {
+	b.countReadDir()
+	return fs.ReadDir(b.dfs.FS, name)
+}
+
+// countReadDir counts a listing made through an open directory
+func (b backend) countReadDir() {
+	b.dfs.ops.readDirs.Add(1)
+	if b.ops != nil {
+		b.ops.ReadDirs++
+	}
+}
+
+// readLink returns the target of the named symbolic link, failing with
+// errors.ErrUnsupported if the filesystem can't read links
+func (b backend) readLink(name string) (string, error) {
+	rl, ok := b.dfs.FS.(readLinkFS)
+	if !ok {
+		return "", &fs.PathError{Op: "readlink", Path: name, Err: errors.ErrUnsupported}
+	}
+	b.dfs.ops.readLinks.Add(1)
+	if b.ops != nil {
+		b.ops.ReadLinks++
+	}
+	return rl.ReadLink(name)
+}
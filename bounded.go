@@ -0,0 +1,97 @@
+package fsdecomp
+
+import (
+	"errors"
+	"io/fs"
+	"path"
+	"strings"
+)
+
+// NewBounded creates a DecompressFS, as New does, for the tree rooted at the
+// directory root of fsys. It is like wrapping fs.Sub(fsys, root), but checks
+// every name it passes to fsys itself, including those of probed variants,
+// sidecars and split parts, rather than trusting a Sub method of fsys, so no
+// name can reach outside root. Names that would, such as "../escape", fail
+// with an fs.PathError wrapping fs.ErrInvalid, as do invalid roots. A nil
+// fsys fails with ErrNilFS.
+func NewBounded(fsys fs.FS, root string, opts ...Option) (*DecompressFS, error) {
+	if fsys == nil {
+		return nil, ErrNilFS
+	}
+	if !fs.ValidPath(root) {
+		return nil, &fs.PathError{Op: "bound", Path: root, Err: fs.ErrInvalid}
+	}
+	if root == "." {
+		return New(fsys, opts...), nil
+	}
+	return New(&boundedFS{fsys: fsys, root: root}, opts...), nil
+}
+
+// boundedFS is the tree below root in fsys
+type boundedFS struct {
+	fsys fs.FS
+	root string
+}
+
+// full returns the name in fsys of name, which must be a valid path
+func (b *boundedFS) full(op, name string) (string, error) {
+	if !fs.ValidPath(name) {
+		return "", &fs.PathError{Op: op, Path: name, Err: fs.ErrInvalid}
+	}
+	return path.Join(b.root, name), nil
+}
+
+// shorten reports errors from fsys with names relative to root, as the
+// caller gave them
+func (b *boundedFS) shorten(err error) error {
+	var pe *fs.PathError
+	if errors.As(err, &pe) {
+		if rel, ok := strings.CutPrefix(pe.Path, b.root+"/"); ok {
+			return &fs.PathError{Op: pe.Op, Path: rel, Err: pe.Err}
+		}
+		if pe.Path == b.root {
+			return &fs.PathError{Op: pe.Op, Path: ".", Err: pe.Err}
+		}
+	}
+	return err
+}
+
+func (b *boundedFS) Open(name string) (fs.File, error) {
+	full, err := b.full("open", name)
+	if err != nil {
+		return nil, err
+	}
+	file, err := b.fsys.Open(full)
+	return file, b.shorten(err)
+}
+
+func (b *boundedFS) Stat(name string) (fs.FileInfo, error) {
+	full, err := b.full("stat", name)
+	if err != nil {
+		return nil, err
+	}
+	info, err := fs.Stat(b.fsys, full)
+	return info, b.shorten(err)
+}
+
+func (b *boundedFS) ReadDir(name string) ([]fs.DirEntry, error) {
+	full, err := b.full("readdir", name)
+	if err != nil {
+		return nil, err
+	}
+	entries, err := fs.ReadDir(b.fsys, full)
+	return entries, b.shorten(err)
+}
+
+func (b *boundedFS) ReadLink(name string) (string, error) {
+	full, err := b.full("readlink", name)
+	if err != nil {
+		return "", err
+	}
+	rl, ok := b.fsys.(readLinkFS)
+	if !ok {
+		return "", &fs.PathError{Op: "readlink", Path: name, Err: errors.ErrUnsupported}
+	}
+	link, err := rl.ReadLink(full)
+	return link, b.shorten(err)
+}
@@ -0,0 +1,57 @@
+// Package brotlifmt adds brotli (.br) support to fsdecomp.
+//
+// Importing the package, usually for its side effect only, registers the
+// decompressor with fsdecomp.Register:
+//
+//	import _ "github.com/AndreRenaud/FSDecomp/brotlifmt"
+//
+// Brotli streams have no magic number, so WithMagicValidation doesn't check
+// .br files, and corrupt files are only found to be so when they are read.
+package brotlifmt
+
+import (
+	"fmt"
+	"io"
+
+	fsdecomp "github.com/AndreRenaud/FSDecomp"
+	"github.com/andybalholm/brotli"
+)
+
+// Extension is the file extension handled by this package
+const Extension = ".br"
+
+// Decompressor decompresses brotli streams
+var Decompressor fsdecomp.Decompressor = decompressor{}
+
+func init() {
+	fsdecomp.Register(Extension, Decompressor)
+}
+
+type decompressor struct{}
+
+func (decompressor) NewReader(r io.Reader) (io.ReadCloser, error) {
+	// Nothing is read until the first Read. The reader doesn't need to be
+	// closed.
+	return io.NopCloser(&safeReader{reader: brotli.NewReader(r)}), nil
+}
+
+// safeReader reports a panic in the decoder, which is translated from C
+// and indexes its tables with values taken from the stream, as an error
+// rather than letting corrupt data crash the program
+type safeReader struct {
+	reader io.Reader
+	err    error
+}
+
+func (sr *safeReader) Read(p []byte) (n int, err error) {
+	if sr.err != nil {
+		return 0, sr.err
+	}
+	defer func() {
+		if r := recover(); r != nil {
+			sr.err = fmt.Errorf("brotli: corrupt stream: %v", r)
+			n, err = 0, sr.err
+		}
+	}()
+	return sr.reader.Read(p)
+}
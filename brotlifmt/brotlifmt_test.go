@@ -0,0 +1,84 @@
+package brotlifmt_test
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/fs"
+	"strings"
+	"testing"
+	"testing/fstest"
+
+	fsdecomp "github.com/AndreRenaud/FSDecomp"
+	_ "github.com/AndreRenaud/FSDecomp/brotlifmt"
+	"github.com/andybalholm/brotli"
+)
+
+func createBrotliData(t *testing.T, content string) []byte {
+	var buf bytes.Buffer
+	bw := brotli.NewWriter(&buf)
+	if _, err := bw.Write([]byte(content)); err != nil {
+		t.Fatalf("Failed to write brotli data: %v", err)
+	}
+	if err := bw.Close(); err != nil {
+		t.Fatalf("Failed to close brotli writer: %v", err)
+	}
+	return buf.Bytes()
+}
+
+// TestRegistered ensures importing the package is enough to open and list
+// .br files by their names without the extension
+func TestRegistered(t *testing.T) {
+	dfs := fsdecomp.New(fstest.MapFS{
+		"assets/app.js.br": &fstest.MapFile{Data: createBrotliData(t, "brotli content")},
+	})
+	data, err := fs.ReadFile(dfs, "assets/app.js")
+	if err != nil {
+		t.Fatalf("Unexpected error reading assets/app.js: %v", err)
+	}
+	if string(data) != "brotli content" {
+		t.Errorf("Expected content %q, got %q", "brotli content", string(data))
+	}
+
+	entries, err := dfs.ReadDir("assets")
+	if err != nil || len(entries) != 1 || entries[0].Name() != "app.js" {
+		t.Errorf("Expected assets to list app.js, got %v, %v", entries, err)
+	}
+}
+
+// TestCorrupt ensures corrupt .br files open, as brotli has no header to
+// check, and fail cleanly with a DecompressError when read
+func TestCorrupt(t *testing.T) {
+	valid := createBrotliData(t, strings.Repeat("brotli compresses web assets well. ", 200))
+	dfs := fsdecomp.New(fstest.MapFS{
+		"garbage.txt.br": &fstest.MapFile{Data: []byte("this is not a brotli stream")},
+	})
+	file, err := dfs.Open("garbage.txt")
+	if err != nil {
+		t.Fatalf("Unexpected error opening garbage.txt: %v", err)
+	}
+	defer file.Close()
+	_, err = file.Read(make([]byte, 512))
+	var de *fsdecomp.DecompressError
+	if !errors.As(err, &de) || de.Format != "br" {
+		t.Errorf("Expected a DecompressError on the first read, got %v", err)
+	}
+
+	// Truncated and damaged streams fail, or decode to something, but never
+	// panic
+	for i := 0; i < len(valid); i += 7 {
+		damaged := bytes.Clone(valid)
+		damaged[i] ^= 0x5a
+		for name, data := range map[string][]byte{"truncated": valid[:i], "damaged": damaged} {
+			dfs := fsdecomp.New(fstest.MapFS{"file.txt.br": &fstest.MapFile{Data: data}})
+			file, err := dfs.Open("file.txt")
+			if err != nil {
+				t.Fatalf("Unexpected error opening %s stream at %d: %v", name, i, err)
+			}
+			if _, err := io.ReadAll(file); err != nil && !errors.As(err, &de) {
+				t.Errorf("Expected a DecompressError for the %s stream at %d, got %v", name, i, err)
+			}
+			file.Close()
+		}
+	}
+}
@@ -0,0 +1,57 @@
+package fsdecomp
+
+import "io"
+
+// Caps describes what a file opened from a DecompressFS supports
+type Caps struct {
+	Seekable  bool // The file implements io.Seeker
+	ReaderAt  bool // The file implements io.ReaderAt
+	ExactSize bool // The size reported by Stat is that of the data read (see ContentLength)
+
+	// RandomAccessIndex reports that the file's compression format keeps
+	// an index allowing decompression to start part way through the file.
+	// None of the formats currently supported do, so it is always false.
+	RandomAccessIndex bool
+}
+
+// Capabilities reports what the file returned by Open(name) would support,
+// without decompressing it, so callers can decide up front whether to offer
+// range requests or to stream rather than buffer. The underlying file is
+// opened to find out, and any error Open would return from the underlying
+// filesystem, or from magic number validation, is returned.
+//
+// Decompressed files are never seekable, and have an exact size only when
+// their format records it (see Sizer). Other files are returned by Open as
+// the underlying filesystem provides them, and have an exact size if they
+// are regular files.
+func (dfs *DecompressFS) Capabilities(name string) (Caps, error) {
+	r, err := dfs.resolve(name)
+	if err != nil {
+		return Caps{}, err
+	}
+	file := r.file
+	if len(r.layers) > 0 && dfs.magicValidation {
+		if file, err = checkMagic(file, r.layers[0]); err != nil {
+			return Caps{}, newDecompressError(r.layers[0], r.name, err)
+		}
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return Caps{}, err
+	}
+	if len(r.layers) > 0 {
+		return Caps{
+			ExactSize: info.Mode().IsRegular() && len(r.layers) == 1 &&
+				dfs.decompressedSize(file, info, r.layers[0]) >= 0,
+		}, nil
+	}
+	_, seekable := file.(io.Seeker)
+	_, readerAt := file.(io.ReaderAt)
+	return Caps{
+		Seekable:  seekable,
+		ReaderAt:  readerAt,
+		ExactSize: info.Mode().IsRegular(),
+	}, nil
+}
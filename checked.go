@@ -0,0 +1,60 @@
+package fsdecomp
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+)
+
+// NewChecked creates a DecompressFS as New does, but reports problems that
+// would otherwise only surface on first use. It fails with ErrNilFS for a
+// nil fsys, with an error wrapping ErrIncompatibleOptions for options that
+// conflict, and with the underlying filesystem's error if the root
+// directory can't be statted, which opens it if fsys doesn't implement
+// fs.StatFS. The root is checked before any snapshot index is built.
+//
+// The options found to conflict are:
+//   - WithMinDecompressedRatio with a ratio above that of
+//     WithMaxDecompressedRatio, which every file would be reported for
+//   - WithMinDecompressedRatio without WithWarningHandler, whose warnings
+//     would be discarded
+//   - WithCompatLevel(0) with WithSnapshotIndex, whose listings are the
+//     same at every level
+//   - WithMetadataSidecars or WithMetaSuffix with an empty suffix, which
+//     would make each file its own metadata
+func NewChecked(fsys fs.FS, opts ...Option) (*DecompressFS, error) {
+	if fsys == nil {
+		return nil, ErrNilFS
+	}
+	dfs := configure(fsys, opts)
+	if err := dfs.checkOptions(); err != nil {
+		return nil, err
+	}
+	info, err := dfs.backend(nil).stat(".")
+	if err != nil {
+		return nil, err
+	}
+	if !info.IsDir() {
+		return nil, &fs.PathError{Op: "stat", Path: ".", Err: errors.New("root is not a directory")}
+	}
+	dfs.loadIndex()
+	return dfs, nil
+}
+
+// checkOptions returns an error wrapping ErrIncompatibleOptions describing
+// the first conflict among the options dfs was created with, if any
+func (dfs *DecompressFS) checkOptions() error {
+	switch {
+	case dfs.minRatio > 0 && dfs.maxRatio > 0 && dfs.minRatio > dfs.maxRatio:
+		return fmt.Errorf("%w: WithMinDecompressedRatio(%g) exceeds WithMaxDecompressedRatio(%g)", ErrIncompatibleOptions, dfs.minRatio, dfs.maxRatio)
+	case dfs.minRatio > 0 && dfs.warning == nil:
+		return fmt.Errorf("%w: WithMinDecompressedRatio needs WithWarningHandler to report files", ErrIncompatibleOptions)
+	case dfs.compatLevel < 1 && dfs.index != nil:
+		return fmt.Errorf("%w: WithCompatLevel(%d) has no effect with WithSnapshotIndex", ErrIncompatibleOptions, dfs.compatLevel)
+	case dfs.sidecars != nil && dfs.sidecars.suffix == "":
+		return fmt.Errorf("%w: WithMetadataSidecars needs a suffix", ErrIncompatibleOptions)
+	case dfs.metaParser != nil && dfs.metaSuffix == "":
+		return fmt.Errorf("%w: WithMetaSuffix needs a suffix", ErrIncompatibleOptions)
+	}
+	return nil
+}
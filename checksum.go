@@ -0,0 +1,117 @@
+package fsdecomp
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"io/fs"
+	"strings"
+)
+
+// ChecksumSide selects the data WithChecksumVerification checks
+type ChecksumSide string
+
+const (
+	// ChecksumCompressed checks compressed files as stored, against a
+	// sidecar named for the compressed file, such as "file.gz.sha256"
+	ChecksumCompressed ChecksumSide = "compressed"
+
+	// ChecksumDecompressed checks the decompressed data, against a sidecar
+	// named for the file without its compression extensions, such as
+	// "file.sha256" alongside "file.gz"
+	ChecksumDecompressed ChecksumSide = "decompressed"
+)
+
+// checksumSuffix is the suffix of the sidecars read by WithChecksumVerification
+const checksumSuffix = ".sha256"
+
+// maxChecksumFileSize bounds how much of a checksum sidecar is read, as it
+// holds a single line
+const maxChecksumFileSize = 4096
+
+// checksum is a SHA-256 checksum computed as a file is read, to compare with
+// the one given by its sidecar
+type checksum struct {
+	hash       hash.Hash
+	want       []byte
+	sidecar    string // Name of the sidecar giving want
+	compressed bool   // Whether the compressed data is hashed
+}
+
+// checksumFor returns the checksum to verify the compressed file name,
+// decoded with layers, against, or nil if it has no checksum sidecar
+func (dfs *DecompressFS) checksumFor(name string, layers []format) (*checksum, error) {
+	sidecar := name
+	if dfs.checksumSide == ChecksumDecompressed {
+		for _, layer := range layers {
+			sidecar = strings.TrimSuffix(sidecar, layer.ext)
+		}
+	}
+	sidecar += checksumSuffix
+
+	file, err := dfs.backend(nil).Open(sidecar)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	data, err := io.ReadAll(io.LimitReader(file, maxChecksumFileSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(data) > maxChecksumFileSize {
+		return nil, &fs.PathError{Op: "checksum", Path: sidecar, Err: ErrTooLarge}
+	}
+	want, err := parseChecksum(data)
+	if err != nil {
+		return nil, &fs.PathError{Op: "checksum", Path: sidecar, Err: err}
+	}
+	return &checksum{
+		hash:       sha256.New(),
+		want:       want,
+		sidecar:    sidecar,
+		compressed: dfs.checksumSide == ChecksumCompressed,
+	}, nil
+}
+
+// parseChecksum returns the SHA-256 checksum in data, written as by
+// sha256sum ("<hex>  <name>"), in the BSD style ("SHA256 (<name>) = <hex>"),
+// or as the hex digest alone
+func parseChecksum(data []byte) ([]byte, error) {
+	line, _, _ := strings.Cut(string(data), "\n")
+	fields := strings.Fields(line)
+	if len(fields) == 0 {
+		return nil, errors.New("no checksum")
+	}
+	digest := fields[0]
+	if strings.HasPrefix(line, "SHA256 (") {
+		digest = fields[len(fields)-1]
+	}
+	sum, err := hex.DecodeString(digest)
+	if err != nil || len(sum) != sha256.Size {
+		return nil, errors.New("not a SHA-256 checksum")
+	}
+	return sum, nil
+}
+
+// verify compares the checksum of the data read with the one expected, once
+// the decompressed data has been read to EOF. For compressed data, the rest
+// of the compressed file, which the decoder may not have needed, is read
+// from compressed first.
+func (c *checksum) verify(compressed io.Reader) error {
+	if c.compressed {
+		if _, err := io.Copy(io.Discard, compressed); err != nil {
+			return err
+		}
+	}
+	if got := c.hash.Sum(nil); !bytes.Equal(got, c.want) {
+		return fmt.Errorf("%w: sha256 %x, %s gives %x", ErrChecksumMismatch, got, c.sidecar, c.want)
+	}
+	return nil
+}
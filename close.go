@@ -0,0 +1,49 @@
+package fsdecomp
+
+import "io/fs"
+
+// Close releases what the filesystem holds in memory, the snapshot index,
+// cached metadata sidecars and SRI strings, after which Open, ReadDir and
+// the functions built on them fail with an error wrapping fs.ErrClosed.
+// Files that are already open remain readable until they are closed
+// themselves. With WithLeakDetection, each decompressed file still open is
+// reported as a LeakError warning, and no longer tracked, so it isn't
+// reported again if it is garbage collected. Close doesn't close the underlying
+// filesystem. It is safe to call more than once, and concurrently with
+// other methods.
+func (dfs *DecompressFS) Close() error {
+	if dfs.closed.Swap(true) {
+		return nil
+	}
+	if dfs.leaks != nil {
+		for _, info := range dfs.leaks.removeAll() {
+			dfs.warn(&LeakError{LeakInfo: info})
+		}
+	}
+	if dfs.index != nil {
+		dfs.index.mu.Lock()
+		dfs.index.dirs = nil
+		dfs.index.mu.Unlock()
+	}
+	if dfs.sidecars != nil {
+		dfs.sidecars.mu.Lock()
+		dfs.sidecars.cache = nil
+		dfs.sidecars.mu.Unlock()
+	}
+	dfs.sri.mu.Lock()
+	dfs.sri.entries = nil
+	dfs.sri.mu.Unlock()
+	dfs.large.mu.Lock()
+	dfs.large.dirs = nil
+	dfs.large.mu.Unlock()
+	return nil
+}
+
+// errIfClosed returns the error for operation op on name once the
+// filesystem has been closed
+func (dfs *DecompressFS) errIfClosed(op, name string) error {
+	if dfs.closed.Load() {
+		return &fs.PathError{Op: op, Path: name, Err: fs.ErrClosed}
+	}
+	return nil
+}
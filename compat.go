@@ -0,0 +1,60 @@
+package fsdecomp
+
+import "io/fs"
+
+// DefaultCompatLevel is the compatibility level of a DecompressFS unless
+// set with WithCompatLevel. It is only raised by releases that change
+// observable behavior, such as the contents or order of listings.
+//
+// At level 0, ReadDir without WithSnapshotIndex lists the entries of the
+// underlying directory in its order, each under its logical name, so a
+// plain file and its compressed variants, or repeated entries from the
+// underlying filesystem, are all listed.
+//
+// At level 1, ReadDir lists each logical name once, described by the file
+// Open picks for it, sorted by logical name. The snapshot index has always
+// listed directories this way.
+//
+// At level 2, directories returned by Open list the same entries as
+// ReadDir, rather than those of the underlying directory, and the Info of
+// listed compressed files reports the decompressed size Stat reports once
+// the file is opened, where it is known, rather than the compressed size.
+// Finding that size opens the file, so listings are slower. Level 2 is
+// only used when requested, with WithCompatLevel(LatestCompatLevel).
+const DefaultCompatLevel = 1
+
+// LatestCompatLevel is the compatibility level with the newest behavior
+const LatestCompatLevel = 2
+
+// listLevel0 lists entries, the contents of directory dir, as ReadDir does
+// at compatibility level 0
+func (dfs *DecompressFS) listLevel0(b backend, dir string, entries []fs.DirEntry) []fs.DirEntry {
+	var present map[string]bool
+	if dfs.sidecars != nil {
+		present = listingNames(entries)
+	}
+	var groups map[string]*splitGroup
+	if dfs.splitParts {
+		groups = dfs.splitGroups(entries)
+	}
+	listed := entries[:0]
+	for _, entry := range entries {
+		if dfs.isHidden(entry) || dfs.sidecars != nil && dfs.sidecars.isSidecar(entry.Name(), present) {
+			continue
+		}
+		if stem, _, ok := splitPart(entry.Name()); ok && groups[stem] != nil {
+			// Split files are listed once, in place of their first part
+			if g := groups[stem]; entry.Name() == g.parts[0].Name() {
+				listed = append(listed, splitEntry{DirEntry: entry, name: g.logical, parts: g.parts})
+			}
+			continue
+		}
+		if !entry.IsDir() {
+			if logical, layers, ok := dfs.layersForName(entry.Name()); ok {
+				entry = dfs.compressedEntry(b, dir, entry, logical, layers, present)
+			}
+		}
+		listed = append(listed, entry)
+	}
+	return listed
+}
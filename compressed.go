@@ -0,0 +1,66 @@
+package fsdecomp
+
+import (
+	"io/fs"
+	"strings"
+)
+
+// CompressedEntry describes a file that a DecompressFS decompresses, as
+// listed by ListCompressed
+type CompressedEntry struct {
+	VirtualName    string   // Name the file is opened and listed by
+	RealName       string   // Name of the file in the underlying filesystem
+	Format         Format   // Format of the file as stored, its outermost layer, as in "gz"
+	Formats        []Format // Formats decoded, outermost first, as in ["gz", "bz2"] for a ".bz2.gz" file
+	CompressedSize int64    // Size of the file as stored
+}
+
+// ListCompressed walks the tree rooted at root and returns every file in it
+// that Open would decompress, in lexical order of VirtualName, such as to
+// audit which files are served precompressed. Each file is resolved as Open
+// resolves it, without being decompressed, so files decompressed because of
+// their metadata or a link target are included, and plain files that take
+// precedence over compressed ones are not. Entries excluded by
+// WithWalkFilter are skipped. The walk stops at the first error.
+func (dfs *DecompressFS) ListCompressed(root string) ([]CompressedEntry, error) {
+	var entries []CompressedEntry
+	seen := make(map[string]bool)
+	err := dfs.walkDir(root, func(name string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		// A file and its compressed variants may be listed under the same name
+		if d.IsDir() || seen[name] {
+			return nil
+		}
+		seen[name] = true
+		r, err := dfs.resolve(name)
+		if err != nil {
+			return err
+		}
+		defer r.file.Close()
+		if len(r.layers) == 0 {
+			return nil
+		}
+		info, err := r.file.Stat()
+		if err != nil {
+			return err
+		}
+		formats := make([]Format, len(r.layers))
+		for i, layer := range r.layers {
+			formats[i] = Format(strings.TrimPrefix(layer.ext, "."))
+		}
+		entries = append(entries, CompressedEntry{
+			VirtualName:    name,
+			RealName:       r.name,
+			Format:         formats[0],
+			Formats:        formats,
+			CompressedSize: info.Size(),
+		})
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return entries, nil
+}
@@ -0,0 +1,113 @@
+package fsdecomp
+
+import (
+	"bufio"
+	"slices"
+	"time"
+)
+
+// Config describes the effective settings of a DecompressFS, for logging
+// and debugging. Settings made with functions, such as read transforms, are
+// reported only by whether or how many of them are in use.
+type Config struct {
+	Extensions           []string // Compression extensions decompressed, in probe order
+	TransformExtensions  []string // Transform extensions added with WithTransforms, in probe order
+	MaxCompressionLayers int      // Compression layers a file may have (see WithChainedDecompression)
+	ProbeStrategy        ProbeStrategy
+	ListingLimit         int // Entries above which directories aren't listed to resolve names, -1 for none
+	CompatLevel          int // Observable behavior kept from earlier releases (see WithCompatLevel)
+
+	DirectoryIndex        string // Index file opened in place of directories, if any
+	MagicValidation       bool
+	ResolveSymlinkTargets bool
+	VariantCheck          bool
+	SplitParts            bool
+	NormalizedNames       bool
+	StrictClose           bool
+	EagerStat             bool
+	SingleMemberSizes     bool
+	SysEncodingDetector   bool   // Whether backend metadata is consulted
+	MetaSuffix            string // Suffix of metadata files naming formats, if any
+
+	SnapshotIndex      bool
+	EagerSnapshotIndex bool
+
+	MetadataSidecarSuffix  string // Suffix of metadata sidecars, if enabled
+	MetadataSidecarMaxSize int64
+	HiddenFileMatchers     int      // Functions given to WithHiddenFiles
+	PreferCompressedIn     []string // Patterns of directories where compressed files take precedence
+	NameMapper             bool
+	WalkFilter             bool
+
+	ReadTransforms       int   // Functions given to WithReadTransform, including WithBOMStripping
+	MaxDecompressedSize  int64 // 0 for no limit
+	MaxFreezeSize        int64 // Limit on the contents of a Freeze snapshot, 0 for none
+	MinDecompressedRatio float64
+	MaxDecompressedRatio float64 // 0 for the largest each format allows
+	MaxLineLength        int     // Longest line accepted by ScanLines
+	ChecksumVerification string  // Data checked against checksum sidecars, if any
+
+	SlowWriteThreshold time.Duration // Duration above which WriteTo reports writes, 0 if not reported
+
+	CustomUnmarshalDecoder bool
+	Digest                 bool
+	CustomBufferPool       bool
+	WarningHandler         bool
+	LeakDetection          bool
+}
+
+// Config returns the effective settings of the filesystem. The result is a
+// copy, which may be modified freely without affecting the filesystem.
+func (dfs *DecompressFS) Config() Config {
+	c := Config{
+		MaxCompressionLayers:   dfs.compressionLimit(),
+		ProbeStrategy:          dfs.probeStrategy,
+		ListingLimit:           dfs.listingLimit(),
+		CompatLevel:            dfs.compatLevel,
+		DirectoryIndex:         dfs.dirIndex,
+		MagicValidation:        dfs.magicValidation,
+		ResolveSymlinkTargets:  dfs.resolveSymlinks,
+		VariantCheck:           dfs.variantCheck,
+		SplitParts:             dfs.splitParts,
+		NormalizedNames:        dfs.normalizedNames,
+		StrictClose:            dfs.strictClose,
+		EagerStat:              dfs.eagerStat,
+		SingleMemberSizes:      dfs.singleMember,
+		SysEncodingDetector:    dfs.sysEncoding != nil,
+		MetaSuffix:             dfs.metaSuffix,
+		SnapshotIndex:          dfs.index != nil,
+		EagerSnapshotIndex:     dfs.index != nil && dfs.index.eager,
+		HiddenFileMatchers:     len(dfs.hidden),
+		ReadTransforms:         len(dfs.readTransforms),
+		MaxDecompressedSize:    dfs.maxSize,
+		MaxFreezeSize:          dfs.freezeLimit,
+		MinDecompressedRatio:   dfs.minRatio,
+		MaxDecompressedRatio:   dfs.maxRatio,
+		ChecksumVerification:   string(dfs.checksumSide),
+		SlowWriteThreshold:     max(dfs.slowWrite, 0),
+		MaxLineLength:          bufio.MaxScanTokenSize,
+		CustomUnmarshalDecoder: dfs.newValueDecoder != nil,
+		Digest:                 dfs.newDigest != nil,
+		CustomBufferPool:       dfs.bufferPool != nil,
+		WarningHandler:         dfs.warning != nil,
+		LeakDetection:          dfs.leaks != nil,
+		NameMapper:             dfs.nameMapper != nil,
+		WalkFilter:             dfs.walkFilter != nil,
+	}
+	for _, f := range dfs.supportedFormats() {
+		if f.transform {
+			c.TransformExtensions = append(c.TransformExtensions, f.ext)
+		} else {
+			c.Extensions = append(c.Extensions, f.ext)
+		}
+	}
+	c.PreferCompressedIn = slices.Clone(dfs.preferIn)
+	if dfs.sidecars != nil {
+		c.MetadataSidecarSuffix = dfs.sidecars.suffix
+		c.MetadataSidecarMaxSize = dfs.sidecars.maxSize
+	}
+	if dfs.maxLineLength > 0 {
+		c.MaxLineLength = dfs.maxLineLength
+	}
+	return c
+}
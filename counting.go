@@ -0,0 +1,41 @@
+package fsdecomp
+
+import (
+	"io"
+	"io/fs"
+	"sync/atomic"
+)
+
+// countingReader counts the bytes read through it from a compressed file
+type countingReader struct {
+	reader io.Reader
+	file   fs.File      // The compressed file, read through reader
+	n      atomic.Int64 // Decompressors reading ahead count from their own goroutines
+}
+
+func (cr *countingReader) Read(p []byte) (int, error) {
+	n, err := cr.reader.Read(p)
+	cr.n.Add(int64(n))
+	return n, err
+}
+
+// Stat returns the FileInfo of the compressed file, as decompressors given
+// a file can size their work by it, as fastgzip.Parallel does. Seeking and
+// ReadAt aren't forwarded, as reads through them would escape the count and
+// any checksum of the compressed data.
+func (cr *countingReader) Stat() (fs.FileInfo, error) {
+	return cr.file.Stat()
+}
+
+// BytesRead returns the number of bytes read so far from the compressed file
+// in the underlying filesystem, and the number of decompressed bytes read
+// from df, e.g. for reporting progress. Decompressors read ahead, so the
+// compressed count may run ahead of the data returned. It is available
+// through an interface assertion:
+//
+//	if counter, ok := file.(interface{ BytesRead() (int64, int64) }); ok {
+//		compressed, decompressed := counter.BytesRead()
+//	}
+func (df *decompressFile) BytesRead() (compressed, decompressed int64) {
+	return df.compressed.n.Load(), df.read
+}
@@ -0,0 +1,116 @@
+package fsdecomp
+
+import (
+	"bytes"
+	"strings"
+)
+
+// Format names a compression format by its usual file extension, without the
+// leading dot, as DecompressError.Format does
+type Format string
+
+// Formats recognised by DetectFormat. gzip, bzip2 and zlib are decompressed
+// by the core package; the others need their packages imported.
+const (
+	FormatGzip  Format = "gz"
+	FormatZstd  Format = "zst"
+	FormatBzip2 Format = "bz2"
+	FormatXz    Format = "xz"
+	FormatLZ4   Format = "lz4"
+	FormatZlib  Format = "zlib"
+)
+
+// SniffLen is the number of leading bytes DetectFormat needs to recognise
+// every format it knows
+const SniffLen = 6
+
+// signature recognises the start of a stream of a format
+type signature struct {
+	format Format
+	magic  []byte              // Bytes every stream starts with
+	size   int                 // Bytes needed to recognise the format, at least len(magic)
+	check  func(p []byte) bool // Checks the first size bytes further, if set
+}
+
+// match reports whether p starts with the signature
+func (sig signature) match(p []byte) bool {
+	if len(p) < sig.size || !bytes.HasPrefix(p, sig.magic) {
+		return false
+	}
+	return sig.check == nil || sig.check(p[:sig.size])
+}
+
+// signatures are the formats DetectFormat recognises. No valid match of one
+// is the start of another, so their order doesn't matter. They are also
+// what WithMagicValidation and StreamFS check streams of these formats
+// against (see formatSignature), so the three always agree.
+var signatures = []signature{
+	{format: FormatGzip, magic: []byte{0x1f, 0x8b}, size: 2},
+	{format: FormatZstd, magic: []byte{0x28, 0xb5, 0x2f, 0xfd}, size: 4},
+	{format: FormatBzip2, magic: []byte("BZh"), size: 4, check: isBzip2},
+	{format: FormatXz, magic: []byte{0xfd, '7', 'z', 'X', 'Z', 0x00}, size: 6},
+	{format: FormatLZ4, magic: []byte{0x04, 0x22, 0x4d, 0x18}, size: 4},
+	{format: FormatZlib, size: 2, check: isZlib},
+}
+
+// DetectFormat returns the compression format of the stream starting with
+// prefix, using the same signatures StreamFS uses to choose a decompressor.
+// It reports false if prefix matches no format, or is too short to tell, so
+// callers should supply SniffLen bytes, or the whole stream if it is shorter.
+func DetectFormat(prefix []byte) (Format, bool) {
+	for _, sig := range signatures {
+		if sig.match(prefix) {
+			return sig.format, true
+		}
+	}
+	return "", false
+}
+
+// signatureOf returns the signature of the format f
+func signatureOf(f Format) (signature, bool) {
+	for _, sig := range signatures {
+		if sig.format == f {
+			return sig, true
+		}
+	}
+	return signature{}, false
+}
+
+// formatSignature returns the signature streams of kind start with, if it
+// has one: that of the format its decompressor decodes, where DetectFormat
+// knows it, found by the decompressor's magic number or its extension, or
+// otherwise the magic number itself
+func formatSignature(kind format) (signature, bool) {
+	if d, ok := kind.decompressor.(interface{ detectedAs() Format }); ok {
+		return signatureOf(d.detectedAs())
+	}
+	m, ok := kind.decompressor.(MagicNumber)
+	if !ok || len(m.MagicNumber()) == 0 {
+		return signatureOf(Format(strings.TrimPrefix(kind.ext, ".")))
+	}
+	magic := m.MagicNumber()
+	for _, sig := range signatures {
+		if bytes.Equal(sig.magic, magic) {
+			return sig, true
+		}
+	}
+	return signature{magic: magic, size: len(magic)}, true
+}
+
+// magicOf returns the magic number of the format f, for the built-in
+// decompressors to report as their MagicNumber
+func magicOf(f Format) []byte {
+	sig, _ := signatureOf(f)
+	return bytes.Clone(sig.magic)
+}
+
+// isBzip2 checks the block size following the "BZh" magic, '1' to '9'
+func isBzip2(p []byte) bool {
+	return p[3] >= '1' && p[3] <= '9'
+}
+
+// isZlib matches the two byte zlib header (RFC 1950): deflate with a window
+// of at most 32KiB, and a header check making it a multiple of 31
+func isZlib(p []byte) bool {
+	return p[0]&0x0f == 8 && p[0]>>4 <= 7 && (uint16(p[0])<<8|uint16(p[1]))%31 == 0
+}
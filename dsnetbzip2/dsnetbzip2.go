@@ -0,0 +1,74 @@
+// Package dsnetbzip2 provides an alternative bzip2 (.bz2) decompressor for
+// fsdecomp, backed by github.com/dsnet/compress/bzip2.
+//
+// It is considerably faster than the standard library decoder, produces more
+// descriptive errors, and its readers are reset and reused between files
+// rather than allocated for each one. Unlike the format packages it does not
+// register itself, as the standard library decoder remains the default.
+// Select it for a single filesystem with
+//
+//	fsdecomp.New(fsys, fsdecomp.WithDecompressor(".bz2", dsnetbzip2.Decompressor))
+//
+// or for every filesystem with
+//
+//	fsdecomp.Register(".bz2", dsnetbzip2.Decompressor)
+package dsnetbzip2
+
+import (
+	"io"
+	"io/fs"
+	"sync"
+
+	fsdecomp "github.com/AndreRenaud/FSDecomp"
+	"github.com/dsnet/compress/bzip2"
+)
+
+// Decompressor decompresses bzip2 streams using pooled dsnet readers
+var Decompressor fsdecomp.Decompressor = decompressor{}
+
+// readerPool holds *bzip2.Reader values for reuse
+var readerPool sync.Pool
+
+type decompressor struct{}
+
+func (decompressor) MagicNumber() []byte {
+	return []byte("BZh")
+}
+
+func (decompressor) NewReader(r io.Reader) (io.ReadCloser, error) {
+	if zr, ok := readerPool.Get().(*bzip2.Reader); ok {
+		if err := zr.Reset(r); err != nil {
+			return nil, err
+		}
+		return &pooledReader{reader: zr}, nil
+	}
+	zr, err := bzip2.NewReader(r, nil)
+	if err != nil {
+		return nil, err
+	}
+	return &pooledReader{reader: zr}, nil
+}
+
+// pooledReader returns its bzip2 reader to the pool when closed
+type pooledReader struct {
+	reader *bzip2.Reader
+}
+
+func (pr *pooledReader) Read(p []byte) (int, error) {
+	if pr.reader == nil {
+		return 0, fs.ErrClosed
+	}
+	return pr.reader.Read(p)
+}
+
+func (pr *pooledReader) Close() error {
+	if pr.reader == nil {
+		return nil
+	}
+	// Any decoding error has already been reported by Read, so the
+	// persistent error returned by the reader's Close is not repeated here
+	pr.reader.Close()
+	readerPool.Put(pr.reader)
+	pr.reader = nil
+	return nil
+}
@@ -0,0 +1,132 @@
+package dsnetbzip2_test
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"testing"
+	"testing/fstest"
+
+	fsdecomp "github.com/AndreRenaud/FSDecomp"
+	"github.com/AndreRenaud/FSDecomp/dsnetbzip2"
+	"github.com/dsnet/compress/bzip2"
+)
+
+// backends lists the bzip2 implementations that must behave identically
+var backends = []struct {
+	name string
+	opts []fsdecomp.Option
+}{
+	{name: "stdlib"},
+	{name: "dsnet", opts: []fsdecomp.Option{fsdecomp.WithDecompressor(".bz2", dsnetbzip2.Decompressor)}},
+}
+
+// Helper to create bzip2 test data
+func createBzip2Data(tb testing.TB, content []byte) []byte {
+	var buf bytes.Buffer
+	bw, err := bzip2.NewWriter(&buf, nil)
+	if err != nil {
+		tb.Fatalf("Failed to create bzip2 writer: %v", err)
+	}
+	if _, err := bw.Write(content); err != nil {
+		tb.Fatalf("Failed to write bzip2 data: %v", err)
+	}
+	if err := bw.Close(); err != nil {
+		tb.Fatalf("Failed to close bzip2 writer: %v", err)
+	}
+	return buf.Bytes()
+}
+
+// textContent generates size bytes of compressible, log-like text
+func textContent(size int) []byte {
+	rng := rand.New(rand.NewSource(1))
+	var buf bytes.Buffer
+	for buf.Len() < size {
+		fmt.Fprintf(&buf, "2024-06-01T12:%02d:%02d host%d service[%d]: request %x completed\n",
+			rng.Intn(60), rng.Intn(60), rng.Intn(8), rng.Intn(1000), rng.Int63())
+	}
+	return buf.Bytes()[:size]
+}
+
+// TestBackends ensures both bzip2 backends decode and classify errors identically
+func TestBackends(t *testing.T) {
+	content := textContent(256 * 1024)
+	valid := createBzip2Data(t, content)
+
+	corrupt := bytes.Clone(valid)
+	corrupt[len(corrupt)/2] ^= 0xff
+
+	testFS := fstest.MapFS{
+		"valid.txt.bz2":     &fstest.MapFile{Data: valid},
+		"corrupt.txt.bz2":   &fstest.MapFile{Data: corrupt},
+		"truncated.txt.bz2": &fstest.MapFile{Data: valid[:len(valid)/2]},
+	}
+
+	for _, backend := range backends {
+		t.Run(backend.name, func(t *testing.T) {
+			dfs := fsdecomp.New(testFS, backend.opts...)
+
+			// Open the valid file repeatedly so pooled readers get reused
+			for i := 0; i < 3; i++ {
+				data, err := readFile(dfs, "valid.txt")
+				if err != nil {
+					t.Fatalf("Unexpected error reading valid.txt: %v", err)
+				}
+				if !bytes.Equal(data, content) {
+					t.Fatalf("Decoded content does not match original")
+				}
+			}
+
+			for _, name := range []string{"corrupt.txt", "truncated.txt"} {
+				_, err := readFile(dfs, name)
+				var decompErr *fsdecomp.DecompressError
+				if !errors.As(err, &decompErr) {
+					t.Fatalf("Expected DecompressError reading %s, got %v", name, err)
+				}
+				if decompErr.Format != "bz2" {
+					t.Errorf("Expected format %q, got %q", "bz2", decompErr.Format)
+				}
+				if decompErr.Name != name+".bz2" {
+					t.Errorf("Expected name %q, got %q", name+".bz2", decompErr.Name)
+				}
+			}
+		})
+	}
+}
+
+func readFile(dfs *fsdecomp.DecompressFS, name string) ([]byte, error) {
+	file, err := dfs.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	return io.ReadAll(file)
+}
+
+// BenchmarkBackends compares the bzip2 backends on a ~50MB file
+func BenchmarkBackends(b *testing.B) {
+	content := textContent(50 << 20)
+	testFS := fstest.MapFS{
+		"large.log.bz2": &fstest.MapFile{Data: createBzip2Data(b, content)},
+	}
+
+	for _, backend := range backends {
+		b.Run(backend.name, func(b *testing.B) {
+			dfs := fsdecomp.New(testFS, backend.opts...)
+			b.SetBytes(int64(len(content)))
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				file, err := dfs.Open("large.log")
+				if err != nil {
+					b.Fatalf("Unexpected error opening large.log: %v", err)
+				}
+				if _, err := io.Copy(io.Discard, file); err != nil {
+					b.Fatalf("Error reading large.log: %v", err)
+				}
+				file.Close()
+			}
+		})
+	}
+}
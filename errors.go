@@ -0,0 +1,134 @@
+package fsdecomp
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+)
+
+// ErrMagicMismatch is the error wrapped in a DecompressError when a file's
+// content doesn't start with the magic number of the format its extension
+// indicates (see WithMagicValidation)
+var ErrMagicMismatch = errors.New("content does not match the format's magic number")
+
+// ErrCorruptHeader is the error wrapped in a DecompressError, alongside the
+// decoder's own error, when a gzip member header is malformed or truncated,
+// or fails its header CRC, as opposed to the compressed data following it
+var ErrCorruptHeader = errors.New("corrupt header")
+
+// ErrChecksumMismatch is the error wrapped in a DecompressError when a file
+// read to the end doesn't match the checksum in its sidecar (see
+// WithChecksumVerification)
+var ErrChecksumMismatch = errors.New("checksum mismatch")
+
+// ErrNilFS is returned by NewChecked and NewBounded when given a nil
+// filesystem
+var ErrNilFS = errors.New("nil filesystem")
+
+// ErrIncompatibleOptions is the error wrapped by NewChecked when it is given
+// options that conflict, or that have no effect in combination
+var ErrIncompatibleOptions = errors.New("incompatible options")
+
+// ErrOutOfOrder is the error a SequentialAccessError matches with errors.Is
+var ErrOutOfOrder = errors.New("stream has already passed the member")
+
+// SequentialAccessError is returned by a SequentialFS for a member that the
+// stream has already passed, when it is opened or read
+type SequentialAccessError struct {
+	Op      string // "open" or "read"
+	Name    string // Name of the member
+	Current string // Member the stream is at, or "" at its end
+	Opened  bool   // Whether the member was opened, rather than skipped over
+}
+
+func (e *SequentialAccessError) Error() string {
+	msg := e.Op + " " + e.Name + ": " + ErrOutOfOrder.Error()
+	if e.Opened {
+		msg += ", which was already opened"
+	}
+	if e.Current != "" {
+		msg += " (stream is at " + e.Current + ")"
+	}
+	return msg
+}
+
+func (e *SequentialAccessError) Is(target error) bool {
+	return target == ErrOutOfOrder
+}
+
+// ErrTooLarge is the error wrapped in a DecompressError when a file
+// decompresses to more than the limit set with WithMaxDecompressedSize, and
+// in an fs.PathError when a file exceeds the limit passed to ReadString or
+// a snapshot exceeds the limit set with WithMaxFreezeSize
+var ErrTooLarge = errors.New("decompressed data exceeds the size limit")
+
+// ErrVariantMismatch is the error wrapped in a DecompressError when a
+// compressed file's contents differ from those of the uncompressed file
+// alongside it (see WithVariantCheck)
+var ErrVariantMismatch = errors.New("contents differ from the uncompressed file")
+
+// ErrLowRatio is the error wrapped in a DecompressError reported as a
+// warning for a file that decompresses to less than expected, which may mean
+// it was truncated (see WithMinDecompressedRatio)
+var ErrLowRatio = errors.New("decompressed size is suspiciously small")
+
+// ErrMissingPart is the error wrapped in an fs.PathError when opening a
+// file split into parts, one of which is missing (see WithSplitParts)
+var ErrMissingPart = errors.New("missing part")
+
+// ErrIncompleteRead is the error an IncompleteReadError matches with
+// errors.Is, returned by Close for decompressed files that haven't been
+// read to the end (see WithStrictClose)
+var ErrIncompleteRead = errors.New("file closed before being read to the end")
+
+// IncompleteReadError is returned by Close for a decompressed file that
+// hasn't been read to the end, when WithStrictClose is enabled
+type IncompleteReadError struct {
+	Name      string // Name of the compressed file as seen by the underlying filesystem
+	Remaining int64  // Decompressed bytes left unread, or -1 if unknown
+}
+
+func (e *IncompleteReadError) Error() string {
+	if e.Remaining < 0 {
+		return "close " + e.Name + ": " + ErrIncompleteRead.Error()
+	}
+	return "close " + e.Name + ": " + ErrIncompleteRead.Error() + " (" + strconv.FormatInt(e.Remaining, 10) + " bytes unread)"
+}
+
+func (e *IncompleteReadError) Is(target error) bool {
+	return target == ErrIncompleteRead
+}
+
+// DecompressError reports a failure while decoding the contents of a
+// compressed file, such as a corrupt stream or a checksum mismatch.
+//
+// Checksums carried by the stream (gzip CRC-32, zstd and lz4 content
+// checksums, bzip2 block CRCs) are always verified by the built-in
+// decompressors, with mismatches reported once the affected data has been
+// read, at the latest when the file is read to EOF.
+type DecompressError struct {
+	Format string // Compression format, the extension without its leading dot (e.g. "lz4")
+	Name   string // Name of the compressed file as seen by the underlying filesystem, less the extensions of any outer layers
+	Err    error  // Underlying decoder error
+}
+
+func (e *DecompressError) Error() string {
+	return "decompress " + e.Name + " (" + e.Format + "): " + e.Err.Error()
+}
+
+func (e *DecompressError) Unwrap() error {
+	return e.Err
+}
+
+// newDecompressError wraps err as a DecompressError for the named file of the
+// given format, unless an inner layer has already done so
+func newDecompressError(kind format, name string, err error) error {
+	if _, ok := err.(*DecompressError); ok {
+		return err
+	}
+	return &DecompressError{
+		Format: strings.TrimPrefix(kind.ext, "."),
+		Name:   name,
+		Err:    err,
+	}
+}
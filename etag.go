@@ -0,0 +1,38 @@
+package fsdecomp
+
+import (
+	"strconv"
+	"strings"
+)
+
+// ETag returns an HTTP entity tag for the named file, derived from the size
+// and modification time of the file providing it in the underlying
+// filesystem, and the formats it is decompressed from. Nothing is
+// decompressed or hashed, so it is cheap enough to compute for every
+// request, but as it doesn't depend on the decompressed bytes themselves it
+// is a weak ETag (W/"..."), suitable for conditional requests but not for
+// range requests. It changes whenever the underlying file's size or
+// modification time does, or a different file starts providing the name.
+func (dfs *DecompressFS) ETag(name string) (string, error) {
+	r, err := dfs.resolve(name)
+	if err != nil {
+		return "", err
+	}
+	defer r.file.Close()
+	info, err := r.file.Stat()
+	if err != nil {
+		return "", err
+	}
+
+	var b strings.Builder
+	b.WriteString(`W/"`)
+	b.WriteString(strconv.FormatInt(info.Size(), 16))
+	b.WriteByte('-')
+	b.WriteString(strconv.FormatInt(info.ModTime().UnixNano(), 16))
+	for _, layer := range r.layers {
+		b.WriteByte('-')
+		b.WriteString(strings.TrimPrefix(layer.ext, "."))
+	}
+	b.WriteByte('"')
+	return b.String(), nil
+}
@@ -0,0 +1,116 @@
+// Package fastgzip provides faster alternative gzip (.gz) decompressors for
+// fsdecomp, backed by github.com/klauspost/compress/gzip and
+// github.com/klauspost/pgzip.
+//
+// Decompressor is a drop-in replacement for the standard library decoder.
+// Parallel additionally decodes large files ahead of the reader on a separate
+// goroutine, so decompression overlaps with whatever the caller does with the
+// data.
+//
+// Neither is registered automatically, as the standard library decoder
+// remains the default. Select one for a single filesystem with
+//
+//	fsdecomp.New(fsys, fsdecomp.WithDecompressor(".gz", fastgzip.Decompressor))
+//
+// or for every filesystem with fsdecomp.Register.
+package fastgzip
+
+import (
+	"io"
+	"io/fs"
+
+	fsdecomp "github.com/AndreRenaud/FSDecomp"
+	"github.com/klauspost/compress/gzip"
+	"github.com/klauspost/pgzip"
+)
+
+// Decompressor decompresses gzip streams using klauspost/compress/gzip
+var Decompressor fsdecomp.Decompressor = sequential{}
+
+// Make sure the decompressors also report sizes like the built-in gzip one
+var _ fsdecomp.WrappingSizer = sequential{}
+var _ fsdecomp.WrappingSizer = Parallel{}
+var _ fsdecomp.MemberSizer = sequential{}
+var _ fsdecomp.MemberSizer = Parallel{}
+
+type sequential struct{}
+
+func (sequential) MagicNumber() []byte {
+	return []byte{0x1f, 0x8b}
+}
+
+func (sequential) NewReader(r io.Reader) (io.ReadCloser, error) {
+	gzReader, err := gzip.NewReader(r)
+	if err != nil {
+		return nil, err
+	}
+	return gzReader, nil
+}
+
+func (sequential) DecompressedSize(r io.ReaderAt, size int64) (int64, bool) {
+	return fsdecomp.GzipSize(r, size)
+}
+
+func (sequential) SizeLimits() (int64, float64) {
+	return sizeLimits()
+}
+
+func (sequential) LastMemberSize() {}
+
+// Parallel decompresses gzip streams with read-ahead decoding for files of at
+// least Threshold bytes, and sequentially like Decompressor otherwise.
+//
+// The read-ahead decoder buffers at most Blocks blocks of BlockSize
+// decompressed bytes per open file, which bounds its memory use.
+type Parallel struct {
+	Threshold int64 // Minimum compressed file size to decode ahead; 0 decodes every file ahead
+	BlockSize int   // Size of each read-ahead block; 0 uses the pgzip default of 250000 bytes
+	Blocks    int   // Number of blocks to decode ahead; 0 uses the pgzip default of 16
+}
+
+// NewReader implements fsdecomp.Decompressor. Files are only decoded ahead
+// when r reports its size via Stat, as files opened from an fs.FS do.
+func (p Parallel) NewReader(r io.Reader) (io.ReadCloser, error) {
+	if !p.large(r) {
+		return sequential{}.NewReader(r)
+	}
+	gzReader, err := pgzip.NewReaderN(r, p.BlockSize, p.Blocks)
+	if err != nil {
+		return nil, err
+	}
+	return gzReader, nil
+}
+
+func (Parallel) MagicNumber() []byte {
+	return []byte{0x1f, 0x8b}
+}
+
+func (p Parallel) DecompressedSize(r io.ReaderAt, size int64) (int64, bool) {
+	return fsdecomp.GzipSize(r, size)
+}
+
+func (Parallel) SizeLimits() (int64, float64) {
+	return sizeLimits()
+}
+
+func (Parallel) LastMemberSize() {}
+
+// large reports whether r is at least p.Threshold bytes long
+func (p Parallel) large(r io.Reader) bool {
+	if p.Threshold <= 0 {
+		return true
+	}
+	f, ok := r.(interface{ Stat() (fs.FileInfo, error) })
+	if !ok {
+		return false
+	}
+	info, err := f.Stat()
+	return err == nil && info.Size() >= p.Threshold
+}
+
+// sizeLimits returns the limits of the sizes read by fsdecomp.GzipSize: ISIZE
+// holds the size modulo 2^32, and deflate compresses by a factor of at most
+// 1032
+func sizeLimits() (int64, float64) {
+	return 1 << 32, 1032
+}
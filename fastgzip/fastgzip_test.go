@@ -0,0 +1,170 @@
+package fastgzip_test
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"math/rand"
+	"testing"
+	"testing/fstest"
+	"time"
+
+	fsdecomp "github.com/AndreRenaud/FSDecomp"
+	"github.com/AndreRenaud/FSDecomp/fastgzip"
+)
+
+// Helper to create gzip test data, with one member per part
+func createGzipData(t testing.TB, parts ...[]byte) []byte {
+	var buf bytes.Buffer
+	for _, part := range parts {
+		gzw := gzip.NewWriter(&buf)
+		if _, err := gzw.Write(part); err != nil {
+			t.Fatalf("Failed to write gzip data: %v", err)
+		}
+		if err := gzw.Close(); err != nil {
+			t.Fatalf("Failed to close gzip writer: %v", err)
+		}
+	}
+	return buf.Bytes()
+}
+
+// textContent generates size bytes of compressible, log-like text
+func textContent(size int) []byte {
+	rng := rand.New(rand.NewSource(1))
+	var buf bytes.Buffer
+	for buf.Len() < size {
+		fmt.Fprintf(&buf, "2024-06-01T12:%02d:%02d host%d service[%d]: request %x completed\n",
+			rng.Intn(60), rng.Intn(60), rng.Intn(8), rng.Intn(1000), rng.Int63())
+	}
+	return buf.Bytes()[:size]
+}
+
+// TestIdenticalOutput ensures every backend decodes to the same bytes as the standard library
+func TestIdenticalOutput(t *testing.T) {
+	large := textContent(8 << 20)
+	testFS := fstest.MapFS{
+		"empty.txt.gz":       &fstest.MapFile{Data: createGzipData(t, nil)},
+		"small.txt.gz":       &fstest.MapFile{Data: createGzipData(t, []byte("small gzip content"))},
+		"multi.txt.gz":       &fstest.MapFile{Data: createGzipData(t, []byte("first member\n"), []byte("second member\n"))},
+		"large.log.gz":       &fstest.MapFile{Data: createGzipData(t, large)},
+		"large-multi.log.gz": &fstest.MapFile{Data: createGzipData(t, large[:3<<20], large[3<<20:])},
+	}
+
+	backends := map[string]fsdecomp.Decompressor{
+		"klauspost":          fastgzip.Decompressor,
+		"parallel":           fastgzip.Parallel{},
+		"parallel-threshold": fastgzip.Parallel{Threshold: 1 << 20, BlockSize: 64 * 1024, Blocks: 4},
+	}
+
+	reference := fsdecomp.New(testFS)
+	for name := range testFS {
+		name = name[:len(name)-len(".gz")]
+		expected, expectedSize := hashFile(t, reference, name)
+
+		for backend, d := range backends {
+			dfs := fsdecomp.New(testFS, fsdecomp.WithDecompressor(".gz", d))
+			sum, size := hashFile(t, dfs, name)
+			if sum != expected {
+				t.Errorf("%s: %s decoded differently from the standard library", backend, name)
+			}
+			if size != expectedSize {
+				t.Errorf("%s: %s reported size %d, expected %d", backend, name, size, expectedSize)
+			}
+		}
+	}
+}
+
+// hashFile returns the SHA-256 of the named file's contents and its reported size
+func hashFile(t *testing.T, dfs *fsdecomp.DecompressFS, name string) ([sha256.Size]byte, int64) {
+	file, err := dfs.Open(name)
+	if err != nil {
+		t.Fatalf("Unexpected error opening %s: %v", name, err)
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		t.Fatalf("Error getting file info: %v", err)
+	}
+	h := sha256.New()
+	if _, err := io.Copy(h, file); err != nil {
+		t.Fatalf("Error reading %s: %v", name, err)
+	}
+	var sum [sha256.Size]byte
+	h.Sum(sum[:0])
+	return sum, info.Size()
+}
+
+// BenchmarkBackends compares the gzip backends on a large file
+func BenchmarkBackends(b *testing.B) {
+	content := textContent(64 << 20)
+	testFS := fstest.MapFS{
+		"large.log.gz": &fstest.MapFile{Data: createGzipData(b, content)},
+	}
+
+	backends := []struct {
+		name string
+		opts []fsdecomp.Option
+	}{
+		{name: "stdlib"},
+		{name: "klauspost", opts: []fsdecomp.Option{fsdecomp.WithDecompressor(".gz", fastgzip.Decompressor)}},
+		{name: "parallel", opts: []fsdecomp.Option{fsdecomp.WithDecompressor(".gz", fastgzip.Parallel{})}},
+	}
+	for _, backend := range backends {
+		b.Run(backend.name, func(b *testing.B) {
+			dfs := fsdecomp.New(testFS, backend.opts...)
+			b.SetBytes(int64(len(content)))
+			for i := 0; i < b.N; i++ {
+				file, err := dfs.Open("large.log")
+				if err != nil {
+					b.Fatalf("Unexpected error opening large.log: %v", err)
+				}
+				if _, err := io.Copy(io.Discard, file); err != nil {
+					b.Fatalf("Error reading large.log: %v", err)
+				}
+				file.Close()
+			}
+		})
+	}
+}
+
+// TestParallelThroughFS ensures files opened through a DecompressFS report
+// their size to Parallel, so that it decodes those above its threshold ahead
+func TestParallelThroughFS(t *testing.T) {
+	// Random content compresses to about its own size, so decoding ahead
+	// reads well beyond what a sequential decoder needs for one byte
+	content := make([]byte, 1<<20)
+	rand.New(rand.NewSource(1)).Read(content)
+	data := createGzipData(t, content)
+	testFS := fstest.MapFS{"random.bin.gz": &fstest.MapFile{Data: data}}
+
+	for _, test := range []struct {
+		threshold int64
+		ahead     bool
+	}{
+		{threshold: int64(len(data)), ahead: true},
+		{threshold: int64(len(data)) + 1, ahead: false},
+	} {
+		p := fastgzip.Parallel{Threshold: test.threshold, BlockSize: 64 << 10, Blocks: 8}
+		dfs := fsdecomp.New(testFS, fsdecomp.WithDecompressor(".gz", p))
+		file, err := dfs.Open("random.bin")
+		if err != nil {
+			t.Fatalf("Unexpected error opening random.bin: %v", err)
+		}
+		if _, err := file.Read(make([]byte, 1)); err != nil {
+			t.Fatalf("Unexpected error reading random.bin: %v", err)
+		}
+		counter := file.(interface{ BytesRead() (int64, int64) })
+		compressed, _ := counter.BytesRead()
+		for deadline := time.Now().Add(10 * time.Second); test.ahead && compressed < 256<<10 && time.Now().Before(deadline); {
+			time.Sleep(time.Millisecond)
+			compressed, _ = counter.BytesRead()
+		}
+		if ahead := compressed >= 256<<10; ahead != test.ahead {
+			t.Errorf("Threshold %d: expected decoding ahead %v, read %d compressed bytes for one", test.threshold, test.ahead, compressed)
+		}
+		file.Close()
+	}
+}
@@ -0,0 +1,91 @@
+package fsdecomp
+
+import (
+	"io"
+	"io/fs"
+	"path"
+	"strings"
+	"testing/fstest"
+)
+
+// Freeze decompresses the tree rooted at root into memory, returning a
+// snapshot that serves the same logical names, relative to root, without
+// touching the underlying filesystem again. Later changes to the underlying
+// filesystem don't affect the snapshot, making it useful for reproducible
+// builds and tests. Where several files provide the same logical name, the
+// one Open picks is used. Entries other than regular files and directories
+// are skipped.
+//
+// The total size of the snapshot's contents may be limited with
+// WithMaxFreezeSize.
+func (dfs *DecompressFS) Freeze(root string) (fs.FS, error) {
+	snapshot := make(fstest.MapFS)
+	var total int64
+	err := dfs.walkDir(root, func(name string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel := "."
+		switch {
+		case name == root && !d.IsDir():
+			rel = path.Base(name)
+		case name == root:
+		case root == ".":
+			rel = name
+		default:
+			rel = strings.TrimPrefix(name, root+"/")
+		}
+		if _, ok := snapshot[rel]; ok || !d.IsDir() && !d.Type().IsRegular() {
+			return nil
+		}
+
+		if d.IsDir() {
+			info, err := d.Info()
+			if err != nil {
+				return err
+			}
+			if rel != "." {
+				snapshot[rel] = &fstest.MapFile{Mode: info.Mode(), ModTime: info.ModTime()}
+			}
+			return nil
+		}
+		file, err := dfs.freezeFile(name, total)
+		if err != nil {
+			return err
+		}
+		total += int64(len(file.Data))
+		snapshot[rel] = file
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return snapshot, nil
+}
+
+// freezeFile reads the named file into memory, given that used bytes of the
+// snapshot's limit have already been taken
+func (dfs *DecompressFS) freezeFile(name string, used int64) (*fstest.MapFile, error) {
+	file, err := dfs.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	var r io.Reader = file
+	if dfs.freezeLimit > 0 {
+		r = io.LimitReader(file, dfs.freezeLimit-used+1)
+	}
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	if dfs.freezeLimit > 0 && used+int64(len(data)) > dfs.freezeLimit {
+		return nil, &fs.PathError{Op: "freeze", Path: name, Err: ErrTooLarge}
+	}
+	return &fstest.MapFile{Data: data, Mode: info.Mode(), ModTime: info.ModTime()}, nil
+}
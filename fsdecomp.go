@@ -1,16 +1,19 @@
 package fsdecomp
 
 import (
-	"compress/bzip2"
-	"compress/gzip"
+	"bytes"
 	"errors"
+	"fmt"
+	"hash"
 	"io"
 	"io/fs"
+	"math"
+	"path"
+	"slices"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
-
-	"github.com/klauspost/compress/zstd"
-	"github.com/pierrec/lz4/v4"
 )
 
 // Make sure DecompressFS implements fs.FS
@@ -20,240 +23,1050 @@ var _ fs.ReadDirFS = (*DecompressFS)(nil)
 // DecompressFS wraps an io.FS and automatically decompresses files with known extensions
 type DecompressFS struct {
 	fs.FS
+
+	formats    []format   // Formats to decompress, nil to use the registry directly
+	bufferPool *sync.Pool // Pool of *[]byte copy buffers, nil for the package default
+	dirIndex   string     // File to open in place of a directory, if set
+
+	magicValidation bool // Check magic numbers before decompressing
+	resolveSymlinks bool // Decompress symlinks to compressed files
+	variantCheck    bool // Compare compressed variants with plain files in VerifyAll
+	splitParts      bool // Join files split into numbered parts
+	normalizedNames bool // Name plain files after the path they were opened by
+	strictClose     bool // Fail Close on decompressed files not read to EOF
+	eagerStat       bool // Stat compressed files when they are opened
+	singleMember    bool // Use the sizes of MemberSizers
+
+	index         *snapshotIndex                        // Immutable index of the tree, if enabled
+	sidecars      *sidecars                             // Metadata sidecars of compressed files, if enabled
+	warning       func(error)                           // Handler for problems that don't fail an operation
+	sysEncoding   func(sys any) (string, bool)          // Format of files from backend metadata, if set
+	metaSuffix    string                                // Suffix of metadata files naming the format of files without an extension
+	metaParser    func(data []byte) string              // Format named by a metadata file, if metaSuffix is set
+	leaks         *leakTracker                          // Decompressed files still open, if leak detection is enabled
+	minRatio      float64                               // Decompressed to compressed size ratio below which files are reported, if set
+	maxRatio      float64                               // Largest decompressed to compressed size ratio of files, if set
+	checksumSide  ChecksumSide                          // Data checked against checksum sidecars, if set
+	slowWrite     time.Duration                         // Duration above which writes by WriteTo are reported, if set
+	onSlowWrite   func(SlowWrite)                       // Handler for slow writes, if slowWrite is set
+	chainLimit    int                                   // Compression layers a file may have, if more than one
+	probeStrategy ProbeStrategy                         // How Open checks for compressed variants
+	hidden        []func(name string) bool              // Files omitted from listings
+	preferIn      []string                              // Patterns of directories where compressed files take precedence over plain ones
+	nameMapper    func(dir, name string) string         // Names given to compressed files, if set
+	maxListing    int                                   // Entries above which directories aren't listed to resolve names, 0 for the default
+	walkFilter    func(path string, d fs.DirEntry) bool // Entries walked by VerifyAll, TarGz, Freeze and WalkParallel, if set
+	compatLevel   int                                   // Observable behavior to keep (see WithCompatLevel)
+
+	readTransforms []func(io.Reader) io.Reader // Applied to decompressed streams, in order
+	maxSize        int64                       // Limit on decompressed bytes per file, 0 for none
+	freezeLimit    int64                       // Limit on decompressed bytes held by Freeze, 0 for none
+
+	newValueDecoder func(io.Reader) ValueDecoder // Decoder used by Unmarshal, nil for JSON
+	maxLineLength   int                          // Longest line accepted by ScanLines, if set
+	newDigest       func() hash.Hash             // Digest of decompressed data, if set
+
+	sri   sriCache   // SRI strings computed by SRIHash
+	large largeDirs  // Directories with more entries than the listing limit
+	ops   opCounters // Calls made to the underlying filesystem
+
+	closed atomic.Bool // Set by Close
+}
+
+// New creates a new DecompressFS that wraps the provided filesystem.
+// The filesystem decompresses the formats registered (see Register) at the
+// time New is called, which always include the standard library formats;
+// later calls to Register don't affect it. fsys need only implement Open: fs.StatFS and
+// fs.ReadDirFS are used where available, and directories are otherwise
+// listed by reading them once opened.
+//
+// New panics if fsys is nil. Use NewChecked to have that, conflicting
+// options and an unreadable filesystem reported as errors.
+func New(fsys fs.FS, opts ...Option) *DecompressFS {
+	if fsys == nil {
+		panic("fsdecomp: New called with a nil filesystem")
+	}
+	dfs := configure(fsys, opts)
+	dfs.loadIndex()
+	return dfs
+}
+
+// configure returns a DecompressFS wrapping fsys with opts applied
+func configure(fsys fs.FS, opts []Option) *DecompressFS {
+	dfs := &DecompressFS{FS: fsys, formats: registeredFormats(), compatLevel: DefaultCompatLevel}
+	for _, opt := range opts {
+		opt(dfs)
+	}
+	return dfs
+}
+
+// loadIndex builds the whole snapshot index, if it is to be built eagerly
+func (dfs *DecompressFS) loadIndex() {
+	if dfs.index != nil && dfs.index.eager {
+		dfs.index.loadAll(dfs.backend(nil))
+	}
 }
 
-// New creates a new DecompressFS that wraps the provided filesystem
-func New(fsys fs.FS) *DecompressFS {
-	return &DecompressFS{FS: fsys}
+// Unwrap returns the filesystem wrapped by dfs
+func (dfs *DecompressFS) Unwrap() fs.FS {
+	return dfs.FS
 }
 
-// Open implements fs.FS.Open
+// supportedFormats returns the formats this filesystem decompresses, in probe order
+func (dfs *DecompressFS) supportedFormats() []format {
+	if dfs.formats != nil {
+		return dfs.formats
+	}
+	return registeredFormats()
+}
+
+// Open implements fs.FS.Open.
+//
+// A file opened by its logical name is decompressed, and its Stat reports the
+// logical name and, where known, the decompressed size. A file opened by its
+// real name, extension included, is passed through as stored, so its Stat
+// reports that name and the compressed size, matching what reading it
+// returns. fs.Stat on the DecompressFS follows the same rules.
+//
+// Directories are opened as the underlying filesystem opens them, so their
+// Stat reports what it does, unless WithDirectoryIndex or WithNormalizedNames
+// is used, and so does their ReadDir below compatibility level 2 (see
+// DefaultCompatLevel). They are never decompressed or renamed, and a
+// directory takes precedence over any file providing the same name, even
+// where compressed files are preferred.
+// Opening a name that doesn't exist, directory or not, fails with an error
+// wrapping fs.ErrNotExist for that name.
 func (dfs *DecompressFS) Open(name string) (fs.File, error) {
+	return dfs.open(name, dfs.maxSize)
+}
+
+// open implements Open, limiting decompressed files to maxSize bytes, or
+// not at all if it is zero or less
+func (dfs *DecompressFS) open(name string, maxSize int64) (fs.File, error) {
+	r, err := dfs.resolve(name)
+	if err != nil {
+		return nil, err
+	}
+	if len(r.layers) == 0 {
+		resolution := r.resolution(name)
+		file := r.file
+		if dfs.compatLevel >= 2 {
+			file = dfs.logicalDir(file, name, resolution)
+		}
+		if dfs.normalizedNames {
+			return withNormalizedName(file, name, resolution), nil
+		}
+		return file, nil
+	}
+	return dfs.decompress(r, name, maxSize)
+}
+
+// decompress returns the decompressed file r, opened as name, limited to
+// maxSize bytes as open does
+func (dfs *DecompressFS) decompress(r resolved, name string, maxSize int64) (fs.File, error) {
+	file, err := dfs.newDecompressFile(r.file, r.name, r.layers)
+	if err != nil {
+		return nil, err
+	}
+	df := file.(*decompressFile)
+	df.resolution = r.resolution(name)
+	df.maxSize = maxSize
+	if dfs.leaks != nil {
+		dfs.track(df, name)
+	}
+	return df, nil
+}
+
+// resolved is the file providing a logical name, opened from the underlying
+// filesystem but not yet decompressed
+type resolved struct {
+	file   fs.File
+	name   string   // Name the file was opened as
+	layers []format // Formats to decode, outermost first, none for plain files
+	misses int      // Candidate names found not to exist before the file was
+	cached bool     // Whether the snapshot index found the file
+	ops    BackendOps
+}
+
+// resolve finds and opens the file that provides name, recording the calls
+// made to the underlying filesystem to do so
+func (dfs *DecompressFS) resolve(name string) (resolved, error) {
+	var ops BackendOps
+	r, err := dfs.find(dfs.backend(&ops), name)
+	r.ops = ops
+	return r, err
+}
+
+// find implements resolve
+func (dfs *DecompressFS) find(b backend, name string) (resolved, error) {
+	if err := dfs.errIfClosed("open", name); err != nil {
+		return resolved{}, err
+	}
+	if !fs.ValidPath(name) {
+		// Probing would only turn names like "" into ones like ".gz"
+		return resolved{}, &fs.PathError{Op: "open", Path: name, Err: fs.ErrInvalid}
+	}
+	if dfs.index != nil {
+		return dfs.resolveIndexed(b, name)
+	}
+
+	var misses int
+	if dfs.prefersCompressed(path.Dir(name)) {
+		p := dfs.newProber(b, path.Dir(name))
+		if r, ok := dfs.probe(p, name, dfs.layerLimit(), dfs.compressionLimit()); ok {
+			// Directories take precedence even so
+			if info, err := b.stat(name); err != nil || !info.IsDir() {
+				r.misses = p.misses
+				return r, nil
+			}
+			r.file.Close()
+		}
+		misses = p.misses
+	}
+
 	// First try to open the file directly
-	file, err := dfs.FS.Open(name)
+	file, err := b.Open(name)
 	if err == nil {
-		return file, nil
+		r, err := dfs.resolveDirect(b, name, file)
+		r.misses += misses
+		return r, err
 	}
 
-	// If not found, try with compression extensions
+	// If not found, try with each registered compression extension in turn
 	if errors.Is(err, fs.ErrNotExist) {
-		// Try .gz
-		gzFile, gzErr := dfs.FS.Open(name + ".gz")
-		if gzErr == nil {
-			return newGzipFile(gzFile)
+		p := dfs.newProber(b, path.Dir(name))
+		r, ok := dfs.probe(p, name, dfs.layerLimit(), dfs.compressionLimit())
+		misses += 1 + p.misses
+		if ok {
+			r.misses = misses
+			return r, nil
+		}
+		if dfs.sidecars != nil || dfs.nameMapper != nil {
+			if r, ok := dfs.resolveRenamed(b, name); ok {
+				r.misses = misses
+				return r, nil
+			}
+		}
+		if dfs.splitParts {
+			if r, ok, err := dfs.resolveSplit(b, name); ok {
+				r.misses = misses
+				return r, err
+			}
 		}
+	}
 
-		// Try .bz2
-		bz2File, bz2Err := dfs.FS.Open(name + ".bz2")
-		if bz2Err == nil {
-			return newBzip2File(bz2File)
+	// Original error if all attempts fail
+	return resolved{}, err
+}
+
+// probe looks for name with up to depth extensions added, trying each
+// format in turn, along with any layers that may wrap it. Other than
+// transforms, up to compressions compression formats are added.
+func (dfs *DecompressFS) probe(p *prober, name string, depth, compressions int) (resolved, bool) {
+	for _, f := range dfs.supportedFormats() {
+		remaining := compressions
+		if !f.transform {
+			if remaining == 0 {
+				continue
+			}
+			remaining--
+		}
+		candidate := name + f.ext
+		if file, ok := p.open(candidate); ok {
+			return resolved{file: file, name: candidate, layers: []format{f}}, true
 		}
+		if depth > 1 {
+			if r, ok := dfs.probe(p, candidate, depth-1, remaining); ok {
+				r.layers = append(r.layers, f)
+				return r, true
+			}
+		}
+	}
+	return resolved{}, false
+}
 
-		// Try .zst
-		zstFile, zstErr := dfs.FS.Open(name + ".zst")
-		if zstErr == nil {
-			return newZstdFile(zstFile)
+// resolveDirect finishes resolving a file found under its requested name
+func (dfs *DecompressFS) resolveDirect(b backend, name string, file fs.File) (resolved, error) {
+	if dfs.resolveSymlinks {
+		if layers, ok := dfs.linkTargetLayers(b, name, file); ok {
+			return resolved{file: file, name: name, layers: layers}, nil
 		}
+	}
+	if dfs.sysEncoding != nil {
+		if kind, ok := dfs.sysFormat(name, file); ok {
+			return resolved{file: file, name: name, layers: []format{kind}}, nil
+		}
+	}
+	if dfs.metaParser != nil {
+		if info, err := file.Stat(); err == nil && !info.IsDir() {
+			if kind, ok := dfs.metaFileFormat(b, name); ok {
+				return resolved{file: file, name: name, layers: []format{kind}}, nil
+			}
+		}
+	}
+	if dfs.dirIndex != "" {
+		return dfs.resolveDirIndex(b, name, file)
+	}
+	return resolved{file: file, name: name}, nil
+}
+
+// maxSymlinkHops bounds how many links linkTargetFormat follows, matching
+// the limit commonly applied by operating systems
+const maxSymlinkHops = 40
+
+// readLinkFS matches fs.ReadLinkFS, which is only available from Go 1.25
+type readLinkFS interface {
+	ReadLink(name string) (string, error)
+}
+
+// linkTargetLayers returns the formats of the compressed file that name,
+// which has been opened as file, is a symbolic link to, if it is one
+func (dfs *DecompressFS) linkTargetLayers(b backend, name string, file fs.File) ([]format, bool) {
+	// Files opened by their compressed name are never decompressed
+	if _, _, ok := dfs.layersForName(name); ok {
+		return nil, false
+	}
 
-		// Try .lz4
-		lz4File, lz4Err := dfs.FS.Open(name + ".lz4")
-		if lz4Err == nil {
-			return newLz4File(lz4File)
+	target := name
+	for range maxSymlinkHops {
+		link, err := b.readLink(target)
+		if err != nil {
+			break
+		}
+		if path.IsAbs(link) {
+			// Outside the filesystem, so only its name can be used
+			target = link
+			break
+		}
+		target = path.Join(path.Dir(target), link)
+	}
+	if target == name {
+		// Some filesystems report the name of the link's target in Stat
+		info, err := file.Stat()
+		if err != nil || info.IsDir() {
+			return nil, false
 		}
+		target = info.Name()
+	} else if info, err := file.Stat(); err == nil && info.IsDir() {
+		return nil, false
 	}
+	_, layers, ok := dfs.layersForName(path.Base(target))
+	return layers, ok
+}
 
-	// Original error if all attempts fail
-	return nil, err
+// sysFormat returns the format that the backend's metadata for file, which
+// has been opened as name, says it is encoded with (see WithSysEncodingDetector)
+func (dfs *DecompressFS) sysFormat(name string, file fs.File) (format, bool) {
+	// Files with a compression extension are handled by name
+	if _, _, ok := dfs.layersForName(name); ok {
+		return format{}, false
+	}
+	info, err := file.Stat()
+	if err != nil || info.IsDir() {
+		return format{}, false
+	}
+	ext, ok := dfs.sysEncoding(info.Sys())
+	if !ok {
+		return format{}, false
+	}
+	return dfs.formatForExt(ext)
 }
 
+// metaFileFormat returns the format that the metadata file stored alongside
+// name says it is encoded with (see WithMetaSuffix)
+func (dfs *DecompressFS) metaFileFormat(b backend, name string) (format, bool) {
+	// Files with a compression extension are handled by name
+	if _, _, ok := dfs.layersForName(name); ok {
+		return format{}, false
+	}
+	meta, err := b.Open(name + dfs.metaSuffix)
+	if err != nil {
+		if !errors.Is(err, fs.ErrNotExist) {
+			dfs.warn(err)
+		}
+		return format{}, false
+	}
+	defer meta.Close()
+	data, err := io.ReadAll(io.LimitReader(meta, maxMetaFileSize+1))
+	if err == nil && len(data) > maxMetaFileSize {
+		err = ErrTooLarge
+	}
+	if err != nil {
+		dfs.warn(&fs.PathError{Op: "read", Path: name + dfs.metaSuffix, Err: err})
+		return format{}, false
+	}
+	ext := dfs.metaParser(data)
+	if ext == "" {
+		return format{}, false
+	}
+	return dfs.formatForExt(ext)
+}
+
+// maxMetaFileSize bounds how much of a metadata file is read for WithMetaSuffix
+const maxMetaFileSize = 64 * 1024
+
+// formatForExt returns the format handling ext, with or without its leading dot
+func (dfs *DecompressFS) formatForExt(ext string) (format, bool) {
+	ext = "." + strings.TrimPrefix(ext, ".")
+	for _, f := range dfs.supportedFormats() {
+		if f.ext == ext {
+			return f, true
+		}
+	}
+	return format{}, false
+}
+
+// resolveDirIndex resolves to the directory index file in place of file if
+// file is a directory containing one, or to file itself otherwise
+func (dfs *DecompressFS) resolveDirIndex(b backend, name string, file fs.File) (resolved, error) {
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return resolved{}, err
+	}
+	if !info.IsDir() {
+		return resolved{file: file, name: name}, nil
+	}
+	index, err := dfs.find(b, path.Join(name, dfs.dirIndex))
+	if errors.Is(err, fs.ErrNotExist) {
+		return resolved{file: file, name: name}, nil
+	}
+	file.Close()
+	return index, err
+}
+
+// ReadDir implements fs.ReadDirFS.ReadDir, listing compressed files under
+// their decompressed names.
+//
+// Only real directories can be listed: name is passed to the underlying
+// filesystem unchanged, without trying compression extensions, and any error
+// it returns is passed back unchanged. In particular, reading "file.txt" when
+// only "file.txt.gz" exists fails with the underlying filesystem's
+// fs.ErrNotExist error, even though Open("file.txt") succeeds.
 func (dfs *DecompressFS) ReadDir(name string) ([]fs.DirEntry, error) {
+	if err := dfs.errIfClosed("readdir", name); err != nil {
+		return nil, err
+	}
+	if dfs.index != nil {
+		return dfs.index.readDir(dfs.backend(nil), name)
+	}
+
 	// Custom implementation that filters/modifies directory entries
-	entries, err := fs.ReadDir(dfs.FS, name)
+	b := dfs.backend(nil)
+	entries, err := dfs.readDir(b, name)
 	if err != nil {
 		return nil, err
 	}
-	for i, entry := range entries {
+	return dfs.logicalEntries(b, name, entries), nil
+}
+
+// logicalEntries lists the directory name under the logical names of its
+// entries, given as the underlying filesystem lists them, sorted by name
+func (dfs *DecompressFS) logicalEntries(b backend, name string, entries []fs.DirEntry) []fs.DirEntry {
+	if dfs.compatLevel < 1 {
+		return dfs.listLevel0(b, name, entries)
+	}
+	entries = uniqueEntries(entries)
+	var present map[string]bool
+	if dfs.sidecars != nil {
+		present = listingNames(entries)
+	}
+	var groups map[string]*splitGroup
+	if dfs.splitParts {
+		groups = dfs.splitGroups(entries)
+	}
+
+	// Where several entries share a logical name, list the one Open picks,
+	// as ranked by probeRank
+	listed := make([]fs.DirEntry, 0, len(entries))
+	ranks := make([][]int, 0, len(entries))
+	positions := make(map[string]int, len(entries))
+	list := func(entry fs.DirEntry, rank []int) {
+		i, ok := positions[entry.Name()]
+		if !ok {
+			positions[entry.Name()] = len(listed)
+			listed = append(listed, entry)
+			ranks = append(ranks, rank)
+		} else if slices.Compare(rank, ranks[i]) < 0 {
+			listed[i], ranks[i] = entry, rank
+		}
+	}
+	for _, entry := range entries {
 		if entry.IsDir() {
+			// Directories are listed as they are, ahead of any file that
+			// would provide the same name
+			list(entry, nil)
 			continue
 		}
-		info, err := entry.Info()
-		if err != nil {
-			return nil, err
+		if dfs.isHidden(entry) || dfs.sidecars != nil && dfs.sidecars.isSidecar(entry.Name(), present) {
+			continue
 		}
-		name := entry.Name()
-		if strings.HasSuffix(name, ".gz") || strings.HasSuffix(name, ".bz2") || strings.HasSuffix(name, ".zst") || strings.HasSuffix(name, ".lz4") {
-			// Modify the name to remove the compression extension
-			newName := strings.TrimSuffix(name, ".gz")
-			newName = strings.TrimSuffix(newName, ".bz2")
-			newName = strings.TrimSuffix(newName, ".zst")
-			newName = strings.TrimSuffix(newName, ".lz4")
-			entries[i] = &fileInfoWrapper{
-				FileInfo: info,
-				name:     newName,
+		if stem, _, ok := splitPart(entry.Name()); ok && groups[stem] != nil {
+			// Split files are listed once, in place of their first part, and
+			// only used when probing finds nothing
+			if g := groups[stem]; entry.Name() == g.parts[0].Name() {
+				rank := append([]int{len(dfs.supportedFormats()) + 1}, dfs.probeRank(g.layers)...)
+				list(splitEntry{DirEntry: entry, name: g.logical, parts: g.parts}, rank)
 			}
+			continue
+		}
+		logical, layers, ok := dfs.layersForName(entry.Name())
+		if !ok {
+			list(entry, dfs.plainRank(name))
+			continue
+		}
+		rank := dfs.probeRank(layers)
+		re := dfs.compressedEntry(b, name, entry, logical, layers, present)
+		if re.name != logical {
+			// Names given by sidecars are only used when probing finds nothing
+			rank = append([]int{len(dfs.supportedFormats())}, rank...)
+		}
+		list(re, rank)
+	}
+	slices.SortFunc(listed, func(a, b fs.DirEntry) int {
+		return strings.Compare(a.Name(), b.Name())
+	})
+	return listed
+}
+
+// prefersCompressed reports whether compressed files take precedence over
+// plain files of the same name in dir (see WithPreferCompressedIn)
+func (dfs *DecompressFS) prefersCompressed(dir string) bool {
+	for _, pattern := range dfs.preferIn {
+		if ok, _ := path.Match(pattern, dir); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// plainRank returns the position of plain files and directories in dir
+// among files of the same logical name, as ranked by probeRank: before
+// compressed files, unless they are preferred in dir
+func (dfs *DecompressFS) plainRank(dir string) []int {
+	if dfs.prefersCompressed(dir) {
+		return []int{len(dfs.supportedFormats())}
+	}
+	return nil
+}
+
+// uniqueEntries removes repeated names from a directory listing, which some
+// filesystems, such as union mounts, may return, keeping the first entry
+// with each name
+func uniqueEntries(entries []fs.DirEntry) []fs.DirEntry {
+	seen := make(map[string]bool, len(entries))
+	return slices.DeleteFunc(entries, func(entry fs.DirEntry) bool {
+		if seen[entry.Name()] {
+			return true
 		}
+		seen[entry.Name()] = true
+		return false
+	})
+}
+
+// isHidden reports whether entry is hidden from listings by WithHiddenFiles
+func (dfs *DecompressFS) isHidden(entry fs.DirEntry) bool {
+	if entry.IsDir() {
+		return false
+	}
+	for _, match := range dfs.hidden {
+		if match(entry.Name()) {
+			return true
+		}
+	}
+	return false
+}
+
+// renamedEntry gives a directory entry a different name. Its Info is only
+// fetched when asked for, as some filesystems find it expensive or fail to
+// provide it, and listing only needs the name.
+type renamedEntry struct {
+	fs.DirEntry
+	name string
+	meta *sidecarMeta            // Metadata overrides from a sidecar, if any
+	size func(fs.FileInfo) int64 // Finds the decompressed size of the entry, if set
+}
+
+func (re renamedEntry) Name() string {
+	return re.name
+}
+
+func (re renamedEntry) Info() (fs.FileInfo, error) {
+	info, err := re.DirEntry.Info()
+	if err != nil {
+		return nil, err
 	}
-	return entries, nil
+	wrapped := fileInfoWrapper{FileInfo: info, name: re.name, size: -1, meta: re.meta}
+	if re.size != nil {
+		wrapped.size = re.size(info)
+	}
+	return wrapped, nil
+}
+
+func (re renamedEntry) String() string {
+	return fs.FormatDirEntry(re)
 }
 
 // decompressFile implements fs.File for a decompressed reader
 type decompressFile struct {
 	reader     io.Reader
 	closer     io.Closer
-	info       fs.FileInfo
-	originalFS fs.File
+	info       fs.FileInfo                 // Description of the file, once the compressed file has been statted
+	stat       func() (fs.FileInfo, error) // Stats the compressed file to describe the file
+	source     fs.File                     // compressed file as opened from the underlying FS
+	name       string                      // name of the compressed file in the underlying FS
+	kind       format
+	bufferPool *sync.Pool
+
+	digest   hash.Hash // Digest of the data read, if requested
+	checksum *checksum // Checksum to verify at EOF, if the file has one
+	complete bool      // Whether the data has been read to EOF
+
+	untrack    func()     // Stops leak detection tracking the file, if set
+	resolution Resolution // How Open found the file
+
+	// Byte counts shared by the features that depend on how far the file
+	// has been read, so that each doesn't wrap the streams separately
+	compressed *countingReader // Counts bytes read from the compressed file
+	read       int64           // Decompressed bytes read so far
+
+	maxSize int64       // Limit on decompressed bytes, 0 for none
+	minSize int64       // Size below which the file is reported as suspiciously small, if set
+	warn    func(error) // Reports problems that don't fail a read
+
+	strictClose bool // Fail Close unless the data has been read to EOF
+
+	slowWrite   time.Duration   // Duration above which writes by WriteTo are slow, if set
+	onSlowWrite func(SlowWrite) // Handler for slow writes
 }
 
+// Stat describes the decompressed file, based on the compressed file's
+// Stat. The compressed file is only statted the first time Stat is called,
+// which may be after it has been read from or closed, unless WithEagerStat
+// or an option that needs its size when opened is in use.
 func (df *decompressFile) Stat() (fs.FileInfo, error) {
-	if df.info != nil {
-		return df.info, nil
+	if df.info == nil {
+		info, err := df.stat()
+		if err != nil {
+			return nil, err
+		}
+		df.info = info
 	}
-	return df.originalFS.Stat()
+	return df.info, nil
 }
 
 func (df *decompressFile) Read(p []byte) (int, error) {
-	return df.reader.Read(p)
+	n, err := df.readLimited(p)
+	if df.digest != nil {
+		df.digest.Write(p[:n])
+	}
+	df.read += int64(n)
+	if err == io.EOF {
+		if !df.complete && df.checksum != nil {
+			if err := df.checksum.verify(df.compressed); err != nil {
+				return n, newDecompressError(df.kind, df.name, err)
+			}
+		}
+		if !df.complete && df.read < df.minSize {
+			df.warn(newDecompressError(df.kind, df.name, fmt.Errorf("%w: %d bytes, expected at least %d", ErrLowRatio, df.read, df.minSize)))
+		}
+		df.complete = true
+	} else if err != nil {
+		err = newDecompressError(df.kind, df.name, err)
+	}
+	return n, err
 }
 
-func (df *decompressFile) Close() error {
-	return df.closer.Close()
+// Sum returns the digest of the decompressed data requested with WithDigest,
+// once the file has been read to EOF. It returns false if no digest was
+// requested or the file hasn't been read in full.
+func (df *decompressFile) Sum() ([]byte, bool) {
+	if df.digest == nil || !df.complete {
+		return nil, false
+	}
+	return df.digest.Sum(nil), true
 }
 
-// newGzipFile creates a decompressed file reader for gzip files
-func newGzipFile(f fs.File) (fs.File, error) {
-	gzReader, err := gzip.NewReader(f)
-	if err != nil {
-		f.Close()
-		return nil, err
+// slowChunkSize is the size of the chunks WriteTo copies once writes to its
+// destination are found to be slow
+const slowChunkSize = 4 * 1024
+
+// SlowWrite describes a write by WriteTo that took longer than the
+// threshold set with WithSlowWriteHandler
+type SlowWrite struct {
+	Name     string        // Name of the compressed file as seen by the underlying filesystem
+	Written  int64         // Decompressed bytes written before the slow write
+	Size     int           // Bytes in the slow write
+	Duration time.Duration // Time the write took
+}
+
+// WriteTo implements io.WriterTo, copying the decompressed data to w through
+// buffers taken from the configured buffer pool, each returned to the pool
+// once its chunk has been written. Once a write is slow (see
+// WithSlowWriteHandler), later chunks are copied through a small buffer of
+// the file's own, so that a transfer to a slow destination holds no pooled
+// buffer while it waits on it.
+func (df *decompressFile) WriteTo(w io.Writer) (int64, error) {
+	var written int64
+	var small []byte // Buffer for chunks once a write has been slow
+	for {
+		chunk := small
+		var buf *[]byte
+		if chunk == nil {
+			buf = df.bufferPool.Get().(*[]byte)
+			chunk = *buf
+		}
+		n, err := df.Read(chunk)
+		var werr error
+		if n > 0 {
+			start := time.Now()
+			var nw int
+			nw, werr = w.Write(chunk[:n])
+			if elapsed := time.Since(start); df.slowWrite > 0 && elapsed > df.slowWrite {
+				df.onSlowWrite(SlowWrite{Name: df.name, Written: written, Size: n, Duration: elapsed})
+				if small == nil {
+					small = make([]byte, min(slowChunkSize, len(chunk)))
+				}
+			}
+			written += int64(nw)
+			if werr == nil && nw != n {
+				werr = io.ErrShortWrite
+			}
+		}
+		if buf != nil {
+			df.bufferPool.Put(buf)
+		}
+		if werr != nil {
+			return written, werr
+		}
+		if err == io.EOF {
+			return written, nil
+		}
+		if err != nil {
+			return written, err
+		}
 	}
+}
 
-	// Get the original file info
-	info, err := f.Stat()
-	if err != nil {
-		f.Close()
-		return nil, err
+func (df *decompressFile) Close() error {
+	if df.untrack != nil {
+		df.untrack()
 	}
+	var incomplete error
+	if df.strictClose && !df.complete {
+		remaining := int64(-1)
+		if size, ok := df.contentLength(); ok {
+			remaining = max(size-df.read, 0)
+		}
+		incomplete = &IncompleteReadError{Name: df.name, Remaining: remaining}
+	}
+	if err := df.closer.Close(); err != nil {
+		return err
+	}
+	return incomplete
+}
 
-	// Create custom FileInfo with the original name without the extension
-	modifiedInfo := modifyFileInfo(info, strings.TrimSuffix(info.Name(), ".gz"))
+// Unwrap returns the compressed file being decompressed, as opened from the
+// underlying filesystem. Every other wrapper Open returns, such as those
+// renaming files for WithNormalizedNames, has the method too, returning the
+// file it wraps, so code looking for a particular file type, such as
+// *os.File, can check the file itself and then each file returned by
+// successive calls to Unwrap. Reading from or seeking the compressed file
+// corrupts the decompressed stream.
+func (df *decompressFile) Unwrap() fs.File {
+	return df.source
+}
 
-	return &decompressFile{
-		reader:     gzReader,
-		closer:     multiCloser{gzReader, f},
-		info:       modifiedInfo,
-		originalFS: f,
-	}, nil
+// defaultBufferPool provides copy buffers when no pool has been configured
+var defaultBufferPool = sync.Pool{
+	New: func() any {
+		buf := make([]byte, 32*1024)
+		return &buf
+	},
 }
 
-// newBzip2File creates a decompressed file reader for bzip2 files
-func newBzip2File(f fs.File) (fs.File, error) {
-	bzReader := bzip2.NewReader(f)
+// newDecompressFile creates a decompressed file reader for f, which was opened
+// as name, decoding the given layers from the outermost in
+func (dfs *DecompressFS) newDecompressFile(f fs.File, name string, layers []format) (fs.File, error) {
+	source := f
+	var compressedInfo fs.FileInfo
+	if dfs.eagerStat || dfs.minRatio > 0 {
+		// Before anything reads from the file
+		var err error
+		if compressedInfo, err = f.Stat(); err != nil {
+			f.Close()
+			return nil, err
+		}
+	}
+	if dfs.magicValidation {
+		var err error
+		if f, err = checkMagic(f, layers[0]); err != nil {
+			return nil, newDecompressError(layers[0], name, err)
+		}
+	}
+	var check *checksum
+	if dfs.checksumSide != "" {
+		var err error
+		if check, err = dfs.checksumFor(name, layers); err != nil {
+			f.Close()
+			return nil, err
+		}
+	}
 
-	// Get the original file info
-	info, err := f.Stat()
-	if err != nil {
-		f.Close()
-		return nil, err
+	// Each layer reads from the one outside it, and is named without the
+	// extensions of the layers outside it in errors
+	compressed := &countingReader{reader: f, file: f}
+	if check != nil && check.compressed {
+		compressed.reader = io.TeeReader(f, check.hash)
+	}
+	var reader io.Reader = compressed
+	closer := multiCloser{f}
+	layerName := name
+	for i, kind := range layers {
+		if i > 0 {
+			reader = &layerReader{reader: reader, kind: layers[i-1], name: layerName}
+			layerName = strings.TrimSuffix(layerName, layers[i-1].ext)
+		}
+		decoder, err := newLayerReader(kind, layerName, reader)
+		if err != nil {
+			closer.Close()
+			return nil, newDecompressError(kind, layerName, err)
+		}
+		reader = decoder
+		closer = append(closer, decoder)
+	}
+	kind := layers[len(layers)-1]
+
+	// Describe the file with the original name without the extensions, and
+	// the decompressed size if known, once the original file has been statted
+	var meta *sidecarMeta
+	if dfs.sidecars != nil {
+		meta = dfs.sidecarFor(dfs.backend(nil), name)
+	}
+	stat := func() (fs.FileInfo, error) {
+		info := compressedInfo
+		if info == nil {
+			var err error
+			if info, err = f.Stat(); err != nil {
+				return nil, err
+			}
+		}
+		modifiedInfo := fileInfoWrapper{
+			FileInfo: info,
+			name:     dfs.mapName(path.Dir(name), strings.TrimSuffix(path.Base(layerName), kind.ext)),
+			size:     -1,
+			meta:     meta,
+		}
+		if len(layers) == 1 {
+			modifiedInfo.size = dfs.decompressedSize(f, info, kind)
+		}
+		return modifiedInfo, nil
+	}
+	var info fs.FileInfo
+	if compressedInfo != nil {
+		info, _ = stat()
+	}
+
+	bufferPool := dfs.bufferPool
+	if bufferPool == nil {
+		bufferPool = &defaultBufferPool
 	}
 
-	// Create custom FileInfo with the original name without the extension
-	modifiedInfo := modifyFileInfo(info, strings.TrimSuffix(info.Name(), ".bz2"))
+	if check != nil && !check.compressed {
+		reader = io.TeeReader(reader, check.hash)
+	}
+	transformed := reader
+	for _, transform := range dfs.readTransforms {
+		transformed = transform(transformed)
+	}
+
+	var digest hash.Hash
+	if dfs.newDigest != nil {
+		digest = dfs.newDigest()
+	}
+
+	var minSize int64
+	if dfs.minRatio > 0 {
+		minSize = int64(math.Ceil(dfs.minRatio * float64(compressedInfo.Size())))
+	}
 
 	return &decompressFile{
-		reader:     bzReader,
-		closer:     f,
-		info:       modifiedInfo,
-		originalFS: f,
+		reader:      transformed,
+		closer:      closer,
+		info:        info,
+		stat:        stat,
+		source:      source,
+		name:        layerName,
+		kind:        kind,
+		bufferPool:  bufferPool,
+		digest:      digest,
+		checksum:    check,
+		compressed:  compressed,
+		maxSize:     dfs.maxSize,
+		minSize:     minSize,
+		warn:        dfs.warn,
+		strictClose: dfs.strictClose,
+		slowWrite:   dfs.slowWrite,
+		onSlowWrite: dfs.onSlowWrite,
 	}, nil
 }
 
-// newZstdFile creates a decompressed file reader for zstd files
-func newZstdFile(f fs.File) (fs.File, error) {
-	zstReader, err := zstd.NewReader(f)
-	if err != nil {
-		f.Close()
-		return nil, err
+// decompressedSize returns the decompressed size of f, a compressed file of
+// the given format described by info, if the format allows it to be found
+// cheaply and no transform can change it, or -1 otherwise
+func (dfs *DecompressFS) decompressedSize(f fs.File, info fs.FileInfo, kind format) int64 {
+	sizer, ok := dfs.sizer(kind)
+	if !ok {
+		return -1
+	}
+	ra, ok := f.(io.ReaderAt)
+	if !ok {
+		return -1
 	}
+	n, ok := sizer.DecompressedSize(ra, info.Size())
+	if !ok {
+		return -1
+	}
+	if ws, ok := sizer.(WrappingSizer); ok && dfs.sizeMayWrap(ws, n, info.Size()) {
+		return -1
+	}
+	return n
+}
 
-	// Get the original file info
-	info, err := f.Stat()
+// entrySize returns the decompressed size of the file at name, of the given
+// format and described by info, as decompressedSize finds it, opening the
+// file only if the format can report it
+func (dfs *DecompressFS) entrySize(name string, info fs.FileInfo, kind format) int64 {
+	if _, ok := dfs.sizer(kind); !ok {
+		return -1
+	}
+	f, err := dfs.backend(nil).Open(name)
 	if err != nil {
-		f.Close()
-		return nil, err
+		return -1
 	}
+	defer f.Close()
+	return dfs.decompressedSize(f, info, kind)
+}
 
-	// Create custom FileInfo with the original name without the extension
-	modifiedInfo := modifyFileInfo(info, strings.TrimSuffix(info.Name(), ".zst"))
+// sizer returns the Sizer of kind, if it has one whose sizes can be used: no
+// transform can change the size, and a MemberSizer's only with
+// WithSingleMemberSizes
+func (dfs *DecompressFS) sizer(kind format) (Sizer, bool) {
+	sizer, ok := kind.decompressor.(Sizer)
+	if !ok || len(dfs.readTransforms) > 0 {
+		return nil, false
+	}
+	if _, ok := sizer.(MemberSizer); ok && !dfs.singleMember {
+		return nil, false
+	}
+	return sizer, true
+}
 
-	return &decompressFile{
-		reader:     zstReader,
-		closer:     f,
-		info:       modifiedInfo,
-		originalFS: f,
-	}, nil
+// sizeMayWrap reports whether a file of compressed bytes, whose size ws
+// gives as n, could decompress to more than n by a multiple of its modulus
+func (dfs *DecompressFS) sizeMayWrap(ws WrappingSizer, n, compressed int64) bool {
+	modulus, ratio := ws.SizeLimits()
+	if dfs.maxRatio > 0 {
+		ratio = dfs.maxRatio
+	}
+	return float64(n)+float64(modulus) <= ratio*float64(compressed)
 }
 
-// newLz4File creates a decompressed file reader for lz4 files
-func newLz4File(f fs.File) (fs.File, error) {
-	lz4Reader := lz4.NewReader(f)
+// checkMagic verifies that f starts with the signature of kind, if it has
+// one (see formatSignature). It returns a file to decompress from the start of, which is f itself
+// unless f had to be wrapped to replay the bytes read. f is closed on error.
+func checkMagic(f fs.File, kind format) (fs.File, error) {
+	sig, ok := formatSignature(kind)
+	if !ok {
+		return f, nil
+	}
+	prefix := make([]byte, sig.size)
 
-	// Get the original file info
-	info, err := f.Stat()
-	if err != nil {
+	// Prefer ReadAt, which leaves the read offset at the start of the file
+	var err error
+	if ra, ok := f.(io.ReaderAt); ok {
+		_, err = ra.ReadAt(prefix, 0)
+	} else {
+		_, err = io.ReadFull(f, prefix)
+		f = &prefixedFile{File: f, reader: io.MultiReader(bytes.NewReader(prefix), f)}
+	}
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
 		f.Close()
 		return nil, err
 	}
+	if err != nil || !sig.match(prefix) {
+		f.Close()
+		return nil, ErrMagicMismatch
+	}
+	return f, nil
+}
 
-	// Create custom FileInfo with the original name without the extension
-	modifiedInfo := modifyFileInfo(info, strings.TrimSuffix(info.Name(), ".lz4"))
-
-	return &decompressFile{
-		reader:     lz4Reader,
-		closer:     f, // LZ4 reader doesn't need to be closed
-		info:       modifiedInfo,
-		originalFS: f,
-	}, nil
+// prefixedFile replays bytes already read from a file before the rest of it
+type prefixedFile struct {
+	fs.File
+	reader io.Reader
 }
 
-// multiCloser helps close multiple resources
-type multiCloser struct {
-	c1, c2 io.Closer
+func (pf *prefixedFile) Read(p []byte) (int, error) {
+	return pf.reader.Read(p)
 }
 
+// multiCloser closes several resources in the reverse of the order they
+// were added, so that each layer of a pipeline is closed before the one it
+// reads from, returning their errors joined
+type multiCloser []io.Closer
+
 func (mc multiCloser) Close() error {
-	err1 := mc.c1.Close()
-	err2 := mc.c2.Close()
-	if err1 != nil {
-		return err1
+	var errs []error
+	for i := len(mc) - 1; i >= 0; i-- {
+		if err := mc[i].Close(); err != nil {
+			errs = append(errs, err)
+		}
 	}
-	return err2
+	return errors.Join(errs...)
 }
 
-// fileInfoWrapper wraps an fs.FileInfo to modify its name
+// fileInfoWrapper wraps an fs.FileInfo to modify its name, and optionally its
+// size and the metadata given by a sidecar
 type fileInfoWrapper struct {
 	fs.FileInfo
 	name string
+	size int64        // Decompressed size, or -1 to report the size of the wrapped FileInfo
+	meta *sidecarMeta // Metadata overrides from a sidecar, if any
 }
 
 func (fiw fileInfoWrapper) Name() string {
+	if fiw.meta != nil && fiw.meta.name != "" {
+		return fiw.meta.name
+	}
 	return fiw.name
 }
 
+func (fiw fileInfoWrapper) Mode() fs.FileMode {
+	if fiw.meta != nil && fiw.meta.hasMode {
+		return fiw.FileInfo.Mode()&^fs.ModePerm | fiw.meta.mode
+	}
+	return fiw.FileInfo.Mode()
+}
+
+func (fiw fileInfoWrapper) Size() int64 {
+	if fiw.size >= 0 {
+		return fiw.size
+	}
+	return fiw.FileInfo.Size()
+}
+
 func (fiw fileInfoWrapper) Info() (fs.FileInfo, error) {
 	return fiw.FileInfo, nil
 }
 
 func (fiw fileInfoWrapper) Type() fs.FileMode {
-	return fiw.FileInfo.Mode()
+	return fiw.Mode()
 }
 
 func (fiw fileInfoWrapper) ModTime() time.Time {
-	return fiw.FileInfo.ModTime()
-}
-
-func modifyFileInfo(info fs.FileInfo, newName string) fs.FileInfo {
-	return fileInfoWrapper{
-		FileInfo: info,
-		name:     newName,
+	if fiw.meta != nil && !fiw.meta.modTime.IsZero() {
+		return fiw.meta.modTime
 	}
+	return fiw.FileInfo.ModTime()
 }
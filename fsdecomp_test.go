@@ -1,18 +1,47 @@
-package fsdecomp
+package fsdecomp_test
 
 import (
+	"archive/tar"
+	"bufio"
 	"bytes"
+	stdbzip2 "compress/bzip2"
+	"compress/flate"
 	"compress/gzip"
+	"compress/zlib"
+	"context"
+	"crypto/sha256"
+	"crypto/sha512"
+	"embed"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/gob"
+	"encoding/hex"
+	"encoding/json"
 	"errors"
+	"fmt"
+	"hash/crc32"
+	htmltemplate "html/template"
 	"io"
 	"io/fs"
+	"math"
+	"math/rand/v2"
+	"os"
+	"path"
+	"runtime"
+	"slices"
 	"strings"
+	"sync"
 	"testing"
 	"testing/fstest"
+	"testing/iotest"
+	"time"
 
+	fsdecomp "github.com/AndreRenaud/FSDecomp"
+	_ "github.com/AndreRenaud/FSDecomp/all"
 	"github.com/dsnet/compress/bzip2"
 	"github.com/klauspost/compress/zstd"
 	lz4 "github.com/pierrec/lz4/v4"
+	"github.com/ulikunitz/xz"
 )
 
 // TestDecompressFS tests the functionality of DecompressFS
@@ -44,7 +73,7 @@ func TestDecompressFS(t *testing.T) {
 	}
 
 	// Create the DecompressFS wrapper
-	dfs := DecompressFS{testFS}
+	dfs := fsdecomp.New(testFS)
 
 	// Test cases
 	tests := []struct {
@@ -127,7 +156,7 @@ func TestDecompressFS(t *testing.T) {
 }
 
 // Helper to create gzip test data
-func createGzipData(t *testing.T, content string) []byte {
+func createGzipData(t testing.TB, content string) []byte {
 	var buf bytes.Buffer
 	gzw := gzip.NewWriter(&buf)
 	if _, err := gzw.Write([]byte(content)); err != nil {
@@ -171,6 +200,35 @@ func createZstdData(t *testing.T, content string) []byte {
 	return buf.Bytes()
 }
 
+// Helper to create zlib test data
+func createZlibData(t *testing.T, content string) []byte {
+	var buf bytes.Buffer
+	zw := zlib.NewWriter(&buf)
+	if _, err := zw.Write([]byte(content)); err != nil {
+		t.Fatalf("Failed to write zlib data: %v", err)
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatalf("Failed to close zlib writer: %v", err)
+	}
+	return buf.Bytes()
+}
+
+// Helper to create raw deflate test data
+func createFlateData(t *testing.T, content string) []byte {
+	var buf bytes.Buffer
+	fw, err := flate.NewWriter(&buf, flate.DefaultCompression)
+	if err != nil {
+		t.Fatalf("Failed to create flate writer: %v", err)
+	}
+	if _, err := fw.Write([]byte(content)); err != nil {
+		t.Fatalf("Failed to write flate data: %v", err)
+	}
+	if err := fw.Close(); err != nil {
+		t.Fatalf("Failed to close flate writer: %v", err)
+	}
+	return buf.Bytes()
+}
+
 // Helper to create lz4 test data
 func createLz4Data(t *testing.T, content string) []byte {
 	var buf bytes.Buffer
@@ -192,7 +250,7 @@ func TestReadDirectoryFails(t *testing.T) {
 		},
 	}
 
-	dfs := DecompressFS{testFS}
+	dfs := fsdecomp.New(testFS)
 
 	// Try to open a directory
 	_, err := dfs.Open("dir")
@@ -231,7 +289,7 @@ func TestDecompressReadDir(t *testing.T) {
 		},
 	}
 
-	dfs := New(testFS)
+	dfs := fsdecomp.New(testFS)
 
 	// Test ReadDir at the root
 	t.Run("ReadDir at root", func(t *testing.T) {
@@ -312,3 +370,5247 @@ func TestDecompressReadDir(t *testing.T) {
 		}
 	})
 }
+
+// TestStdlibOnly ensures formats outside the standard library are treated as plain files
+func TestStdlibOnly(t *testing.T) {
+	testFS := fstest.MapFS{
+		"dir/compressed.txt.gz": &fstest.MapFile{
+			Data: createGzipData(t, "gzipped content"),
+		},
+		"dir/archive.txt.bz2": &fstest.MapFile{
+			Data: createBzip2Data(t, "bzip2 content"),
+		},
+		"dir/file.txt.zst": &fstest.MapFile{
+			Data: createZstdData(t, "zstd content"),
+		},
+		"dir/data.txt.lz4": &fstest.MapFile{
+			Data: createLz4Data(t, "lz4 content"),
+		},
+		"dir/packed.txt.zz": &fstest.MapFile{
+			Data: createZlibData(t, "zlib content"),
+		},
+		"dir/raw.txt.deflate": &fstest.MapFile{
+			Data: createFlateData(t, "deflate content"),
+		},
+	}
+
+	dfs := fsdecomp.New(testFS, fsdecomp.WithStdlibOnly())
+
+	for path, expected := range map[string]string{
+		"dir/compressed.txt": "gzipped content",
+		"dir/archive.txt":    "bzip2 content",
+		"dir/packed.txt":     "zlib content",
+		"dir/raw.txt":        "deflate content",
+	} {
+		data, err := fs.ReadFile(dfs, path)
+		if err != nil {
+			t.Fatalf("Unexpected error reading %s: %v", path, err)
+		}
+		if string(data) != expected {
+			t.Errorf("Expected content %q, got %q", expected, string(data))
+		}
+	}
+
+	for _, path := range []string{"dir/file.txt", "dir/data.txt"} {
+		if _, err := dfs.Open(path); !errors.Is(err, fs.ErrNotExist) {
+			t.Errorf("Expected not-exist error opening %s, got %v", path, err)
+		}
+	}
+
+	// Non-stdlib formats are still readable verbatim under their real names
+	raw, err := fs.ReadFile(dfs, "dir/file.txt.zst")
+	if err != nil {
+		t.Fatalf("Unexpected error reading dir/file.txt.zst: %v", err)
+	}
+	if !bytes.Equal(raw, testFS["dir/file.txt.zst"].Data) {
+		t.Errorf("Expected raw zstd data for dir/file.txt.zst")
+	}
+
+	entries, err := fs.ReadDir(dfs, "dir")
+	if err != nil {
+		t.Fatalf("Failed to read directory: %v", err)
+	}
+	var names []string
+	for _, entry := range entries {
+		names = append(names, entry.Name())
+	}
+	expected := []string{"archive.txt", "compressed.txt", "data.txt.lz4", "file.txt.zst", "packed.txt", "raw.txt"}
+	if strings.Join(names, ",") != strings.Join(expected, ",") {
+		t.Errorf("Expected entries %v, got %v", expected, names)
+	}
+}
+
+// TestBufferPool ensures copying a decompressed file uses buffers from the configured pool
+func TestBufferPool(t *testing.T) {
+	content := strings.Repeat("pooled buffer content\n", 1000)
+	testFS := fstest.MapFS{
+		"file.txt.gz": &fstest.MapFile{
+			Data: createGzipData(t, content),
+		},
+	}
+
+	// The pool starts empty, so every buffer taken from it is counted by New
+	var allocated int
+	pool := &sync.Pool{
+		New: func() any {
+			allocated++
+			buf := make([]byte, 512)
+			return &buf
+		},
+	}
+	dfs := fsdecomp.New(testFS, fsdecomp.WithBufferPool(pool))
+
+	file, err := dfs.Open("file.txt")
+	if err != nil {
+		t.Fatalf("Unexpected error opening file.txt: %v", err)
+	}
+	defer file.Close()
+
+	var buf bytes.Buffer
+	if _, err := io.Copy(&buf, file); err != nil {
+		t.Fatalf("Error copying file: %v", err)
+	}
+	if buf.String() != content {
+		t.Errorf("Copied content does not match original")
+	}
+	if allocated == 0 {
+		t.Errorf("Expected copy buffer to be taken from the configured pool")
+	}
+}
+
+// TestDirectoryIndex ensures opening a directory returns its (possibly compressed) index file
+func TestDirectoryIndex(t *testing.T) {
+	testFS := fstest.MapFS{
+		"index.html": &fstest.MapFile{
+			Data: []byte("root index"),
+		},
+		"site/index.html.gz": &fstest.MapFile{
+			Data: createGzipData(t, "compressed index"),
+		},
+		"site/page.html": &fstest.MapFile{
+			Data: []byte("page"),
+		},
+		"empty/other.txt": &fstest.MapFile{
+			Data: []byte("no index here"),
+		},
+	}
+
+	dfs := fsdecomp.New(testFS, fsdecomp.WithDirectoryIndex("index.html"))
+
+	for name, expected := range map[string]string{
+		".":              "root index",
+		"site":           "compressed index",
+		"site/page.html": "page",
+	} {
+		file, err := dfs.Open(name)
+		if err != nil {
+			t.Fatalf("Unexpected error opening %s: %v", name, err)
+		}
+		data, err := io.ReadAll(file)
+		file.Close()
+		if err != nil {
+			t.Fatalf("Error reading %s: %v", name, err)
+		}
+		if string(data) != expected {
+			t.Errorf("Expected %s content %q, got %q", name, expected, string(data))
+		}
+	}
+
+	// A directory without an index opens as a directory
+	file, err := dfs.Open("empty")
+	if err != nil {
+		t.Fatalf("Unexpected error opening empty: %v", err)
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		t.Fatalf("Error getting file info: %v", err)
+	}
+	if !info.IsDir() {
+		t.Errorf("Expected 'empty' to open as a directory")
+	}
+
+	// Listings still show the directory contents
+	entries, err := fs.ReadDir(dfs, "site")
+	if err != nil {
+		t.Fatalf("Failed to read directory: %v", err)
+	}
+	if len(entries) != 2 {
+		t.Errorf("Expected 2 entries in site, got %d", len(entries))
+	}
+}
+
+// TestRsyncableGzip ensures gzip files with frequent flush points, as produced
+// by `gzip --rsyncable` or `pigz --rsyncable`, decode and report their size
+func TestRsyncableGzip(t *testing.T) {
+	// testdata/rsyncable.txt.gz was generated with `gzip --rsyncable -9 -n`
+	// from the output of rsyncableContent
+	expected := rsyncableContent()
+
+	dfs := fsdecomp.New(os.DirFS("testdata"), fsdecomp.WithSingleMemberSizes())
+	file, err := dfs.Open("rsyncable.txt")
+	if err != nil {
+		t.Fatalf("Unexpected error opening rsyncable.txt: %v", err)
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		t.Fatalf("Error getting file info: %v", err)
+	}
+	if info.Size() != int64(len(expected)) {
+		t.Errorf("Expected size %d, got %d", len(expected), info.Size())
+	}
+
+	data, err := io.ReadAll(file)
+	if err != nil {
+		t.Fatalf("Error reading file: %v", err)
+	}
+	if !bytes.Equal(data, expected) {
+		t.Errorf("Decompressed content does not match original")
+	}
+}
+
+// TestConcatenatedGzipSize ensures the size of gzip files, which may be
+// several members concatenated, is only taken from the trailer with
+// WithSingleMemberSizes
+func TestConcatenatedGzipSize(t *testing.T) {
+	first, second := "the first member holds 38 bytes......", "ab"
+	data := append(createGzipData(t, first), createGzipData(t, second)...)
+	testFS := fstest.MapFS{
+		"joined.txt.gz": &fstest.MapFile{Data: data},
+		"single.txt.gz": &fstest.MapFile{Data: createGzipData(t, first+second)},
+	}
+
+	dfs := fsdecomp.New(testFS)
+	for _, name := range []string{"joined.txt", "single.txt"} {
+		if size, exact, err := fsdecomp.ContentLength(dfs, name); err != nil || exact {
+			t.Errorf("Expected %s to have no exact size by default, got (%d, %v, %v)", name, size, exact, err)
+		}
+	}
+	content, err := fs.ReadFile(dfs, "joined.txt")
+	if err != nil || string(content) != first+second {
+		t.Errorf("Expected joined.txt to contain both members, got %q, %v", content, err)
+	}
+
+	// Declaring single members trusts the trailer, which for joined.txt is
+	// that of its last member
+	sized := fsdecomp.New(testFS, fsdecomp.WithSingleMemberSizes())
+	if size, exact, err := fsdecomp.ContentLength(sized, "single.txt"); err != nil || !exact || size != int64(len(first+second)) {
+		t.Errorf("Expected single.txt to have exact size %d, got (%d, %v, %v)", len(first+second), size, exact, err)
+	}
+	if size, exact, err := fsdecomp.ContentLength(sized, "joined.txt"); err != nil || !exact || size != int64(len(second)) {
+		t.Errorf("Expected joined.txt to report its last member's size %d, got (%d, %v, %v)", len(second), size, exact, err)
+	}
+}
+
+// countingReaderAt counts the bytes read through it
+type countingReaderAt struct {
+	io.ReaderAt
+	n int64
+}
+
+func (r *countingReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	n, err := r.ReaderAt.ReadAt(p, off)
+	r.n += int64(n)
+	return n, err
+}
+
+// TestGzipSizeReadsTrailer ensures finding the size of a gzip file reads
+// only its trailer, however large the file
+func TestGzipSizeReadsTrailer(t *testing.T) {
+	content := strings.Repeat("a fairly compressible line of text\n", 100000)
+	data := createGzipData(t, content)
+
+	r := &countingReaderAt{ReaderAt: bytes.NewReader(data)}
+	size, ok := fsdecomp.GzipSize(r, int64(len(data)))
+	if !ok || size != int64(len(content)) {
+		t.Errorf("Expected size %d, got (%d, %v)", len(content), size, ok)
+	}
+	if r.n > 8 {
+		t.Errorf("Expected at most the 8 byte trailer to be read, read %d bytes", r.n)
+	}
+}
+
+// rsyncableContent generates the original content of testdata/rsyncable.txt.gz
+func rsyncableContent() []byte {
+	words := strings.Fields("alpha bravo charlie delta echo foxtrot golf hotel india juliet kilo lima mike " +
+		"november oscar papa quebec romeo sierra tango uniform victor whiskey xray yankee zulu")
+	var buf bytes.Buffer
+	x := uint64(12345)
+	for i := 0; i < 5000; i++ {
+		line := make([]string, 8)
+		for j := range line {
+			x = (x*1103515245 + 12345) % (1 << 31)
+			line[j] = words[(x>>16)%uint64(len(words))]
+		}
+		fmt.Fprintf(&buf, "%05d %s\n", i, strings.Join(line, " "))
+	}
+	return buf.Bytes()
+}
+
+// TestContentLength ensures sizes are only reported as exact when they are known without decompressing
+func TestContentLength(t *testing.T) {
+	testFS := fstest.MapFS{
+		"plain.txt": &fstest.MapFile{
+			Data: []byte("plain content"),
+		},
+		"compressed.txt.gz": &fstest.MapFile{
+			Data: createGzipData(t, "gzipped content"),
+		},
+		"archive.txt.bz2": &fstest.MapFile{
+			Data: createBzip2Data(t, "bzip2 content"),
+		},
+		"dir/file.txt": &fstest.MapFile{
+			Data: []byte("in a directory"),
+		},
+	}
+	dfs := fsdecomp.New(testFS)
+	sized := fsdecomp.New(testFS, fsdecomp.WithSingleMemberSizes())
+
+	tests := []struct {
+		fsys  fs.FS
+		name  string
+		size  int64
+		exact bool
+	}{
+		{fsys: dfs, name: "plain.txt", size: 13, exact: true},
+		{fsys: dfs, name: "compressed.txt", exact: false}, // ISIZE only covers the last member
+		{fsys: sized, name: "compressed.txt", size: 15, exact: true},
+		{fsys: sized, name: "archive.txt", exact: false}, // bzip2 doesn't record its size
+		{fsys: dfs, name: "dir", exact: false},
+		{fsys: testFS, name: "compressed.txt.gz", size: int64(len(testFS["compressed.txt.gz"].Data)), exact: true},
+	}
+	for _, tc := range tests {
+		size, exact, err := fsdecomp.ContentLength(tc.fsys, tc.name)
+		if err != nil {
+			t.Fatalf("Unexpected error for %s: %v", tc.name, err)
+		}
+		if exact != tc.exact || (exact && size != tc.size) {
+			t.Errorf("%s: expected (%d, %v), got (%d, %v)", tc.name, tc.size, tc.exact, size, exact)
+		}
+	}
+
+	if _, _, err := fsdecomp.ContentLength(dfs, "missing.txt"); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("Expected not-exist error for missing.txt, got %v", err)
+	}
+}
+
+// TestReadDirOnCompressedFile ensures ReadDir never treats a decompressed file as a directory
+func TestReadDirOnCompressedFile(t *testing.T) {
+	testFS := fstest.MapFS{
+		"compressed.txt.gz": &fstest.MapFile{
+			Data: createGzipData(t, "gzipped content"),
+		},
+	}
+	dfs := fsdecomp.New(testFS)
+
+	for _, name := range []string{"compressed.txt", "compressed.txt.gz"} {
+		entries, err := fs.ReadDir(dfs, name)
+		if err == nil {
+			t.Fatalf("Expected error reading %s as a directory, got %d entries", name, len(entries))
+		}
+		// The error must be exactly what the underlying filesystem reports
+		_, expected := fs.ReadDir(testFS, name)
+		if err.Error() != expected.Error() {
+			t.Errorf("Expected underlying error %q for %s, got %q", expected, name, err)
+		}
+	}
+
+	if _, err := fs.ReadDir(dfs, "compressed.txt"); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("Expected not-exist error for compressed.txt, got %v", err)
+	}
+}
+
+// streamFS wraps a filesystem so its files only support Stat, Read and Close,
+// hiding optional interfaces such as io.ReaderAt and io.Seeker
+type streamFS struct {
+	fs.FS
+}
+
+func (sfs streamFS) Open(name string) (fs.File, error) {
+	file, err := sfs.FS.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	return struct{ fs.File }{file}, nil
+}
+
+// TestMagicValidation ensures files whose content doesn't match their extension are rejected
+func TestMagicValidation(t *testing.T) {
+	testFS := fstest.MapFS{
+		"valid.txt.gz": &fstest.MapFile{
+			Data: createGzipData(t, "gzipped content"),
+		},
+		"mislabelled.txt.gz": &fstest.MapFile{
+			Data: createZstdData(t, "zstd content"),
+		},
+		"short.txt.gz": &fstest.MapFile{
+			Data: []byte{0x1f},
+		},
+	}
+
+	for name, fsys := range map[string]fs.FS{"ReaderAt": testFS, "stream": streamFS{testFS}} {
+		t.Run(name, func(t *testing.T) {
+			dfs := fsdecomp.New(fsys, fsdecomp.WithMagicValidation())
+
+			data, err := fs.ReadFile(dfs, "valid.txt")
+			if err != nil {
+				t.Fatalf("Unexpected error reading valid.txt: %v", err)
+			}
+			if string(data) != "gzipped content" {
+				t.Errorf("Expected content %q, got %q", "gzipped content", string(data))
+			}
+
+			for _, path := range []string{"mislabelled.txt", "short.txt"} {
+				_, err := dfs.Open(path)
+				var decompErr *fsdecomp.DecompressError
+				if !errors.As(err, &decompErr) {
+					t.Fatalf("Expected DecompressError opening %s, got %v", path, err)
+				}
+				if decompErr.Format != "gz" {
+					t.Errorf("Expected format %q, got %q", "gz", decompErr.Format)
+				}
+				if !errors.Is(err, fsdecomp.ErrMagicMismatch) {
+					t.Errorf("Expected magic mismatch error opening %s, got %v", path, err)
+				}
+			}
+		})
+	}
+}
+
+// TestRegister ensures globally registered formats are picked up by filesystems created afterwards
+func TestRegister(t *testing.T) {
+	testFS := fstest.MapFS{
+		"shout.txt.upper": &fstest.MapFile{
+			Data: []byte("quiet content"),
+		},
+	}
+	before := fsdecomp.New(testFS)
+
+	fsdecomp.Register(".upper", fsdecomp.DecompressorFunc(func(r io.Reader) (io.ReadCloser, error) {
+		data, err := io.ReadAll(r)
+		if err != nil {
+			return nil, err
+		}
+		return io.NopCloser(bytes.NewReader(bytes.ToUpper(data))), nil
+	}))
+	after := fsdecomp.New(testFS)
+
+	data, err := fs.ReadFile(after, "shout.txt")
+	if err != nil {
+		t.Fatalf("Unexpected error reading shout.txt: %v", err)
+	}
+	if string(data) != "QUIET CONTENT" {
+		t.Errorf("Expected content %q, got %q", "QUIET CONTENT", string(data))
+	}
+
+	// Filesystems created before registration keep their original formats
+	if _, err := before.Open("shout.txt"); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("Expected not-exist error from filesystem created before Register, got %v", err)
+	}
+
+	// Registration is safe alongside concurrent use of the registry
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			fsdecomp.Register(".upper", fsdecomp.DecompressorFunc(func(r io.Reader) (io.ReadCloser, error) {
+				return io.NopCloser(r), nil
+			}))
+		}()
+		go func() {
+			defer wg.Done()
+			fsdecomp.New(testFS)
+		}()
+	}
+	wg.Wait()
+}
+
+// TestVerifyAll ensures every decoding failure in a tree is reported
+func TestVerifyAll(t *testing.T) {
+	corrupt := createZstdData(t, strings.Repeat("zstd content ", 100))
+	corrupt[len(corrupt)-2] ^= 0xff
+
+	testFS := fstest.MapFS{
+		"assets/plain.txt": &fstest.MapFile{
+			Data: []byte("plain content"),
+		},
+		"assets/compressed.txt.gz": &fstest.MapFile{
+			Data: createGzipData(t, "gzipped content"),
+		},
+		"assets/nested/archive.txt.bz2": &fstest.MapFile{
+			Data: createBzip2Data(t, "bzip2 content"),
+		},
+		"assets/nested/good.txt.zst": &fstest.MapFile{
+			Data: createZstdData(t, "zstd content"),
+		},
+		"assets/nested/bad.txt.zst": &fstest.MapFile{
+			Data: corrupt,
+		},
+	}
+	dfs := fsdecomp.New(testFS)
+
+	errs := dfs.VerifyAll(".")
+	if len(errs) != 1 {
+		t.Fatalf("Expected exactly 1 error, got %d: %v", len(errs), errs)
+	}
+	var decompErr *fsdecomp.DecompressError
+	if !errors.As(errs[0], &decompErr) {
+		t.Fatalf("Expected DecompressError, got %v", errs[0])
+	}
+	if decompErr.Name != "assets/nested/bad.txt.zst" {
+		t.Errorf("Expected error for %q, got %q", "assets/nested/bad.txt.zst", decompErr.Name)
+	}
+
+	delete(testFS, "assets/nested/bad.txt.zst")
+	if errs := dfs.VerifyAll("assets"); errs != nil {
+		t.Errorf("Expected no errors for a valid tree, got %v", errs)
+	}
+}
+
+// TestVerifyAllVariants ensures VerifyAll decompresses compressed variants
+// that Open doesn't return, such as those next to an uncompressed file
+func TestVerifyAllVariants(t *testing.T) {
+	corrupt := createGzipData(t, "console.log('compressed')")
+	corrupt[len(corrupt)-8] ^= 0xff // CRC-32 in the trailer
+	testFS := fstest.MapFS{
+		"app.js":        &fstest.MapFile{Data: []byte("console.log('plain')")},
+		"app.js.gz":     &fstest.MapFile{Data: corrupt},
+		"app.js.zst":    &fstest.MapFile{Data: createZstdData(t, "console.log('plain')")},
+		"style.css.gz":  &fstest.MapFile{Data: createGzipData(t, "body {}")},
+		"style.css.bz2": &fstest.MapFile{Data: createBzip2Data(t, "body {}")},
+	}
+
+	for _, opts := range [][]fsdecomp.Option{nil, {fsdecomp.WithVariantCheck()}} {
+		errs := fsdecomp.New(testFS, opts...).VerifyAll(".")
+		var decompErr *fsdecomp.DecompressError
+		if len(errs) != 1 || !errors.As(errs[0], &decompErr) || decompErr.Name != "app.js.gz" {
+			t.Errorf("Expected a single error for app.js.gz with %d options, got %v", len(opts), errs)
+		}
+	}
+}
+
+// linkFS adds symbolic links, resolved relative to the link's directory, to a MapFS
+type linkFS struct {
+	fstest.MapFS
+	links map[string]string
+}
+
+func (lfs linkFS) Open(name string) (fs.File, error) {
+	target := name
+	for hops := 0; ; hops++ {
+		link, ok := lfs.links[target]
+		if !ok {
+			break
+		}
+		if hops == 10 {
+			return nil, &fs.PathError{Op: "open", Path: name, Err: errors.New("too many links")}
+		}
+		target = path.Join(path.Dir(target), link)
+	}
+	file, err := lfs.MapFS.Open(target)
+	if err != nil {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+	}
+	return file, nil
+}
+
+func (lfs linkFS) ReadLink(name string) (string, error) {
+	if link, ok := lfs.links[name]; ok {
+		return link, nil
+	}
+	return "", &fs.PathError{Op: "readlink", Path: name, Err: fs.ErrInvalid}
+}
+
+// targetNameFS reports the name of the target file, rather than the requested one, in Stat
+type targetNameFS struct {
+	fstest.MapFS
+	links map[string]string
+}
+
+func (tfs targetNameFS) Open(name string) (fs.File, error) {
+	if target, ok := tfs.links[name]; ok {
+		name = target
+	}
+	return tfs.MapFS.Open(name)
+}
+
+// TestResolveSymlinkTargets ensures links to compressed files are decompressed under the link's name
+func TestResolveSymlinkTargets(t *testing.T) {
+	content := "archived log content"
+	mapFS := fstest.MapFS{
+		"archive/2024-06-01.log.zst": &fstest.MapFile{
+			Data: createZstdData(t, content),
+		},
+		"plain.txt": &fstest.MapFile{
+			Data: []byte("plain content"),
+		},
+	}
+	lfs := linkFS{
+		MapFS: mapFS,
+		links: map[string]string{
+			"current.log":     "archive/2024-06-01.log.zst",
+			"logs/latest.log": "../current.log", // A chain of links
+			"alias.txt":       "plain.txt",
+			"dangling.log":    "archive/missing.log.zst",
+			"loop-a.log":      "loop-b.log",
+			"loop-b.log":      "loop-a.log",
+			"compressed.zst":  "archive/2024-06-01.log.zst",
+		},
+	}
+	tfs := targetNameFS{
+		MapFS: mapFS,
+		links: map[string]string{"current.log": "archive/2024-06-01.log.zst"},
+	}
+
+	for fsName, fsys := range map[string]fs.FS{"ReadLink": lfs, "Stat name": tfs} {
+		t.Run(fsName, func(t *testing.T) {
+			dfs := fsdecomp.New(fsys, fsdecomp.WithResolveSymlinkTargets())
+			file, err := dfs.Open("current.log")
+			if err != nil {
+				t.Fatalf("Unexpected error opening current.log: %v", err)
+			}
+			defer file.Close()
+			data, err := io.ReadAll(file)
+			if err != nil {
+				t.Fatalf("Error reading file: %v", err)
+			}
+			if string(data) != content {
+				t.Errorf("Expected content %q, got %q", content, string(data))
+			}
+			info, err := file.Stat()
+			if err != nil {
+				t.Fatalf("Error getting file info: %v", err)
+			}
+			if info.Name() != "current.log" {
+				t.Errorf("Expected name %q, got %q", "current.log", info.Name())
+			}
+		})
+	}
+
+	dfs := fsdecomp.New(lfs, fsdecomp.WithResolveSymlinkTargets())
+	for name, expected := range map[string]string{
+		"logs/latest.log": content,
+		"alias.txt":       "plain content",
+	} {
+		data, err := fs.ReadFile(dfs, name)
+		if err != nil {
+			t.Fatalf("Unexpected error reading %s: %v", name, err)
+		}
+		if string(data) != expected {
+			t.Errorf("Expected %s content %q, got %q", name, expected, string(data))
+		}
+	}
+
+	// Links named with a compression extension return the raw data
+	raw, err := fs.ReadFile(dfs, "compressed.zst")
+	if err != nil {
+		t.Fatalf("Unexpected error reading compressed.zst: %v", err)
+	}
+	if !bytes.Equal(raw, mapFS["archive/2024-06-01.log.zst"].Data) {
+		t.Errorf("Expected raw zstd data for compressed.zst")
+	}
+
+	for _, name := range []string{"dangling.log", "loop-a.log"} {
+		if _, err := dfs.Open(name); err == nil {
+			t.Errorf("Expected error opening %s", name)
+		}
+	}
+
+	// Without the option, links are read verbatim
+	raw, err = fs.ReadFile(fsdecomp.New(lfs), "current.log")
+	if err != nil {
+		t.Fatalf("Unexpected error reading current.log: %v", err)
+	}
+	if !bytes.Equal(raw, mapFS["archive/2024-06-01.log.zst"].Data) {
+		t.Errorf("Expected raw zstd data for current.log without the option")
+	}
+}
+
+// countingFS counts the calls made to the wrapped filesystem
+type countingFS struct {
+	fs.FS
+	opens, readDirs int
+}
+
+func (cfs *countingFS) Open(name string) (fs.File, error) {
+	cfs.opens++
+	return cfs.FS.Open(name)
+}
+
+func (cfs *countingFS) ReadDir(name string) ([]fs.DirEntry, error) {
+	cfs.readDirs++
+	return fs.ReadDir(cfs.FS, name)
+}
+
+// TestSnapshotIndex ensures the index resolves names like Open does, without probing
+func TestSnapshotIndex(t *testing.T) {
+	testFS := fstest.MapFS{
+		"plain.txt": &fstest.MapFile{
+			Data: []byte("plain content"),
+		},
+		"both.txt": &fstest.MapFile{
+			Data: []byte("uncompressed wins"),
+		},
+		"both.txt.gz": &fstest.MapFile{
+			Data: createGzipData(t, "gzip loses"),
+		},
+		"dir/multi.txt.zst": &fstest.MapFile{
+			Data: createZstdData(t, "zstd loses"),
+		},
+		"dir/multi.txt.gz": &fstest.MapFile{
+			Data: createGzipData(t, "gzip wins"),
+		},
+		"dir/nested/deep.txt.bz2": &fstest.MapFile{
+			Data: createBzip2Data(t, "bzip2 content"),
+		},
+	}
+
+	for _, eager := range []bool{false, true} {
+		t.Run(fmt.Sprintf("eager=%v", eager), func(t *testing.T) {
+			cfs := &countingFS{FS: testFS}
+			dfs := fsdecomp.New(cfs, fsdecomp.WithSnapshotIndex(eager))
+			for name, expected := range map[string]string{
+				"both.txt":            "uncompressed wins",
+				"dir/multi.txt":       "gzip wins",
+				"dir/nested/deep.txt": "bzip2 content",
+			} {
+				data, err := fs.ReadFile(dfs, name)
+				if err != nil {
+					t.Fatalf("Unexpected error reading %s: %v", name, err)
+				}
+				if string(data) != expected {
+					t.Errorf("Expected %s content %q, got %q", name, expected, string(data))
+				}
+			}
+
+			entries, err := fs.ReadDir(dfs, "dir")
+			if err != nil {
+				t.Fatalf("Unexpected error reading dir: %v", err)
+			}
+			if len(entries) != 2 || entries[0].Name() != "multi.txt" || entries[1].Name() != "nested" {
+				t.Errorf("Expected entries [multi.txt nested], got %v", entries)
+			}
+
+			// Once indexed, names are resolved without touching the filesystem
+			opens, readDirs := cfs.opens, cfs.readDirs
+			for _, name := range []string{"missing.txt", "dir/missing.txt", "dir/nested/missing", "plain.txt/child"} {
+				if _, err := dfs.Open(name); !errors.Is(err, fs.ErrNotExist) {
+					t.Errorf("Expected ErrNotExist opening %s, got %v", name, err)
+				}
+			}
+			if _, err := fs.ReadDir(dfs, "dir/nested"); err != nil {
+				t.Fatalf("Unexpected error reading dir/nested: %v", err)
+			}
+			if cfs.opens != opens || cfs.readDirs != readDirs {
+				t.Errorf("Expected no filesystem calls, got %d opens and %d listings",
+					cfs.opens-opens, cfs.readDirs-readDirs)
+			}
+
+			// The same files can be reached by opening a single physical name
+			file, err := dfs.Open("dir/multi.txt")
+			if err != nil {
+				t.Fatalf("Unexpected error opening dir/multi.txt: %v", err)
+			}
+			file.Close()
+			if cfs.opens != opens+1 {
+				t.Errorf("Expected 1 open, got %d", cfs.opens-opens)
+			}
+		})
+	}
+}
+
+// blockingDirFS holds up listings of one directory until released
+type blockingDirFS struct {
+	fstest.MapFS
+	dir     string
+	listing chan struct{} // Sent to as each listing of dir starts
+	release chan struct{}
+}
+
+func (b blockingDirFS) ReadDir(name string) ([]fs.DirEntry, error) {
+	if name == b.dir {
+		b.listing <- struct{}{}
+		<-b.release
+	}
+	return b.MapFS.ReadDir(name)
+}
+
+// TestSnapshotIndexSlowDir ensures a directory being indexed is listed once,
+// and doesn't hold up lookups in other directories
+func TestSnapshotIndexSlowDir(t *testing.T) {
+	bfs := blockingDirFS{
+		MapFS: fstest.MapFS{
+			"slow/a.txt.gz": &fstest.MapFile{Data: createGzipData(t, "slow")},
+			"fast/b.txt":    &fstest.MapFile{Data: []byte("fast")},
+		},
+		dir:     "slow",
+		listing: make(chan struct{}, 2),
+		release: make(chan struct{}),
+	}
+	dfs := fsdecomp.New(bfs, fsdecomp.WithSnapshotIndex(false))
+
+	var wg sync.WaitGroup
+	for range 2 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if data, err := fs.ReadFile(dfs, "slow/a.txt"); err != nil || string(data) != "slow" {
+				t.Errorf("Expected slow/a.txt to contain %q, got %q, %v", "slow", data, err)
+			}
+		}()
+	}
+	<-bfs.listing
+
+	fast := make(chan error, 1)
+	go func() {
+		_, err := fs.ReadFile(dfs, "fast/b.txt")
+		fast <- err
+	}()
+	select {
+	case err := <-fast:
+		if err != nil {
+			t.Errorf("Unexpected error reading fast/b.txt: %v", err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Errorf("Expected fast/b.txt to be read while slow was being listed")
+	}
+
+	close(bfs.release)
+	wg.Wait()
+	if len(bfs.listing) != 0 {
+		t.Errorf("Expected slow to be listed once, listed %d more times", len(bfs.listing))
+	}
+}
+
+// BenchmarkSnapshotIndex measures the memory used to index a large tree
+func BenchmarkSnapshotIndex(b *testing.B) {
+	const files = 100000
+	testFS := make(fstest.MapFS, files)
+	for i := 0; i < files; i++ {
+		testFS[fmt.Sprintf("dir%02d/file%05d.txt.gz", i%100, i)] = &fstest.MapFile{}
+	}
+
+	var before, after runtime.MemStats
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		runtime.GC()
+		runtime.ReadMemStats(&before)
+		dfs := fsdecomp.New(testFS, fsdecomp.WithSnapshotIndex(true))
+		runtime.GC()
+		runtime.ReadMemStats(&after)
+		runtime.KeepAlive(dfs)
+	}
+	b.ReportMetric(float64(after.HeapAlloc-before.HeapAlloc)/files, "B/entry")
+}
+
+// TestBOMStripping ensures leading byte order marks are removed from decompressed files
+func TestBOMStripping(t *testing.T) {
+	tests := map[string]struct {
+		content  string
+		expected string
+	}{
+		"utf8":    {content: "\xef\xbb\xbfid,name\n", expected: "id,name\n"},
+		"utf16le": {content: "\xff\xfei\x00d\x00", expected: "i\x00d\x00"},
+		"utf16be": {content: "\xfe\xff\x00i\x00d", expected: "\x00i\x00d"},
+		"none":    {content: "id,name\n", expected: "id,name\n"},
+		"short":   {content: "\xef\xbb", expected: "\xef\xbb"},
+		"empty":   {content: "", expected: ""},
+	}
+
+	// Decompressing one byte per Read makes every mark span read boundaries
+	oneByte := fsdecomp.DecompressorFunc(func(r io.Reader) (io.ReadCloser, error) {
+		return io.NopCloser(iotest.OneByteReader(r)), nil
+	})
+
+	testFS := fstest.MapFS{
+		"plain.txt": &fstest.MapFile{Data: []byte("\xef\xbb\xbfplain")},
+	}
+	for name, test := range tests {
+		testFS[name+".txt.gz"] = &fstest.MapFile{Data: createGzipData(t, test.content)}
+		testFS[name+".csv.onebyte"] = &fstest.MapFile{Data: []byte(test.content)}
+	}
+	dfs := fsdecomp.New(testFS, fsdecomp.WithBOMStripping(), fsdecomp.WithDecompressor(".onebyte", oneByte))
+
+	for name, test := range tests {
+		for _, file := range []string{name + ".txt", name + ".csv"} {
+			data, err := fs.ReadFile(dfs, file)
+			if err != nil {
+				t.Fatalf("Unexpected error reading %s: %v", file, err)
+			}
+			if string(data) != test.expected {
+				t.Errorf("Expected %s content %q, got %q", file, test.expected, string(data))
+			}
+		}
+	}
+
+	// Uncompressed files are returned unchanged
+	data, err := fs.ReadFile(dfs, "plain.txt")
+	if err != nil {
+		t.Fatalf("Unexpected error reading plain.txt: %v", err)
+	}
+	if string(data) != "\xef\xbb\xbfplain" {
+		t.Errorf("Expected plain.txt to keep its BOM, got %q", string(data))
+	}
+}
+
+// TestUnwrap ensures callers can reach the underlying filesystem and files
+func TestUnwrap(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(path.Join(dir, "plain.txt"), []byte("plain content"), 0o644); err != nil {
+		t.Fatalf("Failed to write plain.txt: %v", err)
+	}
+	if err := os.WriteFile(path.Join(dir, "compressed.txt.gz"), createGzipData(t, "gzipped content"), 0o644); err != nil {
+		t.Fatalf("Failed to write compressed.txt.gz: %v", err)
+	}
+	fsys := os.DirFS(dir)
+	dfs := fsdecomp.New(fsys, fsdecomp.WithMagicValidation())
+
+	if dfs.Unwrap() != fsys {
+		t.Errorf("Expected Unwrap to return the wrapped filesystem")
+	}
+
+	// Uncompressed files are returned without a wrapper
+	plain, err := dfs.Open("plain.txt")
+	if err != nil {
+		t.Fatalf("Unexpected error opening plain.txt: %v", err)
+	}
+	defer plain.Close()
+	if _, ok := plain.(*os.File); !ok {
+		t.Errorf("Expected *os.File for plain.txt, got %T", plain)
+	}
+
+	compressed, err := dfs.Open("compressed.txt")
+	if err != nil {
+		t.Fatalf("Unexpected error opening compressed.txt: %v", err)
+	}
+	defer compressed.Close()
+	unwrapper, ok := compressed.(interface{ Unwrap() fs.File })
+	if !ok {
+		t.Fatalf("Expected compressed.txt to implement Unwrap, got %T", compressed)
+	}
+	source, ok := unwrapper.Unwrap().(*os.File)
+	if !ok {
+		t.Fatalf("Expected *os.File from Unwrap, got %T", unwrapper.Unwrap())
+	}
+	if path.Base(source.Name()) != "compressed.txt.gz" {
+		t.Errorf("Expected source %q, got %q", "compressed.txt.gz", source.Name())
+	}
+
+	// Renamed files unwrap to the file renamed
+	if err := os.Mkdir(path.Join(dir, "site"), 0o755); err != nil {
+		t.Fatalf("Failed to create site: %v", err)
+	}
+	if err := os.WriteFile(path.Join(dir, "site", "index.html"), []byte("<h1>index</h1>"), 0o644); err != nil {
+		t.Fatalf("Failed to write index.html: %v", err)
+	}
+	named := fsdecomp.New(fsys, fsdecomp.WithDirectoryIndex("index.html"), fsdecomp.WithNormalizedNames())
+	index, err := named.Open("site")
+	if err != nil {
+		t.Fatalf("Unexpected error opening site: %v", err)
+	}
+	defer index.Close()
+	if info, err := index.Stat(); err != nil || info.Name() != "site" {
+		t.Errorf("Expected site to be renamed, got %v, %v", info, err)
+	}
+	unwrapper, ok = index.(interface{ Unwrap() fs.File })
+	if !ok {
+		t.Fatalf("Expected site to implement Unwrap, got %T", index)
+	}
+	if source, ok := unwrapper.Unwrap().(*os.File); !ok || path.Base(source.Name()) != "index.html" {
+		t.Errorf("Expected index.html as an *os.File from Unwrap, got %T", unwrapper.Unwrap())
+	}
+}
+
+// TestBackend ensures the filesystem given to extensions counts their calls
+// and is closed with the DecompressFS
+func TestBackend(t *testing.T) {
+	testFS := fstest.MapFS{"dict.bin": &fstest.MapFile{Data: []byte("dictionary")}}
+	dfs := fsdecomp.New(testFS)
+	backend := dfs.Backend()
+
+	if _, err := fs.Stat(backend, "dict.bin"); err != nil {
+		t.Fatalf("Unexpected error statting dict.bin: %v", err)
+	}
+	if data, err := fs.ReadFile(backend, "dict.bin"); err != nil || string(data) != "dictionary" {
+		t.Errorf("Expected dict.bin to contain %q, got %q, %v", "dictionary", data, err)
+	}
+	if ops := dfs.BackendOps(); ops != (fsdecomp.BackendOps{Opens: 1, Stats: 1}) {
+		t.Errorf("Expected one open and one stat to be counted, got %+v", ops)
+	}
+
+	dfs.Close()
+	if _, err := fs.Stat(backend, "dict.bin"); !errors.Is(err, fs.ErrClosed) {
+		t.Errorf("Expected ErrClosed statting after Close, got %v", err)
+	}
+	if _, err := backend.Open("dict.bin"); !errors.Is(err, fs.ErrClosed) {
+		t.Errorf("Expected ErrClosed opening after Close, got %v", err)
+	}
+}
+
+// TestCapabilities ensures reported capabilities match the files Open returns
+func TestCapabilities(t *testing.T) {
+	testFS := fstest.MapFS{
+		"plain.txt": &fstest.MapFile{
+			Data: []byte("plain content"),
+		},
+		"compressed.txt.gz": &fstest.MapFile{
+			Data: createGzipData(t, "gzipped content"),
+		},
+		"compressed.txt.zst": &fstest.MapFile{
+			Data: createZstdData(t, "zstd content"),
+		},
+		"archive.txt.bz2": &fstest.MapFile{
+			Data: createBzip2Data(t, "bzip2 content"),
+		},
+		"dir/file.txt": &fstest.MapFile{
+			Data: []byte("nested"),
+		},
+	}
+
+	filesystems := map[string]*fsdecomp.DecompressFS{
+		"MapFS":     fsdecomp.New(testFS, fsdecomp.WithSingleMemberSizes()),
+		"streamFS":  fsdecomp.New(streamFS{testFS}, fsdecomp.WithSingleMemberSizes()),
+		"transform": fsdecomp.New(testFS, fsdecomp.WithBOMStripping()),
+	}
+	for fsName, dfs := range filesystems {
+		for _, name := range []string{"plain.txt", "compressed.txt", "archive.txt", "dir"} {
+			caps, err := dfs.Capabilities(name)
+			if err != nil {
+				t.Fatalf("%s: unexpected error for %s: %v", fsName, name, err)
+			}
+
+			file, err := dfs.Open(name)
+			if err != nil {
+				t.Fatalf("%s: unexpected error opening %s: %v", fsName, name, err)
+			}
+			_, seekable := file.(io.Seeker)
+			_, readerAt := file.(io.ReaderAt)
+			file.Close()
+			_, exact, err := fsdecomp.ContentLength(dfs, name)
+			if err != nil {
+				t.Fatalf("%s: unexpected error getting length of %s: %v", fsName, name, err)
+			}
+
+			expected := fsdecomp.Caps{Seekable: seekable, ReaderAt: readerAt, ExactSize: exact}
+			if caps != expected {
+				t.Errorf("%s: expected %s capabilities %+v, got %+v", fsName, name, expected, caps)
+			}
+		}
+	}
+
+	// Spot check the cases callers care about most
+	dfs := filesystems["MapFS"]
+	if caps, _ := dfs.Capabilities("compressed.txt"); caps.Seekable || !caps.ExactSize {
+		t.Errorf("Expected gzip file to have an exact size but no seeking, got %+v", caps)
+	}
+	if caps, _ := dfs.Capabilities("archive.txt"); caps.ExactSize {
+		t.Errorf("Expected bzip2 file to have no exact size, got %+v", caps)
+	}
+	if caps, _ := dfs.Capabilities("plain.txt"); !caps.Seekable || !caps.ReaderAt || !caps.ExactSize {
+		t.Errorf("Expected plain file to support everything, got %+v", caps)
+	}
+	if _, err := dfs.Capabilities("missing.txt"); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("Expected ErrNotExist for missing.txt, got %v", err)
+	}
+}
+
+// TestUnmarshal ensures compressed files can be decoded straight into values
+func TestUnmarshal(t *testing.T) {
+	type config struct {
+		Name string   `json:"name"`
+		Port int      `json:"port"`
+		Tags []string `json:"tags"`
+	}
+	expected := config{Name: "fsdecomp", Port: 8080, Tags: []string{"compressed", "config"}}
+
+	var got config
+	if err := fsdecomp.New(os.DirFS("testdata")).Unmarshal("config.json", &got); err != nil {
+		t.Fatalf("Unexpected error unmarshalling config.json: %v", err)
+	}
+	if got.Name != expected.Name || got.Port != expected.Port || strings.Join(got.Tags, ",") != strings.Join(expected.Tags, ",") {
+		t.Errorf("Expected %+v, got %+v", expected, got)
+	}
+
+	// Other encodings can be plugged in
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(expected); err != nil {
+		t.Fatalf("Failed to encode gob: %v", err)
+	}
+	gobFS := fstest.MapFS{
+		"config.gob.gz": &fstest.MapFile{Data: createGzipData(t, buf.String())},
+	}
+	dfs := fsdecomp.New(gobFS, fsdecomp.WithUnmarshalDecoder(func(r io.Reader) fsdecomp.ValueDecoder {
+		return gob.NewDecoder(r)
+	}))
+	got = config{}
+	if err := dfs.Unmarshal("config.gob", &got); err != nil {
+		t.Fatalf("Unexpected error unmarshalling config.gob: %v", err)
+	}
+	if got.Name != expected.Name || got.Port != expected.Port {
+		t.Errorf("Expected %+v, got %+v", expected, got)
+	}
+
+	// Files larger than the limit are rejected
+	dfs = fsdecomp.New(os.DirFS("testdata"), fsdecomp.WithMaxDecompressedSize(16))
+	err := dfs.Unmarshal("config.json", &got)
+	if !errors.Is(err, fsdecomp.ErrTooLarge) {
+		t.Errorf("Expected ErrTooLarge, got %v", err)
+	}
+}
+
+// TestMaxDecompressedSize ensures the limit allows files of exactly the limit
+func TestMaxDecompressedSize(t *testing.T) {
+	content := strings.Repeat("0123456789", 100)
+	testFS := fstest.MapFS{
+		"file.txt.gz": &fstest.MapFile{Data: createGzipData(t, content)},
+	}
+
+	data, err := fs.ReadFile(fsdecomp.New(testFS, fsdecomp.WithMaxDecompressedSize(int64(len(content)))), "file.txt")
+	if err != nil {
+		t.Fatalf("Unexpected error reading file at the limit: %v", err)
+	}
+	if string(data) != content {
+		t.Errorf("Expected content to be read in full")
+	}
+
+	_, err = fs.ReadFile(fsdecomp.New(testFS, fsdecomp.WithMaxDecompressedSize(int64(len(content))-1)), "file.txt")
+	var decompErr *fsdecomp.DecompressError
+	if !errors.As(err, &decompErr) || !errors.Is(err, fsdecomp.ErrTooLarge) {
+		t.Errorf("Expected DecompressError wrapping ErrTooLarge, got %v", err)
+	}
+}
+
+// TestVariantCheck ensures stale compressed variants of plain files are reported
+func TestVariantCheck(t *testing.T) {
+	large := strings.Repeat("var x = 1;\n", 20000)
+	testFS := fstest.MapFS{
+		"app.js": &fstest.MapFile{
+			Data: []byte(large),
+		},
+		"app.js.gz": &fstest.MapFile{
+			Data: createGzipData(t, large),
+		},
+		"app.js.zst": &fstest.MapFile{
+			// Differs only well past the first block
+			Data: createZstdData(t, large[:len(large)-2]+"2;"),
+		},
+		"style.css": &fstest.MapFile{
+			Data: []byte("body { color: red; }"),
+		},
+		"style.css.gz": &fstest.MapFile{
+			Data: createGzipData(t, "body { color: blue; }"),
+		},
+		"only.txt.gz": &fstest.MapFile{
+			Data: createGzipData(t, "no plain variant"),
+		},
+	}
+
+	if errs := fsdecomp.New(testFS).VerifyAll("."); errs != nil {
+		t.Errorf("Expected no errors without the option, got %v", errs)
+	}
+
+	errs := fsdecomp.New(testFS, fsdecomp.WithVariantCheck()).VerifyAll(".")
+	var stale []string
+	for _, err := range errs {
+		var decompErr *fsdecomp.DecompressError
+		if !errors.As(err, &decompErr) || !errors.Is(err, fsdecomp.ErrVariantMismatch) {
+			t.Fatalf("Expected DecompressError wrapping ErrVariantMismatch, got %v", err)
+		}
+		stale = append(stale, decompErr.Name)
+	}
+	if strings.Join(stale, ",") != "app.js.zst,style.css.gz" {
+		t.Errorf("Expected stale variants [app.js.zst style.css.gz], got %v", stale)
+	}
+}
+
+// noInfoFS lists entries whose Info method always fails, counting the calls
+type noInfoFS struct {
+	fstest.MapFS
+	infoCalls *int
+}
+
+func (nfs noInfoFS) ReadDir(name string) ([]fs.DirEntry, error) {
+	entries, err := nfs.MapFS.ReadDir(name)
+	for i, entry := range entries {
+		entries[i] = noInfoEntry{entry, nfs.infoCalls}
+	}
+	return entries, err
+}
+
+type noInfoEntry struct {
+	fs.DirEntry
+	infoCalls *int
+}
+
+func (e noInfoEntry) Info() (fs.FileInfo, error) {
+	*e.infoCalls++
+	return nil, errors.New("info not available")
+}
+
+// TestReadDirWithoutInfo ensures listings don't depend on entries' Info
+func TestReadDirWithoutInfo(t *testing.T) {
+	var infoCalls int
+	nfs := noInfoFS{
+		MapFS: fstest.MapFS{
+			"plain.txt":         &fstest.MapFile{Data: []byte("plain")},
+			"compressed.txt.gz": &fstest.MapFile{Data: createGzipData(t, "gzipped")},
+		},
+		infoCalls: &infoCalls,
+	}
+	entries, err := fsdecomp.New(nfs).ReadDir(".")
+	if err != nil {
+		t.Fatalf("Unexpected error reading directory: %v", err)
+	}
+	if len(entries) != 2 || entries[0].Name() != "compressed.txt" || entries[1].Name() != "plain.txt" {
+		t.Errorf("Expected entries [compressed.txt plain.txt], got %v", entries)
+	}
+	if infoCalls != 0 {
+		t.Errorf("Expected no calls to Info while listing, got %d", infoCalls)
+	}
+
+	// The failure is deferred until Info is actually needed
+	if _, err := entries[0].Info(); err == nil {
+		t.Errorf("Expected Info to fail for compressed.txt")
+	}
+}
+
+// TestDigest ensures the digest covers the data however the file is read
+func TestDigest(t *testing.T) {
+	content := strings.Repeat("digest me ", 10000)
+	expected := sha256.Sum256([]byte(content))
+	testFS := fstest.MapFS{
+		"file.txt.zst": &fstest.MapFile{Data: createZstdData(t, content)},
+	}
+	dfs := fsdecomp.New(testFS, fsdecomp.WithDigest(sha256.New))
+
+	type summer interface {
+		Sum() ([]byte, bool)
+	}
+	readers := map[string]func(io.Reader) error{
+		"Read": func(r io.Reader) error {
+			_, err := io.ReadAll(iotest.OneByteReader(r))
+			return err
+		},
+		"WriteTo": func(r io.Reader) error {
+			_, err := io.Copy(io.Discard, r)
+			return err
+		},
+	}
+	for method, read := range readers {
+		file, err := dfs.Open("file.txt")
+		if err != nil {
+			t.Fatalf("Unexpected error opening file.txt: %v", err)
+		}
+		if _, ok := file.(summer).Sum(); ok {
+			t.Errorf("%s: expected no digest before reading", method)
+		}
+		if err := read(file); err != nil {
+			t.Fatalf("%s: error reading file: %v", method, err)
+		}
+		file.Close()
+		sum, ok := file.(summer).Sum()
+		if !ok || !bytes.Equal(sum, expected[:]) {
+			t.Errorf("%s: expected digest %x, got %x (%v)", method, expected, sum, ok)
+		}
+	}
+
+	// Partially read files have no digest
+	file, err := dfs.Open("file.txt")
+	if err != nil {
+		t.Fatalf("Unexpected error opening file.txt: %v", err)
+	}
+	defer file.Close()
+	if _, err := file.Read(make([]byte, 100)); err != nil {
+		t.Fatalf("Error reading file: %v", err)
+	}
+	if _, ok := file.(summer).Sum(); ok {
+		t.Errorf("Expected no digest for a partially read file")
+	}
+}
+
+// tarFS presents the regular files of a tar archive as a filesystem whose
+// files can only be read once, from the start
+type tarFS map[string]*tarMember
+
+type tarMember struct {
+	header *tar.Header
+	data   []byte
+}
+
+func newTarFS(t *testing.T, archive []byte) tarFS {
+	tfs := make(tarFS)
+	tr := tar.NewReader(bytes.NewReader(archive))
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			return tfs
+		}
+		if err != nil {
+			t.Fatalf("Failed to read tar archive: %v", err)
+		}
+		data, err := io.ReadAll(tr)
+		if err != nil {
+			t.Fatalf("Failed to read tar member %s: %v", header.Name, err)
+		}
+		tfs[header.Name] = &tarMember{header: header, data: data}
+	}
+}
+
+func (tfs tarFS) Open(name string) (fs.File, error) {
+	member, ok := tfs[name]
+	if !ok {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+	}
+	return &tarFile{member: member, reader: bytes.NewReader(member.data)}, nil
+}
+
+type tarFile struct {
+	member *tarMember
+	reader io.Reader
+}
+
+func (tf *tarFile) Stat() (fs.FileInfo, error) { return tf.member.header.FileInfo(), nil }
+func (tf *tarFile) Read(p []byte) (int, error) { return tf.reader.Read(p) }
+func (tf *tarFile) Close() error               { return nil }
+
+// TestTarFS ensures compressed members of a read-once archive filesystem can be opened
+func TestTarFS(t *testing.T) {
+	content := "gzipped tar member"
+	compressed := createGzipData(t, content)
+
+	var archive bytes.Buffer
+	tw := tar.NewWriter(&archive)
+	if err := tw.WriteHeader(&tar.Header{Name: "docs/file.txt.gz", Mode: 0o644, Size: int64(len(compressed))}); err != nil {
+		t.Fatalf("Failed to write tar header: %v", err)
+	}
+	if _, err := tw.Write(compressed); err != nil {
+		t.Fatalf("Failed to write tar member: %v", err)
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatalf("Failed to close tar writer: %v", err)
+	}
+	tfs := newTarFS(t, archive.Bytes())
+
+	for name, dfs := range map[string]*fsdecomp.DecompressFS{
+		"default":          fsdecomp.New(tfs),
+		"magic validation": fsdecomp.New(tfs, fsdecomp.WithMagicValidation()),
+	} {
+		file, err := dfs.Open("docs/file.txt")
+		if err != nil {
+			t.Fatalf("%s: unexpected error opening docs/file.txt: %v", name, err)
+		}
+		data, err := io.ReadAll(file)
+		file.Close()
+		if err != nil {
+			t.Fatalf("%s: error reading file: %v", name, err)
+		}
+		if string(data) != content {
+			t.Errorf("%s: expected content %q, got %q", name, content, string(data))
+		}
+
+		info, err := file.Stat()
+		if err != nil {
+			t.Fatalf("%s: error getting file info: %v", name, err)
+		}
+		if info.Name() != "file.txt" {
+			t.Errorf("%s: expected name %q, got %q", name, "file.txt", info.Name())
+		}
+	}
+}
+
+// TestReadString ensures files are returned in full up to the limit, and rejected beyond it
+func TestReadString(t *testing.T) {
+	content := "key = value\n"
+	testFS := fstest.MapFS{
+		"config.toml.gz": &fstest.MapFile{Data: createGzipData(t, content)},
+		"plain.toml":     &fstest.MapFile{Data: []byte(content)},
+	}
+	dfs := fsdecomp.New(testFS)
+
+	for _, name := range []string{"config.toml", "plain.toml"} {
+		s, err := dfs.ReadString(name, int64(len(content)))
+		if err != nil {
+			t.Fatalf("Unexpected error reading %s: %v", name, err)
+		}
+		if s != content {
+			t.Errorf("Expected %s content %q, got %q", name, content, s)
+		}
+
+		if _, err := dfs.ReadString(name, int64(len(content))-1); !errors.Is(err, fsdecomp.ErrTooLarge) {
+			t.Errorf("Expected ErrTooLarge reading %s over the limit, got %v", name, err)
+		}
+
+		if s, err := dfs.ReadString(name, math.MaxInt64); err != nil || s != content {
+			t.Errorf("Expected %s content %q with no limit, got %q, %v", name, content, s, err)
+		}
+	}
+
+	// A forged ISIZE within the limit doesn't get allocated ahead of reading
+	forged := createGzipData(t, content)
+	binary.LittleEndian.PutUint32(forged[len(forged)-4:], 1<<30)
+	dfs = fsdecomp.New(fstest.MapFS{"forged.toml.gz": &fstest.MapFile{Data: forged}})
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+	if _, err := dfs.ReadString("forged.toml", 1<<31); err == nil {
+		t.Errorf("Expected an error reading forged.toml")
+	}
+	runtime.ReadMemStats(&after)
+	if allocated := after.TotalAlloc - before.TotalAlloc; allocated > 64<<20 {
+		t.Errorf("Expected ReadString not to allocate the forged size, allocated %d bytes", allocated)
+	}
+}
+
+// xorTransform is a stand-in for decryption, XORing every byte with a key
+// and counting how many of its readers are still open
+type xorTransform struct {
+	key  byte
+	open *int
+}
+
+func (x xorTransform) transform() fsdecomp.Transform {
+	return fsdecomp.Transform{Ext: ".enc", NewReader: func(r io.Reader) (io.ReadCloser, error) {
+		*x.open++
+		return &xorReader{reader: r, key: x.key, open: x.open}, nil
+	}}
+}
+
+func (x xorTransform) apply(data []byte) []byte {
+	out := make([]byte, len(data))
+	for i, b := range data {
+		out[i] = b ^ x.key
+	}
+	return out
+}
+
+type xorReader struct {
+	reader io.Reader
+	key    byte
+	open   *int
+}
+
+func (xr *xorReader) Read(p []byte) (int, error) {
+	n, err := xr.reader.Read(p)
+	for i := range p[:n] {
+		p[i] ^= xr.key
+	}
+	return n, err
+}
+
+func (xr *xorReader) Close() error {
+	*xr.open--
+	return nil
+}
+
+// TestTransforms ensures transforms compose with decompression through chained extensions
+func TestTransforms(t *testing.T) {
+	var open int
+	xor := xorTransform{key: 0x5a, open: &open}
+	content := `{"encrypted": true}`
+	zstdData := createZstdData(t, content)
+	corrupt := bytes.Clone(zstdData)
+	corrupt[len(corrupt)-2] ^= 0xff
+
+	testFS := fstest.MapFS{
+		"data.json.zst.enc": &fstest.MapFile{Data: xor.apply(zstdData)},
+		"bad.json.zst.enc":  &fstest.MapFile{Data: xor.apply(corrupt)},
+		"notes.txt.enc":     &fstest.MapFile{Data: xor.apply([]byte("plain notes"))},
+		"four.txt.enc.enc.enc.enc": &fstest.MapFile{
+			Data: []byte("even layers of XOR cancel out"),
+		},
+		"five.txt.enc.enc.enc.enc.enc": &fstest.MapFile{
+			Data: []byte("too many layers"),
+		},
+	}
+
+	for _, indexed := range []bool{false, true} {
+		t.Run(fmt.Sprintf("indexed=%v", indexed), func(t *testing.T) {
+			opts := []fsdecomp.Option{fsdecomp.WithTransforms(xor.transform())}
+			if indexed {
+				opts = append(opts, fsdecomp.WithSnapshotIndex(true))
+			}
+			dfs := fsdecomp.New(testFS, opts...)
+
+			for name, expected := range map[string]string{
+				"data.json":     content,
+				"data.json.zst": string(zstdData),
+				"notes.txt":     "plain notes",
+				"four.txt":      "even layers of XOR cancel out",
+			} {
+				file, err := dfs.Open(name)
+				if err != nil {
+					t.Fatalf("Unexpected error opening %s: %v", name, err)
+				}
+				data, err := io.ReadAll(file)
+				if err != nil {
+					t.Fatalf("Error reading %s: %v", name, err)
+				}
+				if string(data) != expected {
+					t.Errorf("Expected %s content %q, got %q", name, expected, string(data))
+				}
+				info, err := file.Stat()
+				if err != nil {
+					t.Fatalf("Error getting info for %s: %v", name, err)
+				}
+				if info.Name() != name {
+					t.Errorf("Expected name %q, got %q", name, info.Name())
+				}
+				file.Close()
+				if open != 0 {
+					t.Errorf("Expected every transform reader to be closed after %s, %d open", name, open)
+				}
+			}
+
+			if _, err := dfs.Open("five.txt"); !errors.Is(err, fs.ErrNotExist) {
+				t.Errorf("Expected ErrNotExist for a name with too many layers, got %v", err)
+			}
+
+			// Errors name the layer that failed
+			_, err := fs.ReadFile(dfs, "bad.json")
+			var decompErr *fsdecomp.DecompressError
+			if !errors.As(err, &decompErr) {
+				t.Fatalf("Expected DecompressError, got %v", err)
+			}
+			if decompErr.Format != "zst" || decompErr.Name != "bad.json.zst" {
+				t.Errorf("Expected zst error for bad.json.zst, got %s error for %s", decompErr.Format, decompErr.Name)
+			}
+
+			entries, err := fs.ReadDir(dfs, ".")
+			if err != nil {
+				t.Fatalf("Unexpected error reading directory: %v", err)
+			}
+			var names []string
+			for _, entry := range entries {
+				names = append(names, entry.Name())
+			}
+			if strings.Join(names, ",") != "bad.json,data.json,five.txt.enc,four.txt,notes.txt" {
+				t.Errorf("Expected entries [bad.json data.json five.txt.enc four.txt notes.txt], got %v", names)
+			}
+		})
+	}
+}
+
+// recordingBzip2 decodes bzip2 with the standard library, counting the streams it opens
+type recordingBzip2 struct {
+	calls *int
+}
+
+func (rb recordingBzip2) MagicNumber() []byte {
+	return []byte("BZh")
+}
+
+func (rb recordingBzip2) NewReader(r io.Reader) (io.ReadCloser, error) {
+	if rb.calls != nil {
+		*rb.calls++
+	}
+	return io.NopCloser(stdbzip2.NewReader(r)), nil
+}
+
+// TestRegisterOverride ensures Register replaces a built-in decompressor in place
+func TestRegisterOverride(t *testing.T) {
+	testFS := fstest.MapFS{
+		"archive.txt.bz2": &fstest.MapFile{Data: createBzip2Data(t, "bzip2 content")},
+		"both.txt.gz":     &fstest.MapFile{Data: createGzipData(t, "gzip content")},
+		"both.txt.bz2":    &fstest.MapFile{Data: createBzip2Data(t, "bzip2 content")},
+	}
+
+	var calls int
+	fsdecomp.Register(".bz2", recordingBzip2{calls: &calls})
+	t.Cleanup(func() {
+		fsdecomp.Register(".bz2", recordingBzip2{})
+	})
+	dfs := fsdecomp.New(testFS)
+
+	data, err := fs.ReadFile(dfs, "archive.txt")
+	if err != nil {
+		t.Fatalf("Unexpected error reading archive.txt: %v", err)
+	}
+	if string(data) != "bzip2 content" {
+		t.Errorf("Expected content %q, got %q", "bzip2 content", string(data))
+	}
+	if calls != 1 {
+		t.Errorf("Expected the registered decompressor to be used once, got %d", calls)
+	}
+
+	// The override keeps the extension's place in the probe order
+	data, err = fs.ReadFile(dfs, "both.txt")
+	if err != nil {
+		t.Fatalf("Unexpected error reading both.txt: %v", err)
+	}
+	if string(data) != "gzip content" {
+		t.Errorf("Expected gzip to still be probed first, got %q", string(data))
+	}
+
+	entries, err := dfs.ReadDir(".")
+	if err != nil {
+		t.Fatalf("Unexpected error reading directory: %v", err)
+	}
+	if entries[0].Name() != "archive.txt" {
+		t.Errorf("Expected archive.txt.bz2 to be listed as archive.txt, got %s", entries[0].Name())
+	}
+}
+
+// TestAuxiliaryFiles ensures files such as zstd dictionaries are never treated as compressed content
+func TestAuxiliaryFiles(t *testing.T) {
+	dict := []byte{0x37, 0xa4, 0x30, 0xec, 0x01, 0x02, 0x03, 0x04} // zstd dictionary magic
+	testFS := fstest.MapFS{
+		"foo.dict": &fstest.MapFile{Data: dict},
+	}
+	dfs := fsdecomp.New(testFS)
+
+	data, err := fs.ReadFile(dfs, "foo.dict")
+	if err != nil {
+		t.Fatalf("Unexpected error reading foo.dict: %v", err)
+	}
+	if !bytes.Equal(data, dict) {
+		t.Errorf("Expected foo.dict to be returned unchanged")
+	}
+
+	if _, err := dfs.Open("foo"); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("Expected ErrNotExist opening foo, got %v", err)
+	}
+
+	entries, err := dfs.ReadDir(".")
+	if err != nil {
+		t.Fatalf("Unexpected error reading directory: %v", err)
+	}
+	if len(entries) != 1 || entries[0].Name() != "foo.dict" {
+		t.Errorf("Expected foo.dict to be listed verbatim, got %v", entries)
+	}
+}
+
+func TestMetadataSidecars(t *testing.T) {
+	modTime := time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC)
+	testFS := fstest.MapFS{
+		"report.pdf.gz":      &fstest.MapFile{Data: createGzipData(t, "report"), Mode: 0600},
+		"report.pdf.gz.meta": &fstest.MapFile{Data: []byte(`{"modTime": "2024-06-01T12:00:00Z", "mode": "0644", "name": "Q2 report.pdf"}`)},
+		"notes.txt.gz":       &fstest.MapFile{Data: createGzipData(t, "notes"), Mode: 0600},
+		"notes.txt.gz.meta":  &fstest.MapFile{Data: []byte(`{"mode": "rw-r--r--"}`)},
+		"orphan.meta":        &fstest.MapFile{Data: []byte(`{}`)},
+	}
+
+	for _, indexed := range []bool{false, true} {
+		t.Run(fmt.Sprintf("indexed=%v", indexed), func(t *testing.T) {
+			var warnings []error
+			opts := []fsdecomp.Option{
+				fsdecomp.WithMetadataSidecars(".meta", 1024),
+				fsdecomp.WithWarningHandler(func(err error) { warnings = append(warnings, err) }),
+			}
+			if indexed {
+				opts = append(opts, fsdecomp.WithSnapshotIndex(false))
+			}
+			dfs := fsdecomp.New(testFS, opts...)
+
+			entries, err := dfs.ReadDir(".")
+			if err != nil {
+				t.Fatalf("Unexpected error reading directory: %v", err)
+			}
+			var names []string
+			for _, entry := range entries {
+				names = append(names, entry.Name())
+			}
+			slices.Sort(names)
+			if want := []string{"Q2 report.pdf", "notes.txt", "orphan.meta"}; !slices.Equal(names, want) {
+				t.Errorf("Expected entries %v, got %v", want, names)
+			}
+
+			info, err := fs.Stat(dfs, "Q2 report.pdf")
+			if err != nil {
+				t.Fatalf("Unexpected error statting by sidecar name: %v", err)
+			}
+			if info.Name() != "Q2 report.pdf" || !info.ModTime().Equal(modTime) || info.Mode().Perm() != 0644 {
+				t.Errorf("Expected sidecar metadata, got name %q, mod time %v, mode %v", info.Name(), info.ModTime(), info.Mode())
+			}
+			if data, err := fs.ReadFile(dfs, "report.pdf"); err != nil || string(data) != "report" {
+				t.Errorf("Expected report.pdf to open by its logical name, got %q, %v", data, err)
+			}
+
+			// A malformed sidecar is reported once, and the file keeps its own metadata
+			for range 2 {
+				info, err = fs.Stat(dfs, "notes.txt")
+				if err != nil {
+					t.Fatalf("Unexpected error statting notes.txt: %v", err)
+				}
+				if info.Name() != "notes.txt" || info.Mode().Perm() != 0600 {
+					t.Errorf("Expected notes.txt to keep its metadata, got name %q, mode %v", info.Name(), info.Mode())
+				}
+			}
+			if len(warnings) != 1 || !strings.Contains(warnings[0].Error(), "notes.txt.gz.meta") {
+				t.Errorf("Expected one warning for notes.txt.gz.meta, got %v", warnings)
+			}
+		})
+	}
+
+	t.Run("oversized", func(t *testing.T) {
+		var warnings []error
+		dfs := fsdecomp.New(testFS,
+			fsdecomp.WithMetadataSidecars(".meta", 16),
+			fsdecomp.WithWarningHandler(func(err error) { warnings = append(warnings, err) }))
+		info, err := fs.Stat(dfs, "report.pdf")
+		if err != nil {
+			t.Fatalf("Unexpected error statting report.pdf: %v", err)
+		}
+		if info.Name() != "report.pdf" {
+			t.Errorf("Expected oversized sidecar to be ignored, got name %q", info.Name())
+		}
+		if len(warnings) != 1 || !errors.Is(warnings[0], fsdecomp.ErrTooLarge) {
+			t.Errorf("Expected an ErrTooLarge warning, got %v", warnings)
+		}
+	})
+}
+
+func TestScanLines(t *testing.T) {
+	log := "first line\nsecond line\r\n\nfourth line"
+	testFS := fstest.MapFS{
+		"app.log.gz": &fstest.MapFile{Data: createGzipData(t, log)},
+	}
+	dfs := fsdecomp.New(testFS)
+
+	var lines []string
+	err := dfs.ScanLines("app.log", func(line []byte) error {
+		lines = append(lines, string(line))
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Unexpected error scanning app.log: %v", err)
+	}
+	if want := []string{"first line", "second line", "", "fourth line"}; !slices.Equal(lines, want) {
+		t.Errorf("Expected lines %q, got %q", want, lines)
+	}
+
+	errStop := errors.New("stop")
+	calls := 0
+	err = dfs.ScanLines("app.log", func(line []byte) error {
+		calls++
+		return errStop
+	})
+	if !errors.Is(err, errStop) || calls != 1 {
+		t.Errorf("Expected scanning to stop with the callback's error after one line, got %v after %d", err, calls)
+	}
+
+	short := fsdecomp.New(testFS, fsdecomp.WithMaxLineLength(8))
+	if err := short.ScanLines("app.log", func([]byte) error { return nil }); !errors.Is(err, bufio.ErrTooLong) {
+		t.Errorf("Expected bufio.ErrTooLong with a short line limit, got %v", err)
+	}
+}
+
+func TestSplitParts(t *testing.T) {
+	content := strings.Repeat("split across several parts\n", 1000)
+	compressed := createZstdData(t, content)
+	third := len(compressed) / 3
+	testFS := fstest.MapFS{
+		"image.img.zst.000":  &fstest.MapFile{Data: compressed[:third]},
+		"image.img.zst.001":  &fstest.MapFile{Data: compressed[third : 2*third]},
+		"image.img.zst.002":  &fstest.MapFile{Data: compressed[2*third:]},
+		"broken.img.zst.000": &fstest.MapFile{Data: compressed[:third]},
+		"broken.img.zst.002": &fstest.MapFile{Data: compressed[2*third:]},
+		"unrelated.txt.000":  &fstest.MapFile{Data: []byte("not compressed")},
+		"short.img.zst.00":   &fstest.MapFile{Data: compressed[:third]},
+		"short.img.zst.02":   &fstest.MapFile{Data: compressed[2*third:]},
+		"long.img.zst.0000":  &fstest.MapFile{Data: compressed[:third]},
+		"long.img.zst.0002":  &fstest.MapFile{Data: compressed[2*third:]},
+	}
+
+	for _, indexed := range []bool{false, true} {
+		t.Run(fmt.Sprintf("indexed=%v", indexed), func(t *testing.T) {
+			opts := []fsdecomp.Option{fsdecomp.WithSplitParts()}
+			if indexed {
+				opts = append(opts, fsdecomp.WithSnapshotIndex(false))
+			}
+			dfs := fsdecomp.New(testFS, opts...)
+
+			data, err := fs.ReadFile(dfs, "image.img")
+			if err != nil {
+				t.Fatalf("Unexpected error reading image.img: %v", err)
+			}
+			if string(data) != content {
+				t.Errorf("Expected the parts to decompress to the original content")
+			}
+
+			for name, missing := range map[string]string{
+				"broken.img": "broken.img.zst.001",
+				"short.img":  "short.img.zst.01",
+				"long.img":   "long.img.zst.0001",
+			} {
+				_, err = dfs.Open(name)
+				if !errors.Is(err, fsdecomp.ErrMissingPart) || !strings.HasSuffix(err.Error(), " "+missing) {
+					t.Errorf("Expected an ErrMissingPart error naming %s, got %v", missing, err)
+				}
+			}
+
+			entries, err := dfs.ReadDir(".")
+			if err != nil {
+				t.Fatalf("Unexpected error reading directory: %v", err)
+			}
+			var names []string
+			for _, entry := range entries {
+				names = append(names, entry.Name())
+				if entry.Name() == "image.img" {
+					info, err := entry.Info()
+					if err != nil {
+						t.Fatalf("Unexpected error getting info for image.img: %v", err)
+					}
+					if info.Size() != int64(len(compressed)) {
+						t.Errorf("Expected image.img to be listed with size %d, got %d", len(compressed), info.Size())
+					}
+				}
+			}
+			slices.Sort(names)
+			if want := []string{"broken.img", "image.img", "long.img", "short.img", "unrelated.txt.000"}; !slices.Equal(names, want) {
+				t.Errorf("Expected entries %v, got %v", want, names)
+			}
+		})
+	}
+}
+
+// contentEncoding is the backend metadata of a file in the tests of
+// WithSysEncodingDetector
+type contentEncoding struct {
+	ContentEncoding string
+}
+
+func TestSysEncodingDetector(t *testing.T) {
+	testFS := fstest.MapFS{
+		"object":       &fstest.MapFile{Data: createGzipData(t, "stored compressed"), Sys: contentEncoding{"gzip"}},
+		"plain":        &fstest.MapFile{Data: []byte("stored plain"), Sys: contentEncoding{""}},
+		"unknown":      &fstest.MapFile{Data: []byte("stored as custom"), Sys: contentEncoding{"x-custom"}},
+		"named.txt.gz": &fstest.MapFile{Data: createGzipData(t, "named"), Sys: contentEncoding{"gzip"}},
+	}
+	dfs := fsdecomp.New(testFS, fsdecomp.WithSingleMemberSizes(), fsdecomp.WithSysEncodingDetector(func(sys any) (string, bool) {
+		switch enc, _ := sys.(contentEncoding); enc.ContentEncoding {
+		case "gzip":
+			return "gz", true
+		case "x-custom":
+			return ".custom", true
+		}
+		return "", false
+	}))
+
+	for name, want := range map[string]string{
+		"object":    "stored compressed",
+		"plain":     "stored plain",
+		"unknown":   "stored as custom",
+		"named.txt": "named",
+	} {
+		data, err := fs.ReadFile(dfs, name)
+		if err != nil {
+			t.Errorf("Unexpected error reading %s: %v", name, err)
+		} else if string(data) != want {
+			t.Errorf("Expected %s to contain %q, got %q", name, want, data)
+		}
+	}
+
+	info, err := fs.Stat(dfs, "object")
+	if err != nil {
+		t.Fatalf("Unexpected error statting object: %v", err)
+	}
+	if info.Name() != "object" || info.Size() != int64(len("stored compressed")) {
+		t.Errorf("Expected object with its decompressed size, got %q with size %d", info.Name(), info.Size())
+	}
+}
+
+func TestClose(t *testing.T) {
+	testFS := fstest.MapFS{
+		"data.txt.zst": &fstest.MapFile{Data: createZstdData(t, "closing time")},
+		"dir/file.gz":  &fstest.MapFile{Data: createGzipData(t, "in a directory")},
+	}
+	baseline := runtime.NumGoroutine()
+	dfs := fsdecomp.New(testFS, fsdecomp.WithSnapshotIndex(true))
+
+	open, err := dfs.Open("data.txt")
+	if err != nil {
+		t.Fatalf("Unexpected error opening data.txt: %v", err)
+	}
+	if _, err := fsdecomp.SRIHash(dfs, "dir/file", "sha256"); err != nil {
+		t.Fatalf("Unexpected error hashing dir/file: %v", err)
+	}
+
+	var wg sync.WaitGroup
+	for range 4 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := dfs.Close(); err != nil {
+				t.Errorf("Unexpected error closing: %v", err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if _, err := dfs.Open("dir/file"); !errors.Is(err, fs.ErrClosed) {
+		t.Errorf("Expected fs.ErrClosed opening after Close, got %v", err)
+	}
+	if _, err := dfs.ReadDir("."); !errors.Is(err, fs.ErrClosed) {
+		t.Errorf("Expected fs.ErrClosed listing after Close, got %v", err)
+	}
+	// Not even from the SRI cache
+	if _, err := fsdecomp.SRIHash(dfs, "dir/file", "sha256"); !errors.Is(err, fs.ErrClosed) {
+		t.Errorf("Expected fs.ErrClosed hashing after Close, got %v", err)
+	}
+
+	// Files opened before Close can still be read
+	data, err := io.ReadAll(open)
+	if err != nil || string(data) != "closing time" {
+		t.Errorf("Expected data.txt to remain readable, got %q, %v", data, err)
+	}
+	if err := open.Close(); err != nil {
+		t.Errorf("Unexpected error closing data.txt: %v", err)
+	}
+
+	// Nothing is left running once everything is closed
+	for i := 0; runtime.NumGoroutine() > baseline; i++ {
+		if i == 100 {
+			t.Fatalf("Expected %d goroutines after closing, got %d", baseline, runtime.NumGoroutine())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestLeakDetection(t *testing.T) {
+	testFS := fstest.MapFS{
+		"closed.txt.gz":    &fstest.MapFile{Data: createGzipData(t, "closed")},
+		"leaked.txt.gz":    &fstest.MapFile{Data: createGzipData(t, "leaked")},
+		"collected.txt.gz": &fstest.MapFile{Data: createGzipData(t, "collected")},
+		"plain.txt":        &fstest.MapFile{Data: []byte("plain")},
+	}
+	var mu sync.Mutex
+	var warnings []*fsdecomp.LeakError
+	dfs := fsdecomp.New(testFS, fsdecomp.WithLeakDetection(), fsdecomp.WithWarningHandler(func(err error) {
+		var leak *fsdecomp.LeakError
+		if errors.As(err, &leak) {
+			mu.Lock()
+			warnings = append(warnings, leak)
+			mu.Unlock()
+		}
+	}))
+
+	for _, name := range []string{"closed.txt", "leaked.txt", "plain.txt"} {
+		file, err := dfs.Open(name)
+		if err != nil {
+			t.Fatalf("Unexpected error opening %s: %v", name, err)
+		}
+		if name == "leaked.txt" {
+			defer file.Close()
+		} else {
+			file.Close()
+		}
+	}
+
+	open := dfs.OpenFiles()
+	if len(open) != 1 || open[0].Name != "leaked.txt" {
+		t.Fatalf("Expected only leaked.txt to be open, got %v", open)
+	}
+	if !strings.Contains(open[0].Stack, "TestLeakDetection") {
+		t.Errorf("Expected the stack trace of the Open call, got %s", open[0].Stack)
+	}
+
+	// Files dropped without being closed are reported when collected
+	func() {
+		if _, err := dfs.Open("collected.txt"); err != nil {
+			t.Fatalf("Unexpected error opening collected.txt: %v", err)
+		}
+	}()
+	for i := 0; ; i++ {
+		runtime.GC()
+		mu.Lock()
+		n := len(warnings)
+		mu.Unlock()
+		if n > 0 {
+			break
+		}
+		if i == 100 {
+			t.Fatalf("Expected collected.txt to be reported once garbage collected")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if err := dfs.Close(); err != nil {
+		t.Fatalf("Unexpected error closing: %v", err)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if len(warnings) != 2 || warnings[0].Name != "collected.txt" || !warnings[0].Collected ||
+		warnings[1].Name != "leaked.txt" || warnings[1].Collected {
+		t.Errorf("Expected collected.txt and then leaked.txt to be reported, got %v", warnings)
+	}
+}
+
+// TestLeakReportedOnce ensures a file reported as open when the filesystem
+// is closed isn't reported again when it is garbage collected
+func TestLeakReportedOnce(t *testing.T) {
+	var mu sync.Mutex
+	var warnings []*fsdecomp.LeakError
+	dfs := fsdecomp.New(fstest.MapFS{
+		"leaked.txt.gz": &fstest.MapFile{Data: createGzipData(t, "leaked")},
+	}, fsdecomp.WithLeakDetection(), fsdecomp.WithWarningHandler(func(err error) {
+		var leak *fsdecomp.LeakError
+		if errors.As(err, &leak) {
+			mu.Lock()
+			warnings = append(warnings, leak)
+			mu.Unlock()
+		}
+	}))
+
+	func() {
+		if _, err := dfs.Open("leaked.txt"); err != nil {
+			t.Fatalf("Unexpected error opening leaked.txt: %v", err)
+		}
+	}()
+	if err := dfs.Close(); err != nil {
+		t.Fatalf("Unexpected error closing: %v", err)
+	}
+
+	// Cleanups run one at a time, so once those of objects dropped after
+	// the file have run twice over, any for the file has run too
+	for range 2 {
+		done := make(chan struct{})
+		runtime.AddCleanup(new([64]byte), func(done chan struct{}) { close(done) }, done)
+		for waiting := true; waiting; {
+			runtime.GC()
+			select {
+			case <-done:
+				waiting = false
+			case <-time.After(10 * time.Millisecond):
+			}
+		}
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(warnings) != 1 || warnings[0].Collected {
+		t.Errorf("Expected leaked.txt to be reported once, at Close, got %v", warnings)
+	}
+}
+
+// TestLeakTrackingAfterClose ensures files opened while closing are either
+// reported by Close or not tracked at all
+func TestLeakTrackingAfterClose(t *testing.T) {
+	testFS := fstest.MapFS{
+		"leaked.txt.gz": &fstest.MapFile{Data: createGzipData(t, "leaked")},
+	}
+	for range 100 {
+		dfs := fsdecomp.New(testFS, fsdecomp.WithLeakDetection())
+
+		var wg sync.WaitGroup
+		files := make(chan fs.File, 64)
+		for range cap(files) {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				if f, err := dfs.Open("leaked.txt"); err == nil {
+					files <- f
+				}
+			}()
+		}
+		dfs.Close()
+		wg.Wait()
+		close(files)
+
+		if open := dfs.OpenFiles(); len(open) != 0 {
+			t.Fatalf("Expected no files tracked after Close, got %d", len(open))
+		}
+		for f := range files {
+			f.Close()
+		}
+	}
+}
+
+func TestDataWithEOF(t *testing.T) {
+	// The decompressor returns its final bytes along with io.EOF
+	dataErr := fsdecomp.DecompressorFunc(func(r io.Reader) (io.ReadCloser, error) {
+		return io.NopCloser(iotest.DataErrReader(r)), nil
+	})
+	content := "first\nsecond\nlast line without a newline"
+	testFS := fstest.MapFS{
+		"data.txt.de": &fstest.MapFile{Data: []byte(content)},
+	}
+
+	for name, opts := range map[string][]fsdecomp.Option{
+		"plain":     nil,
+		"digest":    {fsdecomp.WithDigest(sha256.New)},
+		"limited":   {fsdecomp.WithMaxDecompressedSize(int64(len(content)))},
+		"bom":       {fsdecomp.WithBOMStripping()},
+		"transform": {fsdecomp.WithReadTransform(func(r io.Reader) io.Reader { return io.LimitReader(r, 1<<20) })},
+	} {
+		t.Run(name, func(t *testing.T) {
+			dfs := fsdecomp.New(testFS, append(opts, fsdecomp.WithDecompressor(".de", dataErr))...)
+
+			data, err := fs.ReadFile(dfs, "data.txt")
+			if err != nil || string(data) != content {
+				t.Errorf("Expected ReadFile to return %q, got %q, %v", content, data, err)
+			}
+
+			file, err := dfs.Open("data.txt")
+			if err != nil {
+				t.Fatalf("Unexpected error opening data.txt: %v", err)
+			}
+			var buf bytes.Buffer
+			if _, err := io.Copy(&buf, file); err != nil || buf.String() != content {
+				t.Errorf("Expected io.Copy to return %q, got %q, %v", content, buf.String(), err)
+			}
+			if summer, ok := file.(interface{ Sum() ([]byte, bool) }); ok && name == "digest" {
+				want := sha256.Sum256([]byte(content))
+				if sum, ok := summer.Sum(); !ok || !bytes.Equal(sum, want[:]) {
+					t.Errorf("Expected the digest of the whole content, got %x, %v", sum, ok)
+				}
+			}
+			file.Close()
+
+			if s, err := dfs.ReadString("data.txt", int64(len(content))); err != nil || s != content {
+				t.Errorf("Expected ReadString to return %q, got %q, %v", content, s, err)
+			}
+
+			var lines []string
+			err = dfs.ScanLines("data.txt", func(line []byte) error {
+				lines = append(lines, string(line))
+				return nil
+			})
+			if err != nil || strings.Join(lines, "\n") != content {
+				t.Errorf("Expected ScanLines to return every line, got %q, %v", lines, err)
+			}
+		})
+	}
+}
+
+func TestMinDecompressedRatio(t *testing.T) {
+	log := strings.Repeat("2024-06-01T12:00:00Z INFO request handled\n", 200)
+
+	// A valid stream holding only the first line, stored without compression
+	var truncated bytes.Buffer
+	gzw, err := gzip.NewWriterLevel(&truncated, gzip.NoCompression)
+	if err != nil {
+		t.Fatalf("Failed to create gzip writer: %v", err)
+	}
+	gzw.Write([]byte(log[:strings.IndexByte(log, '\n')+1]))
+	gzw.Close()
+
+	testFS := fstest.MapFS{
+		"full.log.gz":      &fstest.MapFile{Data: createGzipData(t, log)},
+		"truncated.log.gz": &fstest.MapFile{Data: truncated.Bytes()},
+	}
+	var warnings []error
+	dfs := fsdecomp.New(testFS, fsdecomp.WithMinDecompressedRatio(1.5),
+		fsdecomp.WithWarningHandler(func(err error) { warnings = append(warnings, err) }))
+
+	for _, name := range []string{"full.log", "truncated.log"} {
+		if _, err := fs.ReadFile(dfs, name); err != nil {
+			t.Fatalf("Unexpected error reading %s: %v", name, err)
+		}
+	}
+	if len(warnings) != 1 {
+		t.Fatalf("Expected one warning, got %v", warnings)
+	}
+	var decompErr *fsdecomp.DecompressError
+	if !errors.Is(warnings[0], fsdecomp.ErrLowRatio) || !errors.As(warnings[0], &decompErr) || decompErr.Name != "truncated.log.gz" {
+		t.Errorf("Expected an ErrLowRatio warning for truncated.log.gz, got %v", warnings[0])
+	}
+}
+
+func TestChainedDecompression(t *testing.T) {
+	const content = "gzip of bzip2"
+	testFS := fstest.MapFS{
+		"file.txt.bz2.gz": &fstest.MapFile{Data: createGzipData(t, string(createBzip2Data(t, content)))},
+	}
+
+	dfs := fsdecomp.New(testFS, fsdecomp.WithChainedDecompression(2))
+	data, err := fs.ReadFile(dfs, "file.txt")
+	if err != nil {
+		t.Fatalf("Unexpected error reading file.txt: %v", err)
+	}
+	if string(data) != content {
+		t.Errorf("Expected content %q, got %q", content, data)
+	}
+	entries, err := dfs.ReadDir(".")
+	if err != nil {
+		t.Fatalf("Unexpected error reading directory: %v", err)
+	}
+	if len(entries) != 1 || entries[0].Name() != "file.txt" {
+		t.Errorf("Expected file.txt to be listed, got %v", entries)
+	}
+
+	// Without chaining, only the outer layer is removed
+	single := fsdecomp.New(testFS)
+	if _, err := single.Open("file.txt"); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("Expected ErrNotExist for file.txt without chaining, got %v", err)
+	}
+	data, err = fs.ReadFile(single, "file.txt.bz2")
+	if err != nil || !bytes.Equal(data, createBzip2Data(t, content)) {
+		t.Errorf("Expected file.txt.bz2 to hold the bzip2 stream, got %v", err)
+	}
+}
+
+func TestConfig(t *testing.T) {
+	dfs := fsdecomp.New(fstest.MapFS{},
+		fsdecomp.WithStdlibOnly(),
+		fsdecomp.WithTransforms(xorTransform{key: 0x5a, open: new(int)}.transform()),
+		fsdecomp.WithMaxDecompressedSize(1<<20),
+		fsdecomp.WithDirectoryIndex("index.html"),
+		fsdecomp.WithBOMStripping(),
+		fsdecomp.WithSnapshotIndex(false),
+		fsdecomp.WithMetadataSidecars(".meta", 4096))
+
+	config := dfs.Config()
+	want := fsdecomp.Config{
+		Extensions:             []string{".gz", ".bz2", ".bgz", ".zz", ".zlib", ".deflate"},
+		TransformExtensions:    []string{".enc"},
+		MaxCompressionLayers:   1,
+		ListingLimit:           10000,
+		CompatLevel:            fsdecomp.DefaultCompatLevel,
+		DirectoryIndex:         "index.html",
+		SnapshotIndex:          true,
+		MetadataSidecarSuffix:  ".meta",
+		MetadataSidecarMaxSize: 4096,
+		ReadTransforms:         1,
+		MaxDecompressedSize:    1 << 20,
+		MaxLineLength:          bufio.MaxScanTokenSize,
+	}
+	if fmt.Sprintf("%+v", config) != fmt.Sprintf("%+v", want) {
+		t.Errorf("Expected config\n%+v\ngot\n%+v", want, config)
+	}
+
+	// Changing the copy doesn't change the filesystem
+	config.Extensions[0] = ".zst"
+	if got := dfs.Config().Extensions; !slices.Equal(got, want.Extensions) {
+		t.Errorf("Expected extensions %v after modifying a copy, got %v", want.Extensions, got)
+	}
+}
+
+func TestPresets(t *testing.T) {
+	defaults := fsdecomp.New(fstest.MapFS{}).Config()
+	for name, test := range map[string]struct {
+		preset fsdecomp.Option
+		want   func(c *fsdecomp.Config)
+	}{
+		"LowMemory": {fsdecomp.LowMemory(), func(c *fsdecomp.Config) {
+			c.CustomBufferPool = true
+			c.MaxDecompressedSize = 64 << 20
+			c.MaxLineLength = 16 * 1024
+		}},
+		"ServerThroughput": {fsdecomp.ServerThroughput(), func(c *fsdecomp.Config) {
+			c.SnapshotIndex = true
+			c.CustomBufferPool = true
+		}},
+		"Paranoid": {fsdecomp.Paranoid(), func(c *fsdecomp.Config) {
+			c.Extensions = []string{".gz", ".bz2", ".bgz", ".zz", ".zlib", ".deflate"}
+			c.MagicValidation = true
+			c.MaxDecompressedSize = 256 << 20
+			c.VariantCheck = true
+		}},
+	} {
+		t.Run(name, func(t *testing.T) {
+			want := defaults
+			want.Extensions = slices.Clone(defaults.Extensions)
+			test.want(&want)
+			if got := fsdecomp.New(fstest.MapFS{}, test.preset).Config(); fmt.Sprintf("%+v", got) != fmt.Sprintf("%+v", want) {
+				t.Errorf("Expected config\n%+v\ngot\n%+v", want, got)
+			}
+
+			// Later options override the preset
+			overridden := fsdecomp.New(fstest.MapFS{}, test.preset, fsdecomp.WithMaxDecompressedSize(1))
+			if got := overridden.Config().MaxDecompressedSize; got != 1 {
+				t.Errorf("Expected a later option to override the size limit, got %d", got)
+			}
+		})
+	}
+}
+
+// oneByteFS wraps a filesystem so its files return a single byte per Read,
+// as a backend delivering data in tiny chunks might
+type oneByteFS struct {
+	fs.FS
+}
+
+func (ofs oneByteFS) Open(name string) (fs.File, error) {
+	file, err := ofs.FS.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	return oneByteFile{file}, nil
+}
+
+type oneByteFile struct {
+	fs.File
+}
+
+func (f oneByteFile) Read(p []byte) (int, error) {
+	return iotest.OneByteReader(f.File).Read(p)
+}
+
+// TestOneByteReads ensures gzip files are decoded and their trailer checked
+// when the underlying file returns a byte at a time, so the trailer arrives
+// in several reads after the compressed data
+func TestOneByteReads(t *testing.T) {
+	content := strings.Repeat("trailer split across reads\n", 100)
+	valid := createGzipData(t, content)
+	badCRC := bytes.Clone(valid)
+	badCRC[len(badCRC)-8] ^= 0xff
+
+	testFS := oneByteFS{fstest.MapFS{
+		"valid.txt.gz":  &fstest.MapFile{Data: valid},
+		"badcrc.txt.gz": &fstest.MapFile{Data: badCRC},
+	}}
+	for name, opts := range map[string][]fsdecomp.Option{
+		"default":    nil,
+		"magic":      {fsdecomp.WithMagicValidation()},
+		"transforms": {fsdecomp.WithBOMStripping(), fsdecomp.WithMaxDecompressedSize(int64(len(content)))},
+	} {
+		t.Run(name, func(t *testing.T) {
+			dfs := fsdecomp.New(testFS, opts...)
+
+			data, err := fs.ReadFile(dfs, "valid.txt")
+			if err != nil {
+				t.Fatalf("Unexpected error reading valid.txt: %v", err)
+			}
+			if string(data) != content {
+				t.Errorf("Expected the full content of valid.txt, got %d bytes", len(data))
+			}
+
+			_, err = fs.ReadFile(dfs, "badcrc.txt")
+			if !errors.Is(err, gzip.ErrChecksum) {
+				t.Errorf("Expected gzip.ErrChecksum reading badcrc.txt, got %v", err)
+			}
+		})
+	}
+}
+
+// recordingFS records the operations made on the filesystem it wraps, and
+// fails to open the files in failOpen
+type recordingFS struct {
+	fsys     fstest.MapFS
+	failOpen map[string]bool
+	ops      []string
+}
+
+func (rfs *recordingFS) Open(name string) (fs.File, error) {
+	rfs.ops = append(rfs.ops, "open "+name)
+	if rfs.failOpen[name] {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrPermission}
+	}
+	return rfs.fsys.Open(name)
+}
+
+func (rfs *recordingFS) Stat(name string) (fs.FileInfo, error) {
+	rfs.ops = append(rfs.ops, "stat "+name)
+	return rfs.fsys.Stat(name)
+}
+
+func (rfs *recordingFS) ReadDir(name string) ([]fs.DirEntry, error) {
+	rfs.ops = append(rfs.ops, "readdir "+name)
+	return rfs.fsys.ReadDir(name)
+}
+
+func TestProbeStrategy(t *testing.T) {
+	testFS := fstest.MapFS{
+		"dir/data.txt.bz2":   &fstest.MapFile{Data: createBzip2Data(t, "bzip2 content")},
+		"dir/locked.txt.gz":  &fstest.MapFile{Data: createGzipData(t, "unreadable")},
+		"dir/locked.txt.bz2": &fstest.MapFile{Data: createBzip2Data(t, "fallback content")},
+	}
+	for _, test := range []struct {
+		strategy fsdecomp.ProbeStrategy
+		name     string
+		want     []string
+	}{
+		{fsdecomp.ProbeByOpen, "dir/data.txt", []string{
+			"open dir/data.txt", "open dir/data.txt.gz", "open dir/data.txt.bz2",
+		}},
+		{fsdecomp.ProbeAuto, "dir/data.txt", []string{
+			"open dir/data.txt", "stat dir/data.txt.gz", "stat dir/data.txt.bz2", "open dir/data.txt.bz2",
+		}},
+		{fsdecomp.ProbeByStat, "dir/locked.txt", []string{
+			"open dir/locked.txt", "stat dir/locked.txt.gz", "open dir/locked.txt.gz",
+			"stat dir/locked.txt.bz2", "open dir/locked.txt.bz2",
+		}},
+		{fsdecomp.ProbeByReadDir, "dir/data.txt", []string{
+			"open dir/data.txt", "open dir", "open dir/data.txt.bz2",
+		}},
+		{fsdecomp.ProbeByReadDir, "dir/locked.txt", []string{
+			"open dir/locked.txt", "open dir", "open dir/locked.txt.gz", "open dir/locked.txt.bz2",
+		}},
+	} {
+		rfs := &recordingFS{fsys: testFS, failOpen: map[string]bool{"dir/locked.txt.gz": true}}
+		dfs := fsdecomp.New(rfs, fsdecomp.WithStdlibOnly(), fsdecomp.WithProbeStrategy(test.strategy))
+		file, err := dfs.Open(test.name)
+		if err != nil {
+			t.Errorf("Unexpected error opening %s with strategy %d: %v", test.name, test.strategy, err)
+			continue
+		}
+		file.Close()
+		if !slices.Equal(rfs.ops, test.want) {
+			t.Errorf("Expected operations %q opening %s with strategy %d, got %q", test.want, test.name, test.strategy, rfs.ops)
+		}
+	}
+}
+
+func TestNormalizedNames(t *testing.T) {
+	tfs := targetNameFS{
+		MapFS: fstest.MapFS{
+			"data/plain-v2.txt":  &fstest.MapFile{Data: []byte("plain")},
+			"data/packed.txt.gz": &fstest.MapFile{Data: createGzipData(t, "packed")},
+			"data/sub/file.txt":  &fstest.MapFile{Data: []byte("in sub")},
+		},
+		links: map[string]string{"plain.txt": "data/plain-v2.txt", "subdir": "data/sub"},
+	}
+
+	for _, normalized := range []bool{false, true} {
+		var opts []fsdecomp.Option
+		if normalized {
+			opts = append(opts, fsdecomp.WithNormalizedNames())
+		}
+		dfs := fsdecomp.New(tfs, opts...)
+
+		want := map[string]string{"plain.txt": "plain-v2.txt", "data/packed.txt": "packed.txt", "subdir": "sub"}
+		if normalized {
+			want = map[string]string{"plain.txt": "plain.txt", "data/packed.txt": "packed.txt", "subdir": "subdir"}
+		}
+		for name, wantName := range want {
+			file, err := dfs.Open(name)
+			if err != nil {
+				t.Fatalf("Unexpected error opening %s: %v", name, err)
+			}
+			info, err := file.Stat()
+			if err != nil {
+				t.Fatalf("Unexpected error statting %s: %v", name, err)
+			}
+			if info.Name() != wantName {
+				t.Errorf("Expected %s to be named %q with normalized names %v, got %q", name, wantName, normalized, info.Name())
+			}
+			switch name {
+			case "plain.txt":
+				if _, ok := file.(io.ReadSeeker); !ok {
+					t.Errorf("Expected %s to remain seekable", name)
+				}
+			case "subdir":
+				dir, ok := file.(fs.ReadDirFile)
+				if !ok {
+					t.Fatalf("Expected %s to remain a ReadDirFile", name)
+				}
+				entries, err := dir.ReadDir(-1)
+				if err != nil || len(entries) != 1 || entries[0].Name() != "file.txt" {
+					t.Errorf("Expected %s to list file.txt, got %v, %v", name, entries, err)
+				}
+			}
+			file.Close()
+		}
+	}
+}
+
+func TestStrictClose(t *testing.T) {
+	content := strings.Repeat("read me to the end\n", 100)
+	testFS := fstest.MapFS{
+		"sized.txt.gz":    &fstest.MapFile{Data: createGzipData(t, content)},
+		"unsized.txt.bz2": &fstest.MapFile{Data: createBzip2Data(t, content)},
+		"plain.txt":       &fstest.MapFile{Data: []byte(content)},
+	}
+	dfs := fsdecomp.New(testFS, fsdecomp.WithStrictClose(), fsdecomp.WithSingleMemberSizes())
+
+	for name, remaining := range map[string]int64{"sized.txt": int64(len(content)) - 10, "unsized.txt": -1} {
+		file, err := dfs.Open(name)
+		if err != nil {
+			t.Fatalf("Unexpected error opening %s: %v", name, err)
+		}
+		if _, err := io.ReadFull(file, make([]byte, 10)); err != nil {
+			t.Fatalf("Unexpected error reading %s: %v", name, err)
+		}
+		err = file.Close()
+		var incomplete *fsdecomp.IncompleteReadError
+		if !errors.Is(err, fsdecomp.ErrIncompleteRead) || !errors.As(err, &incomplete) || incomplete.Remaining != remaining {
+			t.Errorf("Expected an IncompleteReadError with %d bytes remaining closing %s, got %v", remaining, name, err)
+		}
+
+		// Reading to the end satisfies the check
+		file, err = dfs.Open(name)
+		if err != nil {
+			t.Fatalf("Unexpected error opening %s: %v", name, err)
+		}
+		if _, err := io.Copy(io.Discard, file); err != nil {
+			t.Fatalf("Unexpected error reading %s: %v", name, err)
+		}
+		if err := file.Close(); err != nil {
+			t.Errorf("Unexpected error closing %s after reading it all: %v", name, err)
+		}
+	}
+
+	file, err := dfs.Open("plain.txt")
+	if err != nil {
+		t.Fatalf("Unexpected error opening plain.txt: %v", err)
+	}
+	if err := file.Close(); err != nil {
+		t.Errorf("Expected uncompressed files to close without reading, got %v", err)
+	}
+
+	if _, err := dfs.ReadString("sized.txt", 10); !errors.Is(err, fsdecomp.ErrTooLarge) {
+		t.Errorf("Expected ReadString to report ErrTooLarge rather than an incomplete read, got %v", err)
+	}
+}
+
+func TestWalkParallel(t *testing.T) {
+	testFS := fstest.MapFS{
+		"a.txt.gz":         &fstest.MapFile{Data: createGzipData(t, "a")},
+		"a.txt.bz2":        &fstest.MapFile{Data: createBzip2Data(t, "a")},
+		"plain.txt":        &fstest.MapFile{Data: []byte("plain")},
+		"skip/hidden.txt":  &fstest.MapFile{Data: []byte("hidden")},
+		"broken/bad.txt":   &fstest.MapFile{Data: []byte("bad")},
+		"broken/worse.txt": &fstest.MapFile{Data: []byte("worse")},
+	}
+	for i := range 20 {
+		testFS[fmt.Sprintf("dir%02d/sub/file.txt.gz", i)] = &fstest.MapFile{Data: createGzipData(t, "nested")}
+	}
+	dfs := fsdecomp.New(testFS)
+
+	// Visit everything except skip's contents, collecting the broken files
+	var mu sync.Mutex
+	visited := map[string]int{}
+	errBad := errors.New("bad file")
+	err := fsdecomp.WalkParallel(context.Background(), dfs, ".", 4, func(name string, d fs.DirEntry) error {
+		mu.Lock()
+		visited[name]++
+		mu.Unlock()
+		switch {
+		case name == "skip":
+			return fs.SkipDir
+		case path.Dir(name) == "broken":
+			return fmt.Errorf("%s: %w", name, errBad)
+		}
+		return nil
+	}, fsdecomp.WalkCollectErrors())
+	if !errors.Is(err, errBad) || !strings.Contains(err.Error(), "bad.txt") || !strings.Contains(err.Error(), "worse.txt") {
+		t.Errorf("Expected errors for both broken files, got %v", err)
+	}
+	// ., a.txt, plain.txt, skip, broken, its two files, and 20 dirNN, sub and file.txt
+	if len(visited) != 7+3*20 {
+		t.Errorf("Expected %d paths to be visited, got %d: %v", 7+3*20, len(visited), visited)
+	}
+	for name, n := range visited {
+		if n != 1 {
+			t.Errorf("Expected %s to be visited once, got %d", name, n)
+		}
+	}
+	if visited["skip/hidden.txt"] != 0 || visited["dir07/sub/file.txt"] != 1 {
+		t.Errorf("Expected skip's contents to be skipped and nested files to be visited")
+	}
+
+	// Without collecting, the first error is returned
+	err = fsdecomp.WalkParallel(context.Background(), dfs, ".", 4, func(name string, d fs.DirEntry) error {
+		if path.Dir(name) == "broken" {
+			return errBad
+		}
+		return nil
+	})
+	if err != errBad {
+		t.Errorf("Expected the callback's error, got %v", err)
+	}
+
+	// In order, the walk matches fs.WalkDir
+	var ordered, serial []string
+	err = fsdecomp.WalkParallel(context.Background(), dfs, ".", 4, func(name string, d fs.DirEntry) error {
+		ordered = append(ordered, name)
+		return nil
+	}, fsdecomp.WalkInOrder())
+	if err != nil {
+		t.Fatalf("Unexpected error walking in order: %v", err)
+	}
+	seen := map[string]bool{}
+	fs.WalkDir(dfs, ".", func(name string, d fs.DirEntry, err error) error {
+		if !seen[name] {
+			serial = append(serial, name)
+			seen[name] = true
+		}
+		return err
+	})
+	if !slices.Equal(ordered, serial) {
+		t.Errorf("Expected order %v, got %v", serial, ordered)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := fsdecomp.WalkParallel(ctx, dfs, ".", 4, func(string, fs.DirEntry) error { return nil }); err != context.Canceled {
+		t.Errorf("Expected context.Canceled walking with a cancelled context, got %v", err)
+	}
+}
+
+func TestParseTemplates(t *testing.T) {
+	testFS := fstest.MapFS{
+		"templates/page.tmpl.gz":   &fstest.MapFile{Data: createGzipData(t, `<h1>{{.Title}}</h1>{{template "footer.tmpl" .}}`)},
+		"templates/footer.tmpl":    &fstest.MapFile{Data: []byte(`<p>{{.Footer}}</p>`)},
+		"templates/ignored.txt.gz": &fstest.MapFile{Data: createGzipData(t, "not a template")},
+	}
+	dfs := fsdecomp.New(testFS)
+	data := map[string]string{"Title": "Compressed & served", "Footer": "fsdecomp"}
+
+	text, err := dfs.ParseTemplates("templates/*.tmpl")
+	if err != nil {
+		t.Fatalf("Unexpected error parsing templates: %v", err)
+	}
+	var buf strings.Builder
+	if err := text.ExecuteTemplate(&buf, "page.tmpl", data); err != nil {
+		t.Fatalf("Unexpected error executing page.tmpl: %v", err)
+	}
+	if want := "<h1>Compressed & served</h1><p>fsdecomp</p>"; buf.String() != want {
+		t.Errorf("Expected %q, got %q", want, buf.String())
+	}
+
+	html, err := dfs.ParseHTMLTemplates("templates/*.tmpl")
+	if err != nil {
+		t.Fatalf("Unexpected error parsing HTML templates: %v", err)
+	}
+	buf.Reset()
+	if err := html.ExecuteTemplate(&buf, "page.tmpl", data); err != nil {
+		t.Fatalf("Unexpected error executing HTML page.tmpl: %v", err)
+	}
+	if want := "<h1>Compressed &amp; served</h1><p>fsdecomp</p>"; buf.String() != want {
+		t.Errorf("Expected %q, got %q", want, buf.String())
+	}
+}
+
+// TestRetryReopens ensures that when a decoder fails part way into the
+// stream, opening the file again starts from a fresh handle at offset 0
+// rather than reusing the handle the failed attempt left part read
+func TestRetryReopens(t *testing.T) {
+	cfs := &countingFS{FS: fstest.MapFS{
+		"data.txt.zst": &fstest.MapFile{Data: createZstdData(t, "zstd content")},
+	}}
+	failed := false
+	flaky := fsdecomp.DecompressorFunc(func(r io.Reader) (io.ReadCloser, error) {
+		if !failed {
+			failed = true
+			// Consume the frame header before failing, as a decoder might
+			io.ReadFull(r, make([]byte, 6))
+			return nil, errors.New("transient decoder failure")
+		}
+		decoder, err := zstd.NewReader(r)
+		if err != nil {
+			return nil, err
+		}
+		return decoder.IOReadCloser(), nil
+	})
+	dfs := fsdecomp.New(cfs, fsdecomp.WithDecompressor(".zst", flaky))
+
+	if _, err := dfs.Open("data.txt"); err == nil {
+		t.Fatalf("Expected the first open to fail")
+	}
+	opens := cfs.opens
+	data, err := fs.ReadFile(dfs, "data.txt")
+	if err != nil {
+		t.Fatalf("Unexpected error on retry: %v", err)
+	}
+	if string(data) != "zstd content" {
+		t.Errorf("Expected the retry to read from the start, got %q", data)
+	}
+	if cfs.opens <= opens {
+		t.Errorf("Expected the retry to open the underlying file again")
+	}
+}
+
+func TestMetaSuffix(t *testing.T) {
+	const hash = "9f86d081884c7d659a2feaa0c55ad015a3bf4f1b2b0b822cd15d6c15b0f00a08"
+	testFS := fstest.MapFS{
+		"blobs/" + hash:           &fstest.MapFile{Data: createGzipData(t, "content addressed")},
+		"blobs/" + hash + ".meta": &fstest.MapFile{Data: []byte(`{"encoding": "gzip"}`)},
+		"blobs/plain":             &fstest.MapFile{Data: []byte("no metadata")},
+		"blobs/identity":          &fstest.MapFile{Data: []byte("stored as is")},
+		"blobs/identity.meta":     &fstest.MapFile{Data: []byte(`{"encoding": "identity"}`)},
+	}
+	dfs := fsdecomp.New(testFS, fsdecomp.WithMetaSuffix(".meta", func(data []byte) string {
+		var meta struct{ Encoding string }
+		if json.Unmarshal(data, &meta) == nil && meta.Encoding == "gzip" {
+			return "gz"
+		}
+		return ""
+	}))
+
+	for name, want := range map[string]string{
+		"blobs/" + hash:  "content addressed",
+		"blobs/plain":    "no metadata",
+		"blobs/identity": "stored as is",
+	} {
+		data, err := fs.ReadFile(dfs, name)
+		if err != nil {
+			t.Errorf("Unexpected error reading %s: %v", name, err)
+		} else if string(data) != want {
+			t.Errorf("Expected %s to contain %q, got %q", name, want, data)
+		}
+	}
+}
+
+// trackedCloser records the order it is closed in, and fails with err
+type trackedCloser struct {
+	io.Reader
+	name   string
+	closed *[]string
+	err    error
+}
+
+func (tc trackedCloser) Close() error {
+	*tc.closed = append(*tc.closed, tc.name)
+	return tc.err
+}
+
+// trackedFS opens files whose Close is tracked
+type trackedFS struct {
+	fs.FS
+	closed *[]string
+	err    error
+}
+
+func (tfs trackedFS) Open(name string) (fs.File, error) {
+	file, err := tfs.FS.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	return trackedFile{File: file, closer: trackedCloser{name: "file", closed: tfs.closed, err: tfs.err}}, nil
+}
+
+type trackedFile struct {
+	fs.File
+	closer trackedCloser
+}
+
+func (tf trackedFile) Close() error {
+	tf.File.Close()
+	return tf.closer.Close()
+}
+
+// TestLayerCloseOrder ensures the layers of a file are closed from the
+// innermost out, each before the reader it reads from, with errors joined
+func TestLayerCloseOrder(t *testing.T) {
+	var closed []string
+	errFile, errEnc, errGzip := errors.New("file"), errors.New("enc"), errors.New("gzip")
+	tracked := func(name string, err error, newReader func(io.Reader) (io.Reader, error)) func(io.Reader) (io.ReadCloser, error) {
+		return func(r io.Reader) (io.ReadCloser, error) {
+			reader, err2 := newReader(r)
+			if err2 != nil {
+				return nil, err2
+			}
+			return trackedCloser{Reader: reader, name: name, closed: &closed, err: err}, nil
+		}
+	}
+	xor := xorTransform{key: 0x5a, open: new(int)}
+	testFS := trackedFS{FS: fstest.MapFS{
+		"data.txt.gz.enc": &fstest.MapFile{Data: xor.apply(createGzipData(t, "layered"))},
+	}, closed: &closed, err: errFile}
+
+	dfs := fsdecomp.New(testFS,
+		fsdecomp.WithDecompressor(".gz", fsdecomp.DecompressorFunc(tracked("gzip", errGzip, func(r io.Reader) (io.Reader, error) {
+			return gzip.NewReader(r)
+		}))),
+		fsdecomp.WithTransforms(fsdecomp.Transform{Ext: ".enc", NewReader: tracked("enc", errEnc, func(r io.Reader) (io.Reader, error) {
+			return &xorReader{reader: r, key: xor.key, open: xor.open}, nil
+		})}))
+
+	file, err := dfs.Open("data.txt")
+	if err != nil {
+		t.Fatalf("Unexpected error opening data.txt: %v", err)
+	}
+	if data, err := io.ReadAll(file); err != nil || string(data) != "layered" {
+		t.Errorf("Expected content %q, got %q, %v", "layered", data, err)
+	}
+	err = file.Close()
+	if want := []string{"gzip", "enc", "file"}; !slices.Equal(closed, want) {
+		t.Errorf("Expected close order %v, got %v", want, closed)
+	}
+	for _, want := range []error{errFile, errEnc, errGzip} {
+		if !errors.Is(err, want) {
+			t.Errorf("Expected the error from closing to include %v, got %v", want, err)
+		}
+	}
+}
+
+func TestSRIHash(t *testing.T) {
+	script := "console.log('hello');\n"
+	testFS := fstest.MapFS{
+		"app.js.gz": &fstest.MapFile{Data: createGzipData(t, script), ModTime: time.Unix(1, 0)},
+	}
+	dfs := fsdecomp.New(testFS)
+
+	sum := sha512.Sum384([]byte(script))
+	want := "sha384-" + base64.StdEncoding.EncodeToString(sum[:])
+	for range 2 {
+		got, err := fsdecomp.SRIHash(dfs, "app.js", "sha384")
+		if err != nil {
+			t.Fatalf("Unexpected error hashing app.js: %v", err)
+		}
+		if got != want {
+			t.Errorf("Expected %q, got %q", want, got)
+		}
+	}
+
+	// A changed file is hashed again
+	script = "console.log('changed');\n"
+	testFS["app.js.gz"] = &fstest.MapFile{Data: createGzipData(t, script), ModTime: time.Unix(2, 0)}
+	sum256 := sha256.Sum256([]byte(script))
+	if got, _ := fsdecomp.SRIHash(dfs, "app.js", "sha256"); got != "sha256-"+base64.StdEncoding.EncodeToString(sum256[:]) {
+		t.Errorf("Expected the SHA-256 of the changed file, got %q", got)
+	}
+	sum = sha512.Sum384([]byte(script))
+	if got, _ := fsdecomp.SRIHash(dfs, "app.js", "sha384"); got != "sha384-"+base64.StdEncoding.EncodeToString(sum[:]) {
+		t.Errorf("Expected the SHA-384 of the changed file, got %q", got)
+	}
+
+	if _, err := fsdecomp.SRIHash(dfs, "app.js", "md5"); err == nil {
+		t.Errorf("Expected an error for an unsupported algorithm")
+	}
+
+	tmpl, err := htmltemplate.New("page").Funcs(fsdecomp.TemplateFuncs(dfs)).Parse(`<script src="/app.js" integrity="{{sri "app.js" "sha384"}}"></script>`)
+	if err != nil {
+		t.Fatalf("Unexpected error parsing template: %v", err)
+	}
+	var buf strings.Builder
+	if err := tmpl.Execute(&buf, nil); err != nil {
+		t.Fatalf("Unexpected error executing template: %v", err)
+	}
+	if wantHTML := `<script src="/app.js" integrity="sha384-` + base64.StdEncoding.EncodeToString(sum[:]) + `"></script>`; buf.String() != wantHTML {
+		t.Errorf("Expected %q, got %q", wantHTML, buf.String())
+	}
+}
+
+func TestTarGz(t *testing.T) {
+	testFS := fstest.MapFS{
+		"site/index.html":         &fstest.MapFile{Data: []byte("<h1>plain</h1>"), Mode: 0644},
+		"site/app.js.gz":          &fstest.MapFile{Data: createGzipData(t, "gzip js"), Mode: 0644},
+		"site/data/table.csv.bz2": &fstest.MapFile{Data: createBzip2Data(t, "bzip2,csv")},
+		"site/data/doc.txt.zst":   &fstest.MapFile{Data: createZstdData(t, "zstd text")},
+		"site/data/doc.txt.gz":    &fstest.MapFile{Data: createGzipData(t, "gzip text")},
+		"site/joined.txt.gz":      &fstest.MapFile{Data: append(createGzipData(t, "first member, "), createGzipData(t, "second")...)},
+		"other/excluded.txt":      &fstest.MapFile{Data: []byte("outside root")},
+	}
+	dfs := fsdecomp.New(testFS)
+	wantDoc, err := fs.ReadFile(dfs, "site/data/doc.txt")
+	if err != nil {
+		t.Fatalf("Unexpected error reading doc.txt: %v", err)
+	}
+
+	var buf bytes.Buffer
+	if err := dfs.TarGz("site", &buf); err != nil {
+		t.Fatalf("Unexpected error writing tarball: %v", err)
+	}
+
+	gzr, err := gzip.NewReader(&buf)
+	if err != nil {
+		t.Fatalf("Tarball isn't gzip compressed: %v", err)
+	}
+	tr := tar.NewReader(gzr)
+	members := map[string]string{}
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("Unexpected error reading tarball: %v", err)
+		}
+		data, err := io.ReadAll(tr)
+		if err != nil {
+			t.Fatalf("Unexpected error reading %s from tarball: %v", header.Name, err)
+		}
+		if _, ok := members[header.Name]; ok {
+			t.Errorf("Expected %s to be archived once", header.Name)
+		}
+		members[header.Name] = string(data)
+	}
+
+	want := map[string]string{
+		"index.html":     "<h1>plain</h1>",
+		"app.js":         "gzip js",
+		"joined.txt":     "first member, second",
+		"data/":          "",
+		"data/table.csv": "bzip2,csv",
+		"data/doc.txt":   string(wantDoc),
+	}
+	if fmt.Sprint(members) != fmt.Sprint(want) {
+		t.Errorf("Expected members %v, got %v", want, members)
+	}
+}
+
+// endChecked is a sized format that only finds its stream corrupt once all
+// of its contents have been read, as checksums in trailers are found
+type endChecked struct{}
+
+var errEndCheck = errors.New("trailer check failed")
+
+func (endChecked) NewReader(r io.Reader) (io.ReadCloser, error) {
+	return io.NopCloser(io.MultiReader(r, iotest.ErrReader(errEndCheck))), nil
+}
+
+func (endChecked) DecompressedSize(r io.ReaderAt, size int64) (int64, bool) {
+	return size, true
+}
+
+// TestTarGzCorrupt ensures TarGz reports corruption only found at the end
+// of a stream, once the contents promised by the header have been copied
+func TestTarGzCorrupt(t *testing.T) {
+	testFS := fstest.MapFS{
+		"site/corrupt.txt.chk": &fstest.MapFile{Data: []byte("the check of this file fails")},
+	}
+	dfs := fsdecomp.New(testFS, fsdecomp.WithDecompressor(".chk", endChecked{}))
+
+	err := dfs.TarGz("site", io.Discard)
+	if !errors.Is(err, errEndCheck) || !strings.Contains(err.Error(), "site/corrupt.txt") {
+		t.Errorf("Expected the trailer check to fail naming site/corrupt.txt, got %v", err)
+	}
+}
+
+func TestNegotiateEncoding(t *testing.T) {
+	available := []string{"br", "zstd", "gzip"}
+	tests := []struct {
+		header    string
+		available []string
+		want      string
+		ok        bool
+	}{
+		{"", available, "identity", true},
+		{"gzip", available, "gzip", true},
+		{"gzip, br", available, "br", true},
+		{"gzip;q=1.0, br;q=0.5", available, "gzip", true},
+		{"gzip;q=0.5, br;q=1.0", available, "br", true},
+		{"GZIP; Q=0.8", available, "gzip", true},
+		{"x-gzip", available, "gzip", true},
+		{"*", available, "br", true},
+		{"*;q=0.1, gzip;q=0.5", available, "gzip", true},
+		{"*, br;q=0", available, "zstd", true},
+		{"compress, deflate", available, "identity", true},
+		{"gzip;q=0", available, "identity", true},
+		{"identity;q=0", available, "", false},
+		{"*;q=0", available, "", false},
+		{"*;q=0, identity", available, "identity", true},
+		{"gzip;q=0, identity;q=0", available, "", false},
+		{"br;q=0, gzip;q=0.5, br;q=0.9", available, "br", true},
+		{"gzip;q=2, br;q=0.5", available, "br", true},
+		{"gzip;q=0.1234, br;q=0.5", available, "br", true},
+		{"gzip;q=1e-1, br;q=0.5", available, "br", true},
+		{" , gzip ,", available, "gzip", true},
+		{"gzip, identity;q=0", nil, "", false},
+		{"identity;q=0.5, gzip;q=0.2", []string{"gzip", "identity"}, "identity", true},
+		{"gzip", []string{"GZip"}, "GZip", true},
+	}
+	for _, test := range tests {
+		got, ok := fsdecomp.NegotiateEncoding(test.header, test.available)
+		if got != test.want || ok != test.ok {
+			t.Errorf("NegotiateEncoding(%q, %q) = %q, %v; expected %q, %v", test.header, test.available, got, ok, test.want, test.ok)
+		}
+	}
+}
+
+func TestOpenInvalidName(t *testing.T) {
+	testFS := fstest.MapFS{
+		".gz":           &fstest.MapFile{Data: createGzipData(t, "nameless")},
+		"dir/.gz":       &fstest.MapFile{Data: createGzipData(t, "nameless")},
+		"file.txt.gz":   &fstest.MapFile{Data: createGzipData(t, "content")},
+		"dir/other.txt": &fstest.MapFile{Data: []byte("plain")},
+	}
+	for _, name := range []string{"", "/file.txt", "dir/", "dir/../file.txt", "./file.txt"} {
+		for _, opts := range [][]fsdecomp.Option{nil, {fsdecomp.WithSnapshotIndex(false)}} {
+			rfs := &recordingFS{fsys: testFS}
+			dfs := fsdecomp.New(rfs, opts...)
+			file, err := dfs.Open(name)
+			if err == nil {
+				file.Close()
+				t.Errorf("Expected an error opening %q", name)
+				continue
+			}
+			var pathErr *fs.PathError
+			if !errors.As(err, &pathErr) || pathErr.Op != "open" || pathErr.Path != name || !errors.Is(err, fs.ErrInvalid) {
+				t.Errorf("Expected invalid open error for %q, got %v", name, err)
+			}
+			if len(rfs.ops) > 0 {
+				t.Errorf("Expected no backend operations opening %q, got %q", name, rfs.ops)
+			}
+		}
+	}
+}
+
+func TestFreeze(t *testing.T) {
+	testFS := fstest.MapFS{
+		"tree/readme.txt":     &fstest.MapFile{Data: []byte("plain"), Mode: 0644},
+		"tree/a.txt.gz":       &fstest.MapFile{Data: createGzipData(t, "gzip a")},
+		"tree/sub/b.txt.bz2":  &fstest.MapFile{Data: createBzip2Data(t, "bzip2 b")},
+		"tree/sub/c.json.zst": &fstest.MapFile{Data: createZstdData(t, `{"c":true}`)},
+		"tree/empty/.keep":    &fstest.MapFile{},
+		"outside.txt.gz":      &fstest.MapFile{Data: createGzipData(t, "not frozen")},
+	}
+	dfs := fsdecomp.New(testFS)
+	snapshot, err := dfs.Freeze("tree")
+	if err != nil {
+		t.Fatalf("Unexpected error freezing tree: %v", err)
+	}
+
+	// The snapshot mustn't see later changes to the underlying filesystem
+	testFS["tree/a.txt.gz"] = &fstest.MapFile{Data: createGzipData(t, "changed")}
+	delete(testFS, "tree/sub/b.txt.bz2")
+
+	want := map[string]string{
+		"readme.txt":  "plain",
+		"a.txt":       "gzip a",
+		"sub/b.txt":   "bzip2 b",
+		"sub/c.json":  `{"c":true}`,
+		"empty/.keep": "",
+	}
+	for name, content := range want {
+		data, err := fs.ReadFile(snapshot, name)
+		if err != nil {
+			t.Errorf("Unexpected error reading %s from snapshot: %v", name, err)
+		} else if string(data) != content {
+			t.Errorf("Expected %s to contain %q, got %q", name, content, data)
+		}
+	}
+	if _, err := fs.Stat(snapshot, "a.txt.gz"); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("Expected compressed names to be absent from snapshot, got %v", err)
+	}
+	if err := fstest.TestFS(snapshot, "readme.txt", "a.txt", "sub/b.txt", "sub/c.json", "empty/.keep"); err != nil {
+		t.Errorf("Snapshot failed fstest.TestFS: %v", err)
+	}
+
+	// Freezing a single file uses its base name
+	snapshot, err = dfs.Freeze("outside.txt")
+	if err != nil {
+		t.Fatalf("Unexpected error freezing a file: %v", err)
+	}
+	if data, err := fs.ReadFile(snapshot, "outside.txt"); err != nil || string(data) != "not frozen" {
+		t.Errorf("Expected frozen file to contain %q, got %q, %v", "not frozen", data, err)
+	}
+}
+
+func TestMaxFreezeSize(t *testing.T) {
+	testFS := fstest.MapFS{
+		"a.txt.gz": &fstest.MapFile{Data: createGzipData(t, "12345")},
+		"b.txt":    &fstest.MapFile{Data: []byte("67890")},
+	}
+	if _, err := fsdecomp.New(testFS, fsdecomp.WithMaxFreezeSize(10)).Freeze("."); err != nil {
+		t.Errorf("Unexpected error freezing a tree of exactly the limit: %v", err)
+	}
+	_, err := fsdecomp.New(testFS, fsdecomp.WithMaxFreezeSize(9)).Freeze(".")
+	if !errors.Is(err, fsdecomp.ErrTooLarge) {
+		t.Errorf("Expected ErrTooLarge freezing a tree over the limit, got %v", err)
+	}
+}
+
+// TestByteCounts checks the features that depend on how much of a file has
+// been read agree whether it is read with Read, WriteTo or fs.ReadFile
+func TestByteCounts(t *testing.T) {
+	content := strings.Repeat("counted ", 4096)
+	compressed := createGzipData(t, content)
+	testFS := fstest.MapFS{"file.txt.gz": &fstest.MapFile{Data: compressed}}
+
+	paths := map[string]func(fs.File) ([]byte, error){
+		"Read": func(file fs.File) ([]byte, error) {
+			// Read in small pieces, without using WriteTo
+			var buf bytes.Buffer
+			_, err := io.CopyBuffer(struct{ io.Writer }{&buf}, struct{ io.Reader }{file}, make([]byte, 100))
+			return buf.Bytes(), err
+		},
+		"WriteTo": func(file fs.File) ([]byte, error) {
+			var buf bytes.Buffer
+			_, err := file.(io.WriterTo).WriteTo(&buf)
+			return buf.Bytes(), err
+		},
+		"ReadAll": func(file fs.File) ([]byte, error) {
+			return io.ReadAll(file)
+		},
+	}
+	for pathName, read := range paths {
+		file, err := fsdecomp.New(testFS).Open("file.txt")
+		if err != nil {
+			t.Fatalf("Unexpected error opening file: %v", err)
+		}
+		counter := file.(interface{ BytesRead() (int64, int64) })
+		if _, d := counter.BytesRead(); d != 0 {
+			t.Errorf("%s: expected no decompressed bytes read before reading, got %d", pathName, d)
+		}
+		data, err := read(file)
+		if err != nil || string(data) != content {
+			t.Errorf("%s: expected file contents, got %d bytes, %v", pathName, len(data), err)
+		}
+		if c, d := counter.BytesRead(); c != int64(len(compressed)) || d != int64(len(content)) {
+			t.Errorf("%s: expected %d, %d bytes read, got %d, %d", pathName, len(compressed), len(content), c, d)
+		}
+		file.Close()
+
+		// Limits apply at exactly the same point
+		for limit, wantErr := range map[int64]bool{int64(len(content)): false, int64(len(content)) - 1: true} {
+			file, err := fsdecomp.New(testFS, fsdecomp.WithMaxDecompressedSize(limit)).Open("file.txt")
+			if err != nil {
+				t.Fatalf("Unexpected error opening file: %v", err)
+			}
+			_, err = read(file)
+			if errors.Is(err, fsdecomp.ErrTooLarge) != wantErr {
+				t.Errorf("%s: expected ErrTooLarge to be %v with a limit of %d, got %v", pathName, wantErr, limit, err)
+			}
+			file.Close()
+		}
+
+		// Reading to the end satisfies strict close and the ratio check
+		var warnings []error
+		file, err = fsdecomp.New(testFS,
+			fsdecomp.WithStrictClose(),
+			fsdecomp.WithMinDecompressedRatio(float64(len(content))/float64(len(compressed))),
+			fsdecomp.WithWarningHandler(func(err error) { warnings = append(warnings, err) }),
+		).Open("file.txt")
+		if err != nil {
+			t.Fatalf("Unexpected error opening file: %v", err)
+		}
+		if _, err := read(file); err != nil {
+			t.Errorf("%s: unexpected error reading file: %v", pathName, err)
+		}
+		if err := file.Close(); err != nil {
+			t.Errorf("%s: unexpected error closing file read to the end: %v", pathName, err)
+		}
+		if len(warnings) > 0 {
+			t.Errorf("%s: expected no warnings, got %v", pathName, warnings)
+		}
+	}
+
+	// fs.ReadFile goes through the same counts
+	dfs := fsdecomp.New(testFS, fsdecomp.WithMaxDecompressedSize(int64(len(content))-1))
+	if _, err := fs.ReadFile(dfs, "file.txt"); !errors.Is(err, fsdecomp.ErrTooLarge) {
+		t.Errorf("Expected ErrTooLarge from fs.ReadFile, got %v", err)
+	}
+	var warnings []error
+	dfs = fsdecomp.New(testFS,
+		fsdecomp.WithMinDecompressedRatio(float64(len(content))/float64(len(compressed))+1),
+		fsdecomp.WithWarningHandler(func(err error) { warnings = append(warnings, err) }),
+	)
+	if data, err := fs.ReadFile(dfs, "file.txt"); err != nil || string(data) != content {
+		t.Errorf("Expected file contents from fs.ReadFile, got %d bytes, %v", len(data), err)
+	}
+	if len(warnings) != 1 || !errors.Is(warnings[0], fsdecomp.ErrLowRatio) {
+		t.Errorf("Expected one ErrLowRatio warning from fs.ReadFile, got %v", warnings)
+	}
+}
+
+// tapeFS provides files that, like a streaming adapter's, can only be
+// statted before they are read
+type tapeFS struct {
+	fstest.MapFS
+}
+
+type tapeFile struct {
+	fs.File
+	started bool
+}
+
+func (tfs tapeFS) Open(name string) (fs.File, error) {
+	file, err := tfs.MapFS.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	return &tapeFile{File: file}, nil
+}
+
+func (tf *tapeFile) Read(p []byte) (int, error) {
+	tf.started = true
+	return tf.File.Read(p)
+}
+
+func (tf *tapeFile) Stat() (fs.FileInfo, error) {
+	if tf.started {
+		return nil, errors.New("stat after read")
+	}
+	return tf.File.Stat()
+}
+
+func TestEagerStat(t *testing.T) {
+	content := "streamed from tape"
+	modTime := time.Date(2024, 5, 1, 0, 0, 0, 0, time.UTC)
+	for _, test := range []struct {
+		name    string
+		data    []byte
+		opts    []fsdecomp.Option
+		statErr bool
+	}{
+		{"file.txt.bz2", createBzip2Data(t, content), nil, true},
+		{"file.txt.bz2", createBzip2Data(t, content), []fsdecomp.Option{fsdecomp.WithEagerStat()}, false},
+		// gzip reads its header when opened
+		{"file.txt.gz", createGzipData(t, content), nil, true},
+		{"file.txt.gz", createGzipData(t, content), []fsdecomp.Option{fsdecomp.WithEagerStat()}, false},
+		{"file.txt.gz", createGzipData(t, content), []fsdecomp.Option{fsdecomp.WithEagerStat(), fsdecomp.WithMagicValidation()}, false},
+	} {
+		testFS := tapeFS{fstest.MapFS{
+			test.name: &fstest.MapFile{Data: test.data, ModTime: modTime},
+		}}
+		dfs := fsdecomp.New(testFS, test.opts...)
+		file, err := dfs.Open("file.txt")
+		if err != nil {
+			t.Fatalf("Unexpected error opening file: %v", err)
+		}
+		if data, err := io.ReadAll(file); err != nil || string(data) != content {
+			t.Errorf("Expected %q, got %q, %v", content, data, err)
+		}
+		info, err := file.Stat()
+		if test.statErr {
+			if err == nil {
+				t.Errorf("Expected the first Stat after reading to reach the underlying file")
+			}
+		} else if err != nil {
+			t.Errorf("Unexpected error from Stat after reading with WithEagerStat: %v", err)
+		} else if info.Name() != "file.txt" || !info.ModTime().Equal(modTime) {
+			t.Errorf("Expected file.txt modified at %v, got %s modified at %v", modTime, info.Name(), info.ModTime())
+		}
+		file.Close()
+
+		// The result of the first Stat is kept
+		if !test.statErr {
+			file, err = dfs.Open("file.txt")
+			if err != nil {
+				t.Fatalf("Unexpected error opening file: %v", err)
+			}
+			if _, err := file.Stat(); err != nil {
+				t.Errorf("Unexpected error from Stat before reading: %v", err)
+			}
+			io.Copy(io.Discard, file)
+			if _, err := file.Stat(); err != nil {
+				t.Errorf("Unexpected error from a repeated Stat after reading: %v", err)
+			}
+			file.Close()
+		}
+
+		if data, err := fs.ReadFile(dfs, "file.txt"); err != nil || string(data) != content {
+			t.Errorf("Expected fs.ReadFile to return %q, got %q, %v", content, data, err)
+		}
+	}
+}
+
+func TestETag(t *testing.T) {
+	modTime := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	testFS := fstest.MapFS{
+		"file.txt.gz": &fstest.MapFile{Data: createGzipData(t, "version one"), ModTime: modTime},
+	}
+	dfs := fsdecomp.New(testFS)
+
+	etag, err := dfs.ETag("file.txt")
+	if err != nil {
+		t.Fatalf("Unexpected error getting ETag: %v", err)
+	}
+	if !strings.HasPrefix(etag, `W/"`) || !strings.HasSuffix(etag, `"`) {
+		t.Errorf("Expected a weak ETag, got %s", etag)
+	}
+	if again, err := dfs.ETag("file.txt"); err != nil || again != etag {
+		t.Errorf("Expected a stable ETag %s, got %s, %v", etag, again, err)
+	}
+	if _, err := dfs.ETag("missing.txt"); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("Expected ErrNotExist for a missing file, got %v", err)
+	}
+
+	seen := map[string]string{etag: "original"}
+	for _, change := range []struct {
+		desc   string
+		change func()
+	}{
+		{"mtime changed", func() { testFS["file.txt.gz"].ModTime = modTime.Add(time.Second) }},
+		{"size changed", func() { testFS["file.txt.gz"].Data = createGzipData(t, "version two, longer") }},
+		{"format changed", func() {
+			testFS["file.txt.bz2"] = &fstest.MapFile{Data: testFS["file.txt.gz"].Data, ModTime: testFS["file.txt.gz"].ModTime}
+			delete(testFS, "file.txt.gz")
+		}},
+		{"plain file added", func() {
+			testFS["file.txt"] = &fstest.MapFile{Data: testFS["file.txt.bz2"].Data, ModTime: testFS["file.txt.bz2"].ModTime}
+		}},
+	} {
+		change.change()
+		etag, err := dfs.ETag("file.txt")
+		if err != nil {
+			t.Fatalf("Unexpected error getting ETag after %s: %v", change.desc, err)
+		}
+		if prev, ok := seen[etag]; ok {
+			t.Errorf("Expected ETag to change after %s, got the same as after %s: %s", change.desc, prev, etag)
+		}
+		seen[etag] = change.desc
+	}
+}
+
+// duplicatingFS lists every entry twice, in reverse order, as a union mount
+// with overlapping layers might
+type duplicatingFS struct {
+	fstest.MapFS
+}
+
+func (dfs duplicatingFS) ReadDir(name string) ([]fs.DirEntry, error) {
+	entries, err := dfs.MapFS.ReadDir(name)
+	if err != nil {
+		return nil, err
+	}
+	doubled := append(slices.Clone(entries), entries...)
+	slices.Reverse(doubled)
+	return doubled, nil
+}
+
+func TestDuplicateDirEntries(t *testing.T) {
+	testFS := duplicatingFS{fstest.MapFS{
+		"plain.txt":       &fstest.MapFile{Data: []byte("plain wins")},
+		"plain.txt.gz":    &fstest.MapFile{Data: createGzipData(t, "gzip loses to plain")},
+		"multi.txt.bz2":   &fstest.MapFile{Data: createBzip2Data(t, "bzip2 loses to gzip")},
+		"multi.txt.gz":    &fstest.MapFile{Data: createGzipData(t, "gzip wins")},
+		"only.txt.zst":    &fstest.MapFile{Data: createZstdData(t, "zstd only")},
+		"dir/nested.txt":  &fstest.MapFile{Data: []byte("nested")},
+		"dir.gz":          &fstest.MapFile{Data: createGzipData(t, "directory wins")},
+		"a.txt-b":         &fstest.MapFile{Data: []byte("listed before a.txt.gz")},
+		"a.txt.gz":        &fstest.MapFile{Data: createGzipData(t, "listed after a.txt-b")},
+		"z/.keep":         &fstest.MapFile{},
+		"z.txt.gz.bz2.gz": &fstest.MapFile{Data: createGzipData(t, "not decompressed past one layer")},
+	}}
+	for _, opts := range [][]fsdecomp.Option{nil, {fsdecomp.WithSnapshotIndex(false)}} {
+		dfs := fsdecomp.New(testFS, opts...)
+		entries, err := dfs.ReadDir(".")
+		if err != nil {
+			t.Fatalf("Unexpected error reading directory: %v", err)
+		}
+		var names []string
+		for _, entry := range entries {
+			names = append(names, entry.Name())
+		}
+		want := []string{"a.txt", "a.txt-b", "dir", "multi.txt", "only.txt", "plain.txt", "z", "z.txt.gz.bz2"}
+		if !slices.Equal(names, want) {
+			t.Errorf("Expected entries %q, got %q", want, names)
+		}
+
+		// Each listed entry must describe the file Open picks
+		for _, entry := range entries {
+			file, err := dfs.Open(entry.Name())
+			if err != nil {
+				t.Errorf("Unexpected error opening listed entry %s: %v", entry.Name(), err)
+				continue
+			}
+			info, err := file.Stat()
+			if err != nil {
+				t.Errorf("Unexpected error from Stat of %s: %v", entry.Name(), err)
+			} else if info.IsDir() != entry.IsDir() {
+				t.Errorf("Expected %s to be a directory in both the listing and Open: %v, %v", entry.Name(), entry.IsDir(), info.IsDir())
+			}
+			file.Close()
+		}
+		for name, content := range map[string]string{"plain.txt": "plain wins", "multi.txt": "gzip wins"} {
+			if data, err := fs.ReadFile(dfs, name); err != nil || string(data) != content {
+				t.Errorf("Expected %s to contain %q, got %q, %v", name, content, data, err)
+			}
+		}
+	}
+}
+
+func TestPreferCompressedIn(t *testing.T) {
+	testFS := fstest.MapFS{
+		"cdn/x.txt":        &fstest.MapFile{Data: []byte("stale plain copy")},
+		"cdn/x.txt.gz":     &fstest.MapFile{Data: createGzipData(t, "canonical compressed")},
+		"cdn/plain.txt":    &fstest.MapFile{Data: []byte("only plain")},
+		"cdn/sub/y.txt":    &fstest.MapFile{Data: []byte("plain in subdirectory")},
+		"cdn/sub/y.txt.gz": &fstest.MapFile{Data: createGzipData(t, "compressed in subdirectory")},
+		"x.txt":            &fstest.MapFile{Data: []byte("plain outside cdn")},
+		"x.txt.gz":         &fstest.MapFile{Data: createGzipData(t, "compressed outside cdn")},
+	}
+	want := map[string]string{
+		"cdn/x.txt":     "canonical compressed",
+		"cdn/plain.txt": "only plain",
+		"cdn/sub/y.txt": "plain in subdirectory",
+		"x.txt":         "plain outside cdn",
+	}
+	for _, opts := range [][]fsdecomp.Option{nil, {fsdecomp.WithSnapshotIndex(false)}} {
+		dfs := fsdecomp.New(testFS, append(opts, fsdecomp.WithPreferCompressedIn("cdn"))...)
+		for name, content := range want {
+			if data, err := fs.ReadFile(dfs, name); err != nil || string(data) != content {
+				t.Errorf("Expected %s to contain %q, got %q, %v", name, content, data, err)
+			}
+		}
+
+		// The listing describes the compressed file, which is a different
+		// size from the plain one
+		entries, err := dfs.ReadDir("cdn")
+		if err != nil {
+			t.Fatalf("Unexpected error reading cdn: %v", err)
+		}
+		for _, entry := range entries {
+			if entry.Name() != "x.txt" {
+				continue
+			}
+			info, err := entry.Info()
+			if err != nil {
+				t.Fatalf("Unexpected error from Info: %v", err)
+			}
+			if info.Size() != int64(len(testFS["cdn/x.txt.gz"].Data)) {
+				t.Errorf("Expected x.txt to be listed from x.txt.gz, got size %d", info.Size())
+			}
+		}
+	}
+
+	if got := fsdecomp.New(testFS, fsdecomp.WithPreferCompressedIn("cdn", "cdn/*")).Config().PreferCompressedIn; !slices.Equal(got, []string{"cdn", "cdn/*"}) {
+		t.Errorf("Expected patterns in Config, got %q", got)
+	}
+	data, err := fs.ReadFile(fsdecomp.New(testFS, fsdecomp.WithPreferCompressedIn("cdn/*")), "cdn/sub/y.txt")
+	if err != nil || string(data) != "compressed in subdirectory" {
+		t.Errorf("Expected cdn/* to match cdn/sub, got %q, %v", data, err)
+	}
+}
+
+func TestNameMapper(t *testing.T) {
+	testFS := fstest.MapFS{
+		"logs/data.json.gz":   &fstest.MapFile{Data: createGzipData(t, "{\"a\":1}\n{\"a\":2}\n")},
+		"logs/notes.txt.gz":   &fstest.MapFile{Data: createGzipData(t, "notes")},
+		"logs/plain.json":     &fstest.MapFile{Data: []byte("{}")},
+		"config/data.json.gz": &fstest.MapFile{Data: createGzipData(t, "{\"a\":1}")},
+	}
+	mapper := func(dir, name string) string {
+		if dir == "logs" {
+			if stem, ok := strings.CutSuffix(name, ".json"); ok {
+				return stem + ".ndjson"
+			}
+		}
+		return name
+	}
+
+	for _, opts := range [][]fsdecomp.Option{nil, {fsdecomp.WithSnapshotIndex(false)}} {
+		dfs := fsdecomp.New(testFS, append(opts, fsdecomp.WithNameMapper(mapper))...)
+
+		for dir, want := range map[string][]string{
+			"logs":   {"data.ndjson", "notes.txt", "plain.json"},
+			"config": {"data.json"},
+		} {
+			entries, err := dfs.ReadDir(dir)
+			if err != nil {
+				t.Fatalf("Unexpected error reading %s: %v", dir, err)
+			}
+			var names []string
+			for _, entry := range entries {
+				names = append(names, entry.Name())
+				info, err := entry.Info()
+				if err != nil || info.Name() != entry.Name() {
+					t.Errorf("Expected Info of %s to have the same name, got %v, %v", entry.Name(), info, err)
+				}
+			}
+			if !slices.Equal(names, want) {
+				t.Errorf("Expected %s to list %q, got %q", dir, want, names)
+			}
+		}
+
+		info, err := fs.Stat(dfs, "logs/data.ndjson")
+		if err != nil {
+			t.Fatalf("Unexpected error from Stat of mapped name: %v", err)
+		}
+		if info.Name() != "data.ndjson" {
+			t.Errorf("Expected Stat to report data.ndjson, got %s", info.Name())
+		}
+		if data, err := fs.ReadFile(dfs, "logs/data.ndjson"); err != nil || string(data) != "{\"a\":1}\n{\"a\":2}\n" {
+			t.Errorf("Expected decompressed contents from mapped name, got %q, %v", data, err)
+		}
+		if _, err := fs.Stat(dfs, "config/data.ndjson"); !errors.Is(err, fs.ErrNotExist) {
+			t.Errorf("Expected mapping to only apply in logs, got %v", err)
+		}
+		if _, err := fs.Stat(dfs, "logs/plain.ndjson"); !errors.Is(err, fs.ErrNotExist) {
+			t.Errorf("Expected mapping to only apply to compressed files, got %v", err)
+		}
+	}
+}
+
+func TestResolutionInfo(t *testing.T) {
+	testFS := fstest.MapFS{
+		"plain.txt":          &fstest.MapFile{Data: []byte("plain")},
+		"a.txt.gz":           &fstest.MapFile{Data: createGzipData(t, "gzip")},
+		"b.txt.bz2":          &fstest.MapFile{Data: createBzip2Data(t, "bzip2")},
+		"c.txt.bz2.gz":       &fstest.MapFile{Data: createGzipData(t, string(createBzip2Data(t, "chained")))},
+		"cdn/d.txt":          &fstest.MapFile{Data: []byte("plain copy")},
+		"cdn/d.txt.gz":       &fstest.MapFile{Data: createGzipData(t, "preferred")},
+		"logs/e.json.gz":     &fstest.MapFile{Data: createGzipData(t, "{}")},
+		"site/index.html.gz": &fstest.MapFile{Data: createGzipData(t, "<h1>index</h1>")},
+	}
+	opts := []fsdecomp.Option{
+		fsdecomp.WithChainedDecompression(2),
+		fsdecomp.WithPreferCompressedIn("cdn"),
+		fsdecomp.WithDirectoryIndex("index.html"),
+		fsdecomp.WithNameMapper(func(dir, name string) string {
+			if dir == "logs" {
+				return strings.TrimSuffix(name, ".json") + ".ndjson"
+			}
+			return name
+		}),
+	}
+
+	for _, test := range []struct {
+		name     string
+		physical string
+		formats  []string
+		misses   int // -1 to skip the check
+	}{
+		{"a.txt", "a.txt.gz", []string{".gz"}, 1},
+		{"b.txt", "b.txt.bz2", []string{".bz2"}, -1},
+		{"c.txt", "c.txt.bz2.gz", []string{".gz", ".bz2"}, -1},
+		{"cdn/d.txt", "cdn/d.txt.gz", []string{".gz"}, 0},
+		{"logs/e.ndjson", "logs/e.json.gz", []string{".gz"}, -1},
+		{"site", "site/index.html.gz", []string{".gz"}, 1},
+	} {
+		for _, indexed := range []bool{false, true} {
+			options := opts
+			if indexed {
+				options = append(slices.Clone(opts), fsdecomp.WithSnapshotIndex(false))
+			}
+			file, err := fsdecomp.New(testFS, options...).Open(test.name)
+			if err != nil {
+				t.Errorf("Unexpected error opening %s: %v", test.name, err)
+				continue
+			}
+			r, ok := file.(interface{ ResolutionInfo() fsdecomp.Resolution })
+			if !ok {
+				t.Errorf("Expected %s to have ResolutionInfo", test.name)
+				file.Close()
+				continue
+			}
+			got := r.ResolutionInfo()
+			if got.Name != test.name || got.Physical != test.physical || !slices.Equal(got.Formats, test.formats) || got.Cached != indexed {
+				t.Errorf("Expected %s to resolve to %s with %q, cached %v, got %+v", test.name, test.physical, test.formats, indexed, got)
+			}
+			switch {
+			case indexed && got.FailedProbes != 0:
+				t.Errorf("Expected no failed probes for %s from the index, got %d", test.name, got.FailedProbes)
+			case !indexed && test.misses >= 0 && got.FailedProbes != test.misses:
+				t.Errorf("Expected %d failed probes for %s, got %d", test.misses, test.name, got.FailedProbes)
+			case !indexed && test.misses < 0 && got.FailedProbes == 0:
+				t.Errorf("Expected failed probes for %s", test.name)
+			}
+			file.Close()
+		}
+	}
+
+	file, err := fsdecomp.New(testFS, opts...).Open("plain.txt")
+	if err != nil {
+		t.Fatalf("Unexpected error opening plain file: %v", err)
+	}
+	defer file.Close()
+	if _, ok := file.(interface{ ResolutionInfo() fsdecomp.Resolution }); ok {
+		t.Errorf("Expected plain files to be returned without a wrapper")
+	}
+}
+
+// TestResolutionInfoWrappers ensures files Open wraps, whether it
+// decompresses them or not, describe how they were found
+func TestResolutionInfoWrappers(t *testing.T) {
+	compressed := createZstdData(t, strings.Repeat("split in two ", 100))
+	tfs := targetNameFS{
+		MapFS: fstest.MapFS{
+			"data/plain-v2.txt": &fstest.MapFile{Data: []byte("plain")},
+			"data/sub/file.txt": &fstest.MapFile{Data: []byte("in sub")},
+			"log.txt.zst.000":   &fstest.MapFile{Data: compressed[:len(compressed)/2]},
+			"log.txt.zst.001":   &fstest.MapFile{Data: compressed[len(compressed)/2:]},
+		},
+		links: map[string]string{"plain.txt": "data/plain-v2.txt", "subdir": "data/sub"},
+	}
+	for _, test := range []struct {
+		opts     []fsdecomp.Option
+		name     string
+		physical string
+		formats  []string
+		misses   int
+	}{
+		{[]fsdecomp.Option{fsdecomp.WithNormalizedNames()}, "plain.txt", "plain.txt", nil, 0}, // Renamed
+		{[]fsdecomp.Option{fsdecomp.WithNormalizedNames()}, "subdir", "subdir", nil, 0},       // Renamed directory
+		{[]fsdecomp.Option{fsdecomp.WithCompatLevel(2)}, "data", "data", nil, 0},              // Listing logical entries
+		{[]fsdecomp.Option{fsdecomp.WithCompatLevel(2), fsdecomp.WithNormalizedNames()}, "subdir", "subdir", nil, 0},
+		{[]fsdecomp.Option{fsdecomp.WithSplitParts()}, "log.txt", "log.txt.zst", []string{".zst"}, -1},
+		{[]fsdecomp.Option{fsdecomp.WithSplitParts(), fsdecomp.WithSnapshotIndex(false)}, "log.txt", "log.txt.zst", []string{".zst"}, 0},
+	} {
+		file, err := fsdecomp.New(tfs, test.opts...).Open(test.name)
+		if err != nil {
+			t.Fatalf("Unexpected error opening %s: %v", test.name, err)
+		}
+		r, ok := file.(interface{ ResolutionInfo() fsdecomp.Resolution })
+		if !ok {
+			t.Errorf("Expected %s (%T) to have ResolutionInfo", test.name, file)
+		} else if got := r.ResolutionInfo(); got.Name != test.name || got.Physical != test.physical || !slices.Equal(got.Formats, test.formats) ||
+			test.misses >= 0 && got.FailedProbes != test.misses {
+			t.Errorf("Expected %s to resolve to %s with %q and %d failed probes, got %+v", test.name, test.physical, test.formats, test.misses, got)
+		}
+		file.Close()
+	}
+}
+
+// noReadDirFS hides the ReadDir method of the filesystem it wraps, so that
+// directories are listed through their files
+type noReadDirFS struct {
+	fs.FS
+}
+
+func TestListingLimit(t *testing.T) {
+	testFS := fstest.MapFS{
+		"big/target.txt.gz":     &fstest.MapFile{Data: createGzipData(t, "found")},
+		"big/renamed.gz":        &fstest.MapFile{Data: createGzipData(t, "renamed")},
+		"big/renamed.gz.meta":   &fstest.MapFile{Data: []byte(`{"name": "pretty.txt"}`)},
+		"small/renamed.gz":      &fstest.MapFile{Data: createGzipData(t, "renamed")},
+		"small/renamed.gz.meta": &fstest.MapFile{Data: []byte(`{"name": "pretty.txt"}`)},
+		"small/target.txt.gz":   &fstest.MapFile{Data: createGzipData(t, "found")},
+	}
+	for i := range 10 {
+		testFS[fmt.Sprintf("big/filler%02d.txt", i)] = &fstest.MapFile{Data: []byte("filler")}
+	}
+
+	rfs := &recordingFS{fsys: testFS}
+	dfs := fsdecomp.New(rfs,
+		fsdecomp.WithListingLimit(5),
+		fsdecomp.WithProbeStrategy(fsdecomp.ProbeByReadDir),
+		fsdecomp.WithMetadataSidecars(".meta", 1024),
+	)
+	if got := dfs.Config().ListingLimit; got != 5 {
+		t.Errorf("Expected listing limit 5 in Config, got %d", got)
+	}
+
+	// Probing a large directory falls back to opening candidates, and the
+	// directory isn't listed again
+	for range 2 {
+		if data, err := fs.ReadFile(dfs, "big/target.txt"); err != nil || string(data) != "found" {
+			t.Errorf("Expected big/target.txt to contain %q, got %q, %v", "found", data, err)
+		}
+	}
+	// It is read through its file, only as far as the limit, never with
+	// ReadDir, which would read it in full
+	if n := slices.Index(rfs.ops, "open big"); n < 0 || slices.Contains(rfs.ops[n+1:], "open big") ||
+		slices.Contains(rfs.ops, "readdir big") {
+		t.Errorf("Expected big to be listed once, got operations %q", rfs.ops)
+	}
+	if !slices.Contains(rfs.ops, "open big/target.txt.gz") {
+		t.Errorf("Expected the candidate to be opened directly, got operations %q", rfs.ops)
+	}
+
+	// Names from sidecars can't be found in large directories, but can in
+	// small ones, and large directories are still listed in full
+	if _, err := dfs.Open("big/pretty.txt"); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("Expected sidecar names not to be found in a large directory, got %v", err)
+	}
+	if data, err := fs.ReadFile(dfs, "small/pretty.txt"); err != nil || string(data) != "renamed" {
+		t.Errorf("Expected small/pretty.txt to contain %q, got %q, %v", "renamed", data, err)
+	}
+	if entries, err := dfs.ReadDir("big"); err != nil || len(entries) != 12 {
+		t.Errorf("Expected big to list 12 entries, got %d, %v", len(entries), err)
+	}
+
+	// No more than one entry beyond the limit is read, one at a time here
+	cfs := &countingDirFS{MapFS: testFS}
+	dfs = fsdecomp.New(cfs, fsdecomp.WithListingLimit(5), fsdecomp.WithProbeStrategy(fsdecomp.ProbeByReadDir))
+	if data, err := fs.ReadFile(dfs, "big/target.txt"); err != nil || string(data) != "found" {
+		t.Errorf("Expected big/target.txt to contain %q, got %q, %v", "found", data, err)
+	}
+	if cfs.entries != 6 {
+		t.Errorf("Expected 6 entries of big to be read, got %d", cfs.entries)
+	}
+
+	// Without a ReadDir method, directories are listed through their files
+	for _, test := range []struct {
+		limit int
+		found bool
+	}{{5, false}, {-1, true}, {13, true}} {
+		dfs := fsdecomp.New(noReadDirFS{testFS}, fsdecomp.WithListingLimit(test.limit), fsdecomp.WithMetadataSidecars(".meta", 1024))
+		_, err := fs.Stat(dfs, "big/pretty.txt")
+		if found := err == nil; found != test.found {
+			t.Errorf("Expected big/pretty.txt to be found %v with a limit of %d, got %v", test.found, test.limit, err)
+		}
+	}
+}
+
+// countingDirFS counts the directory entries read through its directories'
+// files, which return at most one entry per call
+type countingDirFS struct {
+	fstest.MapFS
+	entries int
+}
+
+func (cfs *countingDirFS) Open(name string) (fs.File, error) {
+	file, err := cfs.MapFS.Open(name)
+	if dir, ok := file.(fs.ReadDirFile); ok {
+		return &countingDir{ReadDirFile: dir, fsys: cfs}, nil
+	}
+	return file, err
+}
+
+type countingDir struct {
+	fs.ReadDirFile
+	fsys *countingDirFS
+}
+
+func (cd *countingDir) ReadDir(n int) ([]fs.DirEntry, error) {
+	entries, err := cd.ReadDirFile.ReadDir(min(n, 1))
+	cd.fsys.entries += len(entries)
+	return entries, err
+}
+
+// hugeDirFS answers Open for files by lookup alone, unlike fstest.MapFS,
+// which searches every name for a directory when a name is missing, so that
+// probing a huge directory costs no more than probing a small one
+type hugeDirFS struct {
+	fstest.MapFS
+}
+
+func (hfs hugeDirFS) Open(name string) (fs.File, error) {
+	if _, ok := hfs.MapFS[name]; !ok && path.Ext(name) != "" {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+	}
+	return hfs.MapFS.Open(name)
+}
+
+// BenchmarkHugeDirectory resolves a name in a directory of a million
+// entries with ProbeByReadDir, which lists the whole directory for every
+// Open without a listing limit
+func BenchmarkHugeDirectory(b *testing.B) {
+	testFS := fstest.MapFS{"huge/target.txt.gz": &fstest.MapFile{Data: createGzipData(b, "found")}}
+	for i := range 1_000_000 {
+		testFS[fmt.Sprintf("huge/file%07d.dat", i)] = &fstest.MapFile{}
+	}
+	for _, limit := range []int{0, -1} {
+		b.Run(fmt.Sprintf("limit=%d", limit), func(b *testing.B) {
+			dfs := fsdecomp.New(hugeDirFS{testFS}, fsdecomp.WithListingLimit(limit), fsdecomp.WithProbeStrategy(fsdecomp.ProbeByReadDir))
+			for i := 0; i < b.N; i++ {
+				file, err := dfs.Open("huge/target.txt")
+				if err != nil {
+					b.Fatalf("Unexpected error opening target: %v", err)
+				}
+				file.Close()
+			}
+		})
+	}
+}
+
+// eofDirFS reports its empty directory with io.EOF, in one of the ways
+// backends have been seen to
+type eofDirFS struct {
+	fstest.MapFS
+	fromOpen bool // Open fails with io.EOF, rather than ReadDir
+}
+
+type eofDirFile struct {
+	fs.File
+}
+
+func (ef eofDirFile) ReadDir(n int) ([]fs.DirEntry, error) {
+	return nil, io.EOF
+}
+
+func (efs eofDirFS) Open(name string) (fs.File, error) {
+	if name != "empty" {
+		return efs.MapFS.Open(name)
+	}
+	if efs.fromOpen {
+		return nil, io.EOF
+	}
+	file, err := efs.MapFS.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	return eofDirFile{file}, nil
+}
+
+// eofReadDirFS has a ReadDir method reporting its empty directory with io.EOF
+type eofReadDirFS struct {
+	eofDirFS
+}
+
+func (efs eofReadDirFS) ReadDir(name string) ([]fs.DirEntry, error) {
+	if name == "empty" {
+		return nil, io.EOF
+	}
+	return efs.MapFS.ReadDir(name)
+}
+
+func TestEmptyDirEOF(t *testing.T) {
+	testFS := fstest.MapFS{
+		"empty":       &fstest.MapFile{Mode: fs.ModeDir | 0755},
+		"file.txt.gz": &fstest.MapFile{Data: createGzipData(t, "content")},
+	}
+	for desc, fsys := range map[string]fs.FS{
+		"ReadDir of file":     eofDirFS{MapFS: testFS},
+		"Open":                eofDirFS{MapFS: testFS, fromOpen: true},
+		"ReadDir of FS":       eofReadDirFS{eofDirFS{MapFS: testFS}},
+		"ReadDir of FS, Open": eofReadDirFS{eofDirFS{MapFS: testFS, fromOpen: true}},
+	} {
+		for _, opts := range [][]fsdecomp.Option{nil, {fsdecomp.WithSnapshotIndex(false)}, {fsdecomp.WithProbeStrategy(fsdecomp.ProbeByReadDir)}} {
+			dfs := fsdecomp.New(fsys, opts...)
+			entries, err := dfs.ReadDir("empty")
+			if err != nil || entries == nil || len(entries) != 0 {
+				t.Errorf("%s: expected an empty listing, got %v, %v", desc, entries, err)
+			}
+			if _, err := dfs.Open("empty/missing.txt"); !errors.Is(err, fs.ErrNotExist) {
+				t.Errorf("%s: expected ErrNotExist opening a file in the empty directory, got %v", desc, err)
+			}
+		}
+	}
+}
+
+func TestWalkFilter(t *testing.T) {
+	testFS := fstest.MapFS{
+		"app/main.js.gz":                     &fstest.MapFile{Data: createGzipData(t, "main")},
+		"app/lib/util.js":                    &fstest.MapFile{Data: []byte("util")},
+		"app/node_modules/dep/index.js.gz":   &fstest.MapFile{Data: createGzipData(t, "dependency")},
+		"app/lib/node_modules/nested.js.bz2": &fstest.MapFile{Data: []byte("not bzip2, so verifying it fails")},
+		"app/skip.tmp":                       &fstest.MapFile{Data: []byte("temporary")},
+	}
+	var filtered []string
+	var mu sync.Mutex
+	dfs := fsdecomp.New(testFS, fsdecomp.WithWalkFilter(func(name string, d fs.DirEntry) bool {
+		if d.Name() == "node_modules" || path.Ext(name) == ".tmp" {
+			mu.Lock()
+			filtered = append(filtered, name)
+			mu.Unlock()
+			return false
+		}
+		return true
+	}))
+	want := []string{"lib/util.js", "main.js"}
+
+	// Extracting to a snapshot or an archive leaves out the filtered entries
+	snapshot, err := dfs.Freeze("app")
+	if err != nil {
+		t.Fatalf("Unexpected error freezing app: %v", err)
+	}
+	var frozen []string
+	fs.WalkDir(snapshot, ".", func(name string, d fs.DirEntry, err error) error {
+		if err == nil && !d.IsDir() {
+			frozen = append(frozen, name)
+		}
+		return err
+	})
+	if !slices.Equal(frozen, want) {
+		t.Errorf("Expected snapshot of %q, got %q", want, frozen)
+	}
+
+	var buf bytes.Buffer
+	if err := dfs.TarGz("app", &buf); err != nil {
+		t.Fatalf("Unexpected error archiving app: %v", err)
+	}
+	gzr, err := gzip.NewReader(&buf)
+	if err != nil {
+		t.Fatalf("Unexpected error reading archive: %v", err)
+	}
+	var archived []string
+	tr := tar.NewReader(gzr)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("Unexpected error reading archive: %v", err)
+		}
+		if header.Typeflag == tar.TypeReg {
+			archived = append(archived, header.Name)
+		}
+	}
+	slices.Sort(archived)
+	if !slices.Equal(archived, want) {
+		t.Errorf("Expected archive of %q, got %q", want, archived)
+	}
+
+	if errs := dfs.VerifyAll("app"); len(errs) > 0 {
+		t.Errorf("Expected the corrupt file to be skipped by VerifyAll, got %v", errs)
+	}
+
+	var walked []string
+	err = fsdecomp.WalkParallel(context.Background(), dfs, "app", 4, func(name string, d fs.DirEntry) error {
+		mu.Lock()
+		defer mu.Unlock()
+		if !d.IsDir() {
+			walked = append(walked, name)
+		}
+		return nil
+	})
+	slices.Sort(walked)
+	if err != nil || !slices.Equal(walked, []string{"app/lib/util.js", "app/main.js"}) {
+		t.Errorf("Expected WalkParallel to visit %q, got %q, %v", want, walked, err)
+	}
+
+	// Excluded directories are never descended into
+	for _, name := range filtered {
+		if strings.Contains(name, "node_modules/") {
+			t.Errorf("Expected the walk not to descend into node_modules, but filter saw %s", name)
+		}
+	}
+}
+
+// TestEnforcementConformance checks that every way of reading a file
+// enforces the options that reject it, so that no read path bypasses them
+func TestEnforcementConformance(t *testing.T) {
+	content := `"` + strings.Repeat("a", 200) + `"`
+	corrupt := createGzipData(t, content)
+	corrupt[len(corrupt)-8] ^= 0xff // CRC-32 in the gzip trailer
+
+	violations := map[string]struct {
+		data []byte
+		opts []fsdecomp.Option
+		want func(error) bool
+	}{
+		"max size": {createGzipData(t, content), []fsdecomp.Option{fsdecomp.WithMaxDecompressedSize(100)},
+			func(err error) bool { return errors.Is(err, fsdecomp.ErrTooLarge) }},
+		"checksum": {corrupt, nil,
+			func(err error) bool { return errors.Is(err, gzip.ErrChecksum) }},
+		"magic": {[]byte(content), []fsdecomp.Option{fsdecomp.WithMagicValidation()},
+			func(err error) bool { return errors.Is(err, fsdecomp.ErrMagicMismatch) }},
+	}
+	paths := map[string]func(dfs *fsdecomp.DecompressFS) error{
+		"Read": func(dfs *fsdecomp.DecompressFS) error {
+			file, err := dfs.Open("dir/file.json")
+			if err != nil {
+				return err
+			}
+			defer file.Close()
+			_, err = io.CopyBuffer(io.Discard, struct{ io.Reader }{file}, make([]byte, 16))
+			return err
+		},
+		"WriteTo": func(dfs *fsdecomp.DecompressFS) error {
+			file, err := dfs.Open("dir/file.json")
+			if err != nil {
+				return err
+			}
+			defer file.Close()
+			_, err = file.(io.WriterTo).WriteTo(io.Discard)
+			return err
+		},
+		"ReadFile": func(dfs *fsdecomp.DecompressFS) error {
+			_, err := fs.ReadFile(dfs, "dir/file.json")
+			return err
+		},
+		"ReadString": func(dfs *fsdecomp.DecompressFS) error {
+			_, err := dfs.ReadString("dir/file.json", 1<<20)
+			return err
+		},
+		"ScanLines": func(dfs *fsdecomp.DecompressFS) error {
+			return dfs.ScanLines("dir/file.json", func([]byte) error { return nil })
+		},
+		"Unmarshal": func(dfs *fsdecomp.DecompressFS) error {
+			var v any
+			return dfs.Unmarshal("dir/file.json", &v)
+		},
+		"SRIHash": func(dfs *fsdecomp.DecompressFS) error {
+			_, err := fsdecomp.SRIHash(dfs, "dir/file.json", "sha256")
+			return err
+		},
+		"SRIHash repeated": func(dfs *fsdecomp.DecompressFS) error {
+			fsdecomp.SRIHash(dfs, "dir/file.json", "sha256")
+			_, err := fsdecomp.SRIHash(dfs, "dir/file.json", "sha256")
+			return err
+		},
+		"TarGz": func(dfs *fsdecomp.DecompressFS) error {
+			return dfs.TarGz("dir", io.Discard)
+		},
+		"Freeze": func(dfs *fsdecomp.DecompressFS) error {
+			_, err := dfs.Freeze("dir")
+			return err
+		},
+		"VerifyAll": func(dfs *fsdecomp.DecompressFS) error {
+			return errors.Join(dfs.VerifyAll("dir")...)
+		},
+	}
+
+	for violation, v := range violations {
+		testFS := fstest.MapFS{"dir/file.json.gz": &fstest.MapFile{Data: v.data}}
+		for _, indexed := range []bool{false, true} {
+			opts := v.opts
+			if indexed {
+				opts = append(slices.Clone(opts), fsdecomp.WithSnapshotIndex(false))
+			}
+			for pathName, read := range paths {
+				if err := read(fsdecomp.New(testFS, opts...)); !v.want(err) {
+					t.Errorf("%s through %s (indexed %v): expected the violation to be reported, got %v", violation, pathName, indexed, err)
+				}
+			}
+		}
+	}
+}
+
+func TestCompatLevel(t *testing.T) {
+	testFS := duplicatingFS{fstest.MapFS{
+		"a.txt.gz": &fstest.MapFile{Data: createGzipData(t, "listed after a.txt-b")},
+		"a.txt-b":  &fstest.MapFile{Data: []byte("listed before a.txt.gz")},
+		"b.txt":    &fstest.MapFile{Data: []byte("plain")},
+		"b.txt.gz": &fstest.MapFile{Data: createGzipData(t, "compressed")},
+	}}
+	for _, test := range []struct {
+		opts []fsdecomp.Option
+		want []string
+	}{
+		// In the order the underlying filesystem lists them
+		{[]fsdecomp.Option{fsdecomp.WithCompatLevel(0)}, []string{
+			"b.txt", "b.txt", "a.txt", "a.txt-b", "b.txt", "b.txt", "a.txt", "a.txt-b",
+		}},
+		{[]fsdecomp.Option{fsdecomp.WithCompatLevel(-1)}, []string{
+			"b.txt", "b.txt", "a.txt", "a.txt-b", "b.txt", "b.txt", "a.txt", "a.txt-b",
+		}},
+		{[]fsdecomp.Option{fsdecomp.WithCompatLevel(1)}, []string{"a.txt", "a.txt-b", "b.txt"}},
+		{[]fsdecomp.Option{fsdecomp.WithCompatLevel(fsdecomp.LatestCompatLevel + 1)}, []string{"a.txt", "a.txt-b", "b.txt"}},
+		{nil, []string{"a.txt", "a.txt-b", "b.txt"}},
+		// The snapshot index lists each name once at every level
+		{[]fsdecomp.Option{fsdecomp.WithCompatLevel(0), fsdecomp.WithSnapshotIndex(false)}, []string{"a.txt", "a.txt-b", "b.txt"}},
+	} {
+		dfs := fsdecomp.New(testFS, test.opts...)
+		entries, err := dfs.ReadDir(".")
+		if err != nil {
+			t.Fatalf("Unexpected error reading directory at level %d: %v", dfs.Config().CompatLevel, err)
+		}
+		var names []string
+		for _, entry := range entries {
+			names = append(names, entry.Name())
+		}
+		if !slices.Equal(names, test.want) {
+			t.Errorf("Expected %q at level %d, got %q", test.want, dfs.Config().CompatLevel, names)
+		}
+
+		// Open resolves names the same way at every level
+		if data, err := fs.ReadFile(dfs, "b.txt"); err != nil || string(data) != "plain" {
+			t.Errorf("Expected b.txt to be the plain file at level %d, got %q, %v", dfs.Config().CompatLevel, data, err)
+		}
+	}
+}
+
+// TestCompatLevelDirs ensures directories opened, and the sizes of listed
+// compressed files, only change from compatibility level 2
+func TestCompatLevelDirs(t *testing.T) {
+	content := "decompressed content, longer than the compressed file ......................"
+	compressed := createGzipData(t, content)
+	testFS := fstest.MapFS{
+		"dir/a.txt.gz": &fstest.MapFile{Data: compressed},
+		"dir/b.txt":    &fstest.MapFile{Data: []byte("plain")},
+	}
+	for _, test := range []struct {
+		opts  []fsdecomp.Option
+		names []string // Listed by the directory opened
+		size  int      // Of a.txt, as listed by ReadDir
+	}{
+		{[]fsdecomp.Option{fsdecomp.WithCompatLevel(0)}, []string{"a.txt.gz", "b.txt"}, len(compressed)},
+		{nil, []string{"a.txt.gz", "b.txt"}, len(compressed)},
+		{[]fsdecomp.Option{fsdecomp.WithCompatLevel(2)}, []string{"a.txt", "b.txt"}, len(content)},
+	} {
+		dfs := fsdecomp.New(testFS, append(test.opts, fsdecomp.WithSingleMemberSizes())...)
+		level := dfs.Config().CompatLevel
+
+		dir, err := dfs.Open("dir")
+		if err != nil {
+			t.Fatalf("Unexpected error opening dir at level %d: %v", level, err)
+		}
+		entries, err := dir.(fs.ReadDirFile).ReadDir(-1)
+		dir.Close()
+		if err != nil {
+			t.Fatalf("Unexpected error listing dir at level %d: %v", level, err)
+		}
+		var names []string
+		for _, entry := range entries {
+			names = append(names, entry.Name())
+		}
+		if !slices.Equal(names, test.names) {
+			t.Errorf("Expected the opened dir to list %q at level %d, got %q", test.names, level, names)
+		}
+
+		entries, err = dfs.ReadDir("dir")
+		if err != nil || len(entries) != 2 || entries[0].Name() != "a.txt" {
+			t.Fatalf("Expected a.txt to be listed first at level %d, got %v, %v", level, entries, err)
+		}
+		if info, err := entries[0].Info(); err != nil || info.Size() != int64(test.size) {
+			t.Errorf("Expected a.txt to be listed with size %d at level %d, got %v, %v", test.size, level, info, err)
+		}
+	}
+}
+
+// createBGZFData returns content as bgzip writes it: one gzip member per
+// block, each with a BC extra field giving its size, then the empty member
+// marking the end of the file
+func createBGZFData(t *testing.T, blocks ...string) []byte {
+	var out bytes.Buffer
+	for _, block := range blocks {
+		var buf bytes.Buffer
+		gzw := gzip.NewWriter(&buf)
+		gzw.Header.Extra = []byte{'B', 'C', 2, 0, 0, 0}
+		if _, err := gzw.Write([]byte(block)); err != nil {
+			t.Fatalf("Failed to write BGZF block: %v", err)
+		}
+		if err := gzw.Close(); err != nil {
+			t.Fatalf("Failed to close BGZF block: %v", err)
+		}
+		member := buf.Bytes()
+		// BSIZE, the member size less one, follows the 12 byte header and
+		// the 4 byte subfield header
+		binary.LittleEndian.PutUint16(member[16:], uint16(len(member)-1))
+		out.Write(member)
+	}
+	out.Write([]byte{
+		0x1f, 0x8b, 0x08, 0x04, 0x00, 0x00, 0x00, 0x00, 0x00, 0xff, 0x06, 0x00, 0x42, 0x43,
+		0x02, 0x00, 0x1b, 0x00, 0x03, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00,
+	})
+	return out.Bytes()
+}
+
+// TestBGZF ensures .bgz files decode every block, not just the first, and
+// are listed under their logical names
+func TestBGZF(t *testing.T) {
+	blocks := []string{
+		strings.Repeat("chr1\t100\tA\n", 500),
+		strings.Repeat("chr2\t200\tC\n", 500),
+		strings.Repeat("chr3\t300\tG\n", 500),
+	}
+	want := strings.Join(blocks, "")
+	dfs := fsdecomp.New(fstest.MapFS{
+		"data/calls.vcf.bgz": &fstest.MapFile{Data: createBGZFData(t, blocks...)},
+	})
+
+	data, err := fs.ReadFile(dfs, "data/calls.vcf")
+	if err != nil {
+		t.Fatalf("Failed to read BGZF file: %v", err)
+	}
+	if string(data) != want {
+		t.Errorf("Expected %d decompressed bytes, got %d", len(want), len(data))
+	}
+
+	entries, err := dfs.ReadDir("data")
+	if err != nil {
+		t.Fatalf("Failed to read directory: %v", err)
+	}
+	if len(entries) != 1 || entries[0].Name() != "calls.vcf" {
+		t.Errorf("Expected the listing to be calls.vcf, got %v", entries)
+	}
+
+	// The trailer of the final, empty block would give a size of zero
+	info, err := fs.Stat(dfs, "data/calls.vcf")
+	if err != nil {
+		t.Fatalf("Failed to stat BGZF file: %v", err)
+	}
+	if info.Size() == 0 {
+		t.Errorf("Expected a non-zero size for the BGZF file")
+	}
+}
+
+// TestGzipHeaderFields ensures files using the optional gzip header fields
+// decode, that the extra field is exposed, and that malformed headers are
+// reported as such. The files in testdata/gzipheaders are written by
+// generate.go there.
+func TestGzipHeaderFields(t *testing.T) {
+	const content = "firmware image manifest\nversion=3.1.4\n"
+	vendorExtra := []byte{'V', 'X', 4, 0, 0x2a, 0, 0, 0, 'S', 'G', 3, 0, 0xde, 0xad, 0xbe}
+	dfs := fsdecomp.New(os.DirFS("testdata/gzipheaders"))
+
+	for _, test := range []struct {
+		name    string
+		extra   []byte
+		comment string
+	}{
+		{"fextra.txt", vendorExtra, ""},
+		{"fhcrc.txt", nil, ""},
+		{"fcomment.txt", nil, "built by mkimage"},
+		{"all.txt", vendorExtra, "built by mkimage"},
+	} {
+		data, err := fs.ReadFile(dfs, test.name)
+		if err != nil || string(data) != content {
+			t.Errorf("Expected %s to decode, got %q, %v", test.name, data, err)
+		}
+		header, err := dfs.GzipHeader(test.name)
+		if err != nil {
+			t.Errorf("Failed to read the header of %s: %v", test.name, err)
+			continue
+		}
+		if !bytes.Equal(header.Extra, test.extra) || header.Comment != test.comment {
+			t.Errorf("Expected %s to have extra field %x and comment %q, got %x and %q", test.name, test.extra, test.comment, header.Extra, header.Comment)
+		}
+	}
+
+	for _, name := range []string{"badhcrc.txt", "badextra.txt"} {
+		_, err := fs.ReadFile(dfs, name)
+		var de *fsdecomp.DecompressError
+		if !errors.As(err, &de) || !errors.Is(err, fsdecomp.ErrCorruptHeader) {
+			t.Errorf("Expected reading %s to fail with ErrCorruptHeader, got %v", name, err)
+		}
+		if _, err := dfs.GzipHeader(name); !errors.Is(err, fsdecomp.ErrCorruptHeader) {
+			t.Errorf("Expected the header of %s to be reported corrupt, got %v", name, err)
+		}
+	}
+
+	// A corrupt body isn't blamed on the header
+	data := createGzipData(t, content)
+	data[len(data)-12] ^= 0xff
+	_, err := fs.ReadFile(fsdecomp.New(fstest.MapFS{"body.txt.gz": &fstest.MapFile{Data: data}}), "body.txt")
+	if err == nil || errors.Is(err, fsdecomp.ErrCorruptHeader) {
+		t.Errorf("Expected a corrupt body to fail without ErrCorruptHeader, got %v", err)
+	}
+
+	// Data after the last member is taken to be the header of another
+	data = append(createGzipData(t, content), "trailing garbage"...)
+	_, err = fs.ReadFile(fsdecomp.New(fstest.MapFS{"trailing.txt.gz": &fstest.MapFile{Data: data}}), "trailing.txt")
+	if !errors.Is(err, fsdecomp.ErrCorruptHeader) {
+		t.Errorf("Expected trailing garbage to fail with ErrCorruptHeader, got %v", err)
+	}
+
+	if _, err := fsdecomp.New(fstest.MapFS{"plain.txt": &fstest.MapFile{Data: []byte(content)}}).GzipHeader("plain.txt"); err == nil {
+		t.Errorf("Expected an error for the header of an uncompressed file")
+	}
+}
+
+// TestNewBounded ensures a bounded filesystem opens names below its root,
+// and rejects names reaching outside it
+func TestNewBounded(t *testing.T) {
+	testFS := fstest.MapFS{
+		"site/index.html.gz": &fstest.MapFile{Data: createGzipData(t, "<h1>hello</h1>")},
+		"site/css/app.css":   &fstest.MapFile{Data: []byte("body{}")},
+		"secret.txt":         &fstest.MapFile{Data: []byte("password")},
+	}
+	dfs, err := fsdecomp.NewBounded(testFS, "site")
+	if err != nil {
+		t.Fatalf("Failed to create bounded filesystem: %v", err)
+	}
+
+	if data, err := fs.ReadFile(dfs, "index.html"); err != nil || string(data) != "<h1>hello</h1>" {
+		t.Errorf("Expected index.html to decompress, got %q, %v", data, err)
+	}
+	if data, err := fs.ReadFile(dfs, "css/app.css"); err != nil || string(data) != "body{}" {
+		t.Errorf("Expected css/app.css to be read, got %q, %v", data, err)
+	}
+	entries, err := dfs.ReadDir(".")
+	if err != nil || len(entries) != 2 || entries[0].Name() != "css" || entries[1].Name() != "index.html" {
+		t.Errorf("Expected the root to list css and index.html, got %v, %v", entries, err)
+	}
+
+	for _, name := range []string{"../secret.txt", "../escape", "css/../../secret.txt", "/secret.txt"} {
+		if _, err := dfs.Open(name); !errors.Is(err, fs.ErrInvalid) {
+			t.Errorf("Expected opening %q to fail with fs.ErrInvalid, got %v", name, err)
+		}
+	}
+
+	// Errors name files as they were asked for, not by their path in testFS
+	var pathErr *fs.PathError
+	if _, err := dfs.Open("missing.txt"); !errors.As(err, &pathErr) || pathErr.Path != "missing.txt" {
+		t.Errorf("Expected a path error for missing.txt, got %v", err)
+	}
+
+	for _, root := range []string{"..", "../site", "/site", "site/"} {
+		if _, err := fsdecomp.NewBounded(testFS, root); !errors.Is(err, fs.ErrInvalid) {
+			t.Errorf("Expected root %q to be rejected with fs.ErrInvalid, got %v", root, err)
+		}
+	}
+}
+
+// TestDirectorySemantics ensures directories are opened, listed and
+// statted as the underlying filesystem has them, whichever way names are
+// resolved
+func TestDirectorySemantics(t *testing.T) {
+	modTime := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	testFS := fstest.MapFS{
+		"docs":                &fstest.MapFile{Mode: fs.ModeDir | 0o750, ModTime: modTime},
+		"docs/guide.txt.gz":   &fstest.MapFile{Data: createGzipData(t, "guide")},
+		"empty/nested/deeper": &fstest.MapFile{Mode: fs.ModeDir | 0o755},
+		"photos.gz/a.jpg":     &fstest.MapFile{Data: []byte("jpeg")},
+		"assets/app.js":       &fstest.MapFile{Data: []byte("app")},
+		"assets.gz":           &fstest.MapFile{Data: createGzipData(t, "not a directory")},
+	}
+
+	for _, test := range []struct {
+		name string
+		opts []fsdecomp.Option
+	}{
+		{"Default", nil},
+		{"ProbeByOpen", []fsdecomp.Option{fsdecomp.WithProbeStrategy(fsdecomp.ProbeByOpen)}},
+		{"ProbeByReadDir", []fsdecomp.Option{fsdecomp.WithProbeStrategy(fsdecomp.ProbeByReadDir)}},
+		{"SnapshotIndex", []fsdecomp.Option{fsdecomp.WithSnapshotIndex(false)}},
+		{"PreferCompressed", []fsdecomp.Option{fsdecomp.WithPreferCompressedIn(".")}},
+		{"PreferCompressedIndexed", []fsdecomp.Option{fsdecomp.WithPreferCompressedIn("."), fsdecomp.WithSnapshotIndex(false)}},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			dfs := fsdecomp.New(testFS, test.opts...)
+
+			for _, name := range []string{".", "docs", "empty", "empty/nested", "empty/nested/deeper", "photos.gz", "assets"} {
+				want, err := fs.Stat(testFS, name)
+				if err != nil {
+					t.Fatalf("Failed to stat %s in the underlying filesystem: %v", name, err)
+				}
+				info, err := fs.Stat(dfs, name)
+				if err != nil {
+					t.Errorf("Failed to stat directory %s: %v", name, err)
+					continue
+				}
+				if !info.IsDir() || info.Name() != want.Name() || info.Mode() != want.Mode() || !info.ModTime().Equal(want.ModTime()) {
+					t.Errorf("Expected %s to stat as %v %v %v, got %v %v %v", name, want.Name(), want.Mode(), want.ModTime(), info.Name(), info.Mode(), info.ModTime())
+				}
+			}
+
+			entries, err := dfs.ReadDir("empty/nested/deeper")
+			if err != nil || len(entries) != 0 {
+				t.Errorf("Expected an empty listing of empty/nested/deeper, got %v, %v", entries, err)
+			}
+			entries, err = dfs.ReadDir(".")
+			if err != nil {
+				t.Fatalf("Failed to read root directory: %v", err)
+			}
+			var names []string
+			for _, entry := range entries {
+				if !entry.IsDir() {
+					t.Errorf("Expected only directories in the root, got file %s", entry.Name())
+				}
+				names = append(names, entry.Name())
+			}
+			if want := []string{"assets", "docs", "empty", "photos.gz"}; !slices.Equal(names, want) {
+				t.Errorf("Expected root listing %q, got %q", want, names)
+			}
+
+			// A directory with a compression extension isn't probed for
+			for _, name := range []string{"photos", "missing", "missing/dir", "empty/missing"} {
+				var pathErr *fs.PathError
+				if _, err := dfs.Open(name); !errors.As(err, &pathErr) || !errors.Is(err, fs.ErrNotExist) || pathErr.Path != name {
+					t.Errorf("Expected opening %s to fail with fs.ErrNotExist for %s, got %v", name, name, err)
+				}
+			}
+			if data, err := fs.ReadFile(dfs, "docs/guide.txt"); err != nil || string(data) != "guide" {
+				t.Errorf("Expected docs/guide.txt to decompress, got %q, %v", data, err)
+			}
+		})
+	}
+}
+
+// TestOpenWithLimit ensures a per-open limit replaces the filesystem's own
+func TestOpenWithLimit(t *testing.T) {
+	content := strings.Repeat("0123456789", 100)
+	dfs := fsdecomp.New(fstest.MapFS{
+		"large.txt.gz": &fstest.MapFile{Data: createGzipData(t, content)},
+	}, fsdecomp.WithMaxDecompressedSize(100))
+
+	if _, err := fs.ReadFile(dfs, "large.txt"); !errors.Is(err, fsdecomp.ErrTooLarge) {
+		t.Fatalf("Expected the filesystem limit to reject large.txt, got %v", err)
+	}
+	for _, limit := range []int64{int64(len(content)), fsdecomp.NoSizeLimit, 0} {
+		file, err := dfs.OpenWithLimit("large.txt", limit)
+		if err != nil {
+			t.Fatalf("Failed to open large.txt with limit %d: %v", limit, err)
+		}
+		data, err := io.ReadAll(file)
+		file.Close()
+		if err != nil || string(data) != content {
+			t.Errorf("Expected large.txt to be read in full with limit %d, got %d bytes, %v", limit, len(data), err)
+		}
+	}
+
+	// A tighter limit applies too
+	file, err := dfs.OpenWithLimit("large.txt", 10)
+	if err != nil {
+		t.Fatalf("Failed to open large.txt: %v", err)
+	}
+	defer file.Close()
+	if _, err := io.ReadAll(file); !errors.Is(err, fsdecomp.ErrTooLarge) {
+		t.Errorf("Expected a limit of 10 bytes to reject large.txt, got %v", err)
+	}
+
+	// Later opens keep the filesystem's limit
+	if _, err := fs.ReadFile(dfs, "large.txt"); !errors.Is(err, fsdecomp.ErrTooLarge) {
+		t.Errorf("Expected the filesystem limit to still apply, got %v", err)
+	}
+}
+
+// TestBackendOps ensures the calls made to the underlying filesystem are
+// counted exactly, per Open and in total
+func TestBackendOps(t *testing.T) {
+	testFS := fstest.MapFS{
+		"plain.txt":  &fstest.MapFile{Data: []byte("plain")},
+		"a.txt.gz":   &fstest.MapFile{Data: createGzipData(t, "gzip")},
+		"b.txt.bz2":  &fstest.MapFile{Data: createBzip2Data(t, "bzip2")},
+		"logs/c.log": &fstest.MapFile{Data: []byte("log")},
+	}
+	opsOf := func(t *testing.T, dfs *fsdecomp.DecompressFS, name string) fsdecomp.BackendOps {
+		t.Helper()
+		file, err := dfs.Open(name)
+		if err != nil {
+			t.Fatalf("Failed to open %s: %v", name, err)
+		}
+		defer file.Close()
+		r, ok := file.(interface{ ResolutionInfo() fsdecomp.Resolution })
+		if !ok {
+			t.Fatalf("Expected %s to be decompressed", name)
+		}
+		return r.ResolutionInfo().Ops
+	}
+
+	for _, test := range []struct {
+		name  string
+		opts  []fsdecomp.Option
+		open  []string
+		want  []fsdecomp.BackendOps // Calls made by each open
+		total fsdecomp.BackendOps
+	}{
+		// Missing name, then a stat per candidate up to the one found
+		{"ProbeByStat", nil, []string{"a.txt", "b.txt"}, []fsdecomp.BackendOps{
+			{Opens: 2, Stats: 1},
+			{Opens: 2, Stats: 2},
+		}, fsdecomp.BackendOps{Opens: 4, Stats: 3}},
+		{"ProbeByOpen", []fsdecomp.Option{fsdecomp.WithProbeStrategy(fsdecomp.ProbeByOpen)}, []string{"a.txt", "b.txt"}, []fsdecomp.BackendOps{
+			{Opens: 2},
+			{Opens: 3},
+		}, fsdecomp.BackendOps{Opens: 5}},
+		{"ProbeByReadDir", []fsdecomp.Option{fsdecomp.WithProbeStrategy(fsdecomp.ProbeByReadDir)}, []string{"a.txt", "b.txt"}, []fsdecomp.BackendOps{
+			{Opens: 3, ReadDirs: 1},
+			{Opens: 3, ReadDirs: 1},
+		}, fsdecomp.BackendOps{Opens: 6, ReadDirs: 2}},
+		// The first open lists the directory, later ones use the index
+		{"SnapshotIndex", []fsdecomp.Option{fsdecomp.WithSnapshotIndex(false)}, []string{"a.txt", "b.txt", "a.txt"}, []fsdecomp.BackendOps{
+			{Opens: 1, ReadDirs: 1},
+			{Opens: 1},
+			{Opens: 1},
+		}, fsdecomp.BackendOps{Opens: 3, ReadDirs: 1}},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			dfs := fsdecomp.New(testFS, test.opts...)
+			for i, name := range test.open {
+				if got := opsOf(t, dfs, name); got != test.want[i] {
+					t.Errorf("Expected open %d of %s to make %+v, got %+v", i+1, name, test.want[i], got)
+				}
+			}
+			if got := dfs.BackendOps(); got != test.total {
+				t.Errorf("Expected %+v in total, got %+v", test.total, got)
+			}
+		})
+	}
+
+	// Opening plain files and listing directories are counted in the total
+	dfs := fsdecomp.New(testFS)
+	if _, err := fs.ReadFile(dfs, "plain.txt"); err != nil {
+		t.Fatalf("Failed to read plain.txt: %v", err)
+	}
+	if _, err := dfs.ReadDir("logs"); err != nil {
+		t.Fatalf("Failed to list logs: %v", err)
+	}
+	if want := (fsdecomp.BackendOps{Opens: 1, ReadDirs: 1}); dfs.BackendOps() != want {
+		t.Errorf("Expected %+v in total, got %+v", want, dfs.BackendOps())
+	}
+}
+
+// createLargeGzipData returns a gzip stream of size zero bytes, built by
+// repeating one flushed deflate segment, so that streams of several GiB can
+// be made without compressing them
+func createLargeGzipData(t *testing.T, size int64) []byte {
+	const segmentSize = 1 << 20
+	if size%segmentSize != 0 {
+		t.Fatalf("Size must be a multiple of %d", segmentSize)
+	}
+	var buf bytes.Buffer
+	fw, err := flate.NewWriter(&buf, flate.BestCompression)
+	if err != nil {
+		t.Fatalf("Failed to create deflate writer: %v", err)
+	}
+	zeros := make([]byte, segmentSize)
+	fw.Write(zeros)
+	fw.Flush()
+	segment := bytes.Clone(buf.Bytes())
+	buf.Reset()
+	fw.Close()
+	final := buf.Bytes()
+
+	out := []byte{0x1f, 0x8b, 8, 0, 0, 0, 0, 0, 0, 255}
+	var crc uint32
+	for range size / segmentSize {
+		out = append(out, segment...)
+		crc = crc32.Update(crc, crc32.IEEETable, zeros)
+	}
+	out = append(out, final...)
+	out = binary.LittleEndian.AppendUint32(out, crc)
+	return binary.LittleEndian.AppendUint32(out, uint32(size))
+}
+
+// TestGzipSizeWrap ensures gzip files that may be larger than 4GiB don't
+// report the size in their trailer, which holds it modulo 4GiB
+func TestGzipSizeWrap(t *testing.T) {
+	if testing.Short() {
+		t.Skip("Skipping 5GiB decompression in short mode")
+	}
+	const size = 5 << 30
+	dfs := fsdecomp.New(fstest.MapFS{
+		"huge.log.gz": &fstest.MapFile{Data: createLargeGzipData(t, size)},
+	})
+
+	info, err := fs.Stat(dfs, "huge.log")
+	if err != nil {
+		t.Fatalf("Failed to stat huge.log: %v", err)
+	}
+	if info.Size() == size%(1<<32) {
+		t.Errorf("Expected the wrapped trailer size not to be reported, got %d", info.Size())
+	}
+	caps, err := dfs.Capabilities("huge.log")
+	if err != nil || caps.ExactSize {
+		t.Errorf("Expected huge.log not to have an exact size, got %+v, %v", caps, err)
+	}
+
+	// The fixture really is that large
+	file, err := dfs.Open("huge.log")
+	if err != nil {
+		t.Fatalf("Failed to open huge.log: %v", err)
+	}
+	defer file.Close()
+	n, err := io.Copy(io.Discard, file)
+	if err != nil || n != size {
+		t.Errorf("Expected %d bytes, got %d, %v", int64(size), n, err)
+	}
+}
+
+// TestMaxDecompressedRatio ensures a lower ratio lets large gzip files
+// report their size
+func TestMaxDecompressedRatio(t *testing.T) {
+	// Incompressible, and large enough that at deflate's best ratio its
+	// size could have wrapped
+	content := make([]byte, 5<<20)
+	rand.NewChaCha8([32]byte{}).Read(content)
+	testFS := fstest.MapFS{
+		"random.bin.gz": &fstest.MapFile{Data: createGzipData(t, string(content))},
+		"small.txt.gz":  &fstest.MapFile{Data: createGzipData(t, "small")},
+	}
+
+	for _, test := range []struct {
+		opts  []fsdecomp.Option
+		exact bool
+	}{
+		{nil, false},
+		{[]fsdecomp.Option{fsdecomp.WithMaxDecompressedRatio(100)}, true},
+		{[]fsdecomp.Option{fsdecomp.WithMaxDecompressedRatio(2000)}, false},
+	} {
+		dfs := fsdecomp.New(testFS, append(test.opts, fsdecomp.WithSingleMemberSizes())...)
+		caps, err := dfs.Capabilities("random.bin")
+		if err != nil || caps.ExactSize != test.exact {
+			t.Errorf("Expected an exact size %v with %+v, got %+v, %v", test.exact, dfs.Config().MaxDecompressedRatio, caps, err)
+		}
+		info, err := fs.Stat(dfs, "random.bin")
+		if err != nil {
+			t.Fatalf("Failed to stat random.bin: %v", err)
+		}
+		if test.exact && info.Size() != int64(len(content)) {
+			t.Errorf("Expected size %d, got %d", len(content), info.Size())
+		}
+		// Small files can't have wrapped whatever the ratio
+		if info, err := fs.Stat(dfs, "small.txt"); err != nil || info.Size() != 5 {
+			t.Errorf("Expected small.txt to have size 5, got %v", err)
+		}
+	}
+}
+
+// TestOpenOnlyFS ensures a backend implementing nothing but Open works, with
+// directories listed by reading the opened directory
+func TestOpenOnlyFS(t *testing.T) {
+	testFS := noReadDirFS{fstest.MapFS{
+		"a.txt.gz":      &fstest.MapFile{Data: createGzipData(t, "gzip")},
+		"b.txt.bz2":     &fstest.MapFile{Data: createBzip2Data(t, "bzip2")},
+		"dir/c.txt":     &fstest.MapFile{Data: []byte("plain")},
+		"dir/d.json.gz": &fstest.MapFile{Data: createGzipData(t, "{}")},
+		"empty":         &fstest.MapFile{Mode: fs.ModeDir | 0o755},
+	}}
+	files := map[string]string{"a.txt": "gzip", "b.txt": "bzip2", "dir/c.txt": "plain", "dir/d.json": "{}"}
+
+	for _, test := range []struct {
+		name string
+		opts []fsdecomp.Option
+	}{
+		{"Default", nil},
+		{"ProbeByStat", []fsdecomp.Option{fsdecomp.WithProbeStrategy(fsdecomp.ProbeByStat)}},
+		{"ProbeByReadDir", []fsdecomp.Option{fsdecomp.WithProbeStrategy(fsdecomp.ProbeByReadDir)}},
+		{"SnapshotIndex", []fsdecomp.Option{fsdecomp.WithSnapshotIndex(false)}},
+		{"CompatLevel0", []fsdecomp.Option{fsdecomp.WithCompatLevel(0)}},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			dfs := fsdecomp.New(testFS, test.opts...)
+			for name, want := range files {
+				if data, err := fs.ReadFile(dfs, name); err != nil || string(data) != want {
+					t.Errorf("Expected %s to read %q, got %q, %v", name, want, data, err)
+				}
+				if info, err := fs.Stat(dfs, name); err != nil || info.Name() != path.Base(name) {
+					t.Errorf("Expected %s to stat under its own name, got %v", name, err)
+				}
+			}
+
+			var walked []string
+			err := fs.WalkDir(dfs, ".", func(name string, d fs.DirEntry, err error) error {
+				if err != nil {
+					return err
+				}
+				walked = append(walked, name)
+				return nil
+			})
+			if err != nil {
+				t.Fatalf("Failed to walk: %v", err)
+			}
+			if want := []string{".", "a.txt", "b.txt", "dir", "dir/c.txt", "dir/d.json", "empty"}; !slices.Equal(walked, want) {
+				t.Errorf("Expected to walk %q, got %q", want, walked)
+			}
+
+			if _, err := dfs.ReadDir("missing"); !errors.Is(err, fs.ErrNotExist) {
+				t.Errorf("Expected listing a missing directory to fail with fs.ErrNotExist, got %v", err)
+			}
+			if _, err := dfs.Open("dir/missing.txt"); !errors.Is(err, fs.ErrNotExist) {
+				t.Errorf("Expected opening a missing file to fail with fs.ErrNotExist, got %v", err)
+			}
+		})
+	}
+}
+
+// TestChecksumVerification ensures files are checked against checksum
+// sidecars for the compressed or decompressed data
+func TestChecksumVerification(t *testing.T) {
+	content := strings.Repeat("mirrored release notes\n", 100)
+	compressed := createGzipData(t, content)
+	sum := func(data []byte) string {
+		digest := sha256.Sum256(data)
+		return hex.EncodeToString(digest[:])
+	}
+	testFS := fstest.MapFS{
+		// Checksums of the compressed files
+		"good.txt.gz":        &fstest.MapFile{Data: compressed},
+		"good.txt.gz.sha256": &fstest.MapFile{Data: []byte(sum(compressed) + "  good.txt.gz\n")},
+		"bad.txt.gz":         &fstest.MapFile{Data: compressed},
+		"bad.txt.gz.sha256":  &fstest.MapFile{Data: []byte(sum([]byte("other")) + "  bad.txt.gz\n")},
+		// Checksums of the decompressed files
+		"plain.txt.gz":            &fstest.MapFile{Data: compressed},
+		"plain.txt.sha256":        &fstest.MapFile{Data: []byte("SHA256 (plain.txt) = " + sum([]byte(content)) + "\n")},
+		"wrong.txt.gz":            &fstest.MapFile{Data: compressed},
+		"wrong.txt.sha256":        &fstest.MapFile{Data: []byte(sum([]byte(content+"!")) + "\n")},
+		"unchecked.txt.gz":        &fstest.MapFile{Data: compressed},
+		"malformed.txt.gz":        &fstest.MapFile{Data: compressed},
+		"malformed.txt.gz.sha256": &fstest.MapFile{Data: []byte("not a checksum\n")},
+		"malformed.txt.sha256":    &fstest.MapFile{Data: []byte("not a checksum\n")},
+	}
+
+	for _, test := range []struct {
+		side fsdecomp.ChecksumSide
+		name string
+		err  error // Expected from reading the file
+	}{
+		{fsdecomp.ChecksumCompressed, "good.txt", nil},
+		{fsdecomp.ChecksumCompressed, "bad.txt", fsdecomp.ErrChecksumMismatch},
+		{fsdecomp.ChecksumCompressed, "plain.txt", nil},
+		{fsdecomp.ChecksumDecompressed, "plain.txt", nil},
+		{fsdecomp.ChecksumDecompressed, "wrong.txt", fsdecomp.ErrChecksumMismatch},
+		{fsdecomp.ChecksumDecompressed, "good.txt", nil},
+		{fsdecomp.ChecksumDecompressed, "unchecked.txt", nil},
+		{"", "bad.txt", nil},
+	} {
+		dfs := fsdecomp.New(testFS, fsdecomp.WithChecksumVerification(test.side))
+		data, err := fs.ReadFile(dfs, test.name)
+		if !errors.Is(err, test.err) || test.err == nil && err != nil {
+			t.Errorf("Expected reading %s with %q checksums to give %v, got %v", test.name, test.side, test.err, err)
+		}
+		var decompErr *fsdecomp.DecompressError
+		if test.err != nil && !errors.As(err, &decompErr) {
+			t.Errorf("Expected a DecompressError for %s, got %T", test.name, err)
+		}
+		if test.err == nil && string(data) != content {
+			t.Errorf("Expected %s to be read in full", test.name)
+		}
+	}
+
+	// A mismatch isn't reported until the end is reached
+	file, err := fsdecomp.New(testFS, fsdecomp.WithChecksumVerification(fsdecomp.ChecksumCompressed)).Open("bad.txt")
+	if err != nil {
+		t.Fatalf("Failed to open bad.txt: %v", err)
+	}
+	if _, err := file.Read(make([]byte, 10)); err != nil {
+		t.Errorf("Expected the start of bad.txt to be read, got %v", err)
+	}
+	file.Close()
+
+	for _, side := range []fsdecomp.ChecksumSide{fsdecomp.ChecksumCompressed, fsdecomp.ChecksumDecompressed} {
+		if _, err := fsdecomp.New(testFS, fsdecomp.WithChecksumVerification(side)).Open("malformed.txt"); err == nil {
+			t.Errorf("Expected a malformed %s checksum to fail Open", side)
+		}
+	}
+}
+
+//go:embed testdata/embed
+var embeddedFS embed.FS
+
+// TestInnerFilesystems runs fstest.TestFS over the filesystems most often
+// wrapped: an embed.FS, a subtree of one taken with fs.Sub, and a MapFS
+// holding the same files
+func TestInnerFilesystems(t *testing.T) {
+	sub, err := fs.Sub(embeddedFS, "testdata/embed")
+	if err != nil {
+		t.Fatalf("Unexpected error from Sub: %v", err)
+	}
+	mapFS := fstest.MapFS{}
+	err = fs.WalkDir(sub, ".", func(name string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		data, err := fs.ReadFile(sub, name)
+		mapFS[name] = &fstest.MapFile{Data: data, Mode: 0o444}
+		return err
+	})
+	if err != nil {
+		t.Fatalf("Unexpected error copying the embedded files: %v", err)
+	}
+
+	want := map[string]string{
+		"about.html":       "<!doctype html>\n<title>About</title>\n",
+		"index.html":       "<!doctype html>\n<title>Embedded</title>\n<p>Served from an embedded archive.</p>\n",
+		"css/site.css":     "body { font-family: sans-serif; }\n",
+		"js/app.js":        "console.log(\"embedded\");\n",
+		"data/config.json": "{\"name\": \"embedded\"}\n",
+		"data/notes.txt":   "Notes kept compressed alongside plain data.\n",
+	}
+	inners := []struct {
+		name   string
+		fsys   fs.FS
+		prefix string // Directory holding the files in fsys
+	}{
+		{"embed.FS", embeddedFS, "testdata/embed/"},
+		{"fs.Sub", sub, ""},
+		{"MapFS", mapFS, ""},
+	}
+	for _, inner := range inners {
+		for _, opts := range [][]fsdecomp.Option{nil, {fsdecomp.WithSnapshotIndex(false)}} {
+			t.Run(inner.name, func(t *testing.T) {
+				// Directories opened list the logical entries from level 2
+				dfs := fsdecomp.New(inner.fsys, append(opts, fsdecomp.WithCompatLevel(fsdecomp.LatestCompatLevel))...)
+				var names []string
+				for name, content := range want {
+					name = inner.prefix + name
+					names = append(names, name)
+					if data, err := fs.ReadFile(dfs, name); err != nil || string(data) != content {
+						t.Errorf("Expected %s to contain %q, got %q, %v", name, content, data, err)
+					}
+				}
+				if err := fstest.TestFS(dfs, names...); err != nil {
+					t.Error(err)
+				}
+			})
+		}
+	}
+}
+
+// failingFS fails every call with err
+type failingFS struct {
+	err error
+}
+
+func (f failingFS) Open(name string) (fs.File, error) {
+	return nil, &fs.PathError{Op: "open", Path: name, Err: f.err}
+}
+
+func TestNewChecked(t *testing.T) {
+	testFS := fstest.MapFS{
+		"file.txt.gz": &fstest.MapFile{Data: createGzipData(t, "checked")},
+	}
+
+	if _, err := fsdecomp.NewChecked(nil); !errors.Is(err, fsdecomp.ErrNilFS) {
+		t.Errorf("Expected ErrNilFS for a nil filesystem, got %v", err)
+	}
+	if _, err := fsdecomp.NewBounded(nil, "sub"); !errors.Is(err, fsdecomp.ErrNilFS) {
+		t.Errorf("Expected ErrNilFS from NewBounded for a nil filesystem, got %v", err)
+	}
+	func() {
+		defer func() {
+			if r := recover(); r == nil || !strings.Contains(fmt.Sprint(r), "nil filesystem") {
+				t.Errorf("Expected New to panic for a nil filesystem, got %v", r)
+			}
+		}()
+		fsdecomp.New(nil)
+	}()
+
+	errUnavailable := errors.New("backend unavailable")
+	if _, err := fsdecomp.NewChecked(failingFS{errUnavailable}); !errors.Is(err, errUnavailable) {
+		t.Errorf("Expected the filesystem's error for an unreadable root, got %v", err)
+	}
+	if _, err := fsdecomp.NewChecked(failingFS{errUnavailable}, fsdecomp.WithSnapshotIndex(true)); !errors.Is(err, errUnavailable) {
+		t.Errorf("Expected the filesystem's error with an eager index, got %v", err)
+	}
+
+	warn := fsdecomp.WithWarningHandler(func(error) {})
+	for _, tc := range []struct {
+		name string
+		opts []fsdecomp.Option
+	}{
+		{"RatiosCrossed", []fsdecomp.Option{warn, fsdecomp.WithMinDecompressedRatio(20), fsdecomp.WithMaxDecompressedRatio(10)}},
+		{"RatioUnreported", []fsdecomp.Option{fsdecomp.WithMinDecompressedRatio(1.5)}},
+		{"CompatWithIndex", []fsdecomp.Option{fsdecomp.WithCompatLevel(0), fsdecomp.WithSnapshotIndex(false)}},
+		{"EmptySidecarSuffix", []fsdecomp.Option{fsdecomp.WithMetadataSidecars("", 1024)}},
+		{"EmptyMetaSuffix", []fsdecomp.Option{fsdecomp.WithMetaSuffix("", func([]byte) string { return "gz" })}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if _, err := fsdecomp.NewChecked(testFS, tc.opts...); !errors.Is(err, fsdecomp.ErrIncompatibleOptions) {
+				t.Errorf("Expected ErrIncompatibleOptions, got %v", err)
+			}
+		})
+	}
+
+	dfs, err := fsdecomp.NewChecked(testFS, warn, fsdecomp.WithMinDecompressedRatio(1.5), fsdecomp.WithMaxDecompressedRatio(10))
+	if err != nil {
+		t.Fatalf("Unexpected error from NewChecked: %v", err)
+	}
+	if data, err := fs.ReadFile(dfs, "file.txt"); err != nil || string(data) != "checked" {
+		t.Errorf("Expected file.txt to contain %q, got %q, %v", "checked", data, err)
+	}
+}
+
+func TestListCompressed(t *testing.T) {
+	bz2 := createBzip2Data(t, "chained")
+	var chained bytes.Buffer
+	gw := gzip.NewWriter(&chained)
+	gw.Write(bz2)
+	gw.Close()
+	testFS := fstest.MapFS{
+		"plain.txt":            &fstest.MapFile{Data: []byte("plain")},
+		"a.txt.gz":             &fstest.MapFile{Data: createGzipData(t, "a")},
+		"dir/b.json.bz2":       &fstest.MapFile{Data: createBzip2Data(t, "{}")},
+		"dir/c.txt":            &fstest.MapFile{Data: []byte("plain wins")},
+		"dir/c.txt.gz":         &fstest.MapFile{Data: createGzipData(t, "shadowed")},
+		"dir/sub/d.bin.zst":    &fstest.MapFile{Data: createZstdData(t, "d")},
+		"dir/sub/e.log.bz2.gz": &fstest.MapFile{Data: chained.Bytes()},
+	}
+	size := func(name string) int64 { return int64(len(testFS[name].Data)) }
+
+	for _, opts := range [][]fsdecomp.Option{nil, {fsdecomp.WithSnapshotIndex(false)}} {
+		dfs := fsdecomp.New(testFS, append(opts, fsdecomp.WithChainedDecompression(2))...)
+		got, err := dfs.ListCompressed(".")
+		if err != nil {
+			t.Fatalf("Unexpected error from ListCompressed: %v", err)
+		}
+		want := []fsdecomp.CompressedEntry{
+			{VirtualName: "a.txt", RealName: "a.txt.gz", Format: "gz", Formats: []fsdecomp.Format{"gz"}, CompressedSize: size("a.txt.gz")},
+			{VirtualName: "dir/b.json", RealName: "dir/b.json.bz2", Format: "bz2", Formats: []fsdecomp.Format{"bz2"}, CompressedSize: size("dir/b.json.bz2")},
+			{VirtualName: "dir/sub/d.bin", RealName: "dir/sub/d.bin.zst", Format: "zst", Formats: []fsdecomp.Format{"zst"}, CompressedSize: size("dir/sub/d.bin.zst")},
+			{VirtualName: "dir/sub/e.log", RealName: "dir/sub/e.log.bz2.gz", Format: "gz", Formats: []fsdecomp.Format{"gz", "bz2"}, CompressedSize: size("dir/sub/e.log.bz2.gz")},
+		}
+		if fmt.Sprint(got) != fmt.Sprint(want) {
+			t.Errorf("Expected %+v, got %+v", want, got)
+		}
+
+		// Listing a subtree only reports the files within it
+		got, err = dfs.ListCompressed("dir/sub")
+		if err != nil || fmt.Sprint(got) != fmt.Sprint(want[2:]) {
+			t.Errorf("Expected %+v for dir/sub, got %+v, %v", want[2:], got, err)
+		}
+	}
+
+	if _, err := fsdecomp.New(testFS).ListCompressed("missing"); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("Expected fs.ErrNotExist for a missing root, got %v", err)
+	}
+}
+
+// streamTar writes a tar archive of files, in order, to a pipe, compressed
+// with compress, returning the reading end, which can't seek
+func streamTar(t *testing.T, files [][2]string, compress func(io.Writer) io.WriteCloser) io.Reader {
+	pr, pw := io.Pipe()
+	go func() {
+		cw := compress(pw)
+		tw := tar.NewWriter(cw)
+		for _, f := range files {
+			hdr := &tar.Header{Name: f[0], Mode: 0o644, Size: int64(len(f[1])), Typeflag: tar.TypeReg}
+			if strings.HasSuffix(f[0], "/") {
+				hdr = &tar.Header{Name: f[0], Mode: 0o755, Typeflag: tar.TypeDir}
+			}
+			if err := tw.WriteHeader(hdr); err != nil {
+				pw.CloseWithError(err)
+				return
+			}
+			io.WriteString(tw, f[1])
+		}
+		tw.Close()
+		cw.Close()
+		pw.Close()
+	}()
+	t.Cleanup(func() { pr.Close() })
+	return pr
+}
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error { return nil }
+
+func TestStreamFS(t *testing.T) {
+	files := [][2]string{
+		{"./docs/", ""},
+		{"./docs/a.txt", "alpha"},
+		{"./docs/b.txt", "bravo"},
+		{"./docs/old/c.txt", "charlie"},
+		{"./d.txt", "delta"},
+	}
+	compressors := map[string]func(io.Writer) io.WriteCloser{
+		"zst": func(w io.Writer) io.WriteCloser {
+			zw, _ := zstd.NewWriter(w) // Fails only for invalid options
+			return zw
+		},
+		"gz":  func(w io.Writer) io.WriteCloser { return gzip.NewWriter(w) },
+		"tar": func(w io.Writer) io.WriteCloser { return nopWriteCloser{w} },
+	}
+
+	for name, compress := range compressors {
+		t.Run(name, func(t *testing.T) {
+			fsys, err := fsdecomp.StreamFS(streamTar(t, files, compress))
+			if err != nil {
+				t.Fatalf("Unexpected error from StreamFS: %v", err)
+			}
+			sfs := fsys.(*fsdecomp.SequentialFS)
+			defer sfs.Close()
+
+			// Skipping ahead discards the members before
+			file, err := sfs.Open("docs/b.txt")
+			if err != nil {
+				t.Fatalf("Unexpected error opening docs/b.txt: %v", err)
+			}
+			if data, err := io.ReadAll(file); err != nil || string(data) != "bravo" {
+				t.Errorf("Expected docs/b.txt to contain %q, got %q, %v", "bravo", data, err)
+			}
+			file.Close()
+
+			var seqErr *fsdecomp.SequentialAccessError
+			if _, err := sfs.Open("docs/a.txt"); !errors.As(err, &seqErr) || seqErr.Opened || !errors.Is(err, fsdecomp.ErrOutOfOrder) {
+				t.Errorf("Expected a SequentialAccessError for a skipped member, got %v", err)
+			}
+			if _, err := sfs.Open("docs/b.txt"); !errors.As(err, &seqErr) || !seqErr.Opened {
+				t.Errorf("Expected a SequentialAccessError for a repeated open, got %v", err)
+			}
+
+			// A member can't be read once the stream has moved past it
+			stale, err := sfs.Open("docs/old/c.txt")
+			if err != nil {
+				t.Fatalf("Unexpected error opening docs/old/c.txt: %v", err)
+			}
+			if _, err := sfs.Open("d.txt"); err != nil {
+				t.Fatalf("Unexpected error opening d.txt: %v", err)
+			}
+			if _, err := io.ReadAll(stale); !errors.Is(err, fsdecomp.ErrOutOfOrder) {
+				t.Errorf("Expected ErrOutOfOrder reading a passed member, got %v", err)
+			}
+
+			if _, err := sfs.Open("missing.txt"); !errors.Is(err, fs.ErrNotExist) {
+				t.Errorf("Expected fs.ErrNotExist for a missing member, got %v", err)
+			}
+			if _, err := sfs.Open("../escape"); !errors.Is(err, fs.ErrInvalid) {
+				t.Errorf("Expected fs.ErrInvalid for an invalid name, got %v", err)
+			}
+		})
+	}
+
+	t.Run("WalkDir", func(t *testing.T) {
+		fsys, err := fsdecomp.StreamFS(streamTar(t, files, compressors["zst"]))
+		if err != nil {
+			t.Fatalf("Unexpected error from StreamFS: %v", err)
+		}
+		sfs := fsys.(*fsdecomp.SequentialFS)
+		var got []string
+		err = sfs.WalkDir(func(name string, d fs.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+			if d.IsDir() {
+				got = append(got, name+"/")
+				return nil
+			}
+			data, err := fs.ReadFile(sfs, name)
+			got = append(got, name+"="+string(data))
+			return err
+		})
+		if err != nil {
+			t.Fatalf("Unexpected error from WalkDir: %v", err)
+		}
+		want := []string{"docs/", "docs/a.txt=alpha", "docs/b.txt=bravo", "docs/old/c.txt=charlie", "d.txt=delta"}
+		if !slices.Equal(got, want) {
+			t.Errorf("Expected %q, got %q", want, got)
+		}
+
+		// The walk has consumed the stream
+		if _, err := sfs.Open("d.txt"); !errors.Is(err, fsdecomp.ErrOutOfOrder) {
+			t.Errorf("Expected ErrOutOfOrder after the walk, got %v", err)
+		}
+	})
+
+	t.Run("SkipDir", func(t *testing.T) {
+		withDir := append(slices.Clone(files[:3]), [2]string{"docs/old/", ""}, files[3], files[4])
+		fsys, err := fsdecomp.StreamFS(streamTar(t, withDir, compressors["gz"]))
+		if err != nil {
+			t.Fatalf("Unexpected error from StreamFS: %v", err)
+		}
+		var got []string
+		err = fsys.(*fsdecomp.SequentialFS).WalkDir(func(name string, d fs.DirEntry, err error) error {
+			got = append(got, name)
+			if name == "docs/old" {
+				return fs.SkipDir
+			}
+			return err
+		})
+		want := []string{"docs", "docs/a.txt", "docs/b.txt", "docs/old", "d.txt"}
+		if err != nil || !slices.Equal(got, want) {
+			t.Errorf("Expected %q, got %q, %v", want, got, err)
+		}
+	})
+}
+
+func TestOpenReader(t *testing.T) {
+	dfs := fsdecomp.New(fstest.MapFS{})
+	file, err := dfs.OpenReader(io.NopCloser(bytes.NewReader(createGzipData(t, "from a reader"))), "dir/x.txt.gz")
+	if err != nil {
+		t.Fatalf("Unexpected error from OpenReader: %v", err)
+	}
+	defer file.Close()
+	if data, err := io.ReadAll(file); err != nil || string(data) != "from a reader" {
+		t.Errorf("Expected %q, got %q, %v", "from a reader", data, err)
+	}
+	if info, err := file.Stat(); err != nil || info.Name() != "x.txt" {
+		t.Errorf("Expected the file to be named x.txt, got %v, %v", info, err)
+	}
+	r, ok := file.(interface{ ResolutionInfo() fsdecomp.Resolution })
+	if !ok || !slices.Equal(r.ResolutionInfo().Formats, []string{".gz"}) {
+		t.Errorf("Expected the file to be decompressed as .gz")
+	}
+
+	// Names without a compression extension are read as they are
+	plain, err := dfs.OpenReader(io.NopCloser(strings.NewReader("plain")), "x.txt")
+	if err != nil {
+		t.Fatalf("Unexpected error from OpenReader: %v", err)
+	}
+	if data, err := io.ReadAll(plain); err != nil || string(data) != "plain" {
+		t.Errorf("Expected %q, got %q, %v", "plain", data, err)
+	}
+	if info, err := plain.Stat(); err != nil || info.Name() != "x.txt" {
+		t.Errorf("Expected the plain file to be named x.txt, got %v, %v", info, err)
+	}
+
+	// Options apply as they do to files opened from the filesystem
+	limited := fsdecomp.New(fstest.MapFS{}, fsdecomp.WithMaxDecompressedSize(4))
+	file, err = limited.OpenReader(io.NopCloser(bytes.NewReader(createGzipData(t, "too long"))), "x.txt.gz")
+	if err != nil {
+		t.Fatalf("Unexpected error from OpenReader: %v", err)
+	}
+	if _, err := io.ReadAll(file); !errors.Is(err, fsdecomp.ErrTooLarge) {
+		t.Errorf("Expected ErrTooLarge, got %v", err)
+	}
+
+	if _, err := dfs.OpenReader(io.NopCloser(strings.NewReader("")), "../x.gz"); !errors.Is(err, fs.ErrInvalid) {
+		t.Errorf("Expected fs.ErrInvalid for an invalid name, got %v", err)
+	}
+}
+
+// blockingWriter blocks its first write until release is closed, and
+// records the capacity of the buffers it is given
+type blockingWriter struct {
+	blocked *sync.WaitGroup // Done once the first write is blocked
+	release chan struct{}
+	caps    []int
+}
+
+func (bw *blockingWriter) Write(p []byte) (int, error) {
+	bw.caps = append(bw.caps, cap(p))
+	if len(bw.caps) == 1 {
+		bw.blocked.Done()
+		<-bw.release
+	}
+	return len(p), nil
+}
+
+func TestSlowWriteHandler(t *testing.T) {
+	const transfers = 4
+	content := strings.Repeat("slow clients drain this slowly\n", 16*1024)
+	testFS := fstest.MapFS{"big.txt.gz": &fstest.MapFile{Data: createGzipData(t, content)}}
+	pool := &sync.Pool{New: func() any {
+		buf := make([]byte, 64*1024)
+		return &buf
+	}}
+	var mu sync.Mutex
+	slow := make(map[int64]int) // Slow writes by the bytes written before them
+	// Every write blocked on a channel takes longer than the threshold
+	dfs := fsdecomp.New(testFS, fsdecomp.WithBufferPool(pool), fsdecomp.WithSlowWriteHandler(time.Nanosecond, func(sw fsdecomp.SlowWrite) {
+		if sw.Name != "big.txt.gz" || sw.Duration <= 0 || sw.Size == 0 {
+			t.Errorf("Unexpected slow write %+v", sw)
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		slow[sw.Written]++
+	}))
+	if got := dfs.Config().SlowWriteThreshold; got != time.Nanosecond {
+		t.Errorf("Expected the threshold in Config, got %v", got)
+	}
+
+	var blocked, done sync.WaitGroup
+	release := make(chan struct{})
+	writers := make([]*blockingWriter, transfers)
+	blocked.Add(transfers)
+	done.Add(transfers)
+	for i := range writers {
+		writers[i] = &blockingWriter{blocked: &blocked, release: release}
+		go func() {
+			defer done.Done()
+			file, err := dfs.Open("big.txt")
+			if err != nil {
+				blocked.Done()
+				t.Errorf("Unexpected error opening big.txt: %v", err)
+				return
+			}
+			defer file.Close()
+			n, err := io.Copy(writers[i], file)
+			if err != nil || n != int64(len(content)) {
+				t.Errorf("Expected to copy %d bytes, copied %d: %v", len(content), n, err)
+			}
+		}()
+	}
+	blocked.Wait()
+	close(release)
+	done.Wait()
+
+	// Each transfer reports its first write, made from a pooled buffer, and
+	// then copies the rest through small buffers, holding no pooled buffer
+	// while it waits on its writer
+	if slow[0] != transfers {
+		t.Errorf("Expected the first write of each of %d transfers to be reported, got %d", transfers, slow[0])
+	}
+	for i, w := range writers {
+		if len(w.caps) < 2 || w.caps[0] != 64*1024 {
+			t.Fatalf("Transfer %d: expected a pooled buffer and then more writes, got capacities %v", i, w.caps)
+		}
+		for _, c := range w.caps[1:] {
+			if c > 4*1024 {
+				t.Errorf("Transfer %d: expected small buffers after a slow write, got capacities %v", i, w.caps)
+				break
+			}
+		}
+	}
+}
+
+// TestStatNames ensures fs.Stat reports the same name, size and mode as
+// statting the opened file, stripping extensions only from logical names
+func TestStatNames(t *testing.T) {
+	testFS := fstest.MapFS{
+		"compressed.txt.gz": &fstest.MapFile{Data: createGzipData(t, "compressed content")},
+		"plain.txt":         &fstest.MapFile{Data: []byte("plain content")},
+		"dir/nested.txt.gz": &fstest.MapFile{Data: createGzipData(t, "nested content")},
+	}
+	tests := []struct {
+		name     string
+		wantName string
+		wantSize int64
+	}{
+		{"compressed.txt", "compressed.txt", int64(len("compressed content"))},
+		{"compressed.txt.gz", "compressed.txt.gz", int64(len(testFS["compressed.txt.gz"].Data))},
+		{"plain.txt", "plain.txt", int64(len("plain content"))},
+		{"dir/nested.txt", "nested.txt", int64(len("nested content"))},
+		{"dir/nested.txt.gz", "nested.txt.gz", int64(len(testFS["dir/nested.txt.gz"].Data))},
+	}
+
+	for _, index := range []bool{false, true} {
+		dfs := fsdecomp.New(testFS, fsdecomp.WithSnapshotIndex(index), fsdecomp.WithSingleMemberSizes())
+		for _, tt := range tests {
+			info, err := fs.Stat(dfs, tt.name)
+			if err != nil {
+				t.Errorf("Unexpected error statting %s (index %v): %v", tt.name, index, err)
+				continue
+			}
+			if info.Name() != tt.wantName || info.Size() != tt.wantSize {
+				t.Errorf("Expected %s (index %v) to stat as %q with size %d, got %q with size %d",
+					tt.name, index, tt.wantName, tt.wantSize, info.Name(), info.Size())
+			}
+
+			file, err := dfs.Open(tt.name)
+			if err != nil {
+				t.Fatalf("Unexpected error opening %s: %v", tt.name, err)
+			}
+			opened, err := file.Stat()
+			file.Close()
+			if err != nil {
+				t.Fatalf("Unexpected error statting opened %s: %v", tt.name, err)
+			}
+			if opened.Name() != info.Name() || opened.Size() != info.Size() || opened.Mode() != info.Mode() {
+				t.Errorf("Expected %s (index %v) to stat as it does once opened, got %q/%d/%v and %q/%d/%v",
+					tt.name, index, info.Name(), info.Size(), info.Mode(), opened.Name(), opened.Size(), opened.Mode())
+			}
+		}
+	}
+}
+
+func TestDetectFormat(t *testing.T) {
+	tests := []struct {
+		name   string
+		prefix []byte
+		want   fsdecomp.Format
+		ok     bool
+	}{
+		{"gzip", []byte{0x1f, 0x8b}, fsdecomp.FormatGzip, true},
+		{"zstd", []byte{0x28, 0xb5, 0x2f, 0xfd}, fsdecomp.FormatZstd, true},
+		{"bzip2 level 1", []byte("BZh1"), fsdecomp.FormatBzip2, true},
+		{"bzip2 level 9", []byte("BZh9"), fsdecomp.FormatBzip2, true},
+		{"xz", []byte{0xfd, '7', 'z', 'X', 'Z', 0x00}, fsdecomp.FormatXz, true},
+		{"lz4", []byte{0x04, 0x22, 0x4d, 0x18}, fsdecomp.FormatLZ4, true},
+		{"zlib default", []byte{0x78, 0x9c}, fsdecomp.FormatZlib, true},
+		{"zlib fastest", []byte{0x78, 0x01}, fsdecomp.FormatZlib, true},
+		{"zlib best", []byte{0x78, 0xda}, fsdecomp.FormatZlib, true},
+		{"zlib small window", []byte{0x08, 0x1d}, fsdecomp.FormatZlib, true},
+		{"followed by data", []byte{0x1f, 0x8b, 0x08, 0x00, 0x00, 0x00}, fsdecomp.FormatGzip, true},
+
+		// Too short to tell, or not quite the signature
+		{"empty", nil, "", false},
+		{"gzip short", []byte{0x1f}, "", false},
+		{"zstd short", []byte{0x28, 0xb5, 0x2f}, "", false},
+		{"bzip2 short", []byte("BZh"), "", false},
+		{"bzip2 level 0", []byte("BZh0"), "", false},
+		{"bzip2 huffman", []byte("BZ0"), "", false},
+		{"xz short", []byte{0xfd, '7', 'z', 'X', 'Z'}, "", false},
+		{"lz4 short", []byte{0x04, 0x22, 0x4d}, "", false},
+		{"lz4 legacy", []byte{0x02, 0x21, 0x4c, 0x18}, "", false},
+		{"zlib short", []byte{0x78}, "", false},
+		{"zlib bad check", []byte{0x78, 0x9d}, "", false},
+		{"zlib large window", []byte{0x88, 0x98}, "", false},
+		{"zlib not deflate", []byte{0x79, 0x9c}, "", false},
+		{"text", []byte("hello world"), "", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := fsdecomp.DetectFormat(tt.prefix)
+			if got != tt.want || ok != tt.ok {
+				t.Errorf("Expected DetectFormat(%x) = %q, %v, got %q, %v", tt.prefix, tt.want, tt.ok, got, ok)
+			}
+		})
+	}
+
+	// Streams from real encoders are recognised from their first SniffLen
+	// bytes
+	var zlibData, xzData bytes.Buffer
+	zw := zlib.NewWriter(&zlibData)
+	zw.Write([]byte("zlib content"))
+	zw.Close()
+	xw, err := xz.NewWriter(&xzData)
+	if err != nil {
+		t.Fatalf("Failed to create xz writer: %v", err)
+	}
+	xw.Write([]byte("xz content"))
+	xw.Close()
+	for want, data := range map[fsdecomp.Format][]byte{
+		fsdecomp.FormatGzip:  createGzipData(t, "gzip content"),
+		fsdecomp.FormatZstd:  createZstdData(t, "zstd content"),
+		fsdecomp.FormatBzip2: createBzip2Data(t, "bzip2 content"),
+		fsdecomp.FormatXz:    xzData.Bytes(),
+		fsdecomp.FormatLZ4:   createLz4Data(t, "lz4 content"),
+		fsdecomp.FormatZlib:  zlibData.Bytes(),
+	} {
+		if got, ok := fsdecomp.DetectFormat(data[:fsdecomp.SniffLen]); got != want || !ok {
+			t.Errorf("Expected %s stream to be detected, got %q, %v", want, got, ok)
+		}
+	}
+}
+
+// TestMagicAgreesWithDetectFormat ensures WithMagicValidation accepts
+// exactly the streams DetectFormat finds to be of each registered format
+func TestMagicAgreesWithDetectFormat(t *testing.T) {
+	var zlibData, xzData bytes.Buffer
+	zw := zlib.NewWriter(&zlibData)
+	zw.Write([]byte("zlib content"))
+	zw.Close()
+	xw, err := xz.NewWriter(&xzData)
+	if err != nil {
+		t.Fatalf("Failed to create xz writer: %v", err)
+	}
+	xw.Write([]byte("xz content"))
+	xw.Close()
+	samples := [][]byte{
+		nil, []byte("text that is no format"), createFlateData(t, "deflate"),
+		createGzipData(t, "gzip"), createBGZFData(t, "bgzf"), createZstdData(t, "zstd"),
+		createBzip2Data(t, "bzip2"), createLz4Data(t, "lz4"), zlibData.Bytes(), xzData.Bytes(),
+		{0x1f}, {0x1f, 0x8b}, {0x28, 0xb5, 0x2f}, []byte("BZh"), []byte("BZh0"), []byte("BZhx"), []byte("BZh9"),
+		{0x78}, {0x78, 0x9c}, {0x78, 0x9d}, {0x08, 0x1d}, {0x88, 0x98}, {0x79, 0x9c},
+		{0x04, 0x22, 0x4d}, {0x02, 0x21, 0x4c, 0x18}, {0xfd, '7', 'z', 'X', 'Z'},
+	}
+
+	// Format of the streams of each extension. DetectFormat knows none of
+	// the others, such as .deflate, so every stream of those is accepted.
+	formats := map[string]fsdecomp.Format{
+		".gz": fsdecomp.FormatGzip, ".bgz": fsdecomp.FormatGzip, ".bz2": fsdecomp.FormatBzip2,
+		".zz": fsdecomp.FormatZlib, ".zlib": fsdecomp.FormatZlib,
+		".zst": fsdecomp.FormatZstd, ".lz4": fsdecomp.FormatLZ4, ".xz": fsdecomp.FormatXz,
+	}
+	for _, ext := range fsdecomp.New(fstest.MapFS{}).Config().Extensions {
+		format := formats[ext]
+		for _, sample := range samples {
+			dfs := fsdecomp.New(fstest.MapFS{"file" + ext: &fstest.MapFile{Data: sample}}, fsdecomp.WithMagicValidation())
+			file, err := dfs.Open("file")
+			if err == nil {
+				file.Close()
+			}
+			accepted := !errors.Is(err, fsdecomp.ErrMagicMismatch)
+			detected, ok := fsdecomp.DetectFormat(sample)
+			if want := format == "" || ok && detected == format; accepted != want {
+				t.Errorf("%s: expected %x to be accepted %v, as DetectFormat gives %q, %v, got %v", ext, sample[:min(len(sample), fsdecomp.SniffLen)], want, detected, ok, err)
+			}
+		}
+	}
+}
@@ -3,7 +3,16 @@ module github.com/AndreRenaud/FSDecomp
 go 1.24.3
 
 require (
+	filippo.io/age v1.2.1
+	github.com/andybalholm/brotli v1.2.0
 	github.com/dsnet/compress v0.0.1
 	github.com/klauspost/compress v1.18.0
+	github.com/klauspost/pgzip v1.2.6
 	github.com/pierrec/lz4/v4 v4.1.22
+	github.com/ulikunitz/xz v0.5.15
+)
+
+require (
+	golang.org/x/crypto v0.24.0 // indirect
+	golang.org/x/sys v0.21.0 // indirect
 )
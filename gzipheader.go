@@ -0,0 +1,61 @@
+package fsdecomp
+
+import (
+	"compress/gzip"
+	"encoding/binary"
+	"errors"
+	"io"
+	"io/fs"
+)
+
+// errNotGzip is returned by GzipHeader for files not stored gzip compressed
+var errNotGzip = errors.New("not gzip compressed")
+
+// GzipHeader returns the header of the gzip member at the start of the
+// file providing name, including the raw extra field (FEXTRA) that vendor
+// tools use for their own subfields, which compress/gzip leaves uninterpreted.
+// Only the header is read. The file must be stored as gzip (.gz or .bgz) in
+// the underlying filesystem, outside any other layers; for others the error
+// is an fs.PathError. A malformed header is reported as a DecompressError
+// wrapping ErrCorruptHeader.
+func (dfs *DecompressFS) GzipHeader(name string) (*gzip.Header, error) {
+	r, err := dfs.resolve(name)
+	if err != nil {
+		return nil, err
+	}
+	defer r.file.Close()
+	if len(r.layers) == 0 || (r.layers[0].ext != ".gz" && r.layers[0].ext != ".bgz") {
+		return nil, &fs.PathError{Op: "gzipheader", Path: name, Err: errNotGzip}
+	}
+
+	gzReader, err := gzip.NewReader(r.file)
+	if err != nil {
+		return nil, newDecompressError(r.layers[0], r.name, gzipHeaderError(err, true))
+	}
+	defer gzReader.Close()
+	header := gzReader.Header
+	return &header, nil
+}
+
+// GzipSize returns the decompressed size of the gzip stream of size bytes in r
+// from the ISIZE field of its trailer, reading only the trailer. It is
+// exported for decompressors replacing the built-in gzip one to implement
+// MemberSizer with.
+//
+// ISIZE only records the size of the last member, so this is the size of
+// the whole stream only for streams of a single member, such as those gzip
+// writes, but not those made by concatenating gzip files. Telling the two
+// apart means reading the whole stream, so DecompressFS only uses the size
+// with WithSingleMemberSizes. ISIZE holds the size modulo 2^32: see
+// WrappingSizer.
+func GzipSize(r io.ReaderAt, size int64) (int64, bool) {
+	// A member is at least a 10 byte header plus an 8 byte trailer
+	if size < 18 {
+		return 0, false
+	}
+	var trailer [4]byte
+	if n, _ := r.ReadAt(trailer[:], size-4); n < len(trailer) {
+		return 0, false
+	}
+	return int64(binary.LittleEndian.Uint32(trailer[:])), true
+}
@@ -0,0 +1,243 @@
+package fsdecomp
+
+import (
+	"io/fs"
+	"path"
+	"slices"
+	"strings"
+	"sync"
+)
+
+// snapshotIndex is an immutable view of the logical tree of an unchanging
+// filesystem, built one directory at a time (see WithSnapshotIndex)
+type snapshotIndex struct {
+	eager bool // Index the whole tree in New, rather than on demand
+
+	mu   sync.Mutex
+	dirs map[string]*indexDir
+}
+
+// indexDir is the logical view of a single directory
+type indexDir struct {
+	entries []fs.DirEntry         // Logical entries, sorted by name
+	files   map[string]indexEntry // Physical file for each logical name
+	err     error                 // Error from listing the directory
+	done    chan struct{}         // Closed once the fields above are set
+}
+
+// indexEntry records where a logical name is stored in the underlying filesystem
+type indexEntry struct {
+	physical string   // Name in the underlying filesystem
+	layers   []format // Formats to decode, outermost first
+	dir      bool
+	rank     []int       // Position in probe order, ordered as by slices.Compare
+	split    *splitGroup // Parts making up the file, if it is split
+}
+
+// dir returns the index of the named directory, listing it if needed.
+// Directories are only listed once their parent has shown them to be
+// directories, so that paths through files or missing directories are
+// rejected from the index alone. Each directory is listed once, without
+// holding idx.mu, so that listing a slow directory doesn't hold up lookups
+// in others: callers wanting one being listed wait for it.
+func (idx *snapshotIndex) dir(b backend, name string) *indexDir {
+	if name != "." {
+		parent := idx.dir(b, path.Dir(name))
+		if parent.err != nil {
+			return parent
+		}
+		if e, ok := parent.files[path.Base(name)]; !ok || !e.dir {
+			return &indexDir{err: &fs.PathError{Op: "readdir", Path: name, Err: fs.ErrNotExist}}
+		}
+	}
+
+	idx.mu.Lock()
+	d, ok := idx.dirs[name]
+	if ok {
+		idx.mu.Unlock()
+		<-d.done
+		return d
+	}
+	d = &indexDir{done: make(chan struct{})}
+	if idx.dirs == nil {
+		idx.dirs = make(map[string]*indexDir)
+	}
+	idx.dirs[name] = d
+	idx.mu.Unlock()
+
+	built := buildIndexDir(b, name)
+	d.entries, d.files, d.err = built.entries, built.files, built.err
+	close(d.done)
+	return d
+}
+
+// loadAll indexes every directory in the tree
+func (idx *snapshotIndex) loadAll(b backend) {
+	pending := []string{"."}
+	for len(pending) > 0 {
+		name := pending[len(pending)-1]
+		pending = pending[:len(pending)-1]
+		for _, entry := range idx.dir(b, name).entries {
+			if entry.IsDir() {
+				pending = append(pending, path.Join(name, entry.Name()))
+			}
+		}
+	}
+}
+
+// buildIndexDir lists the named directory in the underlying filesystem,
+// resolving each logical name the same way Open does: a plain file takes
+// precedence over compressed ones, which are picked in probe order
+func buildIndexDir(b backend, name string) *indexDir {
+	dfs := b.dfs
+	physical, err := dfs.readDir(b, name)
+	if err != nil {
+		return &indexDir{err: err}
+	}
+	physical = uniqueEntries(physical)
+
+	var present map[string]bool
+	if dfs.sidecars != nil {
+		present = listingNames(physical)
+	}
+	var groups map[string]*splitGroup
+	if dfs.splitParts {
+		groups = dfs.splitGroups(physical)
+	}
+	d := &indexDir{files: make(map[string]indexEntry, len(physical))}
+	logical := make(map[string]fs.DirEntry, len(physical))
+	for _, entry := range physical {
+		if entry.IsDir() {
+			// Directories keep their names, ahead of any file that would
+			// provide the same name
+			d.files[entry.Name()] = indexEntry{physical: path.Join(name, entry.Name()), dir: true}
+			logical[entry.Name()] = entry
+			continue
+		}
+		if dfs.isHidden(entry) || dfs.sidecars != nil && dfs.sidecars.isSidecar(entry.Name(), present) {
+			continue
+		}
+		if stem, _, ok := splitPart(entry.Name()); ok && groups[stem] != nil {
+			continue
+		}
+		e := indexEntry{physical: path.Join(name, entry.Name()), rank: dfs.plainRank(name)}
+		logicalName, layers, _ := dfs.layersForName(entry.Name())
+		if len(layers) > 0 {
+			e.layers, e.rank = layers, dfs.probeRank(layers)
+			re := dfs.compressedEntry(b, name, entry, logicalName, layers, present)
+			if re.name != logicalName {
+				// Names given by sidecars are only used when probing finds nothing
+				logicalName = re.name
+				e.rank = append([]int{len(dfs.supportedFormats())}, e.rank...)
+			}
+			entry = re
+		}
+		if existing, ok := d.files[logicalName]; ok && slices.Compare(existing.rank, e.rank) <= 0 {
+			continue
+		}
+		d.files[logicalName] = e
+		logical[logicalName] = entry
+	}
+	for _, g := range groups {
+		// Split files are only used when probing finds nothing
+		rank := append([]int{len(dfs.supportedFormats()) + 1}, dfs.probeRank(g.layers)...)
+		if existing, ok := d.files[g.logical]; ok && slices.Compare(existing.rank, rank) <= 0 {
+			continue
+		}
+		d.files[g.logical] = indexEntry{physical: path.Join(name, g.stem), layers: g.layers, rank: rank, split: g}
+		logical[g.logical] = splitEntry{DirEntry: g.parts[0], name: g.logical, parts: g.parts}
+	}
+
+	// Compressed files can still be opened by their own names, with only their
+	// outer layers removed, or by their logical names if a sidecar renamed
+	// them, as with Open
+	for _, entry := range physical {
+		var layers []format
+		if !entry.IsDir() {
+			_, layers, _ = dfs.layersForName(entry.Name())
+		}
+		partial := entry.Name()
+		for outer := 0; ; outer++ {
+			if _, ok := d.files[partial]; !ok {
+				d.files[partial] = indexEntry{
+					physical: path.Join(name, entry.Name()),
+					layers:   layers[:outer],
+					dir:      entry.IsDir(),
+				}
+			}
+			if outer >= len(layers) {
+				break
+			}
+			partial = strings.TrimSuffix(partial, layers[outer].ext)
+		}
+	}
+
+	d.entries = make([]fs.DirEntry, 0, len(logical))
+	for _, entry := range logical {
+		d.entries = append(d.entries, entry)
+	}
+	slices.SortFunc(d.entries, func(a, b fs.DirEntry) int {
+		return strings.Compare(a.Name(), b.Name())
+	})
+	return d
+}
+
+// readDir returns the logical entries of the named directory
+func (idx *snapshotIndex) readDir(b backend, name string) ([]fs.DirEntry, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: fs.ErrInvalid}
+	}
+	d := idx.dir(b, name)
+	if d.err != nil {
+		return nil, d.err
+	}
+	return slices.Clone(d.entries), nil
+}
+
+// resolveIndexed finds the named file using the index rather than probing
+func (dfs *DecompressFS) resolveIndexed(b backend, name string) (resolved, error) {
+	if name == "." {
+		file, err := b.Open(name)
+		if err != nil {
+			return resolved{}, err
+		}
+		return dfs.resolveDirect(b, name, file)
+	}
+
+	e, ok := dfs.index.dir(b, path.Dir(name)).files[path.Base(name)]
+	if !ok {
+		return resolved{}, &fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+	}
+	if e.split != nil {
+		r, err := dfs.openSplit(b, path.Dir(name), e.split)
+		if err != nil {
+			return resolved{}, &fs.PathError{Op: "open", Path: name, Err: err}
+		}
+		r.cached = true
+		return r, nil
+	}
+	file, err := b.Open(e.physical)
+	if err != nil {
+		return resolved{}, err
+	}
+	if len(e.layers) > 0 {
+		return resolved{file: file, name: e.physical, layers: e.layers, cached: true}, nil
+	}
+	r, err := dfs.resolveDirect(b, name, file)
+	r.cached = true
+	return r, err
+}
+
+// probeRank returns the position in which Open probes for a file encoded
+// with layers, as compared by slices.Compare: by the index of each format
+// from the innermost layer out, with plain files first
+func (dfs *DecompressFS) probeRank(layers []format) []int {
+	formats := dfs.supportedFormats()
+	rank := make([]int, 0, len(layers))
+	for i := len(layers) - 1; i >= 0; i-- {
+		rank = append(rank, slices.IndexFunc(formats, func(f format) bool {
+			return f.ext == layers[i].ext
+		}))
+	}
+	return rank
+}
@@ -0,0 +1,103 @@
+package fsdecomp
+
+import (
+	"io"
+	"slices"
+	"strings"
+)
+
+// Transform is a reader stage identified by a file extension, such as
+// decryption for ".enc" files (see WithTransforms)
+type Transform struct {
+	Ext string // Extension of files the transform applies to, including the leading dot
+
+	// NewReader returns a reader producing the transformed contents of r.
+	// As with Decompressor.NewReader, closing it must release any resources
+	// it holds, but must not close r.
+	NewReader func(r io.Reader) (io.ReadCloser, error)
+
+	// NewReaderFor, if set, is used in place of NewReader, which may then
+	// be nil. It is also given the name of the file being read, without the
+	// extensions of any layers outside this one, for transforms that depend
+	// on the file, such as decryption with a key per file.
+	NewReaderFor func(name string, r io.Reader) (io.ReadCloser, error)
+}
+
+// transformDecompressor adapts a Transform to the Decompressor interface
+type transformDecompressor struct {
+	Transform
+}
+
+func (td transformDecompressor) NewReader(r io.Reader) (io.ReadCloser, error) {
+	return td.NewReaderFor("", r)
+}
+
+func (td transformDecompressor) NewReaderFor(name string, r io.Reader) (io.ReadCloser, error) {
+	if td.Transform.NewReaderFor != nil {
+		return td.Transform.NewReaderFor(name, r)
+	}
+	return td.Transform.NewReader(r)
+}
+
+// newLayerReader returns a reader decoding the layer of the given format
+// from r, which is read from the named file
+func newLayerReader(kind format, name string, r io.Reader) (io.ReadCloser, error) {
+	if nd, ok := kind.decompressor.(NameDecompressor); ok {
+		return nd.NewReaderFor(name, r)
+	}
+	return kind.decompressor.NewReader(r)
+}
+
+// maxLayers bounds how many extensions are removed from a single name, and
+// so how many layers are decoded to read a file, unless a longer chain of
+// compression layers is allowed with WithChainedDecompression
+const maxLayers = 4
+
+// compressionLimit returns how many compression layers a file may have
+func (dfs *DecompressFS) compressionLimit() int {
+	return max(dfs.chainLimit, 1)
+}
+
+// layerLimit returns how many layers a file may have in all
+func (dfs *DecompressFS) layerLimit() int {
+	return max(maxLayers, dfs.chainLimit)
+}
+
+// layersForName returns name without the extensions of the layers it was
+// encoded with, and the formats of those layers, outermost first. Other
+// than transforms, up to compressionLimit compression formats are removed.
+func (dfs *DecompressFS) layersForName(name string) (string, []format, bool) {
+	formats := dfs.supportedFormats()
+	var layers []format
+	compressions := dfs.compressionLimit()
+	for len(layers) < dfs.layerLimit() {
+		i := slices.IndexFunc(formats, func(f format) bool {
+			return (f.transform || compressions > 0) && len(name) > len(f.ext) && strings.HasSuffix(name, f.ext)
+		})
+		if i < 0 {
+			break
+		}
+		name = strings.TrimSuffix(name, formats[i].ext)
+		layers = append(layers, formats[i])
+		if !formats[i].transform {
+			compressions--
+		}
+	}
+	return name, layers, len(layers) > 0
+}
+
+// layerReader reports read errors from one layer of a multi-layer file as
+// a DecompressError for that layer
+type layerReader struct {
+	reader io.Reader
+	kind   format
+	name   string
+}
+
+func (lr *layerReader) Read(p []byte) (int, error) {
+	n, err := lr.reader.Read(p)
+	if err != nil && err != io.EOF {
+		err = newDecompressError(lr.kind, lr.name, err)
+	}
+	return n, err
+}
@@ -0,0 +1,115 @@
+package fsdecomp
+
+import (
+	"fmt"
+	"maps"
+	"runtime"
+	"runtime/debug"
+	"slices"
+	"sync"
+)
+
+// LeakInfo describes a decompressed file that has been opened and not yet
+// closed (see WithLeakDetection)
+type LeakInfo struct {
+	Name  string // Name passed to Open
+	Stack string // Stack trace of the call to Open
+}
+
+// LeakError is the warning reported for a decompressed file that was never
+// closed (see WithLeakDetection)
+type LeakError struct {
+	LeakInfo
+	Collected bool // Whether the file was garbage collected, rather than open at Close
+}
+
+func (e *LeakError) Error() string {
+	if e.Collected {
+		return fmt.Sprintf("%s garbage collected without being closed, opened at:\n%s", e.Name, e.Stack)
+	}
+	return fmt.Sprintf("%s not closed, opened at:\n%s", e.Name, e.Stack)
+}
+
+// leakTracker records the decompressed files that are open
+type leakTracker struct {
+	mu     sync.Mutex
+	nextID uint64
+	open   map[uint64]trackedFile // By the order they were opened in
+}
+
+// trackedFile is a decompressed file recorded by a leakTracker
+type trackedFile struct {
+	LeakInfo
+	cleanup runtime.Cleanup // Reports the file if it is collected while open
+}
+
+// track records that df has been opened as name, unless the filesystem has
+// been closed, as Close has already reported the files that were open
+func (dfs *DecompressFS) track(df *decompressFile, name string) {
+	lt := dfs.leaks
+	info := LeakInfo{Name: name, Stack: string(debug.Stack())}
+	lt.mu.Lock()
+	defer lt.mu.Unlock()
+	if dfs.closed.Load() {
+		return
+	}
+	lt.nextID++
+	id := lt.nextID
+
+	// The cleanup mustn't refer to df, or it would never be collected
+	cleanup := runtime.AddCleanup(df, func(id uint64) {
+		if info, ok := lt.remove(id); ok {
+			dfs.warn(&LeakError{LeakInfo: info, Collected: true})
+		}
+	}, id)
+	if lt.open == nil {
+		lt.open = make(map[uint64]trackedFile)
+	}
+	lt.open[id] = trackedFile{LeakInfo: info, cleanup: cleanup}
+	df.untrack = func() { lt.remove(id) }
+}
+
+// remove forgets the file with the given id, returning what was recorded
+// about it if it was still open. The file is no longer reported if it is
+// collected.
+func (lt *leakTracker) remove(id uint64) (LeakInfo, bool) {
+	lt.mu.Lock()
+	defer lt.mu.Unlock()
+	tracked, ok := lt.open[id]
+	if ok {
+		tracked.cleanup.Stop()
+		delete(lt.open, id)
+	}
+	return tracked.LeakInfo, ok
+}
+
+// removeAll forgets every file still open, returning what was recorded
+// about them in the order they were opened
+func (lt *leakTracker) removeAll() []LeakInfo {
+	lt.mu.Lock()
+	defer lt.mu.Unlock()
+	files := make([]LeakInfo, 0, len(lt.open))
+	for _, id := range slices.Sorted(maps.Keys(lt.open)) {
+		lt.open[id].cleanup.Stop()
+		files = append(files, lt.open[id].LeakInfo)
+	}
+	lt.open = nil
+	return files
+}
+
+// OpenFiles returns the decompressed files that have been opened and not
+// yet closed, in the order they were opened, when leak detection is enabled
+// with WithLeakDetection. It returns nil otherwise.
+func (dfs *DecompressFS) OpenFiles() []LeakInfo {
+	if dfs.leaks == nil {
+		return nil
+	}
+	lt := dfs.leaks
+	lt.mu.Lock()
+	defer lt.mu.Unlock()
+	files := make([]LeakInfo, 0, len(lt.open))
+	for _, id := range slices.Sorted(maps.Keys(lt.open)) {
+		files = append(files, lt.open[id].LeakInfo)
+	}
+	return files
+}
@@ -0,0 +1,38 @@
+package fsdecomp
+
+import "io/fs"
+
+// NoSizeLimit passed to OpenWithLimit opens a file without limiting its
+// decompressed size
+const NoSizeLimit = -1
+
+// OpenWithLimit opens the named file as Open does, but limits it to limit
+// decompressed bytes in place of the limit set with WithMaxDecompressedSize,
+// for the occasional trusted file larger than the rest. A limit of zero or
+// less, such as NoSizeLimit, removes the limit. Uncompressed files are not
+// limited.
+func (dfs *DecompressFS) OpenWithLimit(name string, limit int64) (fs.File, error) {
+	return dfs.open(name, limit)
+}
+
+// readLimited reads from df.reader, failing with ErrTooLarge once more than
+// df.maxSize bytes have been read (see WithMaxDecompressedSize)
+func (df *decompressFile) readLimited(p []byte) (int, error) {
+	if df.maxSize <= 0 {
+		return df.reader.Read(p)
+	}
+	remaining := df.maxSize - df.read
+	if remaining <= 0 {
+		// At the limit, so any further data is too much
+		var probe [1]byte
+		n, err := df.reader.Read(probe[:])
+		if n > 0 {
+			return 0, ErrTooLarge
+		}
+		return 0, err
+	}
+	if int64(len(p)) > remaining {
+		p = p[:remaining]
+	}
+	return df.reader.Read(p)
+}
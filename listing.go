@@ -0,0 +1,192 @@
+package fsdecomp
+
+import (
+	"errors"
+	"io"
+	"io/fs"
+	"slices"
+	"strings"
+	"sync"
+)
+
+// defaultListingLimit is the number of entries above which a directory is
+// too large to list just to resolve one name in it (see WithListingLimit)
+const defaultListingLimit = 10000
+
+// errLargeDir is returned by listDir for directories with more entries than
+// the listing limit
+var errLargeDir = errors.New("directory too large to list")
+
+// largeDirs remembers the directories found to have more entries than the
+// listing limit, so they are only listed once
+type largeDirs struct {
+	mu   sync.Mutex
+	dirs map[string]bool
+}
+
+// listingLimit returns the number of entries above which directories aren't
+// listed to resolve names, or -1 for no limit
+func (dfs *DecompressFS) listingLimit() int {
+	if dfs.maxListing == 0 {
+		return defaultListingLimit
+	}
+	return max(dfs.maxListing, -1)
+}
+
+// listDir lists the named directory in the underlying filesystem, sorted by
+// name, to resolve a name in it. It fails with errLargeDir for directories
+// with more entries than the listing limit, reading no more than one entry
+// beyond the limit, even from filesystems implementing fs.ReadDirFS, unless
+// their directories can't be read in part.
+func (dfs *DecompressFS) listDir(b backend, dir string) ([]fs.DirEntry, error) {
+	limit := dfs.listingLimit()
+	if limit < 0 {
+		return dfs.readDir(b, dir)
+	}
+	dfs.large.mu.Lock()
+	large := dfs.large.dirs[dir]
+	dfs.large.mu.Unlock()
+	if large {
+		return nil, errLargeDir
+	}
+
+	entries, err := dfs.readDirPart(b, dir, limit+1)
+	if err != nil {
+		return nil, err
+	}
+	if len(entries) > limit {
+		dfs.large.mu.Lock()
+		if dfs.large.dirs == nil {
+			dfs.large.dirs = make(map[string]bool)
+		}
+		dfs.large.dirs[dir] = true
+		dfs.large.mu.Unlock()
+		return nil, errLargeDir
+	}
+	slices.SortFunc(entries, func(a, b fs.DirEntry) int {
+		return strings.Compare(a.Name(), b.Name())
+	})
+	return entries, nil
+}
+
+// readDir lists the named directory of the underlying filesystem, as
+// fs.ReadDir does. Some backends report an empty directory with io.EOF,
+// from opening or listing it, which is returned as an empty listing.
+func (dfs *DecompressFS) readDir(b backend, name string) ([]fs.DirEntry, error) {
+	entries, err := b.readDir(name)
+	if errors.Is(err, io.EOF) {
+		return []fs.DirEntry{}, nil
+	}
+	return entries, err
+}
+
+// readDirPart lists up to n entries of the named directory of the underlying
+// filesystem, in directory order, treating io.EOF as readDir does. The
+// directory is read through its file, in as many calls as it takes, and only
+// listed in full if its file can't be read from but the filesystem can list
+// it.
+func (dfs *DecompressFS) readDirPart(b backend, name string, n int) ([]fs.DirEntry, error) {
+	file, err := b.Open(name)
+	if errors.Is(err, io.EOF) {
+		return []fs.DirEntry{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	dir, ok := file.(fs.ReadDirFile)
+	if !ok {
+		if _, ok := dfs.FS.(fs.ReadDirFS); ok {
+			return dfs.readDir(b, name)
+		}
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: errors.New("not implemented")}
+	}
+	b.countReadDir()
+	var entries []fs.DirEntry
+	for len(entries) < n {
+		// ReadDir may return fewer entries than asked for before the end
+		batch, err := dir.ReadDir(n - len(entries))
+		entries = append(entries, batch...)
+		if errors.Is(err, io.EOF) || err == nil && len(batch) == 0 {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return entries, nil
+}
+
+// logicalDir returns file, opened as the directory name, wrapped so that its
+// ReadDir lists the entries DecompressFS.ReadDir does rather than those of
+// the underlying filesystem. Anything that isn't a directory is returned as
+// it is.
+func (dfs *DecompressFS) logicalDir(file fs.File, name string, resolution Resolution) fs.File {
+	dir, ok := file.(fs.ReadDirFile)
+	if !ok {
+		return file
+	}
+	if info, err := file.Stat(); err != nil || !info.IsDir() {
+		return file
+	}
+	return &dirFile{File: file, dir: dir, dfs: dfs, name: name, resolution: resolution}
+}
+
+// dirFile is a directory opened from the underlying filesystem, listing its
+// logical entries. They are listed in full on the first call to ReadDir,
+// and handed out from there.
+type dirFile struct {
+	fs.File
+	dir        fs.ReadDirFile
+	dfs        *DecompressFS
+	name       string
+	resolution Resolution
+	entries    []fs.DirEntry
+	listed     bool
+}
+
+func (d *dirFile) ReadDir(n int) ([]fs.DirEntry, error) {
+	if !d.listed {
+		entries, err := d.list()
+		if err != nil {
+			return nil, err
+		}
+		d.entries, d.listed = entries, true
+	}
+	if n <= 0 {
+		entries := d.entries
+		d.entries = nil
+		if entries == nil {
+			entries = []fs.DirEntry{}
+		}
+		return entries, nil
+	}
+	if len(d.entries) == 0 {
+		return nil, io.EOF
+	}
+	n = min(n, len(d.entries))
+	entries := d.entries[:n:n]
+	d.entries = d.entries[n:]
+	return entries, nil
+}
+
+// list lists the logical entries of the directory, reading it from the
+// opened directory itself unless the snapshot index already holds it
+func (d *dirFile) list() ([]fs.DirEntry, error) {
+	if d.dfs.index != nil {
+		return d.dfs.ReadDir(d.name)
+	}
+	entries, err := d.dir.ReadDir(-1)
+	if err != nil {
+		return nil, err
+	}
+	slices.SortFunc(entries, func(a, b fs.DirEntry) int {
+		return strings.Compare(a.Name(), b.Name())
+	})
+	return d.dfs.logicalEntries(d.dfs.backend(nil), d.name, entries), nil
+}
+
+// Unwrap returns the directory as opened from the underlying filesystem
+func (d *dirFile) Unwrap() fs.File {
+	return d.File
+}
@@ -0,0 +1,35 @@
+// Package lz4fmt adds LZ4 frame (.lz4) support to fsdecomp.
+//
+// Importing the package, usually for its side effect only, registers the
+// decompressor with fsdecomp.Register:
+//
+//	import _ "github.com/AndreRenaud/FSDecomp/lz4fmt"
+package lz4fmt
+
+import (
+	"io"
+
+	fsdecomp "github.com/AndreRenaud/FSDecomp"
+	"github.com/pierrec/lz4/v4"
+)
+
+// Extension is the file extension handled by this package
+const Extension = ".lz4"
+
+// Decompressor decompresses LZ4 frames
+var Decompressor fsdecomp.Decompressor = decompressor{}
+
+func init() {
+	fsdecomp.Register(Extension, Decompressor)
+}
+
+type decompressor struct{}
+
+func (decompressor) MagicNumber() []byte {
+	return []byte{0x04, 0x22, 0x4d, 0x18}
+}
+
+func (decompressor) NewReader(r io.Reader) (io.ReadCloser, error) {
+	// LZ4 reader doesn't need to be closed
+	return io.NopCloser(lz4.NewReader(r)), nil
+}
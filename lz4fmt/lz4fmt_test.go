@@ -0,0 +1,85 @@
+package lz4fmt_test
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"testing"
+	"testing/fstest"
+
+	fsdecomp "github.com/AndreRenaud/FSDecomp"
+	_ "github.com/AndreRenaud/FSDecomp/lz4fmt"
+	lz4 "github.com/pierrec/lz4/v4"
+)
+
+// TestRegistered ensures importing the package is enough to open .lz4 files
+func TestRegistered(t *testing.T) {
+	var buf bytes.Buffer
+	lw := lz4.NewWriter(&buf)
+	if _, err := lw.Write([]byte("lz4 content")); err != nil {
+		t.Fatalf("Failed to write lz4 data: %v", err)
+	}
+	if err := lw.Close(); err != nil {
+		t.Fatalf("Failed to close lz4 writer: %v", err)
+	}
+
+	dfs := fsdecomp.New(fstest.MapFS{
+		"file.txt.lz4": &fstest.MapFile{Data: buf.Bytes()},
+	})
+	file, err := dfs.Open("file.txt")
+	if err != nil {
+		t.Fatalf("Unexpected error opening file.txt: %v", err)
+	}
+	defer file.Close()
+
+	data, err := io.ReadAll(file)
+	if err != nil {
+		t.Fatalf("Error reading file: %v", err)
+	}
+	if string(data) != "lz4 content" {
+		t.Errorf("Expected content %q, got %q", "lz4 content", string(data))
+	}
+}
+
+// TestContentChecksum ensures a corrupt frame content checksum is reported
+// as a DecompressError once the file has been read to EOF
+func TestContentChecksum(t *testing.T) {
+	var buf bytes.Buffer
+	lw := lz4.NewWriter(&buf)
+	if err := lw.Apply(lz4.ChecksumOption(true)); err != nil {
+		t.Fatalf("Failed to enable lz4 content checksum: %v", err)
+	}
+	if _, err := lw.Write([]byte("lz4 content with a checksum")); err != nil {
+		t.Fatalf("Failed to write lz4 data: %v", err)
+	}
+	if err := lw.Close(); err != nil {
+		t.Fatalf("Failed to close lz4 writer: %v", err)
+	}
+	// The content checksum is the final 4 bytes of the frame
+	data := buf.Bytes()
+	data[len(data)-1] ^= 0xff
+
+	dfs := fsdecomp.New(fstest.MapFS{
+		"corrupt.txt.lz4": &fstest.MapFile{Data: data},
+	})
+	file, err := dfs.Open("corrupt.txt")
+	if err != nil {
+		t.Fatalf("Unexpected error opening corrupt.txt: %v", err)
+	}
+	defer file.Close()
+
+	_, err = io.ReadAll(file)
+	var decompErr *fsdecomp.DecompressError
+	if !errors.As(err, &decompErr) {
+		t.Fatalf("Expected DecompressError reading to EOF, got %v", err)
+	}
+	if decompErr.Format != "lz4" {
+		t.Errorf("Expected format %q, got %q", "lz4", decompErr.Format)
+	}
+	if decompErr.Name != "corrupt.txt.lz4" {
+		t.Errorf("Expected name %q, got %q", "corrupt.txt.lz4", decompErr.Name)
+	}
+	if !errors.Is(err, lz4.ErrInvalidFrameChecksum) {
+		t.Errorf("Expected invalid frame checksum error, got %v", err)
+	}
+}
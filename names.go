@@ -0,0 +1,141 @@
+package fsdecomp
+
+import (
+	"io"
+	"io/fs"
+	"path"
+	"strings"
+)
+
+// withNormalizedName returns file, opened as name and found as resolution
+// describes, with Stat reporting the base of name as its name (see
+// WithNormalizedNames). Files that already report that name are returned as
+// they are. Otherwise the wrapper keeps the ReadDir, Seek and ReadAt methods
+// of the file, where it has them.
+func withNormalizedName(file fs.File, name string, resolution Resolution) fs.File {
+	info, err := file.Stat()
+	if err != nil || info.Name() == path.Base(name) {
+		return file
+	}
+	nf := namedFile{File: file, name: path.Base(name), resolution: resolution}
+	if dir, ok := file.(fs.ReadDirFile); ok {
+		return namedDirFile{namedFile: nf, dir: dir}
+	}
+	seeker, ok := file.(io.Seeker)
+	if !ok {
+		return nf
+	}
+	if readerAt, ok := file.(io.ReaderAt); ok {
+		return namedRandomFile{namedFile: nf, Seeker: seeker, ReaderAt: readerAt}
+	}
+	return namedSeekFile{namedFile: nf, Seeker: seeker}
+}
+
+// namedFile gives a file a different name in Stat
+type namedFile struct {
+	fs.File
+	name       string
+	resolution Resolution
+}
+
+func (nf namedFile) Stat() (fs.FileInfo, error) {
+	info, err := nf.File.Stat()
+	if err != nil {
+		return nil, err
+	}
+	return fileInfoWrapper{FileInfo: info, name: nf.name, size: -1}, nil
+}
+
+// Unwrap returns the file nf renames
+func (nf namedFile) Unwrap() fs.File {
+	return nf.File
+}
+
+// namedDirFile is a namedFile for a directory
+type namedDirFile struct {
+	namedFile
+	dir fs.ReadDirFile
+}
+
+func (nd namedDirFile) ReadDir(n int) ([]fs.DirEntry, error) {
+	return nd.dir.ReadDir(n)
+}
+
+// namedSeekFile is a namedFile for a file that can seek
+type namedSeekFile struct {
+	namedFile
+	io.Seeker
+}
+
+// namedRandomFile is a namedFile for a file that can seek and read at an offset
+type namedRandomFile struct {
+	namedFile
+	io.Seeker
+	io.ReaderAt
+}
+
+// compressedEntry returns the entry listing the compressed file entry, in
+// directory dir and compressed in layers, under its logical name as given by
+// the name mapper, if any, applying its sidecar if it has one
+func (dfs *DecompressFS) compressedEntry(b backend, dir string, entry fs.DirEntry, logical string, layers []format, present map[string]bool) renamedEntry {
+	re := renamedEntry{DirEntry: entry, name: dfs.mapName(dir, logical)}
+	if len(layers) == 1 && dfs.compatLevel >= 2 {
+		// Report the size Stat would once the file is opened
+		file := path.Join(dir, entry.Name())
+		re.size = func(info fs.FileInfo) int64 {
+			return dfs.entrySize(file, info, layers[0])
+		}
+	}
+	if dfs.sidecars != nil && present[entry.Name()+dfs.sidecars.suffix] {
+		if meta := dfs.sidecarFor(b, path.Join(dir, entry.Name())); meta != nil {
+			re.meta = meta
+			if meta.name != "" {
+				re.name = meta.name
+			}
+		}
+	}
+	return re
+}
+
+// mapName returns the name the compressed files in dir whose names without
+// their compression extensions are logical are given (see WithNameMapper)
+func (dfs *DecompressFS) mapName(dir, logical string) string {
+	if dfs.nameMapper == nil {
+		return logical
+	}
+	mapped := dfs.nameMapper(dir, logical)
+	if mapped == "" || strings.Contains(mapped, "/") || !fs.ValidPath(mapped) {
+		return logical
+	}
+	return mapped
+}
+
+// resolveRenamed finds the compressed file that the name mapper or its
+// sidecar gives name, in place of the name found by removing its extensions
+func (dfs *DecompressFS) resolveRenamed(b backend, name string) (resolved, bool) {
+	dir := path.Dir(name)
+	entries, err := dfs.listDir(b, dir)
+	if err != nil {
+		return resolved{}, false
+	}
+	present := listingNames(entries)
+	for _, entry := range entries {
+		if entry.IsDir() {
+			continue
+		}
+		logical, layers, ok := dfs.layersForName(entry.Name())
+		if !ok {
+			continue
+		}
+		if re := dfs.compressedEntry(b, dir, entry, logical, layers, present); re.name == logical || re.name != path.Base(name) {
+			continue
+		}
+		physical := path.Join(dir, entry.Name())
+		file, err := b.Open(physical)
+		if err != nil {
+			return resolved{}, false
+		}
+		return resolved{file: file, name: physical, layers: layers}, true
+	}
+	return resolved{}, false
+}
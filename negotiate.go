@@ -0,0 +1,96 @@
+package fsdecomp
+
+import (
+	"strconv"
+	"strings"
+)
+
+// NegotiateEncoding picks the content coding to send for a request with the
+// given Accept-Encoding header, following RFC 9110 section 12.5.3. available
+// lists the codings the server can provide, most preferred first; codings
+// the client accepts with equal quality are chosen in that order. Codings
+// are compared case-insensitively, with "x-gzip" treated as "gzip", and the
+// name returned is the one from available.
+//
+// The identity coding (the unencoded content) is acceptable unless the
+// header rejects it, either explicitly with "identity;q=0" or with "*;q=0"
+// and no identity entry, and is returned as "identity" when no listed
+// coding is acceptable. An empty header only accepts identity. It reports
+// false if nothing is acceptable, when a server would reply with
+// 406 Not Acceptable.
+func NegotiateEncoding(header string, available []string) (string, bool) {
+	accepted := parseAcceptEncoding(header)
+	quality := func(coding string) (q float64, listed bool) {
+		if q, ok := accepted[coding]; ok {
+			return q, true
+		}
+		q, ok := accepted["*"]
+		return q, ok
+	}
+
+	best, bestQ := "", 0.0
+	for _, coding := range available {
+		q, listed := quality(canonicalCoding(coding))
+		if listed && q > bestQ {
+			best, bestQ = coding, q
+		}
+	}
+	if best != "" {
+		return best, true
+	}
+	if q, listed := quality("identity"); !listed || q > 0 {
+		return "identity", true
+	}
+	return "", false
+}
+
+// parseAcceptEncoding returns the quality value of each coding listed in an
+// Accept-Encoding header. Malformed entries are ignored, and the highest
+// quality is kept for codings listed more than once.
+func parseAcceptEncoding(header string) map[string]float64 {
+	accepted := make(map[string]float64)
+	for _, entry := range strings.Split(header, ",") {
+		coding, params, _ := strings.Cut(entry, ";")
+		coding = canonicalCoding(coding)
+		if coding == "" {
+			continue
+		}
+		q, ok := 1.0, true
+		for _, param := range strings.Split(params, ";") {
+			key, value, _ := strings.Cut(param, "=")
+			if strings.EqualFold(strings.TrimSpace(key), "q") {
+				q, ok = parseQuality(strings.TrimSpace(value))
+			}
+		}
+		if !ok {
+			continue
+		}
+		if existing, seen := accepted[coding]; !seen || q > existing {
+			accepted[coding] = q
+		}
+	}
+	return accepted
+}
+
+// parseQuality parses a quality value, which must lie between 0 and 1 with
+// at most three decimal places
+func parseQuality(value string) (float64, bool) {
+	whole, frac, _ := strings.Cut(value, ".")
+	if whole == "" || len(frac) > 3 || strings.Trim(whole+frac, "0123456789") != "" {
+		return 0, false
+	}
+	q, err := strconv.ParseFloat(value, 64)
+	if err != nil || q < 0 || q > 1 {
+		return 0, false
+	}
+	return q, true
+}
+
+// canonicalCoding normalises a content coding name for comparison
+func canonicalCoding(coding string) string {
+	coding = strings.ToLower(strings.TrimSpace(coding))
+	if coding == "x-gzip" {
+		return "gzip"
+	}
+	return coding
+}
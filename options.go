@@ -0,0 +1,533 @@
+package fsdecomp
+
+import (
+	"hash"
+	"io"
+	"io/fs"
+	"sync"
+	"time"
+)
+
+// Option configures a DecompressFS created by New
+type Option func(*DecompressFS)
+
+// WithStdlibOnly restricts decompression to the formats implemented by the
+// Go standard library (gzip, BGZF, bzip2, zlib and raw deflate), ignoring any formats added with
+// Register. Files in other formats are treated like any other file: they are
+// not probed for by Open and keep their extension in directory listings.
+//
+// This keeps third party decoders out of the attack surface without having
+// to control which format packages are linked into the program.
+func WithStdlibOnly() Option {
+	return func(dfs *DecompressFS) {
+		dfs.formats = append([]format(nil), stdlibFormats...)
+	}
+}
+
+// WithDecompressor decompresses files ending in ext (including the leading
+// dot) with d for this filesystem only, replacing the decompressor registered
+// for ext, if any. It can be used to pick an alternative implementation of a
+// format, or to add a format without registering it globally.
+func WithDecompressor(ext string, d Decompressor) Option {
+	return func(dfs *DecompressFS) {
+		dfs.formats = withFormat(dfs.supportedFormats(), ext, d)
+	}
+}
+
+// WithDirectoryIndex makes opening a directory return the named index file
+// within it (e.g. "index.html"), decompressing it if needed. Directories
+// without an index file are opened as normal. ReadDir is unaffected.
+func WithDirectoryIndex(index string) Option {
+	return func(dfs *DecompressFS) {
+		dfs.dirIndex = index
+	}
+}
+
+// WithSysEncodingDetector decompresses files stored without a compression
+// extension when the backend's metadata says they are compressed, as object
+// stores may record in a Content-Encoding header. detect is called with the
+// Sys value of each opened file's FileInfo, and returns the extension of the
+// format it is encoded with, with or without the leading dot (e.g. "gz"),
+// and whether it is encoded at all. Files with a compression extension, and
+// formats this filesystem doesn't decompress, are opened as normal.
+//
+// The file keeps its name. ReadDir doesn't consult the metadata, so listings
+// report the compressed size of such files.
+func WithSysEncodingDetector(detect func(sys any) (format string, ok bool)) Option {
+	return func(dfs *DecompressFS) {
+		dfs.sysEncoding = detect
+	}
+}
+
+// WithNormalizedNames makes the Stat method of files opened without
+// decompression report the base of the name they were opened by, as
+// decompressed files do, rather than the name the underlying filesystem
+// gives them, which may differ for files reached through symbolic links or
+// a directory index. Opened files keep their ReadDir, Seek and ReadAt methods.
+func WithNormalizedNames() Option {
+	return func(dfs *DecompressFS) {
+		dfs.normalizedNames = true
+	}
+}
+
+// WithStrictClose makes Close fail on decompressed files that haven't been
+// read to the end, returning an IncompleteReadError (matching
+// ErrIncompleteRead), though the file is still closed. As checksums are
+// verified by the time a file has been read to the end, a nil error from
+// Close then means the whole file was decoded and verified, which catches
+// code that abandons files part way through. Reading a file fully with
+// io.Copy or fs.ReadFile satisfies it. Helpers such as ReadString and
+// ScanLines, which may stop early, ignore the error. Uncompressed files
+// are unaffected.
+func WithStrictClose() Option {
+	return func(dfs *DecompressFS) {
+		dfs.strictClose = true
+	}
+}
+
+// WithMetaSuffix decompresses files stored without a compression extension,
+// such as blobs named by their hash in a content addressed store, when a
+// metadata file alongside them names their format. Opening "<hash>" reads
+// "<hash>" + suffix, and passes its contents (up to 64KiB) to parse, which
+// returns the extension of the format the file is encoded with, with or
+// without its leading dot (e.g. "gz"), or "" if it isn't encoded. Files
+// with a compression extension, and formats this filesystem doesn't
+// decompress, are opened as normal. Metadata files that can't be read are
+// reported to the handler set by WithWarningHandler.
+func WithMetaSuffix(suffix string, parse func(data []byte) (format string)) Option {
+	return func(dfs *DecompressFS) {
+		dfs.metaSuffix = suffix
+		dfs.metaParser = parse
+	}
+}
+
+// WithMagicValidation checks that each compressed file starts with the magic
+// number of the format selected by its extension (see MagicNumber), so that
+// mislabelled or corrupt files fail at Open with a DecompressError wrapping
+// ErrMagicMismatch. Formats DetectFormat knows are checked as it checks them,
+// and others without a magic number are not checked.
+func WithMagicValidation() Option {
+	return func(dfs *DecompressFS) {
+		dfs.magicValidation = true
+	}
+}
+
+// WithResolveSymlinkTargets decompresses files opened through a symbolic
+// link whose target has a compression extension, such as "current.log"
+// pointing at "archive/2024-06-01.log.zst". The file keeps the link's name.
+//
+// Link targets are found with ReadLink if the underlying filesystem provides
+// it (as fs.ReadLinkFS does), or otherwise from the name reported by Stat.
+// Opening a dangling or looping link fails as it would without the option.
+func WithResolveSymlinkTargets() Option {
+	return func(dfs *DecompressFS) {
+		dfs.resolveSymlinks = true
+	}
+}
+
+// WithReadTransform passes the output of every decompressed file through
+// transform, which returns a reader producing the data to be read in its
+// place. Transforms are applied in the order they are given, after
+// decompression; uncompressed files are returned unchanged. As a transform
+// may change the length of the data, decompressed files don't report their
+// decompressed size in Stat when any transform is configured.
+func WithReadTransform(transform func(io.Reader) io.Reader) Option {
+	return func(dfs *DecompressFS) {
+		dfs.readTransforms = append(dfs.readTransforms, transform)
+	}
+}
+
+// WithBOMStripping removes a leading UTF-8, UTF-16LE or UTF-16BE byte order
+// mark from decompressed files, for parsers that don't expect one. It is
+// implemented with WithReadTransform.
+func WithBOMStripping() Option {
+	return WithReadTransform(stripBOM)
+}
+
+// WithMaxDecompressedSize limits each decompressed file to limit bytes, after
+// any read transforms, guarding against files that expand to far more than
+// expected. Reading beyond the limit fails with a DecompressError wrapping
+// ErrTooLarge. Uncompressed files are not limited.
+func WithMaxDecompressedSize(limit int64) Option {
+	return func(dfs *DecompressFS) {
+		dfs.maxSize = limit
+	}
+}
+
+// WithMaxFreezeSize limits the snapshots made by Freeze to limit bytes of
+// decompressed content in total. Freeze fails with an error wrapping
+// ErrTooLarge rather than exceed it.
+func WithMaxFreezeSize(limit int64) Option {
+	return func(dfs *DecompressFS) {
+		dfs.freezeLimit = limit
+	}
+}
+
+// WithUnmarshalDecoder sets the decoder Unmarshal uses in place of JSON.
+// newDecoder is called with the contents of each file, e.g.
+//
+//	fsdecomp.WithUnmarshalDecoder(func(r io.Reader) fsdecomp.ValueDecoder { return gob.NewDecoder(r) })
+func WithUnmarshalDecoder(newDecoder func(io.Reader) ValueDecoder) Option {
+	return func(dfs *DecompressFS) {
+		dfs.newValueDecoder = newDecoder
+	}
+}
+
+// WithMaxLineLength sets the longest line, in bytes, that ScanLines
+// accepts. Longer lines fail with bufio.ErrTooLong.
+func WithMaxLineLength(n int) Option {
+	return func(dfs *DecompressFS) {
+		dfs.maxLineLength = n
+	}
+}
+
+// WithMinDecompressedRatio reports decompressed files that turn out to be
+// smaller than ratio times their compressed size, as a truncated file often
+// does, to the handler set by WithWarningHandler. The warning is a
+// DecompressError wrapping ErrLowRatio. Files are checked once they have
+// been read to EOF, when their decompressed size is known, and reading them
+// is unaffected. Text typically compresses by a factor of three or more, so
+// a ratio of around 1.5 suits it.
+func WithMinDecompressedRatio(ratio float64) Option {
+	return func(dfs *DecompressFS) {
+		dfs.minRatio = ratio
+	}
+}
+
+// WithMaxDecompressedRatio sets the largest ratio of decompressed to
+// compressed size the files of dfs have, where that is less than their
+// formats allow. Formats whose size fields wrap, such as gzip's ISIZE, which
+// holds the size modulo 4GiB, only report the decompressed size in Stat
+// where the file couldn't have wrapped it: with gzip's worst case ratio of
+// 1032, that is for compressed files of less than about 4MiB. Setting a
+// lower ratio extends this to larger files, such as 400MiB for a ratio of
+// 10. A file that compresses better than ratio may then report a size too
+// small by a multiple of 4GiB.
+func WithMaxDecompressedRatio(ratio float64) Option {
+	return func(dfs *DecompressFS) {
+		dfs.maxRatio = ratio
+	}
+}
+
+// WithSingleMemberSizes declares that compressed files in formats of
+// concatenated members, such as gzip, hold a single member, as gzip itself
+// writes, so that their Stat reports the size recorded in their trailer
+// (see MemberSizer), and ContentLength treats it as exact. Without it their
+// size is unknown, as finding out would mean reading the whole file. Files
+// of several members, such as those made by concatenating gzip files, then
+// report the size of their last member.
+func WithSingleMemberSizes() Option {
+	return func(dfs *DecompressFS) {
+		dfs.singleMember = true
+	}
+}
+
+// WithSlowWriteHandler calls handler for each write to its destination
+// made by a decompressed file's WriteTo method, as used by io.Copy, that
+// takes longer than threshold, such as when proxying to a slow client. Once
+// a write has been slow, WriteTo copies the rest of the file in small chunks
+// through a buffer of its own, returning the pooled buffer it was using
+// (see WithBufferPool), so that transfers blocked on slow destinations hold
+// as little memory as their decoders need. The handler may be called
+// concurrently. A threshold of zero or less disables it.
+func WithSlowWriteHandler(threshold time.Duration, handler func(SlowWrite)) Option {
+	return func(dfs *DecompressFS) {
+		dfs.slowWrite = threshold
+		dfs.onSlowWrite = handler
+		if handler == nil {
+			dfs.slowWrite = 0
+		}
+	}
+}
+
+// WithVariantCheck makes VerifyAll compare every file that exists both
+// uncompressed and compressed, such as "app.js" and "app.js.gz", reporting
+// compressed variants whose contents differ as a DecompressError wrapping
+// ErrVariantMismatch. This catches precompressed files left stale after the
+// uncompressed file was updated. Open is unaffected, and keeps returning the
+// uncompressed file.
+func WithVariantCheck() Option {
+	return func(dfs *DecompressFS) {
+		dfs.variantCheck = true
+	}
+}
+
+// WithDigest computes a digest of each decompressed file's contents as it
+// is read, using hashes from newHash (e.g. sha256.New, or an xxhash
+// constructor), so that files needn't be read a second time to hash them.
+// The digest is returned by the file's Sum method,
+//
+//	Sum() ([]byte, bool)
+//
+// which reports false until the file has been read to EOF, whether by Read,
+// io.Copy or fs.ReadFile. Uncompressed files are returned as they are by the
+// underlying filesystem, and have no Sum method.
+func WithDigest(newHash func() hash.Hash) Option {
+	return func(dfs *DecompressFS) {
+		dfs.newDigest = newHash
+	}
+}
+
+// WithChecksumVerification checks decompressed files against the SHA-256
+// checksums in sidecar files, as mirrors commonly publish them, written as
+// by sha256sum. With ChecksumCompressed, the file as stored is checked
+// against a sidecar named for it, such as "file.gz.sha256"; with
+// ChecksumDecompressed, the decompressed data is checked against a sidecar
+// named for the file without its compression extensions, such as
+// "file.sha256". Files are checked once read to the end, which fails with a
+// DecompressError wrapping ErrChecksumMismatch if they don't match. Files
+// without a sidecar are read unchecked, while Open fails for a sidecar that
+// can't be read or doesn't hold a checksum. Uncompressed files are not
+// checked, and other values of side disable checking.
+func WithChecksumVerification(side ChecksumSide) Option {
+	return func(dfs *DecompressFS) {
+		switch side {
+		case ChecksumCompressed, ChecksumDecompressed:
+			dfs.checksumSide = side
+		default:
+			dfs.checksumSide = ""
+		}
+	}
+}
+
+// WithTransforms adds reader stages for files whose names end in their
+// extensions, chained with decompression. Transforms are handled as formats
+// that may be layered with others: "data.json.zst.enc" is read by applying
+// the ".enc" transform and then decompressing the zstd stream, opens as
+// "data.json", and is listed as such by ReadDir, while "data.json.enc.zst"
+// is decompressed before the transform is applied. A file may have any
+// number of transform layers, and at most one compression layer unless
+// WithChainedDecompression allows more, up to a total of four.
+//
+// Failures in a transform are reported as a DecompressError whose Format
+// is the transform's extension without its dot. When magic validation is
+// enabled, only the outermost layer is checked. Transforms are probed
+// after the formats already configured, in the order given.
+func WithTransforms(transforms ...Transform) Option {
+	return func(dfs *DecompressFS) {
+		for _, t := range transforms {
+			formats := withFormat(dfs.supportedFormats(), t.Ext, transformDecompressor{t})
+			for i := range formats {
+				if formats[i].ext == t.Ext {
+					formats[i].transform = true
+				}
+			}
+			dfs.formats = formats
+		}
+	}
+}
+
+// WithMetadataSidecars reads metadata for compressed files from sidecar
+// files named by appending suffix, such as "report.pdf.gz.meta" for
+// "report.pdf.gz". A sidecar is a JSON object of at most maxSize bytes, any
+// of whose fields may be omitted:
+//
+//	{"modTime": "2024-06-01T12:00:00Z", "mode": "0644", "name": "Q2 report.pdf"}
+//
+// The file's FileInfo, from Stat or ReadDir, reports the given modification
+// time and permission bits in place of those of the compressed file, and
+// the given name in place of its logical name. Files can be opened by that
+// name unless another file provides it, and are listed under it by ReadDir.
+// Sidecars themselves are hidden from listings, but can still be opened.
+//
+// Sidecars are read when first needed and cached for the life of the
+// filesystem. Unreadable, oversized or malformed sidecars are reported to
+// the handler set by WithWarningHandler, and the file keeps its own
+// metadata. Uncompressed files are unaffected.
+func WithMetadataSidecars(suffix string, maxSize int64) Option {
+	return func(dfs *DecompressFS) {
+		dfs.sidecars = &sidecars{suffix: suffix, maxSize: maxSize}
+	}
+}
+
+// WithWarningHandler calls handler with problems that don't cause an
+// operation to fail, such as a malformed metadata sidecar. Warnings are
+// discarded by default. The handler may be called concurrently.
+func WithWarningHandler(handler func(error)) Option {
+	return func(dfs *DecompressFS) {
+		dfs.warning = handler
+	}
+}
+
+// WithSplitParts joins compressed files that have been split into numbered
+// parts, such as "image.img.zst.000", "image.img.zst.001" and so on, each a
+// slice of the compressed stream. Open("image.img") reads the parts in turn
+// through a single decompressor, and ReadDir lists them as one "image.img"
+// entry, whose size is that of the parts combined, in place of the parts.
+// Part numbers have at least two digits and start at zero; opening a file
+// with a part missing fails with an error wrapping ErrMissingPart that names
+// the first missing part, numbered with as many digits as the parts found.
+//
+// Parts are found by listing their directory, so Open does this for names
+// that are not otherwise found. The parts themselves can still be opened by
+// their own names.
+func WithSplitParts() Option {
+	return func(dfs *DecompressFS) {
+		dfs.splitParts = true
+	}
+}
+
+// WithLeakDetection records where each decompressed file is opened, so that
+// files that are never closed can be found. OpenFiles lists the files still
+// open, each with the stack trace of its Open call; Close reports them as
+// LeakError warnings to the handler set by WithWarningHandler, as it does
+// files that are garbage collected without being closed. Capturing stack
+// traces makes Open slower, so this is meant for tests and staging; without
+// the option, nothing is recorded. Uncompressed files are not tracked.
+func WithLeakDetection() Option {
+	return func(dfs *DecompressFS) {
+		dfs.leaks = &leakTracker{}
+	}
+}
+
+// WithNameMapper changes the names compressed files are given, which are
+// otherwise their names without their compression extensions. mapper is
+// called with the directory holding each compressed file and that name, and
+// returns the name to use, e.g. to rewrite "data.json" to "data.ndjson".
+// Results that are empty or not a single path element leave the name
+// unchanged. Listings and Stat report mapped names, and Open accepts them,
+// falling back to them when no file is found by removing extensions, so
+// the unmapped names can still be opened too. Names given by metadata
+// sidecars (see WithMetadataSidecars) take precedence.
+func WithNameMapper(mapper func(dir, name string) string) Option {
+	return func(dfs *DecompressFS) {
+		dfs.nameMapper = mapper
+	}
+}
+
+// WithPreferCompressedIn gives compressed files precedence over plain files
+// of the same name in directories whose paths match any of patterns, as
+// path.Match does, such as a CDN origin where both are present but the
+// compressed ones are canonical. In those directories Open("x.txt") returns
+// the decompressed contents of "x.txt.gz" even if "x.txt" exists, and
+// listings describe it. Patterns match directories themselves rather than
+// their subdirectories: "cdn" matches only "cdn", and "cdn/*" its children.
+// The root directory is ".".
+func WithPreferCompressedIn(patterns ...string) Option {
+	return func(dfs *DecompressFS) {
+		dfs.preferIn = append(dfs.preferIn, patterns...)
+	}
+}
+
+// WithHiddenFiles omits files from ReadDir listings whose names (without
+// their directory) match reports true for, such as auxiliary files used by
+// a decompressor. Hidden files can still be opened by name. The option may
+// be given more than once, hiding files that match any of the functions.
+func WithHiddenFiles(match func(name string) bool) Option {
+	return func(dfs *DecompressFS) {
+		dfs.hidden = append(dfs.hidden, match)
+	}
+}
+
+// WithChainedDecompression lets files be compressed more than once, up to
+// limit times, with the formats given by their extensions from the outside
+// in. "file.txt.bz2.gz" is a gzip stream of a bzip2 stream: it is read by
+// decompressing the gzip stream and then the bzip2 stream within it, opens
+// as "file.txt", and is listed as such by ReadDir. Without the option a
+// file has at most one compression layer, and "file.txt.bz2.gz" opens as
+// "file.txt.bz2", decompressed once.
+//
+// A file may have up to four layers in all, including any transforms, or
+// limit if that is more. Open probes every combination of formats for names
+// that are not found, so allowing longer chains makes misses slower.
+func WithChainedDecompression(limit int) Option {
+	return func(dfs *DecompressFS) {
+		dfs.chainLimit = limit
+	}
+}
+
+// WithProbeStrategy sets how Open checks for the compressed variants of a
+// name that isn't found as it is, such as "data.json.gz" for "data.json".
+// The default, ProbeAuto, calls Stat for each candidate if the underlying
+// filesystem implements fs.StatFS, and only opens the one that exists.
+// The name itself is always tried with Open first.
+func WithProbeStrategy(strategy ProbeStrategy) Option {
+	return func(dfs *DecompressFS) {
+		dfs.probeStrategy = strategy
+	}
+}
+
+// WithCompatLevel keeps the observable behavior of an earlier release, such
+// as the contents and order of listings, for callers with recorded outputs
+// that would otherwise change on upgrade, or opts in to newer behavior.
+// Level 0 is the oldest behavior, DefaultCompatLevel the default, and
+// LatestCompatLevel the newest; the documentation of DefaultCompatLevel
+// describes what each level changes. Levels above the latest are treated as
+// the latest.
+func WithCompatLevel(level int) Option {
+	return func(dfs *DecompressFS) {
+		dfs.compatLevel = min(max(level, 0), LatestCompatLevel)
+	}
+}
+
+// WithWalkFilter limits the entries visited by the methods that walk a tree,
+// VerifyAll, TarGz and Freeze, and by WalkParallel when walking the
+// filesystem. filter is called with the path and entry of each file and
+// directory below the root of the walk, and returns whether to include it;
+// directories it excludes aren't descended into, e.g.
+//
+//	fsdecomp.WithWalkFilter(func(path string, d fs.DirEntry) bool { return d.Name() != "node_modules" })
+func WithWalkFilter(filter func(path string, d fs.DirEntry) bool) Option {
+	return func(dfs *DecompressFS) {
+		dfs.walkFilter = filter
+	}
+}
+
+// WithListingLimit sets the number of entries above which a directory is
+// too large to list just to resolve a name in it, 10,000 by default, so that
+// huge directories slow Open down no more than probing does. Above the
+// limit, ProbeByReadDir falls back to ProbeByOpen, and names given by
+// metadata sidecars or WithNameMapper, and split files, can't be found by
+// Open, though ReadDir still lists them. Directories found to be over the
+// limit aren't listed again. A negative limit removes it.
+func WithListingLimit(limit int) Option {
+	return func(dfs *DecompressFS) {
+		dfs.maxListing = limit
+	}
+}
+
+// WithEagerStat stats each compressed file as soon as it is opened, before
+// any of it is read, and answers every later Stat of the decompressed file
+// from that result. By default the compressed file is only statted the first
+// time the decompressed file's Stat is called, which may be after it has
+// been read or closed, so the underlying filesystem's files must support
+// Stat at any point while they are open. Use this option for filesystems
+// whose files can only be statted before they are read, such as streaming
+// adapters.
+func WithEagerStat() Option {
+	return func(dfs *DecompressFS) {
+		dfs.eagerStat = true
+	}
+}
+
+// WithBufferPool supplies the pool used for the intermediate buffers when
+// copying decompressed data, such as by io.Copy via the files' WriteTo method.
+// The pool must hold non-empty *[]byte values, so its New function should
+// allocate one, e.g.
+//
+//	&sync.Pool{New: func() any { buf := make([]byte, 64*1024); return &buf }}
+func WithBufferPool(pool *sync.Pool) Option {
+	return func(dfs *DecompressFS) {
+		dfs.bufferPool = pool
+	}
+}
+
+// WithSnapshotIndex builds an immutable index of the logical tree, mapping
+// each name to the physical file and format that provide it, and answers
+// Open and ReadDir (and so Stat, Glob and WalkDir) from it without probing.
+// It suits filesystems whose contents never change, such as embed.FS;
+// changes made to the underlying filesystem after a directory has been
+// indexed are not seen.
+//
+// Directories are indexed the first time they are used, or all at once
+// by New if eager is set. Where several files provide the same logical
+// name, the index holds the one Open would pick: the uncompressed file, or
+// else the first in probe order, and listings contain each name once, sorted.
+//
+// The index costs roughly 500 bytes per file, about 50MB for a tree of
+// 100,000 files.
+func WithSnapshotIndex(eager bool) Option {
+	return func(dfs *DecompressFS) {
+		dfs.index = &snapshotIndex{eager: eager}
+	}
+}
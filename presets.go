@@ -0,0 +1,63 @@
+package fsdecomp
+
+import "sync"
+
+// LowMemory configures a filesystem for constrained environments: copies
+// use 4KiB buffers, decompressed files are limited to 64MiB, and ScanLines
+// accepts lines of up to 16KiB. Options given after it in the same call to
+// New override its settings.
+//
+// Decoder settings belong to the format packages, so memory hungry formats
+// may need configuring separately, e.g. zstd with a decoder using
+// zstd.WithDecoderLowmem and zstd.WithDecoderConcurrency(1) passed to
+// WithDecompressor.
+func LowMemory() Option {
+	return options(
+		WithBufferPool(newBufferPool(4*1024)),
+		WithMaxDecompressedSize(64<<20),
+		WithMaxLineLength(16*1024),
+	)
+}
+
+// ServerThroughput configures a filesystem for serving many requests from
+// an unchanging tree, such as embed.FS: Open and ReadDir are answered from
+// a snapshot index built on demand (see WithSnapshotIndex), and copies use
+// 256KiB buffers. Options given after it in the same call to New override
+// its settings.
+func ServerThroughput() Option {
+	return options(
+		WithSnapshotIndex(false),
+		WithBufferPool(newBufferPool(256*1024)),
+	)
+}
+
+// Paranoid configures a filesystem for untrusted content: only the standard
+// library's decoders are used, each compressed file must start with its
+// format's magic number, decompressed files are limited to 256MiB, and
+// VerifyAll checks that compressed variants match their uncompressed files.
+// Options given after it in the same call to New override its settings.
+func Paranoid() Option {
+	return options(
+		WithStdlibOnly(),
+		WithMagicValidation(),
+		WithMaxDecompressedSize(256<<20),
+		WithVariantCheck(),
+	)
+}
+
+// options combines several options into one, applied in order
+func options(opts ...Option) Option {
+	return func(dfs *DecompressFS) {
+		for _, opt := range opts {
+			opt(dfs)
+		}
+	}
+}
+
+// newBufferPool returns a pool of copy buffers of the given size
+func newBufferPool(size int) *sync.Pool {
+	return &sync.Pool{New: func() any {
+		buf := make([]byte, size)
+		return &buf
+	}}
+}
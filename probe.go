@@ -0,0 +1,95 @@
+package fsdecomp
+
+import (
+	"errors"
+	"io/fs"
+	"path"
+	"slices"
+)
+
+// ProbeStrategy selects how Open checks for the compressed variants of a
+// name that isn't found as it is (see WithProbeStrategy)
+type ProbeStrategy int
+
+const (
+	// ProbeAuto uses ProbeByStat if the underlying filesystem implements
+	// fs.StatFS, and ProbeByOpen otherwise
+	ProbeAuto ProbeStrategy = iota
+
+	// ProbeByOpen tries to open each candidate name in turn
+	ProbeByOpen
+
+	// ProbeByStat calls Stat for each candidate name in turn, and only
+	// opens a candidate that exists. It suits filesystems where opening a
+	// file is expensive, such as ones that fetch it from a remote store.
+	ProbeByStat
+
+	// ProbeByReadDir lists the directory once, and only opens a candidate
+	// that is listed. It suits filesystems where each lookup is a round
+	// trip, but is slow for very large directories.
+	ProbeByReadDir
+)
+
+// prober checks candidate names for existence while resolving a single name
+type prober struct {
+	b        backend
+	strategy ProbeStrategy
+	listing  map[string]bool // Names in the directory, for ProbeByReadDir
+	misses   int             // Candidates found not to exist
+}
+
+// newProber returns a prober for names in dir, using the configured strategy
+func (dfs *DecompressFS) newProber(b backend, dir string) *prober {
+	p := &prober{b: b, strategy: dfs.probeStrategy}
+	if p.strategy == ProbeAuto {
+		p.strategy = ProbeByOpen
+		if _, ok := dfs.FS.(fs.StatFS); ok {
+			p.strategy = ProbeByStat
+		}
+	}
+	if p.strategy == ProbeByReadDir {
+		entries, err := dfs.listDir(b, dir)
+		if err != nil {
+			if errors.Is(err, fs.ErrNotExist) {
+				// Nothing can be found in a missing directory
+				p.listing = map[string]bool{}
+				return p
+			}
+			p.strategy = ProbeByOpen
+			return p
+		}
+		p.listing = listingNames(slices.DeleteFunc(entries, fs.DirEntry.IsDir))
+	}
+	return p
+}
+
+// open opens the named candidate if it exists. A candidate reported to
+// exist that then fails to open is treated as missing, so probing moves on,
+// as is a directory, which is never decompressed.
+func (p *prober) open(name string) (fs.File, bool) {
+	switch p.strategy {
+	case ProbeByStat:
+		if info, err := p.b.stat(name); err != nil || info.IsDir() {
+			p.misses++
+			return nil, false
+		}
+	case ProbeByReadDir:
+		if !p.listing[path.Base(name)] {
+			p.misses++
+			return nil, false
+		}
+	}
+	file, err := p.b.Open(name)
+	if err != nil {
+		p.misses++
+		return nil, false
+	}
+	if p.strategy == ProbeByOpen {
+		if info, err := file.Stat(); err == nil && info.IsDir() {
+			file.Close()
+			p.misses++
+			return nil, false
+		}
+	}
+	return file, true
+}
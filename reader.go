@@ -0,0 +1,79 @@
+package fsdecomp
+
+import (
+	"io"
+	"io/fs"
+	"path"
+	"time"
+)
+
+// OpenReader returns the file whose contents as stored are read from r as
+// Open would return it had it been opened from the underlying filesystem
+// as name, decompressing it with the formats given by the extensions of
+// name. It lets tests exercise code that reads through a DecompressFS with
+// data that isn't in the filesystem: r is never looked up in it, though
+// options that read files alongside the file, such as
+// WithChecksumVerification, still look for them there by name.
+//
+// If r is an fs.File its Stat describes the file; otherwise the file is
+// described only by name, with a size of zero before decompression. For
+// names without a compression extension, the file returned reads r as it
+// is. r is closed on error.
+func (dfs *DecompressFS) OpenReader(r io.ReadCloser, name string) (fs.File, error) {
+	if err := dfs.errIfClosed("open", name); err != nil {
+		r.Close()
+		return nil, err
+	}
+	if !fs.ValidPath(name) {
+		r.Close()
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrInvalid}
+	}
+	file, ok := r.(fs.File)
+	if !ok {
+		file = readerFile{ReadCloser: r, name: path.Base(name)}
+	}
+	_, layers, ok := dfs.layersForName(name)
+	if !ok {
+		return file, nil
+	}
+	return dfs.decompress(resolved{file: file, name: name, layers: layers}, name, dfs.maxSize)
+}
+
+// readerFile is a reader passed to OpenReader, as a file called name
+type readerFile struct {
+	io.ReadCloser
+	name string
+}
+
+func (rf readerFile) Stat() (fs.FileInfo, error) {
+	return readerInfo{name: rf.name}, nil
+}
+
+// readerInfo describes a readerFile, of which only the name is known
+type readerInfo struct {
+	name string
+}
+
+func (ri readerInfo) Name() string {
+	return ri.name
+}
+
+func (ri readerInfo) Size() int64 {
+	return 0
+}
+
+func (ri readerInfo) Mode() fs.FileMode {
+	return 0o444
+}
+
+func (ri readerInfo) ModTime() time.Time {
+	return time.Time{}
+}
+
+func (ri readerInfo) IsDir() bool {
+	return false
+}
+
+func (ri readerInfo) Sys() any {
+	return nil
+}
@@ -0,0 +1,45 @@
+package fsdecomp
+
+import (
+	"io"
+	"io/fs"
+	"math"
+	"strings"
+)
+
+// maxReadStringHint is the most ReadString allocates ahead of reading, from
+// the size the file reports
+const maxReadStringHint = 64 * 1024
+
+// ReadString returns the contents of the named file as a string,
+// decompressing it if needed. Files whose contents exceed limit bytes are
+// rejected with an error wrapping ErrTooLarge, having read no more than one
+// byte beyond the limit.
+func (dfs *DecompressFS) ReadString(name string, limit int64) (string, error) {
+	file, err := dfs.Open(name)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	// The size is only a hint, as the size of some decompressed files isn't
+	// known, and comes from the file itself, so a forged one mustn't cause a
+	// large allocation before anything has been read
+	var b strings.Builder
+	if info, err := file.Stat(); err == nil && info.Mode().IsRegular() && info.Size() <= limit {
+		b.Grow(int(min(info.Size(), maxReadStringHint)))
+	}
+	// Reading one byte past the limit tells a file that's too large from one
+	// that fits exactly, and nothing can be past a limit of MaxInt64
+	n := limit
+	if limit < math.MaxInt64 {
+		n++
+	}
+	if _, err := io.Copy(&b, io.LimitReader(file, n)); err != nil {
+		return "", err
+	}
+	if int64(b.Len()) > limit {
+		return "", &fs.PathError{Op: "read", Path: name, Err: ErrTooLarge}
+	}
+	return b.String(), nil
+}
@@ -0,0 +1,265 @@
+package fsdecomp
+
+import (
+	"compress/bzip2"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+)
+
+// Decompressor creates readers that decompress a single compression format
+type Decompressor interface {
+	// NewReader returns a reader producing the decompressed contents of r.
+	// Closing the returned reader must release any decoder resources, but
+	// must not close r.
+	NewReader(r io.Reader) (io.ReadCloser, error)
+}
+
+// DecompressorFunc adapts an ordinary function to the Decompressor interface
+type DecompressorFunc func(r io.Reader) (io.ReadCloser, error)
+
+// NewReader implements Decompressor.NewReader by calling f(r)
+func (f DecompressorFunc) NewReader(r io.Reader) (io.ReadCloser, error) {
+	return f(r)
+}
+
+// NameDecompressor is implemented by decompressors that depend on the file
+// being read, such as to find a dictionary stored alongside it. DecompressFS
+// calls NewReaderFor in place of NewReader for them.
+type NameDecompressor interface {
+	Decompressor
+
+	// NewReaderFor is NewReader for the named file in the underlying
+	// filesystem, less the extensions of any layers outside this one
+	NewReaderFor(name string, r io.Reader) (io.ReadCloser, error)
+}
+
+// Sizer is implemented by decompressors that can determine the decompressed
+// size of a stream without decoding it, typically from a header or trailer.
+// DecompressFS uses it to report the size of decompressed files in Stat when
+// the underlying file implements io.ReaderAt, and ContentLength reports the
+// size as exact, so sizes that may be wrong must not be reported.
+type Sizer interface {
+	// DecompressedSize returns the decompressed size of the size byte
+	// compressed stream in r, and whether it could be determined exactly
+	DecompressedSize(r io.ReaderAt, size int64) (int64, bool)
+}
+
+// WrappingSizer is implemented by Sizers whose size field holds the
+// decompressed size modulo some power of two, as gzip's ISIZE holds it
+// modulo 2^32. DecompressFS only uses the size where the file is too small
+// to have decompressed to a multiple of the modulus more, given the largest
+// ratio the format can compress by, or that set with WithMaxDecompressedRatio.
+type WrappingSizer interface {
+	Sizer
+
+	// SizeLimits returns the modulus of the sizes DecompressedSize returns,
+	// and the largest ratio of decompressed to compressed size the format
+	// allows
+	SizeLimits() (modulus int64, maxRatio float64)
+}
+
+// MemberSizer is implemented by Sizers of formats whose streams may be
+// several members concatenated, such as gzip, where the size recorded only
+// covers the last member. Telling one member from several would mean
+// reading the whole stream, so DecompressFS only uses their sizes with
+// WithSingleMemberSizes, and treats them as unknown otherwise.
+type MemberSizer interface {
+	Sizer
+
+	// LastMemberSize marks DecompressedSize as returning the size of the
+	// last member of the stream
+	LastMemberSize()
+}
+
+// MagicNumber is implemented by decompressors whose streams always start
+// with a fixed signature, allowing the content of a file to be checked
+// against the format its extension claims (see WithMagicValidation). Where
+// it is the magic number of a format DetectFormat knows, streams are checked
+// as DetectFormat checks them, such as for the block size following "BZh".
+type MagicNumber interface {
+	// MagicNumber returns the bytes every stream of the format starts with
+	MagicNumber() []byte
+}
+
+// format associates a file extension with the decompressor that handles it
+type format struct {
+	ext          string
+	decompressor Decompressor
+	transform    bool // Added with WithTransforms, so may wrap other layers
+}
+
+// stdlibFormats are the built-in formats decoded by the standard library
+var stdlibFormats = []format{
+	{ext: ".gz", decompressor: gzipDecompressor{}},
+	{ext: ".bz2", decompressor: bzip2Decompressor{}},
+	{ext: ".bgz", decompressor: bgzfDecompressor{}},
+	{ext: ".zz", decompressor: zlibDecompressor{}},
+	{ext: ".zlib", decompressor: zlibDecompressor{}},
+	{ext: ".deflate", decompressor: flateDecompressor{}},
+}
+
+var (
+	formatsMu sync.RWMutex
+	formats   = append([]format(nil), stdlibFormats...)
+)
+
+// gzipDecompressor decompresses gzip streams
+type gzipDecompressor struct{}
+
+func (gzipDecompressor) MagicNumber() []byte {
+	return magicOf(FormatGzip)
+}
+
+func (gzipDecompressor) NewReader(r io.Reader) (io.ReadCloser, error) {
+	gzReader, err := gzip.NewReader(r)
+	if err != nil {
+		return nil, gzipHeaderError(err, true)
+	}
+	return gzipReader{gzReader}, nil
+}
+
+// gzipReader is a gzip.Reader reporting malformed headers of the members
+// after the first as ErrCorruptHeader
+type gzipReader struct {
+	*gzip.Reader
+}
+
+func (r gzipReader) Read(p []byte) (int, error) {
+	n, err := r.Reader.Read(p)
+	return n, gzipHeaderError(err, false)
+}
+
+// gzipHeaderError wraps err with ErrCorruptHeader if it is compress/gzip
+// reporting a bad header. A header cut short is only reported as such for
+// the first member, as for later ones the data can't be told apart from a
+// truncated body.
+func gzipHeaderError(err error, first bool) error {
+	if err == gzip.ErrHeader || (first && err == io.ErrUnexpectedEOF) {
+		return fmt.Errorf("%w: %w", ErrCorruptHeader, err)
+	}
+	return err
+}
+
+// DecompressedSize implements Sizer using the ISIZE field of the gzip
+// trailer (see GzipSize)
+func (gzipDecompressor) DecompressedSize(r io.ReaderAt, size int64) (int64, bool) {
+	return GzipSize(r, size)
+}
+
+// LastMemberSize implements MemberSizer: ISIZE records the size of the last
+// member only
+func (gzipDecompressor) LastMemberSize() {}
+
+// SizeLimits implements WrappingSizer. ISIZE holds the size modulo 2^32, and
+// deflate compresses by a factor of at most 1032.
+func (gzipDecompressor) SizeLimits() (int64, float64) {
+	return 1 << 32, maxDeflateRatio
+}
+
+// maxDeflateRatio is the most deflate can compress by, coding runs of 258
+// bytes in a single bit each
+const maxDeflateRatio = 1032
+
+// bgzfDecompressor decompresses BGZF files, as written by bgzip for
+// genomics data. These are gzip streams of many members, each holding up
+// to 64KiB, ending in an empty member, so it is gzipDecompressor without
+// the Sizer: the trailer of the last member records a size of zero.
+type bgzfDecompressor struct{}
+
+func (bgzfDecompressor) MagicNumber() []byte {
+	return gzipDecompressor{}.MagicNumber()
+}
+
+func (bgzfDecompressor) NewReader(r io.Reader) (io.ReadCloser, error) {
+	return gzipDecompressor{}.NewReader(r)
+}
+
+// bzip2Decompressor decompresses bzip2 streams
+type bzip2Decompressor struct{}
+
+func (bzip2Decompressor) MagicNumber() []byte {
+	return magicOf(FormatBzip2)
+}
+
+func (bzip2Decompressor) NewReader(r io.Reader) (io.ReadCloser, error) {
+	return io.NopCloser(bzip2.NewReader(r)), nil
+}
+
+// zlibDecompressor decompresses zlib streams (RFC 1950), as written by
+// pigz -z. Their two byte header has no fixed value, so it has no
+// MagicNumber, but is checked as DetectFormat checks it.
+type zlibDecompressor struct{}
+
+func (zlibDecompressor) detectedAs() Format {
+	return FormatZlib
+}
+
+func (zlibDecompressor) NewReader(r io.Reader) (io.ReadCloser, error) {
+	zr, err := zlib.NewReader(r)
+	if err == zlib.ErrHeader || err == io.ErrUnexpectedEOF {
+		return nil, fmt.Errorf("%w: %w", ErrCorruptHeader, err)
+	} else if err != nil {
+		return nil, err
+	}
+	return zr, nil
+}
+
+// flateDecompressor decompresses raw deflate streams (RFC 1951), which have
+// no header at all
+type flateDecompressor struct{}
+
+func (flateDecompressor) NewReader(r io.Reader) (io.ReadCloser, error) {
+	return flate.NewReader(r), nil
+}
+
+// Register makes a decompressor available for files whose names end in ext
+// (including the leading dot, e.g. ".zst"). Registering an extension that is
+// already known replaces its decompressor. Extensions are probed in the order
+// they were first registered; gzip (.gz), bzip2 (.bz2), BGZF (.bgz), zlib
+// (.zz and .zlib) and raw deflate (.deflate) are built in.
+//
+// The registry seeds the formats of each DecompressFS created by New, so
+// registration affects filesystems created after it, not existing ones.
+// Register is safe to call concurrently, and is typically called from the
+// init function of a format package, such as
+// github.com/AndreRenaud/FSDecomp/zstdfmt.
+func Register(ext string, d Decompressor) {
+	formatsMu.Lock()
+	defer formatsMu.Unlock()
+	formats = withFormat(formats, ext, d)
+}
+
+// withFormat returns a copy of formats with ext handled by d, replacing any
+// existing entry for ext in place, or appending it otherwise
+func withFormat(formats []format, ext string, d Decompressor) []format {
+	updated := append([]format(nil), formats...)
+	for i := range updated {
+		if updated[i].ext == ext {
+			updated[i].decompressor = d
+			return updated
+		}
+	}
+	return append(updated, format{ext: ext, decompressor: d})
+}
+
+// registeredFormats returns a snapshot of the registered formats in probe order
+func registeredFormats() []format {
+	formatsMu.RLock()
+	defer formatsMu.RUnlock()
+	return append([]format(nil), formats...)
+}
+
+// formatForName returns the format from formats whose extension name ends in
+func formatForName(formats []format, name string) (format, bool) {
+	for _, f := range formats {
+		if len(name) > len(f.ext) && strings.HasSuffix(name, f.ext) {
+			return f, true
+		}
+	}
+	return format{}, false
+}
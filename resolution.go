@@ -0,0 +1,55 @@
+package fsdecomp
+
+// Resolution describes how Open found a decompressed file, for debugging
+type Resolution struct {
+	Name     string   // Name passed to Open
+	Physical string   // Name of the file opened from the underlying filesystem
+	Formats  []string // Extensions of the formats decoded, outermost first
+
+	// FailedProbes counts the names, including Name itself, that were
+	// found not to exist before Physical was found
+	FailedProbes int
+
+	// Cached reports whether the snapshot index (see WithSnapshotIndex)
+	// found the file, rather than the underlying filesystem being probed
+	Cached bool
+
+	// Ops counts the calls made to the underlying filesystem to find and
+	// open the file, including any listings the snapshot index made
+	Ops BackendOps
+}
+
+// resolution describes r, found by opening name
+func (r resolved) resolution(name string) Resolution {
+	formats := make([]string, len(r.layers))
+	for i, layer := range r.layers {
+		formats[i] = layer.ext
+	}
+	return Resolution{Name: name, Physical: r.name, Formats: formats, FailedProbes: r.misses, Cached: r.cached, Ops: r.ops}
+}
+
+// ResolutionInfo returns how Open found df. It is available through an
+// interface assertion:
+//
+//	if r, ok := file.(interface{ ResolutionInfo() fsdecomp.Resolution }); ok {
+//		log.Printf("%s served from %s", r.ResolutionInfo().Name, r.ResolutionInfo().Physical)
+//	}
+//
+// Files that aren't decompressed have the method where Open wraps them:
+// files renamed by WithNormalizedNames, and directories listing their
+// logical entries. Others are returned as the underlying filesystem
+// provides them, so don't have it; they were found by opening the name
+// given, or the directory index file within it.
+func (df *decompressFile) ResolutionInfo() Resolution {
+	return df.resolution
+}
+
+// ResolutionInfo returns how Open found the file nf renames
+func (nf namedFile) ResolutionInfo() Resolution {
+	return nf.resolution
+}
+
+// ResolutionInfo returns how Open found the directory d
+func (d *dirFile) ResolutionInfo() Resolution {
+	return d.resolution
+}
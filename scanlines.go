@@ -0,0 +1,30 @@
+package fsdecomp
+
+import "bufio"
+
+// ScanLines calls fn with each line of the named file, decompressing it if
+// needed. Lines are split as by bufio.ScanLines, without their line endings,
+// and the slice passed to fn is only valid until it returns. Scanning stops
+// at the first error from fn, which is returned, or from reading the file,
+// including bufio.ErrTooLong for lines longer than the limit set with
+// WithMaxLineLength (64KiB by default).
+func (dfs *DecompressFS) ScanLines(name string, fn func(line []byte) error) error {
+	file, err := dfs.Open(name)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	maxLine := bufio.MaxScanTokenSize
+	if dfs.maxLineLength > 0 {
+		maxLine = dfs.maxLineLength
+	}
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 0, min(maxLine, 4096)), maxLine)
+	for scanner.Scan() {
+		if err := fn(scanner.Bytes()); err != nil {
+			return err
+		}
+	}
+	return scanner.Err()
+}
@@ -0,0 +1,127 @@
+package fsdecomp
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"io/fs"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// sidecars reads and caches the metadata sidecars of compressed files (see
+// WithMetadataSidecars)
+type sidecars struct {
+	suffix  string
+	maxSize int64
+
+	mu    sync.Mutex
+	cache map[string]*sidecarMeta // By name of the described file, nil if it has none
+}
+
+// sidecarMeta is the metadata parsed from a sidecar
+type sidecarMeta struct {
+	modTime time.Time   // Zero to keep the file's own
+	mode    fs.FileMode // Permission bits, if hasMode is set
+	hasMode bool
+	name    string // Empty to keep the file's logical name
+}
+
+// sidecarJSON is the format of a sidecar file
+type sidecarJSON struct {
+	ModTime time.Time `json:"modTime"`
+	Mode    string    `json:"mode"` // Octal permission bits, e.g. "0644"
+	Name    string    `json:"name"`
+}
+
+// sidecarFor returns the metadata from the sidecar of the named compressed
+// file, or nil if it has none or it can't be used. Sidecars are read once,
+// and problems with them reported as warnings.
+func (dfs *DecompressFS) sidecarFor(b backend, name string) *sidecarMeta {
+	sc := dfs.sidecars
+	sc.mu.Lock()
+	meta, ok := sc.cache[name]
+	sc.mu.Unlock()
+	if ok {
+		return meta
+	}
+
+	meta, err := sc.read(b, name+sc.suffix)
+	if err != nil {
+		meta = nil
+	}
+	sc.mu.Lock()
+	if cached, ok := sc.cache[name]; ok {
+		// Read concurrently, and already reported
+		sc.mu.Unlock()
+		return cached
+	}
+	if sc.cache == nil {
+		sc.cache = make(map[string]*sidecarMeta)
+	}
+	sc.cache[name] = meta
+	sc.mu.Unlock()
+
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		dfs.warn(&fs.PathError{Op: "sidecar", Path: name + sc.suffix, Err: err})
+	}
+	return meta
+}
+
+// read parses the named sidecar file
+func (sc *sidecars) read(fsys fs.FS, name string) (*sidecarMeta, error) {
+	file, err := fsys.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	data, err := io.ReadAll(io.LimitReader(file, sc.maxSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(data)) > sc.maxSize {
+		return nil, ErrTooLarge
+	}
+
+	var raw sidecarJSON
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return nil, err
+	}
+	meta := &sidecarMeta{modTime: raw.ModTime, name: raw.Name}
+	if raw.Name != "" && (strings.Contains(raw.Name, "/") || !fs.ValidPath(raw.Name)) {
+		return nil, errors.New("name must be a single valid path element")
+	}
+	if raw.Mode != "" {
+		mode, err := strconv.ParseUint(raw.Mode, 8, 32)
+		if err != nil || fs.FileMode(mode)&^fs.ModePerm != 0 {
+			return nil, errors.New("mode must be octal permission bits")
+		}
+		meta.mode, meta.hasMode = fs.FileMode(mode), true
+	}
+	return meta, nil
+}
+
+// warn reports a problem that doesn't fail an operation to the warning handler
+func (dfs *DecompressFS) warn(err error) {
+	if dfs.warning != nil {
+		dfs.warning(err)
+	}
+}
+
+// isSidecar reports whether the entry named name, in a directory whose
+// entries are present, is the sidecar of another entry
+func (sc *sidecars) isSidecar(name string, present map[string]bool) bool {
+	described, ok := strings.CutSuffix(name, sc.suffix)
+	return ok && present[described]
+}
+
+// listingNames returns the set of names in entries
+func listingNames(entries []fs.DirEntry) map[string]bool {
+	names := make(map[string]bool, len(entries))
+	for _, entry := range entries {
+		names[entry.Name()] = true
+	}
+	return names
+}
@@ -0,0 +1,52 @@
+package fsdecomp
+
+import "io/fs"
+
+// ContentLength returns the size of the named file's contents as read from
+// fsys, and whether that size is exact. It is intended for setting headers
+// such as Content-Length ahead of streaming a file.
+//
+// The file is opened but never decompressed to find its size: for files
+// decompressed by a DecompressFS the size is only exact when the format
+// records it in a way that can't be mistaken (see Sizer), so gzip files of
+// several members, for instance, aren't. Otherwise, and for anything that isn't a regular
+// file, the returned bool is false. Files that aren't decompressed report
+// their size from Stat.
+func ContentLength(fsys fs.FS, name string) (int64, bool, error) {
+	file, err := fsys.Open(name)
+	if err != nil {
+		return 0, false, err
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return 0, false, err
+	}
+	if !info.Mode().IsRegular() {
+		return 0, false, nil
+	}
+	if df, ok := file.(*decompressFile); ok {
+		size, exact := df.contentLength()
+		return size, exact, nil
+	}
+	return info.Size(), true, nil
+}
+
+// contentLength returns the decompressed size of df, if it is exact: once
+// df has been read to EOF, or if its format's Sizer reported it to Stat.
+// Sizers only report sizes the stream guarantees, and gzip's only with
+// WithSingleMemberSizes (see MemberSizer); anything else is inexact.
+func (df *decompressFile) contentLength() (int64, bool) {
+	if df.complete {
+		return df.read, true
+	}
+	info, err := df.Stat()
+	if err != nil {
+		return 0, false
+	}
+	if fiw, ok := info.(fileInfoWrapper); ok && fiw.size >= 0 {
+		return fiw.size, true
+	}
+	return 0, false
+}
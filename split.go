@@ -0,0 +1,202 @@
+package fsdecomp
+
+import (
+	"fmt"
+	"io"
+	"io/fs"
+	"maps"
+	"path"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// splitGroup is a compressed file stored as numbered parts (see WithSplitParts)
+type splitGroup struct {
+	stem    string        // Name of the file the parts make up, e.g. "image.img.zst"
+	logical string        // Name with its layers removed, e.g. "image.img"
+	layers  []format      // Formats to decode, outermost first
+	parts   []fs.DirEntry // Parts present, in order
+	missing string        // Name of the first missing part, if any
+}
+
+// splitPart returns the name of the file that the part named name is a piece
+// of, and its number, if it is a part: "image.img.zst.001" is part 1 of
+// "image.img.zst"
+func splitPart(name string) (string, int, bool) {
+	dot := strings.LastIndexByte(name, '.')
+	if dot <= 0 {
+		return "", 0, false
+	}
+	suffix := name[dot+1:]
+	if len(suffix) < 2 || strings.Trim(suffix, "0123456789") != "" {
+		return "", 0, false
+	}
+	n, err := strconv.Atoi(suffix)
+	if err != nil {
+		return "", 0, false
+	}
+	return name[:dot], n, true
+}
+
+// splitGroups gathers the parts of split compressed files from the entries
+// of a directory, by the names of the files they make up
+func (dfs *DecompressFS) splitGroups(entries []fs.DirEntry) map[string]*splitGroup {
+	groups := make(map[string]*splitGroup)
+	numbered := make(map[string]map[int]fs.DirEntry)
+	for _, entry := range entries {
+		if entry.IsDir() {
+			continue
+		}
+		stem, n, ok := splitPart(entry.Name())
+		if !ok {
+			continue
+		}
+		if _, ok := groups[stem]; !ok {
+			logical, layers, ok := dfs.layersForName(stem)
+			if !ok {
+				continue
+			}
+			groups[stem] = &splitGroup{stem: stem, logical: logical, layers: layers}
+			numbered[stem] = make(map[int]fs.DirEntry)
+		}
+		numbered[stem][n] = entry
+	}
+
+	for stem, g := range groups {
+		for _, n := range slices.Sorted(maps.Keys(numbered[stem])) {
+			part := numbered[stem][n]
+			if n != len(g.parts) && g.missing == "" {
+				// Name the missing part with as many digits as the next one
+				width := len(part.Name()) - len(stem) - 1
+				g.missing = fmt.Sprintf("%s.%0*d", stem, width, len(g.parts))
+			}
+			g.parts = append(g.parts, part)
+		}
+	}
+	return groups
+}
+
+// resolveSplit finds the split file that provides name, if there is one
+func (dfs *DecompressFS) resolveSplit(b backend, name string) (resolved, bool, error) {
+	dir := path.Dir(name)
+	entries, err := dfs.listDir(b, dir)
+	if err != nil {
+		return resolved{}, false, nil
+	}
+	for _, g := range dfs.splitGroups(entries) {
+		if g.logical != path.Base(name) {
+			continue
+		}
+		r, err := dfs.openSplit(b, dir, g)
+		if err != nil {
+			return resolved{}, true, &fs.PathError{Op: "open", Path: name, Err: err}
+		}
+		return r, true, nil
+	}
+	return resolved{}, false, nil
+}
+
+// openSplit opens the split file g in directory dir
+func (dfs *DecompressFS) openSplit(b backend, dir string, g *splitGroup) (resolved, error) {
+	if g.missing != "" {
+		return resolved{}, fmt.Errorf("%w %s", ErrMissingPart, path.Join(dir, g.missing))
+	}
+	info, err := splitInfo(g.parts)
+	if err != nil {
+		return resolved{}, err
+	}
+	file := &splitFile{fsys: backend{dfs: b.dfs}, info: info}
+	for _, part := range g.parts {
+		file.parts = append(file.parts, path.Join(dir, part.Name()))
+	}
+	return resolved{file: file, name: path.Join(dir, g.stem), layers: g.layers}, nil
+}
+
+// splitInfo returns the FileInfo of a split file: that of its first part,
+// named for the whole file and with the total size of the parts
+func splitInfo(parts []fs.DirEntry) (fs.FileInfo, error) {
+	info, err := parts[0].Info()
+	if err != nil {
+		return nil, err
+	}
+	stem, _, _ := splitPart(info.Name())
+	total := info.Size()
+	for _, part := range parts[1:] {
+		partInfo, err := part.Info()
+		if err != nil {
+			return nil, err
+		}
+		total += partInfo.Size()
+	}
+	return fileInfoWrapper{FileInfo: info, name: stem, size: total}, nil
+}
+
+// splitFile reads the parts of a split file one after another
+type splitFile struct {
+	fsys    fs.FS
+	parts   []string // Names of the parts still to be opened
+	info    fs.FileInfo
+	current fs.File // Part being read, if any
+}
+
+func (sf *splitFile) Read(p []byte) (int, error) {
+	for {
+		if sf.current == nil {
+			if len(sf.parts) == 0 {
+				return 0, io.EOF
+			}
+			part, err := sf.fsys.Open(sf.parts[0])
+			if err != nil {
+				return 0, err
+			}
+			sf.current, sf.parts = part, sf.parts[1:]
+		}
+		n, err := sf.current.Read(p)
+		if err == io.EOF {
+			sf.current.Close()
+			sf.current = nil
+			if n == 0 {
+				continue
+			}
+			err = nil
+		}
+		return n, err
+	}
+}
+
+func (sf *splitFile) Stat() (fs.FileInfo, error) {
+	return sf.info, nil
+}
+
+func (sf *splitFile) Close() error {
+	if sf.current == nil {
+		return nil
+	}
+	err := sf.current.Close()
+	sf.current = nil
+	return err
+}
+
+// splitEntry lists a split file under its logical name
+type splitEntry struct {
+	fs.DirEntry // First part
+	name        string
+	parts       []fs.DirEntry
+}
+
+func (se splitEntry) Name() string {
+	return se.name
+}
+
+func (se splitEntry) Info() (fs.FileInfo, error) {
+	info, err := splitInfo(se.parts)
+	if err != nil {
+		return nil, err
+	}
+	return fileInfoWrapper{FileInfo: info, name: se.name, size: -1}, nil
+}
+
+func (se splitEntry) String() string {
+	return fs.FormatDirEntry(se)
+}
@@ -0,0 +1,137 @@
+package fsdecomp
+
+import (
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"fmt"
+	"hash"
+	htmltemplate "html/template"
+	"io"
+	"io/fs"
+	"sync"
+	"time"
+)
+
+// SRIHash returns the subresource integrity string, such as "sha384-...",
+// for the contents of the named file in fsys, for use in the integrity
+// attribute of script and link elements. algo is "sha256", "sha384" or
+// "sha512". Files in a DecompressFS are hashed as decompressed, as that is
+// what browsers check against, and the result is cached until the file
+// providing the name changes its modification time or size, or the
+// DecompressFS is closed, after which SRIHash fails with fs.ErrClosed.
+func SRIHash(fsys fs.FS, name string, algo string) (string, error) {
+	newHash, err := sriAlgorithm(algo)
+	if err != nil {
+		return "", err
+	}
+	if dfs, ok := fsys.(*DecompressFS); ok {
+		return dfs.sriHash(name, algo, newHash)
+	}
+	file, err := fsys.Open(name)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+	return sriDigest(file, algo, newHash)
+}
+
+// TemplateFuncs returns functions for html/template that use dfs:
+//
+//	sri NAME ALGORITHM
+//		The subresource integrity string for the named file (see SRIHash),
+//		e.g. <script src="/app.js" integrity="{{sri "app.js" "sha384"}}">
+func TemplateFuncs(dfs *DecompressFS) htmltemplate.FuncMap {
+	return htmltemplate.FuncMap{
+		"sri": func(name, algo string) (string, error) {
+			return SRIHash(dfs, name, algo)
+		},
+	}
+}
+
+// sriAlgorithm returns the hash function for an SRI algorithm name
+func sriAlgorithm(algo string) (func() hash.Hash, error) {
+	switch algo {
+	case "sha256":
+		return sha256.New, nil
+	case "sha384":
+		return sha512.New384, nil
+	case "sha512":
+		return sha512.New, nil
+	}
+	return nil, fmt.Errorf("unsupported subresource integrity algorithm %q", algo)
+}
+
+// sriDigest returns the SRI string for the contents of r
+func sriDigest(r io.Reader, algo string, newHash func() hash.Hash) (string, error) {
+	h := newHash()
+	if _, err := io.Copy(h, r); err != nil {
+		return "", err
+	}
+	return algo + "-" + base64.StdEncoding.EncodeToString(h.Sum(nil)), nil
+}
+
+// sriCache holds SRI strings by the physical file and algorithm they were
+// computed for
+type sriCache struct {
+	mu      sync.Mutex
+	entries map[sriKey]sriEntry
+}
+
+type sriKey struct {
+	physical string
+	algo     string
+}
+
+// sriEntry is an SRI string, with the version of the file it was computed for
+type sriEntry struct {
+	modTime time.Time
+	size    int64
+	sri     string
+}
+
+// sriHash implements SRIHash for files in dfs, caching results
+func (dfs *DecompressFS) sriHash(name, algo string, newHash func() hash.Hash) (string, error) {
+	r, err := dfs.resolve(name)
+	if err != nil {
+		return "", err
+	}
+	info, err := r.file.Stat()
+	if err != nil {
+		r.file.Close()
+		return "", err
+	}
+	key := sriKey{physical: r.name, algo: algo}
+	dfs.sri.mu.Lock()
+	cached, ok := dfs.sri.entries[key]
+	dfs.sri.mu.Unlock()
+	if ok && cached.modTime.Equal(info.ModTime()) && cached.size == info.Size() {
+		r.file.Close()
+		return cached.sri, nil
+	}
+
+	file := r.file
+	if len(r.layers) > 0 {
+		if file, err = dfs.newDecompressFile(r.file, r.name, r.layers); err != nil {
+			return "", err
+		}
+	}
+	defer file.Close()
+	sri, err := sriDigest(file, algo, newHash)
+	if err != nil {
+		return "", err
+	}
+
+	// Close may have emptied the cache while the file was being hashed,
+	// and it must stay empty
+	dfs.sri.mu.Lock()
+	defer dfs.sri.mu.Unlock()
+	if dfs.closed.Load() {
+		return sri, nil
+	}
+	if dfs.sri.entries == nil {
+		dfs.sri.entries = make(map[sriKey]sriEntry)
+	}
+	dfs.sri.entries[key] = sriEntry{modTime: info.ModTime(), size: info.Size(), sri: sri}
+	return sri, nil
+}
@@ -0,0 +1,208 @@
+package fsdecomp
+
+import (
+	"archive/tar"
+	"bufio"
+	"io"
+	"io/fs"
+	"path"
+	"strings"
+)
+
+// StreamFS returns a filesystem holding the members of the tar archive read
+// from r, such as a ".tar.zst" stream received over the network. The stream
+// is decompressed if DetectFormat recognises it as a registered format, or it
+// starts with the magic number of one (see MagicNumber), and read as a plain
+// tar archive otherwise.
+//
+// The archive is read in a single forward pass, without seeking, so the
+// returned filesystem, a *SequentialFS, only supports reading its members
+// in the order they appear in the archive, each at most once: see
+// SequentialFS for its contract. fs.WalkDir, fs.ReadDir and fs.Glob don't
+// work on it; use its WalkDir method instead.
+func StreamFS(r io.Reader) (fs.FS, error) {
+	br := bufio.NewReader(r)
+	s := &SequentialFS{passed: make(map[string]bool)}
+	var archive io.Reader = br
+	if kind, ok := sniffFormat(br, registeredFormats()); ok {
+		decoder, err := newLayerReader(kind, "", br)
+		if err != nil {
+			return nil, newDecompressError(kind, "", err)
+		}
+		archive, s.closer = decoder, decoder
+	}
+	s.tr = tar.NewReader(archive)
+	return s, nil
+}
+
+// sniffFormat returns the format among formats the data buffered by br
+// starts with, peeking at it without consuming it, by the signatures of the
+// formats (see formatSignature), in probe order.
+func sniffFormat(br *bufio.Reader, formats []format) (format, bool) {
+	for _, kind := range formats {
+		if kind.transform {
+			continue
+		}
+		sig, ok := formatSignature(kind)
+		if !ok {
+			continue
+		}
+		if prefix, _ := br.Peek(sig.size); sig.match(prefix) {
+			return kind, true
+		}
+	}
+	return format{}, false
+}
+
+// SequentialFS is a tar archive read in a single forward pass, as returned
+// by StreamFS. Members are named by their paths in the archive, cleaned of
+// any leading "./" or "/", and those whose names aren't valid paths are
+// skipped.
+//
+// Open reads ahead to the member named, discarding those before it, and
+// returns it to be read until the stream moves past it. Opening a member
+// that the stream has already passed, whether because it was opened before
+// or because a later member was, fails with a *SequentialAccessError, as
+// does reading a member once the stream has moved on. Opening a name the
+// archive doesn't hold reads it to the end, and fails with fs.ErrNotExist.
+//
+// A SequentialFS is not safe for concurrent use.
+type SequentialFS struct {
+	tr     *tar.Reader
+	closer io.Closer // Decompressor of the stream, if it is compressed
+
+	hdr    *tar.Header     // Member the stream is at, nil before the first and at the end
+	name   string          // Name of hdr
+	index  int             // Position of hdr in the stream, from 1
+	opened bool            // Whether hdr has been opened
+	passed map[string]bool // Members passed, and whether each was opened
+	err    error           // Error ending the stream, io.EOF at its end
+}
+
+// Open returns the member called name, reading ahead to it
+func (s *SequentialFS) Open(name string) (fs.File, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrInvalid}
+	}
+	if opened, ok := s.passed[name]; ok {
+		return nil, &SequentialAccessError{Op: "open", Name: name, Current: s.name, Opened: opened}
+	}
+	for s.hdr == nil || s.name != name {
+		if err := s.advance(); err == io.EOF {
+			return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+		} else if err != nil {
+			return nil, &fs.PathError{Op: "open", Path: name, Err: err}
+		}
+	}
+	if s.opened {
+		return nil, &SequentialAccessError{Op: "open", Name: name, Current: s.name, Opened: true}
+	}
+	s.opened = true
+	return &memberFile{s: s, hdr: s.hdr, name: name, index: s.index}, nil
+}
+
+// WalkDir calls fn for each member of the archive in the order they appear
+// in it, starting from the stream's current position, with the member's
+// name and a DirEntry describing it. fn may Open the member to read it.
+// As with fs.WalkDir, fn may return fs.SkipDir for a directory to skip the
+// members below it that follow, and fs.SkipAll to stop without error. Errors
+// reading the stream are passed to fn with an empty name, and returned
+// unless fn handles them by returning nil.
+func (s *SequentialFS) WalkDir(fn fs.WalkDirFunc) error {
+	var skip string // Directory whose members are being skipped, if set
+	for {
+		err := s.advance()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fn("", nil, err)
+		}
+		if skip != "" && strings.HasPrefix(s.name, skip+"/") {
+			continue
+		}
+		skip = ""
+		entry := fs.FileInfoToDirEntry(s.hdr.FileInfo())
+		switch err := fn(s.name, entry, nil); {
+		case err == fs.SkipDir && entry.IsDir():
+			skip = s.name
+		case err == fs.SkipAll:
+			return nil
+		case err != nil && err != fs.SkipDir:
+			return err
+		}
+	}
+}
+
+// Close releases the decompressor of the stream, if it is compressed. It
+// doesn't close the reader passed to StreamFS.
+func (s *SequentialFS) Close() error {
+	if s.err == nil {
+		s.err = fs.ErrClosed
+	}
+	if s.closer != nil {
+		return s.closer.Close()
+	}
+	return nil
+}
+
+// advance moves the stream on to the next member with a valid name,
+// returning io.EOF at the end of the archive
+func (s *SequentialFS) advance() error {
+	if s.err != nil {
+		return s.err
+	}
+	if s.hdr != nil {
+		s.passed[s.name] = s.opened
+	}
+	for {
+		hdr, err := s.tr.Next()
+		if err != nil {
+			s.hdr, s.name, s.err = nil, "", err
+			return err
+		}
+		s.index++
+		// Later members of the same name as one passed are skipped too
+		name := memberName(hdr)
+		if _, ok := s.passed[name]; ok || !fs.ValidPath(name) {
+			continue
+		}
+		s.hdr, s.name, s.opened = hdr, name, false
+		return nil
+	}
+}
+
+// memberName returns the name of the member hdr describes, without any
+// leading "./" or "/"
+func memberName(hdr *tar.Header) string {
+	return path.Clean(strings.TrimLeft(strings.TrimPrefix(hdr.Name, "./"), "/"))
+}
+
+// memberFile is a member of a SequentialFS, readable until the stream moves
+// past it
+type memberFile struct {
+	s      *SequentialFS
+	hdr    *tar.Header
+	name   string
+	index  int // Position of the member in the stream
+	closed bool
+}
+
+func (f *memberFile) Stat() (fs.FileInfo, error) {
+	return f.hdr.FileInfo(), nil
+}
+
+func (f *memberFile) Read(p []byte) (int, error) {
+	if f.closed {
+		return 0, &fs.PathError{Op: "read", Path: f.name, Err: fs.ErrClosed}
+	}
+	if f.s.hdr == nil || f.s.index != f.index {
+		return 0, &SequentialAccessError{Op: "read", Name: f.name, Current: f.s.name, Opened: true}
+	}
+	return f.s.tr.Read(p)
+}
+
+func (f *memberFile) Close() error {
+	f.closed = true
+	return nil
+}
@@ -0,0 +1,120 @@
+package fsdecomp
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/fs"
+	"path"
+	"strings"
+)
+
+// TarGz writes a gzip compressed tar archive to w holding the tree rooted
+// at root, with every file decompressed and named by its logical name
+// relative to root, as a "download folder" feature might. Where several
+// files provide the same logical name, the one Open picks is archived.
+// Entries other than regular files and directories are skipped.
+//
+// Tar headers record each file's size ahead of its contents, so files whose
+// decompressed size isn't known exactly in advance (see ContentLength), such
+// as gzip files of several members, are decompressed twice: once to find
+// their size and once to archive them.
+func (dfs *DecompressFS) TarGz(root string, w io.Writer) error {
+	gzw := gzip.NewWriter(w)
+	tw := tar.NewWriter(gzw)
+	seen := make(map[string]bool)
+	err := dfs.walkDir(root, func(name string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if seen[name] || !d.IsDir() && !d.Type().IsRegular() {
+			return nil
+		}
+		seen[name] = true
+		switch {
+		case name == root && d.IsDir():
+			return nil
+		case name == root:
+			return dfs.addToTar(tw, name, path.Base(name), false)
+		case root == ".":
+			return dfs.addToTar(tw, name, name, d.IsDir())
+		}
+		return dfs.addToTar(tw, name, strings.TrimPrefix(name, root+"/"), d.IsDir())
+	})
+	if err != nil {
+		return err
+	}
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	return gzw.Close()
+}
+
+// addToTar writes the named file or directory to tw as rel
+func (dfs *DecompressFS) addToTar(tw *tar.Writer, name, rel string, dir bool) error {
+	file, err := dfs.Open(name)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+	header, err := tar.FileInfoHeader(info, "")
+	if err != nil {
+		return err
+	}
+	header.Name = rel
+	if dir {
+		header.Name += "/"
+		return tw.WriteHeader(header)
+	}
+
+	size, exact := int64(0), false
+	if df, ok := file.(*decompressFile); ok {
+		size, exact = df.contentLength()
+	} else {
+		size, exact = info.Size(), true
+	}
+	if !exact {
+		if size, err = dfs.decompressedLength(name); err != nil {
+			return err
+		}
+	}
+	header.Size = size
+	if err := tw.WriteHeader(header); err != nil {
+		return err
+	}
+	// Copy no more than the header promised, so a file that turns out
+	// longer is reported as such rather than as a tar write error
+	n, err := io.Copy(tw, io.LimitReader(file, size))
+	if err != nil {
+		return err
+	}
+	// Reading on to EOF also runs the checks made at the end of the stream,
+	// such as its checksum
+	extra, err := file.Read(make([]byte, 1))
+	if n != size || extra > 0 {
+		return fmt.Errorf("%s changed size while being archived", name)
+	}
+	if err == nil {
+		err = io.ErrNoProgress // A read of nothing that didn't reach EOF
+	}
+	if err != io.EOF {
+		return fmt.Errorf("archiving %s: %w", name, err)
+	}
+	return nil
+}
+
+// decompressedLength returns the length of the named file's contents by
+// reading them
+func (dfs *DecompressFS) decompressedLength(name string) (int64, error) {
+	file, err := dfs.Open(name)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+	return io.Copy(io.Discard, file)
+}
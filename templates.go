@@ -0,0 +1,19 @@
+package fsdecomp
+
+import (
+	htmltemplate "html/template"
+	"text/template"
+)
+
+// ParseTemplates parses the files matching the fs.Glob patterns into a new
+// text/template set, decompressing them as needed, as template.ParseFS does.
+// Patterns match logical names, so "*.tmpl" matches "page.tmpl.gz", and
+// each template is named for the base of its logical name ("page.tmpl").
+func (dfs *DecompressFS) ParseTemplates(patterns ...string) (*template.Template, error) {
+	return template.ParseFS(dfs, patterns...)
+}
+
+// ParseHTMLTemplates is ParseTemplates for html/template
+func (dfs *DecompressFS) ParseHTMLTemplates(patterns ...string) (*htmltemplate.Template, error) {
+	return htmltemplate.ParseFS(dfs, patterns...)
+}
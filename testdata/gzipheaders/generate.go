@@ -0,0 +1,101 @@
+//go:build ignore
+
+// Generates the gzip files in this directory, which exercise the optional
+// header fields that gzip(1) and compress/gzip don't write. Run with
+//
+//	go run generate.go
+package main
+
+import (
+	"bytes"
+	"compress/flate"
+	"encoding/binary"
+	"hash/crc32"
+	"log"
+	"os"
+)
+
+const content = "firmware image manifest\nversion=3.1.4\n"
+
+const (
+	flagHCRC    = 1 << 1
+	flagExtra   = 1 << 2
+	flagName    = 1 << 3
+	flagComment = 1 << 4
+)
+
+// vendorExtra is an extra field holding two subfields, as vendor tooling
+// writes them: "VX" with a build number and "SG" with a signature stub
+var vendorExtra = []byte{
+	'V', 'X', 4, 0, 0x2a, 0x00, 0x00, 0x00,
+	'S', 'G', 3, 0, 0xde, 0xad, 0xbe,
+}
+
+type member struct {
+	flags   byte
+	extra   []byte
+	name    string
+	comment string
+	badHCRC bool // Write the wrong header CRC
+	xlen    int  // Overrides the length of the extra field, if set
+}
+
+func (m member) bytes() []byte {
+	var b bytes.Buffer
+	b.Write([]byte{0x1f, 0x8b, 8, m.flags, 0, 0, 0, 0, 0, 3})
+	if m.flags&flagExtra != 0 {
+		xlen := len(m.extra)
+		if m.xlen != 0 {
+			xlen = m.xlen
+		}
+		b.Write(binary.LittleEndian.AppendUint16(nil, uint16(xlen)))
+		b.Write(m.extra)
+	}
+	if m.flags&flagName != 0 {
+		b.WriteString(m.name)
+		b.WriteByte(0)
+	}
+	if m.flags&flagComment != 0 {
+		b.WriteString(m.comment)
+		b.WriteByte(0)
+	}
+	if m.flags&flagHCRC != 0 {
+		crc := uint16(crc32.ChecksumIEEE(b.Bytes()))
+		if m.badHCRC {
+			crc = ^crc
+		}
+		b.Write(binary.LittleEndian.AppendUint16(nil, crc))
+	}
+	if m.xlen != 0 {
+		return b.Bytes()
+	}
+
+	fw, err := flate.NewWriter(&b, flate.BestCompression)
+	if err != nil {
+		log.Fatal(err)
+	}
+	fw.Write([]byte(content))
+	fw.Close()
+	b.Write(binary.LittleEndian.AppendUint32(nil, crc32.ChecksumIEEE([]byte(content))))
+	b.Write(binary.LittleEndian.AppendUint32(nil, uint32(len(content))))
+	return b.Bytes()
+}
+
+func main() {
+	files := map[string]member{
+		"fextra.txt.gz":   {flags: flagExtra, extra: vendorExtra},
+		"fhcrc.txt.gz":    {flags: flagHCRC},
+		"fcomment.txt.gz": {flags: flagComment, comment: "built by mkimage"},
+		"all.txt.gz": {
+			flags: flagExtra | flagName | flagComment | flagHCRC,
+			extra: vendorExtra, name: "manifest.txt", comment: "built by mkimage",
+		},
+		"badhcrc.txt.gz":  {flags: flagExtra | flagHCRC, extra: vendorExtra, badHCRC: true},
+		"badextra.txt.gz": {flags: flagExtra, extra: vendorExtra, xlen: 0x1000},
+	}
+	for name, m := range files {
+		if err := os.WriteFile(name, m.bytes(), 0o644); err != nil {
+			log.Fatal(err)
+		}
+	}
+}
@@ -0,0 +1,55 @@
+package fsdecomp
+
+import (
+	"bytes"
+	"io"
+)
+
+// byteOrderMarks are the BOMs removed by WithBOMStripping
+var byteOrderMarks = [][]byte{
+	{0xef, 0xbb, 0xbf}, // UTF-8
+	{0xff, 0xfe},       // UTF-16LE
+	{0xfe, 0xff},       // UTF-16BE
+}
+
+// stripBOM returns a reader that skips a leading byte order mark in r
+func stripBOM(r io.Reader) io.Reader {
+	return &bomReader{reader: r}
+}
+
+// bomReader removes a byte order mark from the start of a stream. The first
+// Read collects enough bytes to recognise the longest mark, however the
+// underlying reader splits them, and replays whatever follows the mark.
+type bomReader struct {
+	reader  io.Reader
+	checked bool
+	pending []byte // Bytes read while checking for a mark, still to be returned
+	err     error  // Error encountered while checking for a mark
+}
+
+func (br *bomReader) Read(p []byte) (int, error) {
+	if !br.checked {
+		br.checked = true
+		prefix := make([]byte, 3)
+		n, err := io.ReadFull(br.reader, prefix)
+		if err == io.ErrUnexpectedEOF {
+			err = io.EOF
+		}
+		br.pending, br.err = prefix[:n], err
+		for _, bom := range byteOrderMarks {
+			if bytes.HasPrefix(br.pending, bom) {
+				br.pending = br.pending[len(bom):]
+				break
+			}
+		}
+	}
+	if len(br.pending) > 0 {
+		n := copy(p, br.pending)
+		br.pending = br.pending[n:]
+		return n, nil
+	}
+	if br.err != nil {
+		return 0, br.err
+	}
+	return br.reader.Read(p)
+}
@@ -0,0 +1,39 @@
+package fsdecomp
+
+import (
+	"encoding/json"
+	"io"
+)
+
+// ValueDecoder decodes a single value from a stream, as json.Decoder and
+// gob.Decoder do
+type ValueDecoder interface {
+	Decode(v any) error
+}
+
+// Unmarshal decodes the contents of the named file into v, decompressing it
+// if needed. Files are decoded as JSON unless another decoder has been set
+// with WithUnmarshalDecoder. The whole file is read, even beyond the value,
+// so files that fail checksums or exceed WithMaxDecompressedSize are
+// rejected as they are when read in any other way.
+func (dfs *DecompressFS) Unmarshal(name string, v any) error {
+	file, err := dfs.Open(name)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	var decoder ValueDecoder
+	if dfs.newValueDecoder != nil {
+		decoder = dfs.newValueDecoder(file)
+	} else {
+		decoder = json.NewDecoder(file)
+	}
+	if err := decoder.Decode(v); err != nil {
+		return err
+	}
+	// Read whatever follows the value, so that checksums at the end of the
+	// stream and size limits are enforced as they are for other reads
+	_, err = io.Copy(io.Discard, file)
+	return err
+}
@@ -0,0 +1,146 @@
+package fsdecomp
+
+import (
+	"bytes"
+	"io"
+	"io/fs"
+)
+
+// VerifyAll walks the tree rooted at root and fully decompresses every file,
+// returning all the errors encountered rather than stopping at the first.
+// Decoding failures are reported as *DecompressError, naming the compressed
+// file, and other failures as returned by the underlying filesystem. A tree
+// that verifies cleanly returns nil.
+//
+// Every compressed variant of a file is decompressed, not only the one Open
+// returns, as the others are still served by their own names, or to clients
+// accepting their encoding: a corrupt "app.js.gz" next to "app.js" is
+// reported. With WithVariantCheck, compressed files are also compared with
+// the uncompressed file of the same name, if there is one.
+func (dfs *DecompressFS) VerifyAll(root string) []error {
+	var errs []error
+	seen := make(map[string]bool)
+	walkErr := dfs.walkDir(root, func(name string, d fs.DirEntry, err error) error {
+		if err != nil {
+			errs = append(errs, err)
+			return nil
+		}
+		// A file and its compressed variants are listed under the same name
+		if d.IsDir() || seen[name] {
+			return nil
+		}
+		seen[name] = true
+		physical, err := dfs.verify(name)
+		if err != nil {
+			errs = append(errs, err)
+		}
+		errs = append(errs, dfs.verifyVariants(name, physical)...)
+		return nil
+	})
+	if walkErr != nil {
+		errs = append(errs, walkErr)
+	}
+	return errs
+}
+
+// verify reads the whole of the named file, returning the name of the file
+// providing it in the underlying filesystem and any error
+func (dfs *DecompressFS) verify(name string) (string, error) {
+	file, err := dfs.Open(name)
+	if err != nil {
+		return name, err
+	}
+	defer file.Close()
+
+	physical := name
+	if r, ok := file.(interface{ ResolutionInfo() Resolution }); ok {
+		physical = r.ResolutionInfo().Physical
+	}
+	_, err = io.Copy(io.Discard, file)
+	return physical, err
+}
+
+// verifyVariants decompresses each compressed variant of the named file
+// other than physical, which verify has read, returning an error for each
+// that can't be read. With WithVariantCheck, variants of a file that also
+// exists uncompressed are instead compared with it, physical included.
+// Failures opening the uncompressed file are left to verify.
+func (dfs *DecompressFS) verifyVariants(name, physical string) []error {
+	b := dfs.backend(nil)
+	compare := false
+	if dfs.variantCheck {
+		_, err := b.stat(name)
+		compare = err == nil
+	}
+	var errs []error
+	for _, f := range dfs.supportedFormats() {
+		if !compare && name+f.ext == physical {
+			continue
+		}
+		compressed, err := b.Open(name + f.ext)
+		if err != nil {
+			continue
+		}
+		if compare {
+			err = dfs.compareVariant(name, compressed, f)
+		} else {
+			err = dfs.readVariant(compressed, name+f.ext, f)
+		}
+		if err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errs
+}
+
+// readVariant reads the whole of compressed, the named file in the given
+// format, returning any error
+func (dfs *DecompressFS) readVariant(compressed fs.File, name string, kind format) error {
+	variant, err := dfs.newDecompressFile(compressed, name, []format{kind})
+	if err != nil {
+		return err
+	}
+	defer variant.Close()
+
+	_, err = io.Copy(io.Discard, variant)
+	return err
+}
+
+// variantBlockSize is the amount of each file compareVariant holds at once
+const variantBlockSize = 32 * 1024
+
+// compareVariant compares the contents of the named uncompressed file with
+// compressed, a variant of it in the given format, a block at a time and
+// stopping at the first difference
+func (dfs *DecompressFS) compareVariant(name string, compressed fs.File, kind format) error {
+	variant, err := dfs.newDecompressFile(compressed, name+kind.ext, []format{kind})
+	if err != nil {
+		return err
+	}
+	defer variant.Close()
+	plain, err := dfs.backend(nil).Open(name)
+	if err != nil {
+		return err
+	}
+	defer plain.Close()
+
+	plainBuf := make([]byte, variantBlockSize)
+	variantBuf := make([]byte, variantBlockSize)
+	for {
+		pn, perr := io.ReadFull(plain, plainBuf)
+		vn, verr := io.ReadFull(variant, variantBuf)
+		if perr != nil && perr != io.EOF && perr != io.ErrUnexpectedEOF {
+			return perr
+		}
+		if verr != nil && verr != io.EOF && verr != io.ErrUnexpectedEOF {
+			return verr
+		}
+		if !bytes.Equal(plainBuf[:pn], variantBuf[:vn]) {
+			return newDecompressError(kind, name+kind.ext, ErrVariantMismatch)
+		}
+		if perr != nil {
+			// Both ended together, as the blocks were equal
+			return nil
+		}
+	}
+}
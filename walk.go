@@ -0,0 +1,198 @@
+package fsdecomp
+
+import (
+	"context"
+	"errors"
+	"io/fs"
+	"path"
+	"slices"
+	"strings"
+	"sync"
+)
+
+// WalkOption configures WalkParallel
+type WalkOption func(*walker)
+
+// WalkCollectErrors makes WalkParallel carry on after errors from fn or from
+// listing directories, returning them all joined with errors.Join, rather
+// than stopping at the first
+func WalkCollectErrors() WalkOption {
+	return func(w *walker) {
+		w.collect = true
+	}
+}
+
+// WalkInOrder makes WalkParallel visit one entry at a time in lexical order,
+// as fs.WalkDir does, ignoring its workers argument. It is meant for tests
+// that need repeatable results.
+func WalkInOrder() WalkOption {
+	return func(w *walker) {
+		w.ordered = true
+	}
+}
+
+// WalkParallel walks the tree rooted at root, calling fn for each file and
+// directory including root, listing up to workers directories at once. It
+// suits filesystems where listing a directory takes a round trip, such as
+// network backed ones, where fs.WalkDir spends most of its time waiting.
+//
+// fn may be called concurrently from several goroutines, and directories
+// are visited in no particular order, though each directory is visited
+// before its contents. Each path is visited once, even where several files
+// in a directory provide the same logical name, as when a DecompressFS
+// lists "a.txt.gz" and "a.txt.bz2" as "a.txt". Entries of a DecompressFS
+// excluded by WithWalkFilter aren't visited. As with fs.WalkDir, fn may
+// return fs.SkipDir to skip a directory, or the rest of the directory
+// containing a file, and fs.SkipAll to stop the walk without error.
+//
+// The walk stops at the first error from fn or from listing a directory,
+// which is returned, unless WalkCollectErrors is given. It also stops if
+// ctx is cancelled, returning ctx.Err().
+func WalkParallel(ctx context.Context, fsys fs.FS, root string, workers int, fn func(path string, d fs.DirEntry) error, opts ...WalkOption) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	w := &walker{ctx: ctx, cancel: cancel, fsys: fsys, fn: fn}
+	if dfs, ok := fsys.(*DecompressFS); ok {
+		w.filter = dfs.walkFilter
+	}
+	for _, opt := range opts {
+		opt(w)
+	}
+	if !w.ordered {
+		w.workers = make(chan struct{}, max(workers-1, 0))
+	}
+
+	info, err := fs.Stat(fsys, root)
+	if err != nil {
+		return err
+	}
+	switch err := fn(root, fs.FileInfoToDirEntry(info)); {
+	case err == fs.SkipDir || err == fs.SkipAll:
+		return nil
+	case err != nil:
+		return err
+	}
+	if info.IsDir() {
+		w.visitDir(root)
+	}
+	w.wg.Wait()
+
+	if w.skipAll {
+		return nil
+	}
+	if len(w.errs) > 0 {
+		if w.collect {
+			return errors.Join(w.errs...)
+		}
+		return w.errs[0]
+	}
+	return context.Cause(ctx)
+}
+
+// walker holds the state of a WalkParallel call
+type walker struct {
+	ctx     context.Context
+	cancel  context.CancelFunc
+	fsys    fs.FS
+	fn      func(path string, d fs.DirEntry) error
+	filter  func(path string, d fs.DirEntry) bool // Entries to visit, if set (see WithWalkFilter)
+	collect bool
+	ordered bool
+
+	workers chan struct{} // Tokens for directories listed in their own goroutine
+	wg      sync.WaitGroup
+
+	mu      sync.Mutex
+	errs    []error
+	skipAll bool
+}
+
+// visitDir calls fn for the contents of the named directory, and visits
+// its subdirectories
+func (w *walker) visitDir(dir string) {
+	if w.ctx.Err() != nil {
+		return
+	}
+	entries, err := fs.ReadDir(w.fsys, dir)
+	if err != nil {
+		w.fail(err)
+		return
+	}
+	if w.ordered {
+		slices.SortStableFunc(entries, func(a, b fs.DirEntry) int {
+			return strings.Compare(a.Name(), b.Name())
+		})
+	}
+
+	seen := make(map[string]bool, len(entries))
+	for _, entry := range entries {
+		if w.ctx.Err() != nil {
+			return
+		}
+		if seen[entry.Name()] {
+			continue
+		}
+		seen[entry.Name()] = true
+
+		name := path.Join(dir, entry.Name())
+		if w.filter != nil && !w.filter(name, entry) {
+			continue
+		}
+		switch err := w.fn(name, entry); {
+		case err == fs.SkipAll:
+			w.mu.Lock()
+			w.skipAll = true
+			w.mu.Unlock()
+			w.cancel()
+			return
+		case err == fs.SkipDir:
+			if !entry.IsDir() {
+				return
+			}
+		case err != nil:
+			w.fail(err)
+		case entry.IsDir():
+			w.spawn(name)
+		}
+	}
+}
+
+// spawn visits the named directory in a new goroutine if a worker is free,
+// or otherwise before returning
+func (w *walker) spawn(dir string) {
+	select {
+	case w.workers <- struct{}{}:
+		w.wg.Add(1)
+		go func() {
+			defer w.wg.Done()
+			defer func() { <-w.workers }()
+			w.visitDir(dir)
+		}()
+	default:
+		w.visitDir(dir)
+	}
+}
+
+// fail records an error, stopping the walk unless errors are being collected
+func (w *walker) fail(err error) {
+	w.mu.Lock()
+	w.errs = append(w.errs, err)
+	w.mu.Unlock()
+	if !w.collect {
+		w.cancel()
+	}
+}
+
+// walkDir walks the tree rooted at root as fs.WalkDir does, leaving out the
+// entries below root that the walk filter excludes (see WithWalkFilter)
+func (dfs *DecompressFS) walkDir(root string, fn fs.WalkDirFunc) error {
+	return fs.WalkDir(dfs, root, func(name string, d fs.DirEntry, err error) error {
+		if err == nil && name != root && dfs.walkFilter != nil && !dfs.walkFilter(name, d) {
+			if d.IsDir() {
+				return fs.SkipDir
+			}
+			return nil
+		}
+		return fn(name, d, err)
+	})
+}
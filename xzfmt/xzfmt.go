@@ -0,0 +1,40 @@
+// Package xzfmt adds xz (.xz) support to fsdecomp.
+//
+// Importing the package, usually for its side effect only, registers the
+// decompressor with fsdecomp.Register:
+//
+//	import _ "github.com/AndreRenaud/FSDecomp/xzfmt"
+package xzfmt
+
+import (
+	"io"
+
+	fsdecomp "github.com/AndreRenaud/FSDecomp"
+	"github.com/ulikunitz/xz"
+)
+
+// Extension is the file extension handled by this package
+const Extension = ".xz"
+
+// Decompressor decompresses xz streams
+var Decompressor fsdecomp.Decompressor = decompressor{}
+
+func init() {
+	fsdecomp.Register(Extension, Decompressor)
+}
+
+type decompressor struct{}
+
+func (decompressor) MagicNumber() []byte {
+	return []byte{0xfd, '7', 'z', 'X', 'Z', 0x00}
+}
+
+func (decompressor) NewReader(r io.Reader) (io.ReadCloser, error) {
+	// The stream header is read and checked here, so files that aren't xz
+	// streams fail when opened. The reader doesn't need to be closed.
+	xr, err := xz.NewReader(r)
+	if err != nil {
+		return nil, err
+	}
+	return io.NopCloser(xr), nil
+}
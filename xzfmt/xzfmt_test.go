@@ -0,0 +1,113 @@
+package xzfmt_test
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/fs"
+	"math/rand/v2"
+	"testing"
+	"testing/fstest"
+
+	fsdecomp "github.com/AndreRenaud/FSDecomp"
+	_ "github.com/AndreRenaud/FSDecomp/xzfmt"
+	"github.com/ulikunitz/xz"
+)
+
+func createXzData(t *testing.T, content []byte) []byte {
+	var buf bytes.Buffer
+	xw, err := xz.NewWriter(&buf)
+	if err != nil {
+		t.Fatalf("Failed to create xz writer: %v", err)
+	}
+	if _, err := xw.Write(content); err != nil {
+		t.Fatalf("Failed to write xz data: %v", err)
+	}
+	if err := xw.Close(); err != nil {
+		t.Fatalf("Failed to close xz writer: %v", err)
+	}
+	return buf.Bytes()
+}
+
+// TestRegistered ensures importing the package is enough to open and list
+// .xz files by their names without the extension
+func TestRegistered(t *testing.T) {
+	dfs := fsdecomp.New(fstest.MapFS{
+		"logs/syslog.txt.xz": &fstest.MapFile{Data: createXzData(t, []byte("xz content"))},
+	})
+	file, err := dfs.Open("logs/syslog.txt")
+	if err != nil {
+		t.Fatalf("Unexpected error opening logs/syslog.txt: %v", err)
+	}
+	defer file.Close()
+
+	data, err := io.ReadAll(file)
+	if err != nil {
+		t.Fatalf("Error reading file: %v", err)
+	}
+	if string(data) != "xz content" {
+		t.Errorf("Expected content %q, got %q", "xz content", string(data))
+	}
+	if info, err := file.Stat(); err != nil || info.Name() != "syslog.txt" {
+		t.Errorf("Expected the file to be named syslog.txt, got %v, %v", info, err)
+	}
+
+	entries, err := dfs.ReadDir("logs")
+	if err != nil || len(entries) != 1 || entries[0].Name() != "syslog.txt" {
+		t.Errorf("Expected logs to list syslog.txt, got %v, %v", entries, err)
+	}
+}
+
+// TestInvalidHeader ensures a file that isn't an xz stream fails when it is
+// opened, rather than when it is read
+func TestInvalidHeader(t *testing.T) {
+	dfs := fsdecomp.New(fstest.MapFS{
+		"bad.txt.xz": &fstest.MapFile{Data: []byte("not an xz stream at all")},
+	})
+	_, err := dfs.Open("bad.txt")
+	var de *fsdecomp.DecompressError
+	if !errors.As(err, &de) || de.Format != "xz" || de.Name != "bad.txt.xz" {
+		t.Errorf("Expected a DecompressError for bad.txt.xz, got %v", err)
+	}
+}
+
+// TestStreaming ensures a large file is decompressed as it is read, rather
+// than read into memory in full when opened
+func TestStreaming(t *testing.T) {
+	// Log-like text, which xz compresses by about half
+	content := make([]byte, 2<<20)
+	rng := rand.NewChaCha8([32]byte{})
+	for i := range content {
+		content[i] = "0123456789abcdef\n"[rng.Uint64()%17]
+	}
+	compressed := createXzData(t, content)
+	dfs := fsdecomp.New(fstest.MapFS{"bundle.tar.xz": &fstest.MapFile{Data: compressed}})
+
+	file, err := dfs.Open("bundle.tar")
+	if err != nil {
+		t.Fatalf("Unexpected error opening bundle.tar: %v", err)
+	}
+	defer file.Close()
+	counter, ok := file.(interface{ BytesRead() (int64, int64) })
+	if !ok {
+		t.Fatalf("Expected the file to count the bytes read")
+	}
+
+	head := make([]byte, 64*1024)
+	if _, err := io.ReadFull(file, head); err != nil {
+		t.Fatalf("Unexpected error reading bundle.tar: %v", err)
+	}
+	if read, _ := counter.BytesRead(); read > int64(len(compressed))/4 {
+		t.Errorf("Expected little of the %d compressed bytes read for the first %d, got %d", len(compressed), len(head), read)
+	}
+	rest, err := io.ReadAll(file)
+	if err != nil {
+		t.Fatalf("Unexpected error reading bundle.tar: %v", err)
+	}
+	if !bytes.Equal(append(head, rest...), content) {
+		t.Errorf("Expected the decompressed content to match")
+	}
+	if _, err := fs.Stat(dfs, "bundle.tar"); err != nil {
+		t.Errorf("Unexpected error statting bundle.tar: %v", err)
+	}
+}
@@ -0,0 +1,133 @@
+package zstdfmt
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"path"
+	"sync"
+	"time"
+
+	fsdecomp "github.com/AndreRenaud/FSDecomp"
+	"github.com/klauspost/compress/zstd"
+)
+
+// WithDictionaryDiscovery decompresses .zst files using a dictionary stored
+// alongside them, in a file called dictName (e.g. ".zstd-dict") in the same
+// directory, or if searchParents is set, in the nearest directory above it
+// that has one. Dictionaries must be in the zstd dictionary format, as
+// written by "zstd --train"; streams that don't need one decode as normal.
+//
+// Dictionary files are hidden from ReadDir. Each is read the first time it
+// is used and cached, and read again if its modification time or size
+// changes. Decoding errors say which dictionary was used, if any, to help
+// track down files compressed with a different dictionary.
+func WithDictionaryDiscovery(dictName string, searchParents bool) fsdecomp.Option {
+	return func(dfs *fsdecomp.DecompressFS) {
+		d := &dictDecompressor{fsys: dfs.Backend(), dictName: dictName, searchParents: searchParents}
+		fsdecomp.WithDecompressor(Extension, d)(dfs)
+		fsdecomp.WithHiddenFiles(func(name string) bool { return name == dictName })(dfs)
+	}
+}
+
+// dictDecompressor decompresses Zstandard streams with a dictionary found
+// next to each file
+type dictDecompressor struct {
+	decompressor
+	fsys          fs.FS // Backend of the DecompressFS
+	dictName      string
+	searchParents bool
+
+	mu    sync.Mutex
+	cache map[string]cachedDict // By name of the dictionary file
+}
+
+// cachedDict is the contents of a dictionary file, with what identifies the
+// version of the file that was read
+type cachedDict struct {
+	modTime time.Time
+	size    int64
+	data    []byte
+}
+
+func (d *dictDecompressor) NewReaderFor(name string, r io.Reader) (io.ReadCloser, error) {
+	dictPath, dict, err := d.find(path.Dir(name))
+	if err != nil {
+		return nil, err
+	}
+	var opts []zstd.DOption
+	if dict != nil {
+		opts = append(opts, zstd.WithDecoderDicts(dict))
+	}
+	decoder, err := zstd.NewReader(r, opts...)
+	if err != nil {
+		return nil, dictError(err, dictPath)
+	}
+	return &dictReader{ReadCloser: decoder.IOReadCloser(), dictPath: dictPath}, nil
+}
+
+// find returns the name and contents of the dictionary for files in dir,
+// or an empty name if there is none
+func (d *dictDecompressor) find(dir string) (string, []byte, error) {
+	for {
+		name := path.Join(dir, d.dictName)
+		info, err := fs.Stat(d.fsys, name)
+		if err == nil {
+			data, err := d.load(name, info)
+			return name, data, err
+		}
+		if !errors.Is(err, fs.ErrNotExist) {
+			return "", nil, err
+		}
+		if !d.searchParents || dir == "." {
+			return "", nil, nil
+		}
+		dir = path.Dir(dir)
+	}
+}
+
+// load returns the contents of the named dictionary file, described by
+// info, reading it only if the cached copy is out of date
+func (d *dictDecompressor) load(name string, info fs.FileInfo) ([]byte, error) {
+	d.mu.Lock()
+	cached, ok := d.cache[name]
+	d.mu.Unlock()
+	if ok && cached.modTime.Equal(info.ModTime()) && cached.size == info.Size() {
+		return cached.data, nil
+	}
+
+	data, err := fs.ReadFile(d.fsys, name)
+	if err != nil {
+		return nil, err
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.cache == nil {
+		d.cache = make(map[string]cachedDict)
+	}
+	d.cache[name] = cachedDict{modTime: info.ModTime(), size: info.Size(), data: data}
+	return data, nil
+}
+
+// dictReader notes the dictionary used in decoding errors
+type dictReader struct {
+	io.ReadCloser
+	dictPath string
+}
+
+func (dr *dictReader) Read(p []byte) (int, error) {
+	n, err := dr.ReadCloser.Read(p)
+	if err != nil && err != io.EOF {
+		err = dictError(err, dr.dictPath)
+	}
+	return n, err
+}
+
+// dictError adds the dictionary used, if any, to a decoding error
+func dictError(err error, dictPath string) error {
+	if dictPath == "" {
+		return fmt.Errorf("%w (no dictionary found)", err)
+	}
+	return fmt.Errorf("%w (with dictionary %s)", err, dictPath)
+}
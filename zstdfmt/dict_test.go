@@ -0,0 +1,93 @@
+package zstdfmt_test
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"testing/fstest"
+	"time"
+
+	fsdecomp "github.com/AndreRenaud/FSDecomp"
+	"github.com/AndreRenaud/FSDecomp/zstdfmt"
+)
+
+// TestDictionaryDiscovery decodes files compressed with "zstd -D" using the
+// dictionary found in their directory or above it
+func TestDictionaryDiscovery(t *testing.T) {
+	testFS := fstest.MapFS{}
+	err := filepath.WalkDir("testdata/dicts", func(name string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		data, err := os.ReadFile(name)
+		rel, _ := filepath.Rel("testdata/dicts", name)
+		testFS[filepath.ToSlash(rel)] = &fstest.MapFile{Data: data, ModTime: time.Unix(1, 0)}
+		return err
+	})
+	if err != nil {
+		t.Fatalf("Failed to load test data: %v", err)
+	}
+
+	dfs := fsdecomp.New(testFS, zstdfmt.WithDictionaryDiscovery(".zstd-dict", true))
+	for name, id := range map[string]string{"a.json": `"id": 1,`, "sub/b.json": `"id": 2,`} {
+		data, err := fs.ReadFile(dfs, name)
+		if err != nil {
+			t.Errorf("Unexpected error reading %s: %v", name, err)
+		} else if !strings.Contains(string(data), id) {
+			t.Errorf("Expected %s to contain %s, got %q", name, id, data)
+		}
+	}
+
+	// The dictionary in the file's own directory is used, and named in errors
+	_, err = fs.ReadFile(dfs, "mismatched/c.json")
+	var decompErr *fsdecomp.DecompressError
+	if !errors.As(err, &decompErr) || !strings.Contains(err.Error(), "mismatched/.zstd-dict") {
+		t.Errorf("Expected a DecompressError naming mismatched/.zstd-dict, got %v", err)
+	}
+
+	// Without searching parents, files in sub have no dictionary
+	nearest := fsdecomp.New(testFS, zstdfmt.WithDictionaryDiscovery(".zstd-dict", false))
+	if _, err := fs.ReadFile(nearest, "sub/b.json"); err == nil || !strings.Contains(err.Error(), "no dictionary found") {
+		t.Errorf("Expected an error saying no dictionary was found, got %v", err)
+	}
+
+	// Dictionaries are read through the DecompressFS, which counts the
+	// calls made, only statting them once they are cached
+	counted := fsdecomp.New(testFS, zstdfmt.WithDictionaryDiscovery(".zstd-dict", false))
+	for i, want := range []fsdecomp.BackendOps{{Opens: 1, Stats: 1}, {Stats: 1}} {
+		before := counted.BackendOps()
+		file, err := counted.Open("a.json")
+		if err != nil {
+			t.Fatalf("Unexpected error opening a.json: %v", err)
+		}
+		resolution := file.(interface{ ResolutionInfo() fsdecomp.Resolution }).ResolutionInfo().Ops
+		file.Close()
+		after := counted.BackendOps()
+		got := fsdecomp.BackendOps{
+			Opens: after.Opens - before.Opens - resolution.Opens,
+			Stats: after.Stats - before.Stats - resolution.Stats,
+		}
+		if got != want {
+			t.Errorf("Expected open %d to make %+v calls for the dictionary, got %+v", i+1, want, got)
+		}
+	}
+
+	// A dictionary replaced with a newer one is read again
+	testFS[".zstd-dict"] = &fstest.MapFile{Data: testFS["mismatched/.zstd-dict"].Data, ModTime: time.Unix(2, 0)}
+	if _, err := fs.ReadFile(dfs, "a.json"); err == nil {
+		t.Errorf("Expected a.json to fail with the replaced dictionary")
+	}
+
+	entries, err := fs.ReadDir(dfs, ".")
+	if err != nil {
+		t.Fatalf("Unexpected error reading directory: %v", err)
+	}
+	for _, entry := range entries {
+		if entry.Name() == ".zstd-dict" {
+			t.Errorf("Expected the dictionary to be hidden from listings")
+		}
+	}
+}
@@ -0,0 +1,54 @@
+// Package zstdfmt adds Zstandard (.zst) support to fsdecomp.
+//
+// Importing the package, usually for its side effect only, registers the
+// decompressor with fsdecomp.Register:
+//
+//	import _ "github.com/AndreRenaud/FSDecomp/zstdfmt"
+package zstdfmt
+
+import (
+	"io"
+
+	fsdecomp "github.com/AndreRenaud/FSDecomp"
+	"github.com/klauspost/compress/zstd"
+)
+
+// Extension is the file extension handled by this package
+const Extension = ".zst"
+
+// Decompressor decompresses Zstandard streams
+var Decompressor fsdecomp.Decompressor = decompressor{}
+
+func init() {
+	fsdecomp.Register(Extension, Decompressor)
+}
+
+// New returns a Decompressor for Zstandard streams that decodes them with
+// opts, to be registered under an extension of its own, such as one for
+// files compressed with a larger window than Decompressor accepts:
+//
+//	fsdecomp.Register(".zstbig", zstdfmt.New(zstd.WithDecoderMaxWindow(1<<31)))
+//
+// Each extension is decoded with the decompressor registered for it, so
+// files keep being decoded with the default options under Extension.
+func New(opts ...zstd.DOption) fsdecomp.Decompressor {
+	return decompressor{opts: opts}
+}
+
+type decompressor struct {
+	opts []zstd.DOption // Decoder options, if set by New
+}
+
+func (decompressor) MagicNumber() []byte {
+	return []byte{0x28, 0xb5, 0x2f, 0xfd}
+}
+
+func (d decompressor) NewReader(r io.Reader) (io.ReadCloser, error) {
+	decoder, err := zstd.NewReader(r, d.opts...)
+	if err != nil {
+		return nil, err
+	}
+	// The decoder runs background goroutines which are only released by
+	// closing it, which IOReadCloser does for us
+	return decoder.IOReadCloser(), nil
+}
@@ -0,0 +1,185 @@
+package zstdfmt_test
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"math/rand/v2"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+	"testing/fstest"
+	"time"
+
+	fsdecomp "github.com/AndreRenaud/FSDecomp"
+	"github.com/AndreRenaud/FSDecomp/zstdfmt"
+	"github.com/klauspost/compress/zstd"
+)
+
+// TestRegistered ensures importing the package is enough to open .zst files
+func TestRegistered(t *testing.T) {
+	var buf bytes.Buffer
+	zw, err := zstd.NewWriter(&buf)
+	if err != nil {
+		t.Fatalf("Failed to create zstd writer: %v", err)
+	}
+	if _, err := zw.Write([]byte("zstd content")); err != nil {
+		t.Fatalf("Failed to write zstd data: %v", err)
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatalf("Failed to close zstd writer: %v", err)
+	}
+
+	dfs := fsdecomp.New(fstest.MapFS{
+		"file.txt.zst": &fstest.MapFile{Data: buf.Bytes()},
+	})
+	file, err := dfs.Open("file.txt")
+	if err != nil {
+		t.Fatalf("Unexpected error opening file.txt: %v", err)
+	}
+	defer file.Close()
+
+	data, err := io.ReadAll(file)
+	if err != nil {
+		t.Fatalf("Error reading file: %v", err)
+	}
+	if string(data) != "zstd content" {
+		t.Errorf("Expected content %q, got %q", "zstd content", string(data))
+	}
+}
+
+// TestFrames ensures a stream split into several frames, as written by
+// parallel compressors such as pzstd, decodes identically to a single frame
+func TestFrames(t *testing.T) {
+	const expectedSum = "eeabbfbceaa0af0d1991e4483049097e8ee5092ef2bc06df5ea6f1854a6b5a3c"
+	dfs := fsdecomp.New(os.DirFS("testdata"))
+
+	for name, frames := range map[string]int{"single.txt": 1, "multiframe.txt": 4} {
+		raw, err := os.ReadFile(filepath.Join("testdata", name+".zst"))
+		if err != nil {
+			t.Fatalf("Failed to read fixture: %v", err)
+		}
+		if n := frameCount(t, raw); n != frames {
+			t.Fatalf("Expected %s to have %d frames, got %d", name, frames, n)
+		}
+
+		data, err := fs.ReadFile(dfs, name)
+		if err != nil {
+			t.Fatalf("Unexpected error reading %s: %v", name, err)
+		}
+		if len(data) != 400000 {
+			t.Errorf("Expected %s to decode to 400000 bytes, got %d", name, len(data))
+		}
+		if sum := fmt.Sprintf("%x", sha256.Sum256(data)); sum != expectedSum {
+			t.Errorf("Expected %s SHA-256 %s, got %s", name, expectedSum, sum)
+		}
+	}
+}
+
+// frameCount counts the zstd frames in data, using the skippable frames
+// pzstd writes ahead of each frame to find where the next one starts
+func frameCount(t *testing.T, data []byte) int {
+	const skippableMagic = 0x184d2a50
+	frames := 0
+	for len(data) > 0 {
+		if len(data) < 12 || binary.LittleEndian.Uint32(data) != skippableMagic {
+			// A lone frame with no size header runs to the end
+			return frames + 1
+		}
+		size := int(binary.LittleEndian.Uint32(data[8:]))
+		if len(data) < 12+size {
+			t.Fatalf("Frame of %d bytes overruns the data", size)
+		}
+		data = data[12+size:]
+		frames++
+	}
+	return frames
+}
+
+// TestVariants ensures two extensions registered with differently configured
+// zstd decompressors each decode with their own options
+func TestVariants(t *testing.T) {
+	// The encoder only declares the window it was given for content that
+	// needs it
+	content := strings.Repeat("needs a large window\n", 100000)
+	var buf bytes.Buffer
+	zw, err := zstd.NewWriter(&buf, zstd.WithWindowSize(8<<20), zstd.WithSingleSegment(false))
+	if err != nil {
+		t.Fatalf("Failed to create zstd writer: %v", err)
+	}
+	zw.Write([]byte(content))
+	if err := zw.Close(); err != nil {
+		t.Fatalf("Failed to close zstd writer: %v", err)
+	}
+
+	dfs := fsdecomp.New(fstest.MapFS{
+		"small.txt.zst":    &fstest.MapFile{Data: buf.Bytes()},
+		"large.txt.zstbig": &fstest.MapFile{Data: buf.Bytes()},
+	},
+		fsdecomp.WithDecompressor(".zst", zstdfmt.New(zstd.WithDecoderMaxWindow(1<<20))),
+		fsdecomp.WithDecompressor(".zstbig", zstdfmt.New(zstd.WithDecoderMaxWindow(16<<20))),
+	)
+
+	if _, err := fs.ReadFile(dfs, "small.txt"); !errors.Is(err, zstd.ErrWindowSizeExceeded) {
+		t.Errorf("Expected ErrWindowSizeExceeded decoding under .zst, got %v", err)
+	}
+	if data, err := fs.ReadFile(dfs, "large.txt"); err != nil || string(data) != content {
+		t.Errorf("Expected the content decoding under .zstbig, got %d bytes, %v", len(data), err)
+	}
+}
+
+// TestCloseReleasesDecoder ensures closing a .zst file stops the goroutines
+// its decoder runs, whether or not it was read to the end
+func TestCloseReleasesDecoder(t *testing.T) {
+	var buf bytes.Buffer
+	zw, err := zstd.NewWriter(&buf)
+	if err != nil {
+		t.Fatalf("Failed to create zstd writer: %v", err)
+	}
+	// Enough blocks that the decoder is still running after a short read
+	content := make([]byte, 1<<20)
+	rng := rand.NewChaCha8([32]byte{})
+	for i := range content {
+		content[i] = "zstd content"[rng.Uint64()%12]
+	}
+	zw.Write(content)
+	if err := zw.Close(); err != nil {
+		t.Fatalf("Failed to close zstd writer: %v", err)
+	}
+	// Decoders only run goroutines when decoding concurrently, which by
+	// default depends on GOMAXPROCS
+	dfs := fsdecomp.New(fstest.MapFS{"file.txt.zst": &fstest.MapFile{Data: buf.Bytes()}},
+		fsdecomp.WithDecompressor(zstdfmt.Extension, zstdfmt.New(zstd.WithDecoderConcurrency(4))))
+
+	baseline := runtime.NumGoroutine()
+	for i := range 60 {
+		file, err := dfs.Open("file.txt")
+		if err != nil {
+			t.Fatalf("Unexpected error opening file.txt: %v", err)
+		}
+		switch i % 3 {
+		case 0:
+			io.ReadAll(file)
+		case 1:
+			file.Read(make([]byte, 100))
+		}
+		file.Close()
+	}
+
+	// The decoders' goroutines may take a moment to exit once closed, so
+	// wait for them, with a deadline only a leak should reach
+	deadline := time.Now().Add(10 * time.Second)
+	for runtime.NumGoroutine() > baseline {
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected %d goroutines after closing, got %d", baseline, runtime.NumGoroutine())
+		}
+		runtime.Gosched()
+		time.Sleep(time.Millisecond)
+	}
+}